@@ -1,24 +1,37 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/caarlos0/env/v10"
 	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/admin"
+	"github.com/ryanbekhen/nanoproxy/pkg/certauth"
 	"github.com/ryanbekhen/nanoproxy/pkg/config"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/dnsserver"
+	"github.com/ryanbekhen/nanoproxy/pkg/egress"
+	"github.com/ryanbekhen/nanoproxy/pkg/filter"
+	"github.com/ryanbekhen/nanoproxy/pkg/headers"
 	"github.com/ryanbekhen/nanoproxy/pkg/httpproxy"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
+	"github.com/ryanbekhen/nanoproxy/pkg/outboundtls"
+	"github.com/ryanbekhen/nanoproxy/pkg/pac"
 	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
 	"github.com/ryanbekhen/nanoproxy/pkg/socks5"
+	"github.com/ryanbekhen/nanoproxy/pkg/tlscert"
 	"github.com/ryanbekhen/nanoproxy/pkg/tor"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/ryanbekhen/nanoproxy/pkg/upstream"
 
 	_ "time/tzdata"
 )
@@ -52,9 +65,15 @@ func main() {
 	if cfg.NoAuthMode {
 		logger.Warn().Msg("NO_AUTH_MODE is enabled; proxy authentication, admin server, and database-backed state loading are skipped")
 	}
+	authSchemes, err := buildAuthSchemes(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid PROXY_AUTH_SCHEMES")
+	}
 
-	dnsResolver := &resolver.DNSResolver{}
 	trafficTracker := traffic.NewTracker()
+	if userFileStore != nil {
+		go maintainCredentials(&logger, userFileStore, credentials, trafficTracker, time.Minute)
+	}
 
 	trafficStore := trafficStoreForMode(cfg)
 	if trafficStore != nil {
@@ -66,29 +85,38 @@ func main() {
 	}
 
 	httpConfig := httpproxy.Config{
-		Credentials:       proxyCredentials,
-		Logger:            &logger,
-		DestConnTimeout:   cfg.DestTimeout,
-		ClientConnTimeout: cfg.ClientTimeout,
-		Dial:              net.Dial,
-		Resolver:          dnsResolver,
-		Tracker:           trafficTracker,
+		Credentials:            proxyCredentials,
+		Logger:                 &logger,
+		DestConnTimeout:        cfg.DestTimeout,
+		ClientConnTimeout:      cfg.ClientTimeout,
+		Dial:                   net.Dial,
+		Tracker:                trafficTracker,
+		ConnectionAttemptDelay: cfg.HappyEyeballsDelay,
+		IdleConnTimeout:        cfg.HTTPUpstreamIdleTimeout,
+		MaxIdleConnsPerHost:    cfg.HTTPUpstreamMaxIdle,
+		AuthSchemes:            authSchemes,
+		Realm:                  cfg.ProxyAuthRealm,
 	}
 
 	httpServer := httpproxy.New(&httpConfig)
 
 	socks5Config := socks5.Config{
-		Logger:            &logger,
-		DestConnTimeout:   cfg.DestTimeout,
-		ClientConnTimeout: cfg.ClientTimeout,
-		Resolver:          dnsResolver,
-		Tracker:           trafficTracker,
+		Logger:                 &logger,
+		DestConnTimeout:        cfg.DestTimeout,
+		ClientConnTimeout:      cfg.ClientTimeout,
+		Tracker:                trafficTracker,
+		ConnectionAttemptDelay: cfg.HappyEyeballsDelay,
 	}
 
+	direct := &upstream.Direct{Timeout: cfg.DestTimeout}
+	torDialer := &tor.DefaultDialer{}
+	var outbound upstream.Dialer = direct
 	if cfg.TorEnabled {
-		torDialer := &tor.DefaultDialer{}
+		outbound = torDialer
 		socks5Config.Dial = torDialer.Dial
 		httpConfig.Dial = torDialer.Dial
+		httpConfig.DialRemote = true
+		socks5Config.DialRemote = true
 		logger.Info().Msg("Tor mode enabled")
 
 		torController := tor.NewTorController(torDialer)
@@ -101,13 +129,241 @@ func main() {
 		}()
 	}
 
+	upstreamDialer, upstreamURLs, err := buildUpstreamDialer(cfg, outbound)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure upstream proxies")
+	}
+	if upstreamDialer != nil {
+		socks5Config.Dial = upstreamDialer.Dial
+		httpConfig.Dial = upstreamDialer.Dial
+		httpConfig.DialRemote = true
+		socks5Config.DialRemote = true
+		for i, rawURL := range upstreamURLs {
+			logger.Info().Int("hop", i+1).Str("upstream", upstream.Redact(rawURL)).Msg("Upstream proxy enabled")
+		}
+	}
+
+	resolverDialer := outbound
+	if upstreamDialer != nil {
+		resolverDialer = upstreamDialer
+	}
+	var dnsResolver resolver.Resolver
+	dnsResolver, err = buildResolver(cfg, resolverDialer)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure DNS servers")
+	}
+	if len(cfg.DNSServers) > 0 {
+		logger.Info().Strs("servers", cfg.DNSServers).Bool("via_outbound", cfg.DNSViaOutbound).Msg("Using configured DNS servers")
+	}
+	dnsCache := buildDNSCache(cfg, dnsResolver)
+	if dnsCache != nil {
+		dnsResolver = dnsCache
+		logger.Info().Int("size", cfg.DNSCacheSize).Msg("DNS cache enabled")
+	}
+	if len(cfg.DNSSplitServers) > 0 {
+		logger.Info().Strs("rules", cfg.DNSSplitServers).Msg("Split DNS enabled")
+	}
+	dnsPolicy, err := buildDNSPolicy(cfg, dnsResolver, &logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load DNS hosts and block lists")
+	}
+	if dnsPolicy != nil {
+		dnsPolicy.Start()
+		dnsResolver = dnsPolicy
+		hosts, blocked := dnsPolicy.Counts()
+		logger.Info().Int("hosts", hosts).Int("blocked", blocked).Msg("DNS hosts and block lists loaded")
+	}
+	family, err := resolver.ParseFamily(cfg.DNSFamily)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure DNS address family")
+	}
+	dnsResolver = resolver.NewFamilyResolver(dnsResolver, family)
+	httpConfig.Resolver = dnsResolver
+	socks5Config.Resolver = dnsResolver
+
+	upstreamPools, err := buildUpstreamPools(cfg, direct)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure upstream pools")
+	}
+	for _, pool := range upstreamPools {
+		pool.StartHealthChecks()
+		logger.Info().Str("pool", pool.Name()).Int("members", len(pool.Status())).Msg("Upstream pool enabled")
+	}
+	if len(upstreamPools) > 0 && cfg.RoutingRulesFile == "" {
+		logger.Warn().Msg("UPSTREAM_POOLS_FILE is set but ROUTING_RULES_FILE is not; pools are only used through routing rules")
+	}
+
+	egressPool, err := buildEgressPool(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure egress source addresses")
+	}
+	if egressPool != nil {
+		logger.Info().Strs("sources", cfg.EgressSources).Str("strategy", string(egressPool.Strategy())).Msg("Egress source address pool enabled")
+	}
+
+	router, err := buildRouter(cfg, direct, torDialer, upstreamDialer, upstreamPools, egressPool)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure routing rules")
+	}
+	if router != nil {
+		socks5Config.Router = router
+		httpConfig.Router = router
+		if cfg.RoutingRulesFile != "" {
+			logger.Info().Str("routing_rules_file", cfg.RoutingRulesFile).Msg("Policy-based routing enabled")
+		}
+	}
+
+	headerPolicy, err := buildHeaderPolicy(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure header rules")
+	}
+	if headerPolicy != nil {
+		httpConfig.Headers = headerPolicy
+		logger.Info().Str("header_rules_file", cfg.HeaderRulesFile).Msg("Header rewrite rules enabled")
+	}
+
+	contentFilter, err := buildContentFilter(cfg, &logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load content filter")
+	}
+	if contentFilter != nil {
+		contentFilter.Start()
+		socks5Config.Filter = contentFilter
+		httpConfig.Filter = contentFilter
+		categories, entries := contentFilter.Counts()
+		logger.Info().
+			Str("filter_rules_file", cfg.FilterRulesFile).
+			Int("categories", categories).
+			Int("entries", entries).
+			Msg("Content filter enabled")
+	}
+
+	pacGenerator, err := buildPAC(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure proxy auto-config")
+	}
+	if pacGenerator != nil {
+		logger.Info().Strs("pac_users", pacGenerator.Users()).Msg("Proxy auto-config enabled")
+	}
+
+	outboundTLS, err := buildOutboundTLS(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure outbound TLS")
+	}
+	if outboundTLS != nil {
+		httpConfig.OutboundTLS = outboundTLS
+		logger.Info().
+			Str("min_version", cfg.OutboundTLSMinVersion).
+			Strs("alpn", cfg.OutboundTLSALPN).
+			Str("outbound_tls_file", cfg.OutboundTLSFile).
+			Msg("Outbound TLS settings enabled")
+	}
+
+	errorPages, err := buildErrorPages(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load error page templates")
+	}
+	if errorPages != nil {
+		httpConfig.ErrorPages = errorPages
+		logger.Info().Str("error_pages_dir", cfg.ErrorPagesDir).Msg("Custom error pages enabled")
+	}
+
+	httpCache, err := buildHTTPCache(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to open HTTP cache")
+	}
+	if httpCache != nil {
+		httpConfig.Cache = httpCache
+		logger.Info().
+			Int64("memory_mb", cfg.HTTPCacheMemoryMB).
+			Str("dir", cfg.HTTPCacheDir).
+			Msg("HTTP response cache enabled")
+	}
+
+	if cfg.UsernameParams && proxyCredentials != nil {
+		grammar := credential.NewUsernameGrammar(cfg.UsernameParamsSep, cfg.UsernameParamsKeys)
+		httpConfig.UsernameParams = grammar
+		logger.Info().Str("separator", grammar.Separator).Strs("keys", grammar.Keys).Msg("Username parameters enabled")
+	}
+
 	if proxyCredentials != nil {
 		authenticator := &socks5.UserPassAuthenticator{
 			Credentials: proxyCredentials,
+			Params:      httpConfig.UsernameParams,
 		}
 		socks5Config.Authentication = append(socks5Config.Authentication, authenticator)
 	}
 
+	var certificates *tlscert.Manager
+	if cfg.ADDRHttps != "" || cfg.ADDRSocks5TLS != "" {
+		certificates, err = buildTLSCertificates(cfg, &logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load TLS certificate")
+		}
+		certificates.Start()
+		if certificates.SelfSigned() {
+			logger.Warn().Str("fingerprint", certificates.Fingerprint()).Msg("Using a self-signed TLS certificate")
+		}
+	}
+
+	var clientCertAuth *certauth.Authenticator
+	if certificates != nil {
+		clientCertAuth, err = buildClientCertAuth(cfg, &logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load client certificate policy")
+		}
+	}
+	if clientCertAuth != nil {
+		clientCertAuth.Start()
+		rules, revoked := clientCertAuth.Counts()
+		logger.Info().
+			Str("path", cfg.ClientCertAuthFile).
+			Int("rules", rules).
+			Int("revoked", revoked).
+			Msg("Client certificate authentication enabled")
+	}
+
+	if cfg.ADDRHttps != "" && clientCertAuth != nil {
+		httpConfig.ClientCertUsername = clientCertAuth.Identify
+	}
+
+	var socks5TLSConfig *tls.Config
+	if cfg.ADDRSocks5TLS != "" {
+		socks5CertAuth, err := buildSOCKS5ClientAuth(cfg, &logger, clientCertAuth)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to configure SOCKS5 client certificates")
+		}
+		socks5TLSConfig = certificates.TLSConfig()
+		if socks5CertAuth != nil {
+			if socks5CertAuth != clientCertAuth {
+				socks5CertAuth.Start()
+			}
+			socks5Config.ClientCertUsername = socks5CertAuth.Identify
+			socks5TLSConfig = certificates.TLSConfigWithClientAuth(socks5CertAuth.ClientCAs, cfg.SOCKS5TLSRequireClientCert)
+			logger.Info().
+				Bool("required", cfg.SOCKS5TLSRequireClientCert).
+				Msg("SOCKS5 client certificate authentication enabled")
+		}
+	}
+
+	inspector, err := buildInspector(cfg)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure HTTPS inspection")
+	}
+	if inspector != nil {
+		httpConfig.Inspector = inspector
+		socks5Config.Interceptor = httpServer
+		authority := inspector.Authority()
+		logger.Warn().
+			Str("ca_cert", cfg.InspectCACertFile).
+			Bool("ca_generated", authority.Generated()).
+			Str("ca_fingerprint", authority.Fingerprint()).
+			Strs("users", cfg.InspectUsers).
+			Strs("domains", cfg.InspectDomains).
+			Ints("ports", cfg.InspectPorts).
+			Msg("HTTPS inspection is enabled; selected tunnels are decrypted")
+	}
+
 	socks5Server := socks5.New(&socks5Config)
 
 	go func() {
@@ -126,6 +382,26 @@ func main() {
 		}
 	}()
 
+	if cfg.ADDRHttps != "" {
+		go func() {
+			logger.Info().Bool("http2", cfg.HTTPSHTTP2).Msgf("Starting HTTPS proxy server on %s://%s", cfg.Network, cfg.ADDRHttps)
+
+			server := &http.Server{
+				Addr:         cfg.ADDRHttps,
+				Handler:      httpServer,
+				TLSConfig:    httpsTLSConfig(certificates, clientCertAuth, cfg.HTTPSRequireClientCert, cfg.HTTPSHTTP2),
+				Protocols:    httpsProtocols(cfg.HTTPSHTTP2),
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+				IdleTimeout:  60 * time.Second,
+			}
+
+			if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal().Msg(err.Error())
+			}
+		}()
+	}
+
 	go func() {
 		logger.Info().Msgf("Starting SOCKS5 server on %s://%s", cfg.Network, cfg.ADDR)
 		if err := socks5Server.ListenAndServe(cfg.Network, cfg.ADDR); err != nil {
@@ -133,6 +409,59 @@ func main() {
 		}
 	}()
 
+	if socks5TLSConfig != nil {
+		go func() {
+			logger.Info().Msgf("Starting SOCKS5 over TLS server on %s://%s", cfg.Network, cfg.ADDRSocks5TLS)
+			if err := socks5Server.ListenAndServeTLS(cfg.Network, cfg.ADDRSocks5TLS, socks5TLSConfig); err != nil {
+				logger.Fatal().Msg(err.Error())
+			}
+		}()
+	}
+
+	if cfg.DNSListenAddr != "" {
+		allowedClients := make([]*net.IPNet, 0, len(cfg.DNSAllowedClients))
+		for _, raw := range cfg.DNSAllowedClients {
+			network, err := routing.ParseCIDR(raw)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Failed to parse DNS_ALLOWED_CLIENTS")
+			}
+			allowedClients = append(allowedClients, network)
+		}
+		dnsServer := dnsserver.New(&dnsserver.Config{
+			Resolver:        dnsResolver,
+			Logger:          &logger,
+			TTL:             cfg.DNSAnswerTTL,
+			UserForClientIP: clientUserLookup(cfg.DNSClientUsers, trafficTracker),
+			AllowedClients:  allowedClients,
+			MaxConcurrent:   cfg.DNSMaxConcurrent,
+		})
+
+		go func() {
+			logger.Info().Msgf("Starting DNS server on udp+tcp://%s", cfg.DNSListenAddr)
+			if err := dnsServer.ListenAndServe(cfg.DNSListenAddr); err != nil {
+				logger.Fatal().Msg(err.Error())
+			}
+		}()
+	}
+
+	if pacGenerator != nil {
+		go func() {
+			logger.Info().Msgf("Starting PAC server on %s", cfg.ADDRPac)
+
+			server := &http.Server{
+				Addr:         cfg.ADDRPac,
+				Handler:      pacGenerator,
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+				IdleTimeout:  60 * time.Second,
+			}
+
+			if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatal().Msg(err.Error())
+			}
+		}()
+	}
+
 	if adminEnabledForMode(cfg) {
 		adminStore := admin.NewBoltAdminStore(cfg.UserStorePath)
 		adminServer := admin.New(&admin.Config{
@@ -146,6 +475,11 @@ func main() {
 			LoginWindow:      cfg.AdminLoginWindow,
 			LockoutDuration:  cfg.AdminLockoutDuration,
 			AllowedOrigins:   cfg.AdminAllowedOrigins,
+			UpstreamPools:    upstreamPools,
+			DNSCache:         dnsCache,
+			HTTPCache:        httpCache,
+			PAC:              pacGenerator,
+			Inspector:        inspector,
 			Logger:           &logger,
 		})
 
@@ -186,6 +520,13 @@ func buildCredentialStore(cfg *config.Config) (*credential.StaticCredentialStore
 	userStore := credential.NewBoltStore(userStorePath)
 
 	credentials := credential.NewStaticCredentialStore()
+	credentials.SetRealm(cfg.ProxyAuthRealm)
+	// Digest secrets are only derived and kept while Digest is accepted.
+	for _, name := range cfg.ProxyAuthSchemes {
+		if scheme, err := httpproxy.ParseAuthScheme(name); err == nil && scheme == httpproxy.AuthDigest {
+			credentials.SetDigestEnabled(true)
+		}
+	}
 	if err := credential.LoadInto(userStore, credentials); err != nil {
 		return nil, userStore, fmt.Errorf("load persisted proxy users: %w", err)
 	}
@@ -193,6 +534,39 @@ func buildCredentialStore(cfg *config.Config) (*credential.StaticCredentialStore
 	return credentials, userStore, nil
 }
 
+// maintainCredentials periodically removes expired ephemeral credentials
+// and saves credential usage, which changes without any admin action.
+func maintainCredentials(logger *zerolog.Logger, store credential.PersistentStore, credentials *credential.StaticCredentialStore, tracker *traffic.Tracker, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, id := range credentials.PurgeExpired(now) {
+			tracker.ForgetCredential(id)
+			logger.Info().Str("credential", id).Msg("Ephemeral credential expired")
+		}
+		if err := credential.SaveUsage(store, credentials); err != nil {
+			logger.Warn().Err(err).Msg("Failed to persist credential usage")
+		}
+	}
+}
+
+// buildAuthSchemes parses PROXY_AUTH_SCHEMES.
+func buildAuthSchemes(cfg *config.Config) ([]httpproxy.AuthScheme, error) {
+	var schemes []httpproxy.AuthScheme
+	for _, name := range cfg.ProxyAuthSchemes {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		scheme, err := httpproxy.ParseAuthScheme(name)
+		if err != nil {
+			return nil, err
+		}
+		schemes = append(schemes, scheme)
+	}
+	return schemes, nil
+}
+
 func proxyCredentialsForMode(cfg *config.Config, credentials *credential.StaticCredentialStore) credential.Store {
 	if cfg != nil && cfg.NoAuthMode {
 		return nil
@@ -207,6 +581,506 @@ func adminEnabledForMode(cfg *config.Config) bool {
 	return !cfg.NoAuthMode
 }
 
+// buildUpstreamDialer chains the configured parent proxies on top of forward.
+// It returns a nil dialer when no upstream proxies are configured.
+func buildUpstreamDialer(cfg *config.Config, forward upstream.Dialer) (upstream.Dialer, []string, error) {
+	if cfg == nil {
+		return nil, nil, nil
+	}
+
+	urls := append([]string(nil), cfg.UpstreamProxies...)
+	if cfg.UpstreamProxiesFile != "" {
+		fromFile, err := upstream.LoadChainFile(cfg.UpstreamProxiesFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("load upstream proxies file: %w", err)
+		}
+		urls = append(urls, fromFile...)
+	}
+
+	dialer, err := upstream.ParseChain(urls, forward, cfg.DestTimeout)
+	if errors.Is(err, upstream.ErrEmptyChain) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dialer, urls, nil
+}
+
+// buildUpstreamPools loads the named pools from UPSTREAM_POOLS_FILE.
+func buildUpstreamPools(cfg *config.Config, forward upstream.Dialer) ([]*upstream.Pool, error) {
+	if cfg == nil || cfg.UpstreamPoolsFile == "" {
+		return nil, nil
+	}
+
+	pools, err := upstream.LoadPoolsFile(cfg.UpstreamPoolsFile, forward, cfg.DestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("load upstream pools: %w", err)
+	}
+	return pools, nil
+}
+
+// buildResolver returns the resolver for proxy destinations: the configured
+// DNS_SERVERS, or the host resolver when none are set, with the domains in
+// DNS_SPLIT_SERVERS sent to their own servers. With DNS_VIA_OUTBOUND the
+// servers are reached through outbound.
+func buildResolver(cfg *config.Config, outbound upstream.Dialer) (resolver.Resolver, error) {
+	if cfg == nil {
+		return &resolver.DNSResolver{}, nil
+	}
+
+	opts := resolver.ServerOptions{Timeout: cfg.DNSTimeout}
+	if cfg.DNSViaOutbound && outbound != nil {
+		opts.Dial = outbound.Dial
+	}
+	newServerResolver := func(raws []string) (resolver.Resolver, error) {
+		servers, err := resolver.ParseServers(raws, opts)
+		if err != nil {
+			return nil, err
+		}
+		return resolver.NewServerResolver(servers)
+	}
+
+	var base resolver.Resolver = &resolver.DNSResolver{}
+	if len(cfg.DNSServers) > 0 {
+		r, err := newServerResolver(cfg.DNSServers)
+		if err != nil {
+			return nil, err
+		}
+		base = r
+	}
+	if len(cfg.DNSSplitServers) == 0 {
+		return base, nil
+	}
+
+	split := resolver.NewSplitResolver(base)
+	for _, raw := range cfg.DNSSplitServers {
+		rule, err := resolver.ParseSplitRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newServerResolver(rule.Servers)
+		if err != nil {
+			return nil, fmt.Errorf("split DNS rule for %s: %w", rule.Domain, err)
+		}
+		split.Add(rule.Domain, r)
+	}
+	return split, nil
+}
+
+// clientUserLookup attributes DNS queries to proxy users: first by the static
+// DNS_CLIENT_USERS map, then by the user last seen connecting from the same
+// client address.
+func clientUserLookup(static map[string]string, tracker *traffic.Tracker) func(clientIP string) (string, bool) {
+	return func(clientIP string) (string, bool) {
+		if username, ok := static[clientIP]; ok {
+			return username, true
+		}
+		return tracker.UserForClientIP(clientIP)
+	}
+}
+
+// buildDNSPolicy loads DNS_HOSTS_FILES and DNS_BLOCKLISTS in front of
+// upstream. It returns nil when neither is set.
+func buildDNSPolicy(cfg *config.Config, upstream resolver.Resolver, logger *zerolog.Logger) (*resolver.PolicyResolver, error) {
+	if cfg == nil || (len(cfg.DNSHostsFiles) == 0 && len(cfg.DNSBlocklists) == 0) {
+		return nil, nil
+	}
+
+	var policy *resolver.PolicyResolver
+	policy, err := resolver.NewPolicyResolver(upstream, resolver.PolicyConfig{
+		HostsFiles:     cfg.DNSHostsFiles,
+		BlockLists:     cfg.DNSBlocklists,
+		ReloadInterval: cfg.DNSListsReloadInterval,
+		OnReload: func(err error) {
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to reload DNS hosts and block lists; keeping previous rules")
+				return
+			}
+			hosts, blocked := policy.Counts()
+			logger.Info().Int("hosts", hosts).Int("blocked", blocked).Msg("DNS hosts and block lists reloaded")
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// buildTLSCertificates loads the certificate of the TLS listeners from
+// TLS_CERT_FILE and TLS_KEY_FILE, or generates a self-signed one when
+// neither is set.
+func buildTLSCertificates(cfg *config.Config, logger *zerolog.Logger) (*tlscert.Manager, error) {
+	var certificates *tlscert.Manager
+	certificates, err := tlscert.New(tlscert.Config{
+		CertFile:       cfg.TLSCertFile,
+		KeyFile:        cfg.TLSKeyFile,
+		Hosts:          cfg.TLSSelfSignedHosts,
+		ReloadInterval: cfg.TLSReloadInterval,
+		OnReload: func(err error) {
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to reload TLS certificate; keeping previous certificate")
+				return
+			}
+			logger.Info().Str("fingerprint", certificates.Fingerprint()).Msg("TLS certificate reloaded")
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return certificates, nil
+}
+
+// buildClientCertAuth loads the client certificate policy shared by the TLS
+// listeners from CLIENT_CERT_AUTH_FILE. It returns nil when the file is not
+// set.
+func buildClientCertAuth(cfg *config.Config, logger *zerolog.Logger) (*certauth.Authenticator, error) {
+	if cfg.ClientCertAuthFile == "" {
+		if cfg.HTTPSRequireClientCert {
+			return nil, errors.New("HTTPS_REQUIRE_CLIENT_CERT needs CLIENT_CERT_AUTH_FILE")
+		}
+		return nil, nil
+	}
+
+	return certauth.New(certauth.Config{
+		File:           cfg.ClientCertAuthFile,
+		ReloadInterval: cfg.TLSReloadInterval,
+		OnReload:       clientCertReloadLogger(logger, cfg.ClientCertAuthFile),
+	})
+}
+
+// buildSOCKS5ClientAuth selects how the SOCKS5 over TLS listener identifies
+// client certificates: the shared policy when there is one, otherwise the CAs
+// in SOCKS5_TLS_CLIENT_CA with the field SOCKS5_TLS_CLIENT_CERT_USER naming
+// the user. It returns nil when neither is configured.
+func buildSOCKS5ClientAuth(cfg *config.Config, logger *zerolog.Logger, shared *certauth.Authenticator) (*certauth.Authenticator, error) {
+	if shared != nil {
+		if cfg.SOCKS5TLSClientCA != "" {
+			logger.Warn().Msg("SOCKS5_TLS_CLIENT_CA is ignored because CLIENT_CERT_AUTH_FILE is set")
+		}
+		return shared, nil
+	}
+	if cfg.SOCKS5TLSClientCA == "" {
+		if cfg.SOCKS5TLSRequireClientCert {
+			return nil, errors.New("SOCKS5_TLS_REQUIRE_CLIENT_CERT needs SOCKS5_TLS_CLIENT_CA or CLIENT_CERT_AUTH_FILE")
+		}
+		return nil, nil
+	}
+
+	field, err := certauth.ParseField(cfg.SOCKS5TLSClientCertUser)
+	if err != nil {
+		return nil, err
+	}
+	return certauth.New(certauth.Config{
+		Policy: certauth.Policy{
+			CAFile: cfg.SOCKS5TLSClientCA,
+			Rules:  []certauth.Rule{{Field: field}},
+		},
+		ReloadInterval: cfg.TLSReloadInterval,
+		OnReload:       clientCertReloadLogger(logger, cfg.SOCKS5TLSClientCA),
+	})
+}
+
+func clientCertReloadLogger(logger *zerolog.Logger, path string) func(error) {
+	return func(err error) {
+		if err != nil {
+			logger.Error().Err(err).Str("path", path).Msg("Failed to reload client certificate policy; keeping previous policy")
+			return
+		}
+		logger.Info().Str("path", path).Msg("Client certificate policy reloaded")
+	}
+}
+
+// buildInspector sets up the HTTPS inspection mode from the INSPECT_*
+// settings. It returns nil unless INSPECT_ENABLED is set.
+func buildInspector(cfg *config.Config) (*mitm.Inspector, error) {
+	if !cfg.InspectEnabled {
+		return nil, nil
+	}
+
+	authority, err := mitm.NewAuthority(mitm.AuthorityConfig{
+		CertFile:  cfg.InspectCACertFile,
+		KeyFile:   cfg.InspectCAKeyFile,
+		CacheSize: cfg.InspectCertCacheSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var har *mitm.HAR
+	if cfg.InspectHAREntries > 0 {
+		har = mitm.NewHAR(cfg.InspectHAREntries)
+	}
+	return mitm.New(mitm.Config{
+		Authority:      authority,
+		Users:          cfg.InspectUsers,
+		Domains:        cfg.InspectDomains,
+		ExcludeDomains: cfg.InspectExcludeDomains,
+		Ports:          cfg.InspectPorts,
+		HAR:            har,
+	}), nil
+}
+
+// httpsProtocols selects the protocols offered to clients of the HTTPS
+// proxy listener.
+func httpsProtocols(http2 bool) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(http2)
+	return protocols
+}
+
+// httpsTLSConfig returns the TLS configuration of the HTTPS proxy listener.
+// The protocols are announced explicitly because the configuration may be
+// replaced per handshake, which hides the ones http.Server would add.
+func httpsTLSConfig(certificates *tlscert.Manager, clientCertAuth *certauth.Authenticator, requireClientCert, http2 bool) *tls.Config {
+	var conf *tls.Config
+	if clientCertAuth != nil {
+		conf = certificates.TLSConfigWithClientAuth(clientCertAuth.ClientCAs, requireClientCert)
+	} else {
+		conf = certificates.TLSConfig()
+	}
+	conf.NextProtos = []string{"http/1.1"}
+	if http2 {
+		conf.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return conf
+}
+
+// buildDNSCache wraps upstream in a caching resolver. It returns nil when
+// DNS_CACHE_SIZE is zero or negative.
+func buildDNSCache(cfg *config.Config, upstream resolver.Resolver) *resolver.CachingResolver {
+	if cfg == nil || cfg.DNSCacheSize <= 0 {
+		return nil
+	}
+
+	return resolver.NewCachingResolver(upstream, resolver.CacheConfig{
+		Size:        cfg.DNSCacheSize,
+		MinTTL:      cfg.DNSCacheMinTTL,
+		MaxTTL:      cfg.DNSCacheMaxTTL,
+		DefaultTTL:  cfg.DNSCacheDefaultTTL,
+		NegativeTTL: cfg.DNSCacheNegativeTTL,
+	})
+}
+
+// buildEgressPool creates the source address pool from EGRESS_SOURCES and
+// EGRESS_BINDINGS. It returns nil when neither is set.
+func buildEgressPool(cfg *config.Config) (*egress.Pool, error) {
+	if cfg == nil || (len(cfg.EgressSources) == 0 && len(cfg.EgressBindings) == 0) {
+		return nil, nil
+	}
+
+	return egress.New(egress.Config{
+		Sources:   cfg.EgressSources,
+		Strategy:  egress.Strategy(cfg.EgressStrategy),
+		Bindings:  cfg.EgressBindings,
+		StickyTTL: cfg.EgressStickyTTL,
+		Timeout:   cfg.DestTimeout,
+	})
+}
+
+// buildHeaderPolicy loads HEADER_RULES_FILE. It returns nil when it is not
+// set.
+func buildHeaderPolicy(cfg *config.Config) (*headers.Policy, error) {
+	if cfg == nil || cfg.HeaderRulesFile == "" {
+		return nil, nil
+	}
+
+	file, err := headers.LoadFile(cfg.HeaderRulesFile)
+	if err != nil {
+		return nil, err
+	}
+	return headers.New(*file)
+}
+
+// buildContentFilter loads FILTER_RULES_FILE and the lists it names. It
+// returns nil when it is not set.
+func buildContentFilter(cfg *config.Config, logger *zerolog.Logger) (*filter.Filter, error) {
+	if cfg == nil || cfg.FilterRulesFile == "" {
+		return nil, nil
+	}
+
+	var contentFilter *filter.Filter
+	contentFilter, err := filter.New(filter.Config{
+		File:           cfg.FilterRulesFile,
+		ReloadInterval: cfg.FilterReloadInterval,
+		OnReload: func(err error) {
+			if err != nil {
+				logger.Error().Err(err).Msg("Failed to reload content filter; keeping previous rules")
+				return
+			}
+			categories, entries := contentFilter.Counts()
+			logger.Info().Int("categories", categories).Int("entries", entries).Msg("Content filter reloaded")
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contentFilter, nil
+}
+
+// buildOutboundTLS loads the TLS settings for connections to the
+// destinations of https requests. It returns nil when the defaults apply.
+func buildOutboundTLS(cfg *config.Config) (*outboundtls.Client, error) {
+	if cfg == nil || (cfg.OutboundTLSCAFile == "" && (cfg.OutboundTLSMinVersion == "" || cfg.OutboundTLSMinVersion == "1.2") &&
+		len(cfg.OutboundTLSALPN) == 0 && cfg.OutboundTLSFile == "") {
+		return nil, nil
+	}
+
+	conf := outboundtls.Config{
+		CAFile:     cfg.OutboundTLSCAFile,
+		MinVersion: cfg.OutboundTLSMinVersion,
+		ALPN:       cfg.OutboundTLSALPN,
+	}
+	if cfg.OutboundTLSFile != "" {
+		file, err := outboundtls.LoadFile(cfg.OutboundTLSFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Destinations = file.Destinations
+	}
+	return outboundtls.New(conf)
+}
+
+// buildErrorPages loads the error page templates in ERROR_PAGES_DIR. It
+// returns nil when it is not set.
+func buildErrorPages(cfg *config.Config) (*httpproxy.ErrorPages, error) {
+	if cfg == nil || cfg.ErrorPagesDir == "" {
+		return nil, nil
+	}
+
+	return httpproxy.NewErrorPages(cfg.ErrorPagesDir)
+}
+
+// buildPAC prepares the proxy auto-config files pointing to the HTTPS, HTTP
+// and SOCKS5 listeners. It returns nil when ADDR_PAC is not set.
+func buildPAC(cfg *config.Config) (*pac.Generator, error) {
+	if cfg == nil || cfg.ADDRPac == "" {
+		return nil, nil
+	}
+
+	conf := pac.Config{Host: cfg.PACProxyHost}
+	if cfg.PACFile != "" {
+		file, err := pac.LoadFile(cfg.PACFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.File = *file
+	}
+
+	var err error
+	if conf.HTTPSPort, err = listenerPort(cfg.ADDRHttps); err != nil {
+		return nil, fmt.Errorf("ADDR_HTTPS: %w", err)
+	}
+	if conf.HTTPPort, err = listenerPort(cfg.ADDRHttp); err != nil {
+		return nil, fmt.Errorf("ADDR_HTTP: %w", err)
+	}
+	if conf.SOCKS5Port, err = listenerPort(cfg.ADDR); err != nil {
+		return nil, fmt.Errorf("ADDR: %w", err)
+	}
+	return pac.New(conf)
+}
+
+// listenerPort returns the port of a listen address, or zero when addr is
+// empty.
+func listenerPort(addr string) (int, error) {
+	if addr == "" {
+		return 0, nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return 0, fmt.Errorf("invalid port %q", port)
+	}
+	return n, nil
+}
+
+// buildHTTPCache opens the HTTP response cache. It returns nil when
+// HTTP_CACHE_ENABLED is not set.
+func buildHTTPCache(cfg *config.Config) (*httpproxy.Cache, error) {
+	if cfg == nil || !cfg.HTTPCacheEnabled {
+		return nil, nil
+	}
+
+	return httpproxy.NewCache(httpproxy.CacheConfig{
+		MemoryBytes:    cfg.HTTPCacheMemoryMB << 20,
+		Dir:            cfg.HTTPCacheDir,
+		DiskBytes:      cfg.HTTPCacheDiskMB << 20,
+		MaxObjectBytes: cfg.HTTPCacheMaxObjectMB << 20,
+	})
+}
+
+// buildRouter loads ROUTING_RULES_FILE and registers the direct, tor, upstream,
+// pool and named upstream outbounds. When an egress pool is given it serves the
+// direct route, and a rule-less router is built even without a rules file so
+// that every connection picks a source address. It returns nil otherwise when
+// no rules file is set.
+func buildRouter(cfg *config.Config, direct, torDialer, upstreamDialer upstream.Dialer, pools []*upstream.Pool, egressPool *egress.Pool) (*routing.Router, error) {
+	if cfg == nil || (cfg.RoutingRulesFile == "" && egressPool == nil) {
+		return nil, nil
+	}
+
+	file := &routing.File{}
+	if cfg.RoutingRulesFile != "" {
+		var err error
+		if file, err = routing.LoadFile(cfg.RoutingRulesFile); err != nil {
+			return nil, fmt.Errorf("load routing rules: %w", err)
+		}
+	}
+
+	outbounds := map[string]routing.Outbound{
+		routing.RouteDirect: routing.DialFunc(direct.Dial),
+		routing.RouteTor:    routing.DialFunc(torDialer.Dial),
+	}
+	if egressPool != nil {
+		outbounds[routing.RouteDirect] = egressPool
+	}
+	if upstreamDialer != nil {
+		outbounds["upstream"] = routing.DialFunc(upstreamDialer.Dial)
+	}
+	for _, pool := range pools {
+		if _, exists := outbounds[pool.Name()]; exists {
+			return nil, fmt.Errorf("pool %q shadows a built-in route", pool.Name())
+		}
+		outbounds[pool.Name()] = pool
+	}
+	for name, urls := range file.Upstreams {
+		if _, exists := outbounds[name]; exists {
+			return nil, fmt.Errorf("upstream %q shadows a built-in route", name)
+		}
+		chain, err := upstream.ParseChain(urls, direct, cfg.DestTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", name, err)
+		}
+		outbounds[name] = routing.DialFunc(chain.Dial)
+	}
+
+	defaultRoute := file.Default
+	if defaultRoute == "" {
+		switch {
+		case upstreamDialer != nil:
+			defaultRoute = "upstream"
+		case cfg.TorEnabled:
+			defaultRoute = routing.RouteTor
+		default:
+			defaultRoute = routing.RouteDirect
+		}
+	}
+
+	router, err := routing.NewRouter(file.Rules, outbounds, defaultRoute)
+	if err != nil {
+		return nil, err
+	}
+	if err := router.AllowClientRoutes(file.Selectable, file.UserSelectable); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
 func trafficStoreForMode(cfg *config.Config) traffic.Store {
 	if cfg == nil || cfg.NoAuthMode {
 		return nil
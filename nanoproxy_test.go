@@ -1,11 +1,31 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/config"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/egress"
+	"github.com/ryanbekhen/nanoproxy/pkg/filter"
+	"github.com/ryanbekhen/nanoproxy/pkg/headers"
+	"github.com/ryanbekhen/nanoproxy/pkg/httpproxy"
+	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+	"github.com/ryanbekhen/nanoproxy/pkg/tlscert"
+	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/ryanbekhen/nanoproxy/pkg/upstream"
 )
 
 func TestBuildCredentialStore_LoadsFromDatabase(t *testing.T) {
@@ -37,6 +57,31 @@ func TestBuildCredentialStore_LoadsFromDatabase(t *testing.T) {
 	}
 }
 
+func TestBuildCredentialStore_DigestSecrets(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		schemes []string
+		digest  bool
+	}{
+		{schemes: nil, digest: false},
+		{schemes: []string{"basic", "bearer"}, digest: false},
+		{schemes: []string{"Basic", " digest"}, digest: true},
+	} {
+		credentials, _, err := buildCredentialStore(&config.Config{
+			UserStorePath:    filepath.Join(t.TempDir(), "data.db"),
+			ProxyAuthSchemes: tc.schemes,
+		})
+		if err != nil {
+			t.Fatalf("buildCredentialStore returned error: %v", err)
+		}
+		credentials.Add("alice", "password")
+		if _, ok := credentials.DigestSecret("alice"); ok != tc.digest {
+			t.Fatalf("schemes %v: expected digest secret %v, got %v", tc.schemes, tc.digest, ok)
+		}
+	}
+}
+
 func TestBuildCredentialStore_NoAuthModeSkipsDatabase(t *testing.T) {
 	t.Parallel()
 
@@ -118,3 +163,657 @@ func TestTrafficStoreForMode_NoAuthDisabled(t *testing.T) {
 		t.Fatal("expected non-nil traffic store when NO_AUTH_MODE is disabled")
 	}
 }
+
+func TestBuildUpstreamDialer_NoneConfigured(t *testing.T) {
+	t.Parallel()
+
+	dialer, urls, err := buildUpstreamDialer(&config.Config{}, nil)
+	if err != nil {
+		t.Fatalf("buildUpstreamDialer returned error: %v", err)
+	}
+	if dialer != nil || urls != nil {
+		t.Fatal("expected no upstream dialer when none are configured")
+	}
+}
+
+func TestBuildUpstreamDialer_EnvAndFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "upstreams.txt")
+	if err := os.WriteFile(path, []byte("http://10.0.0.2:3128\n"), 0o600); err != nil {
+		t.Fatalf("write upstreams file: %v", err)
+	}
+
+	cfg := &config.Config{
+		UpstreamProxies:     []string{"socks5://10.0.0.1:1080"},
+		UpstreamProxiesFile: path,
+	}
+
+	dialer, urls, err := buildUpstreamDialer(cfg, nil)
+	if err != nil {
+		t.Fatalf("buildUpstreamDialer returned error: %v", err)
+	}
+	if dialer == nil {
+		t.Fatal("expected upstream dialer")
+	}
+	if len(urls) != 2 || urls[1] != "http://10.0.0.2:3128" {
+		t.Fatalf("unexpected upstream urls: %v", urls)
+	}
+}
+
+func TestBuildUpstreamDialer_InvalidScheme(t *testing.T) {
+	t.Parallel()
+
+	cfg := &config.Config{UpstreamProxies: []string{"ftp://10.0.0.1:21"}}
+	if _, _, err := buildUpstreamDialer(cfg, nil); err == nil {
+		t.Fatal("expected error for unsupported upstream scheme")
+	}
+}
+
+func TestBuildHeaderPolicy(t *testing.T) {
+	t.Parallel()
+
+	policy, err := buildHeaderPolicy(&config.Config{})
+	if err != nil || policy != nil {
+		t.Fatalf("expected no header policy without HEADER_RULES_FILE, got %v, %v", policy, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "headers.json")
+	if err := os.WriteFile(path, []byte(`{"rules": [{"forwarding": "strip"}]}`), 0o600); err != nil {
+		t.Fatalf("write header rules file: %v", err)
+	}
+	policy, err = buildHeaderPolicy(&config.Config{HeaderRulesFile: path})
+	if err != nil {
+		t.Fatalf("buildHeaderPolicy returned error: %v", err)
+	}
+	header := http.Header{"Via": {"1.1 gw"}}
+	policy.For(headers.Request{Host: "example.com"}).Request(header)
+	if len(header) != 0 {
+		t.Fatalf("expected forwarding headers to be stripped, got %v", header)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"rules": [{"request": {"remove": ["Host"]}}]}`), 0o600); err != nil {
+		t.Fatalf("write header rules file: %v", err)
+	}
+	if _, err := buildHeaderPolicy(&config.Config{HeaderRulesFile: path}); err == nil {
+		t.Fatal("expected error for a rule removing Host")
+	}
+}
+
+func TestBuildContentFilter(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(io.Discard)
+	contentFilter, err := buildContentFilter(&config.Config{}, &logger)
+	if err != nil || contentFilter != nil {
+		t.Fatalf("expected no content filter without FILTER_RULES_FILE, got %v, %v", contentFilter, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "filter.json")
+	if err := os.WriteFile(path, []byte(`{"categories": {"ads": {"domains": ["ads.example"]}}, "policies": [{"block": ["ads"]}]}`), 0o600); err != nil {
+		t.Fatalf("write filter rules file: %v", err)
+	}
+	contentFilter, err = buildContentFilter(&config.Config{FilterRulesFile: path}, &logger)
+	if err != nil {
+		t.Fatalf("buildContentFilter returned error: %v", err)
+	}
+	if _, blocked := contentFilter.Check(filter.Request{Username: "alice", Host: "www.ads.example"}); !blocked {
+		t.Fatal("expected ads.example subdomain to be blocked")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"policies": [{"block": ["missing"]}]}`), 0o600); err != nil {
+		t.Fatalf("write filter rules file: %v", err)
+	}
+	if _, err := buildContentFilter(&config.Config{FilterRulesFile: path}, &logger); err == nil {
+		t.Fatal("expected error for a policy naming an unknown category")
+	}
+}
+
+func TestBuildOutboundTLS(t *testing.T) {
+	t.Parallel()
+
+	client, err := buildOutboundTLS(&config.Config{OutboundTLSMinVersion: "1.2"})
+	if err != nil || client != nil {
+		t.Fatalf("expected no outbound TLS settings by default, got %v, %v", client, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "outbound-tls.json")
+	if err := os.WriteFile(path, []byte(`{"destinations": [{"domains": ["api.internal"], "server_name": "gateway.internal", "alpn": ["h2"]}]}`), 0o600); err != nil {
+		t.Fatalf("write outbound TLS file: %v", err)
+	}
+	client, err = buildOutboundTLS(&config.Config{OutboundTLSMinVersion: "1.3", OutboundTLSFile: path})
+	if err != nil {
+		t.Fatalf("buildOutboundTLS returned error: %v", err)
+	}
+	if conf := client.Config("www.example.com"); conf.MinVersion != tls.VersionTLS13 || conf.ServerName != "www.example.com" {
+		t.Fatalf("unexpected shared TLS settings: min version %x, server name %q", conf.MinVersion, conf.ServerName)
+	}
+	if conf := client.Config("eu.api.internal"); conf.ServerName != "gateway.internal" || !client.OffersHTTP2() {
+		t.Fatalf("unexpected destination TLS settings: server name %q, h2 %v", conf.ServerName, client.OffersHTTP2())
+	}
+
+	if _, err := buildOutboundTLS(&config.Config{OutboundTLSMinVersion: "1.1"}); err == nil {
+		t.Fatal("expected error for an unsupported TLS version")
+	}
+}
+
+func TestBuildErrorPages(t *testing.T) {
+	t.Parallel()
+
+	pages, err := buildErrorPages(&config.Config{})
+	if err != nil || pages != nil {
+		t.Fatalf("expected no custom error pages without ERROR_PAGES_DIR, got %v, %v", pages, err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "502.gohtml"), []byte(`<p>{{.Message}}</p>`), 0o600); err != nil {
+		t.Fatalf("write error page template: %v", err)
+	}
+	if pages, err = buildErrorPages(&config.Config{ErrorPagesDir: dir}); err != nil || pages == nil {
+		t.Fatalf("buildErrorPages returned %v, %v", pages, err)
+	}
+
+	if _, err := buildErrorPages(&config.Config{ErrorPagesDir: filepath.Join(dir, "missing")}); err == nil {
+		t.Fatal("expected error for a missing error pages directory")
+	}
+}
+
+func TestBuildPAC(t *testing.T) {
+	t.Parallel()
+
+	generator, err := buildPAC(&config.Config{})
+	if err != nil || generator != nil {
+		t.Fatalf("expected no PAC generator without ADDR_PAC, got %v, %v", generator, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "pac.json")
+	if err := os.WriteFile(path, []byte(`{"bypass": {"domains": ["corp.example"]}, "users": {"alice": {}}}`), 0o600); err != nil {
+		t.Fatalf("write PAC file: %v", err)
+	}
+	generator, err = buildPAC(&config.Config{
+		ADDRPac:      ":8088",
+		PACProxyHost: "proxy.example.com",
+		PACFile:      path,
+		ADDR:         ":1080",
+		ADDRHttp:     "0.0.0.0:8080",
+		ADDRHttps:    ":8443",
+	})
+	if err != nil {
+		t.Fatalf("buildPAC returned error: %v", err)
+	}
+	script, ok := generator.Script("", "alice")
+	if !ok {
+		t.Fatal("expected a PAC file for alice")
+	}
+	for _, want := range []string{
+		`dnsDomainIs(host, ".corp.example")`,
+		`return "HTTPS proxy.example.com:8443; PROXY proxy.example.com:8080; SOCKS5 proxy.example.com:1080";`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Fatalf("expected PAC file to contain %q, got:\n%s", want, script)
+		}
+	}
+
+	if _, err := buildPAC(&config.Config{ADDRPac: ":8088", ADDRHttp: "8080"}); err == nil {
+		t.Fatal("expected error for a listen address without a port")
+	}
+}
+
+func TestBuildHTTPCache(t *testing.T) {
+	t.Parallel()
+
+	cache, err := buildHTTPCache(&config.Config{})
+	if err != nil || cache != nil {
+		t.Fatalf("expected no HTTP cache unless HTTP_CACHE_ENABLED is set, got %v, %v", cache, err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "http-cache")
+	cache, err = buildHTTPCache(&config.Config{HTTPCacheEnabled: true, HTTPCacheMemoryMB: 1, HTTPCacheDir: dir})
+	if err != nil {
+		t.Fatalf("buildHTTPCache returned error: %v", err)
+	}
+	if cache == nil {
+		t.Fatal("expected an HTTP cache")
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("expected the cache directory to be created: %v", err)
+	}
+}
+
+func TestBuildRouter_NoRulesFile(t *testing.T) {
+	t.Parallel()
+
+	router, err := buildRouter(&config.Config{}, &upstream.Direct{}, &upstream.Direct{}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRouter returned error: %v", err)
+	}
+	if router != nil {
+		t.Fatal("expected nil router without ROUTING_RULES_FILE")
+	}
+}
+
+func TestBuildRouter_NamedUpstreamsAndDefault(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	content := `{
+  "upstreams": {"corp": ["http://gw.internal:3128"]},
+  "rules": [
+    {"route": "corp", "domains": ["corp.example.com"]},
+    {"route": "tor", "domains": ["onion"]}
+  ]
+}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+
+	cfg := &config.Config{RoutingRulesFile: path, TorEnabled: true}
+	router, err := buildRouter(cfg, &upstream.Direct{}, &upstream.Direct{}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("buildRouter returned error: %v", err)
+	}
+
+	if route, _ := router.Select(&routing.Request{Host: "git.corp.example.com"}); route != "corp" {
+		t.Fatalf("expected corp route, got %q", route)
+	}
+	if route, _ := router.Select(&routing.Request{Host: "example.org"}); route != routing.RouteTor {
+		t.Fatalf("expected tor default route, got %q", route)
+	}
+}
+
+func TestBuildRouter_RejectsShadowedRoute(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(path, []byte(`{"upstreams": {"direct": ["socks5://10.0.0.1:1080"]}}`), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+
+	if _, err := buildRouter(&config.Config{RoutingRulesFile: path}, &upstream.Direct{}, &upstream.Direct{}, nil, nil, nil); err == nil {
+		t.Fatal("expected error for upstream shadowing built-in route")
+	}
+}
+
+func TestBuildRouter_RegistersPools(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	poolsPath := filepath.Join(dir, "pools.json")
+	if err := os.WriteFile(poolsPath, []byte(`{"pools": {"residential": {"members": ["socks5://10.0.0.1:1080"]}}}`), 0o600); err != nil {
+		t.Fatalf("write pools file: %v", err)
+	}
+	routesPath := filepath.Join(dir, "routes.json")
+	if err := os.WriteFile(routesPath, []byte(`{"rules": [{"route": "residential", "users": ["scraper"]}]}`), 0o600); err != nil {
+		t.Fatalf("write routes file: %v", err)
+	}
+
+	cfg := &config.Config{UpstreamPoolsFile: poolsPath, RoutingRulesFile: routesPath}
+	pools, err := buildUpstreamPools(cfg, nil)
+	if err != nil {
+		t.Fatalf("buildUpstreamPools returned error: %v", err)
+	}
+	if len(pools) != 1 {
+		t.Fatalf("expected one pool, got %d", len(pools))
+	}
+
+	router, err := buildRouter(cfg, &upstream.Direct{}, &upstream.Direct{}, nil, pools, nil)
+	if err != nil {
+		t.Fatalf("buildRouter returned error: %v", err)
+	}
+	route, outbound := router.Select(&routing.Request{Host: "example.com", Username: "scraper"})
+	if route != "residential" || outbound != pools[0] {
+		t.Fatalf("expected residential pool route, got %q", route)
+	}
+}
+
+func TestBuildEgressPool(t *testing.T) {
+	t.Parallel()
+
+	pool, err := buildEgressPool(&config.Config{})
+	if err != nil || pool != nil {
+		t.Fatalf("expected no egress pool without sources, got %v, %v", pool, err)
+	}
+
+	if _, err := buildEgressPool(&config.Config{EgressSources: []string{"bogus"}}); err == nil {
+		t.Fatal("expected error for invalid egress source")
+	}
+
+	pool, err = buildEgressPool(&config.Config{EgressSources: []string{"203.0.113.1"}, EgressStrategy: "random"})
+	if err != nil {
+		t.Fatalf("buildEgressPool returned error: %v", err)
+	}
+	if pool.Strategy() != egress.StrategyRandom {
+		t.Fatalf("expected random strategy, got %q", pool.Strategy())
+	}
+}
+
+func TestBuildRouter_EgressWithoutRulesFile(t *testing.T) {
+	t.Parallel()
+
+	pool, err := buildEgressPool(&config.Config{EgressSources: []string{"203.0.113.1"}})
+	if err != nil {
+		t.Fatalf("buildEgressPool returned error: %v", err)
+	}
+
+	router, err := buildRouter(&config.Config{}, &upstream.Direct{}, &upstream.Direct{}, nil, nil, pool)
+	if err != nil {
+		t.Fatalf("buildRouter returned error: %v", err)
+	}
+	if router == nil {
+		t.Fatal("expected router when an egress pool is configured")
+	}
+	route, outbound := router.Select(&routing.Request{Host: "example.com"})
+	if route != routing.RouteDirect || outbound != pool {
+		t.Fatalf("expected direct route through egress pool, got %q", route)
+	}
+}
+
+func TestBuildDNSCache(t *testing.T) {
+	t.Parallel()
+
+	if cache := buildDNSCache(&config.Config{DNSCacheSize: 0}, &resolver.DNSResolver{}); cache != nil {
+		t.Fatal("expected DNS cache to be disabled when size is zero")
+	}
+
+	cache := buildDNSCache(&config.Config{DNSCacheSize: 16}, &resolver.DNSResolver{})
+	if cache == nil {
+		t.Fatal("expected DNS cache to be enabled")
+	}
+	if _, err := cache.Resolve("localhost"); err != nil {
+		t.Fatalf("resolve localhost: %v", err)
+	}
+	if stats := cache.Stats(); stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("unexpected cache stats: %+v", stats)
+	}
+}
+
+func TestBuildResolver(t *testing.T) {
+	t.Parallel()
+
+	r, err := buildResolver(&config.Config{}, nil)
+	if err != nil {
+		t.Fatalf("buildResolver returned error: %v", err)
+	}
+	if _, ok := r.(*resolver.DNSResolver); !ok {
+		t.Fatalf("expected host resolver without DNS_SERVERS, got %T", r)
+	}
+
+	r, err = buildResolver(&config.Config{DNSServers: []string{"tls://1.1.1.1", "https://dns.google/dns-query"}}, nil)
+	if err != nil {
+		t.Fatalf("buildResolver returned error: %v", err)
+	}
+	if _, ok := r.(*resolver.ServerResolver); !ok {
+		t.Fatalf("expected server resolver, got %T", r)
+	}
+
+	if _, err := buildResolver(&config.Config{DNSServers: []string{"quic://dns.example"}}, nil); err == nil {
+		t.Fatal("expected error for unsupported DNS server scheme")
+	}
+
+	r, err = buildResolver(&config.Config{DNSSplitServers: []string{"*.corp=10.0.0.53|tcp://10.0.0.54"}}, nil)
+	if err != nil {
+		t.Fatalf("buildResolver returned error: %v", err)
+	}
+	if _, ok := r.(*resolver.SplitResolver); !ok {
+		t.Fatalf("expected split resolver, got %T", r)
+	}
+
+	if _, err := buildResolver(&config.Config{DNSSplitServers: []string{"*.corp"}}, nil); err == nil {
+		t.Fatal("expected error for split rule without servers")
+	}
+}
+
+func TestBuildDNSPolicy(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(io.Discard)
+	policy, err := buildDNSPolicy(&config.Config{}, &resolver.DNSResolver{}, &logger)
+	if err != nil || policy != nil {
+		t.Fatalf("expected no DNS policy without files, got %v, %v", policy, err)
+	}
+
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	blockPath := filepath.Join(dir, "block.txt")
+	if err := os.WriteFile(hostsPath, []byte("10.0.0.5 git.corp\n"), 0o600); err != nil {
+		t.Fatalf("write hosts: %v", err)
+	}
+	if err := os.WriteFile(blockPath, []byte("ads.example\n"), 0o600); err != nil {
+		t.Fatalf("write block list: %v", err)
+	}
+
+	policy, err = buildDNSPolicy(&config.Config{DNSHostsFiles: []string{hostsPath}, DNSBlocklists: []string{blockPath}}, &resolver.DNSResolver{}, &logger)
+	if err != nil {
+		t.Fatalf("buildDNSPolicy returned error: %v", err)
+	}
+	if ip, err := policy.Resolve("git.corp"); err != nil || ip.String() != "10.0.0.5" {
+		t.Fatalf("expected hosts override, got %v, %v", ip, err)
+	}
+	if !policy.Blocked("www.ads.example") {
+		t.Fatal("expected ads.example subdomain to be blocked")
+	}
+
+	if _, err := buildDNSPolicy(&config.Config{DNSBlocklists: []string{filepath.Join(dir, "missing")}}, nil, &logger); err == nil {
+		t.Fatal("expected error for missing block list")
+	}
+}
+
+func TestClientUserLookup(t *testing.T) {
+	t.Parallel()
+
+	tracker := traffic.NewTracker()
+	session := tracker.Start("alice", "10.0.0.2")
+	defer session.Close()
+
+	lookup := clientUserLookup(map[string]string{"10.0.0.9": "printer"}, tracker)
+	if username, ok := lookup("10.0.0.9"); !ok || username != "printer" {
+		t.Fatalf("expected static mapping, got %q, %v", username, ok)
+	}
+	if username, ok := lookup("10.0.0.2"); !ok || username != "alice" {
+		t.Fatalf("expected tracker attribution, got %q, %v", username, ok)
+	}
+	if _, ok := lookup("10.0.0.3"); ok {
+		t.Fatal("expected unknown client to be unattributed")
+	}
+}
+
+func TestBuildTLSCertificates(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(io.Discard)
+	certificates, err := buildTLSCertificates(&config.Config{TLSSelfSignedHosts: []string{"proxy.internal"}}, &logger)
+	if err != nil {
+		t.Fatalf("buildTLSCertificates returned error: %v", err)
+	}
+	if !certificates.SelfSigned() {
+		t.Fatal("expected a self-signed certificate without files")
+	}
+	if err := certificates.Certificate().Leaf.VerifyHostname("proxy.internal"); err != nil {
+		t.Fatalf("expected certificate for proxy.internal: %v", err)
+	}
+
+	if _, err := buildTLSCertificates(&config.Config{TLSCertFile: "cert.pem"}, &logger); err == nil {
+		t.Fatal("expected error for a certificate without a key")
+	}
+}
+
+func TestHTTPSProtocols(t *testing.T) {
+	t.Parallel()
+
+	if protocols := httpsProtocols(false); !protocols.HTTP1() || protocols.HTTP2() {
+		t.Fatalf("expected HTTP/1 only, got %v", protocols)
+	}
+	if protocols := httpsProtocols(true); !protocols.HTTP1() || !protocols.HTTP2() {
+		t.Fatalf("expected HTTP/1 and HTTP/2, got %v", protocols)
+	}
+}
+
+func TestBuildClientCertAuth(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(io.Discard)
+	authenticator, err := buildClientCertAuth(&config.Config{}, &logger)
+	if err != nil || authenticator != nil {
+		t.Fatalf("expected no client certificate policy without a file, got %v, %v", authenticator, err)
+	}
+	if _, err := buildClientCertAuth(&config.Config{HTTPSRequireClientCert: true}, &logger); err == nil {
+		t.Fatal("expected error when client certificates are required without a policy")
+	}
+
+	dir := t.TempDir()
+	writeTestClientCA(t, filepath.Join(dir, "ca.pem"))
+	policyPath := filepath.Join(dir, "client-certs.json")
+	policy := `{"ca_file": "ca.pem", "rules": [{"field": "uri", "match": "^spiffe://corp/(.+)$", "username": "$1"}], "users": {"legacy": false}}`
+	if err := os.WriteFile(policyPath, []byte(policy), 0o600); err != nil {
+		t.Fatalf("write policy: %v", err)
+	}
+
+	authenticator, err = buildClientCertAuth(&config.Config{ClientCertAuthFile: policyPath}, &logger)
+	if err != nil {
+		t.Fatalf("buildClientCertAuth returned error: %v", err)
+	}
+	if rules, _ := authenticator.Counts(); rules != 1 {
+		t.Fatalf("expected 1 rule, got %d", rules)
+	}
+}
+
+func TestBuildSOCKS5ClientAuth(t *testing.T) {
+	t.Parallel()
+
+	logger := zerolog.New(io.Discard)
+	authenticator, err := buildSOCKS5ClientAuth(&config.Config{}, &logger, nil)
+	if err != nil || authenticator != nil {
+		t.Fatalf("expected no client authentication without a CA, got %v, %v", authenticator, err)
+	}
+	if _, err := buildSOCKS5ClientAuth(&config.Config{SOCKS5TLSRequireClientCert: true}, &logger, nil); err == nil {
+		t.Fatal("expected error when client certificates are required without a CA")
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestClientCA(t, caPath)
+
+	authenticator, err = buildSOCKS5ClientAuth(&config.Config{SOCKS5TLSClientCA: caPath, SOCKS5TLSClientCertUser: "email"}, &logger, nil)
+	if err != nil {
+		t.Fatalf("buildSOCKS5ClientAuth returned error: %v", err)
+	}
+	username, err := authenticator.Identify(&x509.Certificate{SerialNumber: big.NewInt(1), EmailAddresses: []string{"alice@corp.example"}})
+	if err != nil || username != "alice@corp.example" {
+		t.Fatalf("expected the e-mail address as username, got %q, %v", username, err)
+	}
+
+	shared, err := buildSOCKS5ClientAuth(&config.Config{SOCKS5TLSClientCA: caPath}, &logger, authenticator)
+	if err != nil || shared != authenticator {
+		t.Fatalf("expected the shared policy to be used, got %v, %v", shared, err)
+	}
+
+	if _, err := buildSOCKS5ClientAuth(&config.Config{SOCKS5TLSClientCA: caPath, SOCKS5TLSClientCertUser: "serial"}, &logger, nil); err == nil {
+		t.Fatal("expected error for unknown username field")
+	}
+}
+
+func writeTestClientCA(t *testing.T, path string) {
+	t.Helper()
+
+	ca, err := tlscert.GenerateSelfSigned([]string{"client-ca"}, time.Hour)
+	if err != nil {
+		t.Fatalf("generate CA: %v", err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("write CA: %v", err)
+	}
+}
+
+func TestBuildAuthSchemes(t *testing.T) {
+	t.Parallel()
+
+	schemes, err := buildAuthSchemes(&config.Config{ProxyAuthSchemes: []string{"digest", " Basic", "", "bearer"}})
+	if err != nil {
+		t.Fatalf("buildAuthSchemes returned error: %v", err)
+	}
+	want := []httpproxy.AuthScheme{httpproxy.AuthDigest, httpproxy.AuthBasic, httpproxy.AuthBearer}
+	if !reflect.DeepEqual(schemes, want) {
+		t.Fatalf("expected %v, got %v", want, schemes)
+	}
+
+	if _, err := buildAuthSchemes(&config.Config{ProxyAuthSchemes: []string{"ntlm"}}); err == nil {
+		t.Fatal("expected error for an unknown scheme")
+	}
+}
+
+func TestBuildInspector(t *testing.T) {
+	t.Parallel()
+
+	inspector, err := buildInspector(&config.Config{})
+	if err != nil || inspector != nil {
+		t.Fatalf("expected no inspector when disabled, got %v, %v", inspector, err)
+	}
+
+	dir := t.TempDir()
+	cfg := &config.Config{
+		InspectEnabled:    true,
+		InspectCACertFile: filepath.Join(dir, "ca.pem"),
+		InspectCAKeyFile:  filepath.Join(dir, "ca.key"),
+		InspectDomains:    []string{"example.com"},
+		InspectPorts:      []int{443},
+	}
+	inspector, err = buildInspector(cfg)
+	if err != nil {
+		t.Fatalf("buildInspector returned error: %v", err)
+	}
+	if !inspector.Authority().Generated() {
+		t.Fatal("expected the inspection CA to be generated")
+	}
+	if inspector.HAR() != nil {
+		t.Fatal("expected HAR capture to be disabled by default")
+	}
+	if !inspector.Inspects("alice", "example.com", 443) || inspector.Inspects("alice", "example.org", 443) {
+		t.Fatal("expected only example.com to be inspected")
+	}
+
+	cfg.InspectHAREntries = 5
+	inspector, err = buildInspector(cfg)
+	if err != nil {
+		t.Fatalf("buildInspector returned error: %v", err)
+	}
+	if inspector.Authority().Generated() {
+		t.Fatal("expected the existing inspection CA to be reused")
+	}
+	if inspector.HAR() == nil {
+		t.Fatal("expected HAR capture to be enabled")
+	}
+
+	if err := os.Remove(cfg.InspectCAKeyFile); err != nil {
+		t.Fatalf("remove key: %v", err)
+	}
+	if _, err := buildInspector(cfg); err == nil {
+		t.Fatal("expected error when the CA key is missing")
+	}
+}
+
+func TestHTTPSTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	certificates, err := tlscert.New(tlscert.Config{})
+	if err != nil {
+		t.Fatalf("tlscert.New returned error: %v", err)
+	}
+	conf := httpsTLSConfig(certificates, nil, false, true)
+	if conf.GetConfigForClient != nil || len(conf.NextProtos) != 2 || conf.NextProtos[0] != "h2" {
+		t.Fatalf("unexpected configuration without client certificates: %v", conf.NextProtos)
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	writeTestClientCA(t, caPath)
+	logger := zerolog.New(io.Discard)
+	authenticator, err := buildSOCKS5ClientAuth(&config.Config{SOCKS5TLSClientCA: caPath}, &logger, nil)
+	if err != nil {
+		t.Fatalf("buildSOCKS5ClientAuth returned error: %v", err)
+	}
+	handshake, err := httpsTLSConfig(certificates, authenticator, true, false).GetConfigForClient(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("GetConfigForClient returned error: %v", err)
+	}
+	if handshake.ClientAuth != tls.RequireAndVerifyClientCert || len(handshake.NextProtos) != 1 || handshake.NextProtos[0] != "http/1.1" {
+		t.Fatalf("unexpected handshake configuration: %v, %v", handshake.ClientAuth, handshake.NextProtos)
+	}
+}
@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+)
+
+// MaxEphemeralTTL is the longest lifetime an ephemeral credential can be
+// minted with.
+const MaxEphemeralTTL = 7 * 24 * time.Hour
+
+// maxAPIRequestBytes bounds the JSON bodies the API reads.
+const maxAPIRequestBytes = 64 << 10
+
+const ephemeralAPIPath = "/admin/api/ephemeral-credentials"
+
+type ephemeralRequest struct {
+	Username     string   `json:"username"`
+	TTL          string   `json:"ttl"`
+	Destinations []string `json:"destinations"`
+	ByteBudget   int64    `json:"byte_budget"`
+	SingleUse    bool     `json:"single_use"`
+}
+
+type ephemeralResponse struct {
+	ID           string          `json:"id"`
+	Username     string          `json:"username"`
+	Secret       string          `json:"secret,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	ExpiresAt    time.Time       `json:"expires_at"`
+	Destinations []string        `json:"destinations,omitempty"`
+	ByteBudget   int64           `json:"byte_budget,omitempty"`
+	BytesUsed    int64           `json:"bytes_used"`
+	SingleUse    bool            `json:"single_use"`
+	Traffic      *ephemeralUsage `json:"traffic,omitempty"`
+}
+
+type ephemeralUsage struct {
+	Connections   uint64 `json:"connections"`
+	UploadBytes   uint64 `json:"upload_bytes"`
+	DownloadBytes uint64 `json:"download_bytes"`
+}
+
+// handleEphemeralAPI mints, lists and revokes ephemeral credentials. It is
+// meant for automation, so it authenticates the admin with HTTP Basic on
+// every request instead of a session and needs no CSRF token.
+func (s *Server) handleEphemeralAPI(w http.ResponseWriter, r *http.Request) {
+	if !s.authenticateAPI(w, r) {
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, ephemeralAPIPath), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		s.listEphemeral(w)
+	case id == "" && r.Method == http.MethodPost:
+		s.mintEphemeral(w, r)
+	case id != "" && !strings.Contains(id, "/") && r.Method == http.MethodDelete:
+		s.revokeEphemeral(w, id)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// authenticateAPI checks the admin credentials of an API request, sharing
+// the lockout of the login form.
+func (s *Server) authenticateAPI(w http.ResponseWriter, r *http.Request) bool {
+	clientIP := extractClientIP(r.RemoteAddr)
+	if s.isLocked(clientIP) {
+		writeAPIError(w, http.StatusTooManyRequests, "too many failed attempts, try again later")
+		return false
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok || !s.validateAdminCredentials(username, password) {
+		if ok {
+			s.recordFailedLogin(clientIP)
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="nanoproxy admin", charset="UTF-8"`)
+		writeAPIError(w, http.StatusUnauthorized, "admin authentication required")
+		return false
+	}
+	s.clearFailedLogins(clientIP)
+	return true
+}
+
+func (s *Server) mintEphemeral(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeAPIError(w, http.StatusUnsupportedMediaType, "request body must be application/json")
+		return
+	}
+	var req ephemeralRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIRequestBytes))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	ttl, err := time.ParseDuration(req.TTL)
+	if err != nil || ttl <= 0 {
+		writeAPIError(w, http.StatusBadRequest, "ttl must be a positive duration such as 15m or 2h")
+		return
+	}
+	if ttl > MaxEphemeralTTL {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("ttl must not exceed %s", MaxEphemeralTTL))
+		return
+	}
+
+	ephemeral, secret, err := s.config.Credentials.IssueEphemeral(credential.Ephemeral{
+		User:         strings.TrimSpace(req.Username),
+		ExpiresAt:    time.Now().Add(ttl),
+		Destinations: req.Destinations,
+		ByteBudget:   req.ByteBudget,
+		SingleUse:    req.SingleUse,
+	})
+	switch {
+	case errors.Is(err, credential.ErrUnknownUser):
+		writeAPIError(w, http.StatusNotFound, "user not found")
+		return
+	case errors.Is(err, credential.ErrCredentialInvalid):
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	case err != nil:
+		writeAPIError(w, http.StatusInternalServerError, "failed to generate credential")
+		return
+	}
+	if err := s.persistUsers(); err != nil {
+		s.config.Credentials.RevokeEphemeral(ephemeral.ID)
+		writeAPIError(w, http.StatusInternalServerError, "failed to persist credential")
+		return
+	}
+
+	s.config.Logger.Info().
+		Str("credential", ephemeral.ID).
+		Str("username", ephemeral.User).
+		Time("expires_at", ephemeral.ExpiresAt).
+		Msg("ephemeral credential issued")
+	response := newEphemeralResponse(ephemeral)
+	response.Secret = secret
+	writeAPIJSON(w, http.StatusCreated, response)
+}
+
+func (s *Server) listEphemeral(w http.ResponseWriter) {
+	totals := s.config.Tracker.TotalsByCredential()
+	credentials := s.config.Credentials.EphemeralCredentials()
+	responses := make([]ephemeralResponse, 0, len(credentials))
+	for _, ephemeral := range credentials {
+		response := newEphemeralResponse(ephemeral)
+		if usage, ok := totals[ephemeral.ID]; ok {
+			response.Traffic = &ephemeralUsage{
+				Connections:   usage.Connections,
+				UploadBytes:   usage.UploadBytes,
+				DownloadBytes: usage.DownloadBytes,
+			}
+		}
+		responses = append(responses, response)
+	}
+	writeAPIJSON(w, http.StatusOK, responses)
+}
+
+func (s *Server) revokeEphemeral(w http.ResponseWriter, id string) {
+	revoked, ok := s.config.Credentials.RemoveEphemeral(id)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "credential not found")
+		return
+	}
+	if err := s.persistUsers(); err != nil {
+		s.config.Credentials.RestoreEphemeral(revoked)
+		writeAPIError(w, http.StatusInternalServerError, "failed to persist credential")
+		return
+	}
+	s.config.Tracker.ForgetCredential(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newEphemeralResponse(ephemeral credential.Ephemeral) ephemeralResponse {
+	return ephemeralResponse{
+		ID:           ephemeral.ID,
+		Username:     ephemeral.User,
+		CreatedAt:    ephemeral.CreatedAt,
+		ExpiresAt:    ephemeral.ExpiresAt,
+		Destinations: ephemeral.Destinations,
+		ByteBudget:   ephemeral.ByteBudget,
+		BytesUsed:    ephemeral.BytesUsed,
+		SingleUse:    ephemeral.SingleUse,
+	}
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeAPIJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,221 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_EphemeralAPI(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("ci", "secret")
+	userStore := credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	tracker := traffic.NewTracker()
+	s := New(&Config{
+		Credentials: credentials,
+		UserStore:   userStore,
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		Tracker:     tracker,
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	call := func(method, path, password, body string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+ephemeralAPIPath+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", password)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp, data
+	}
+
+	resp, _ := call(http.MethodGet, "", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	resp, _ = call(http.MethodPost, "", "secret", `{"username":"ci","ttl":"1h","destinations":["example.com"],"byte_budget":1024,"single_use":true}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, data := call(http.MethodPost, "", "secret", `{"username":"ci","ttl":"30m"}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var minted ephemeralResponse
+	require.NoError(t, json.Unmarshal(data, &minted))
+	assert.True(t, strings.HasPrefix(minted.ID, credential.EphemeralPrefix))
+	assert.WithinDuration(t, time.Now().Add(30*time.Minute), minted.ExpiresAt, time.Minute)
+	grant, ok := credentials.Grant("ci", minted.Secret)
+	require.True(t, ok)
+
+	// The credential survives a restart.
+	secrets, err := userStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.Len(t, secrets.Ephemeral, 2)
+
+	session := tracker.Start("ci", "127.0.0.1")
+	session.SetCredential(grant.ID())
+	session.AddDownload(512)
+	session.Close()
+
+	resp, data = call(http.MethodGet, "", "secret", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var listed []ephemeralResponse
+	require.NoError(t, json.Unmarshal(data, &listed))
+	require.Len(t, listed, 2)
+	for _, ephemeral := range listed {
+		assert.Empty(t, ephemeral.Secret)
+		if ephemeral.ID == minted.ID {
+			require.NotNil(t, ephemeral.Traffic)
+			assert.EqualValues(t, 512, ephemeral.Traffic.DownloadBytes)
+		} else {
+			assert.Equal(t, []string{"example.com"}, ephemeral.Destinations)
+			assert.EqualValues(t, 1024, ephemeral.ByteBudget)
+			assert.True(t, ephemeral.SingleUse)
+		}
+	}
+
+	for _, body := range []string{
+		`{"username":"ci","ttl":"-1h"}`,
+		`{"username":"ci","ttl":"1000h"}`,
+		`{"username":"ci","ttl":"1h","byte_budget":-1}`,
+		`{"username":"ci","ttl":"1h","unknown":true}`,
+		`not json`,
+	} {
+		resp, _ = call(http.MethodPost, "", "secret", body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	resp, _ = call(http.MethodPost, "", "secret", `{"username":"nobody","ttl":"1h"}`)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = call(http.MethodDelete, "/"+minted.ID, "secret", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Error(t, grant.Check())
+	assert.NotContains(t, tracker.TotalsByCredential(), minted.ID)
+	resp, _ = call(http.MethodDelete, "/"+minted.ID, "secret", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_EphemeralAPI_RequiresJSONAndLocksOut(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("ci", "secret")
+	s := New(&Config{
+		Credentials:      credentials,
+		AdminStore:       newSeededAdminStore(t, "admin", "secret"),
+		MaxLoginAttempts: 2,
+		Logger:           &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+ephemeralAPIPath, strings.NewReader(`{"username":"ci","ttl":"1h"}`))
+	require.NoError(t, err)
+	req.SetBasicAuth("admin", "secret")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Empty(t, credentials.EphemeralCredentials())
+
+	status := func(password string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, ts.URL+ephemeralAPIPath, nil)
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", password)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusUnauthorized, status("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, status("wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, status("secret"))
+}
+
+// failingUserStore fails every save while fail is set, after calling
+// during, if set.
+type failingUserStore struct {
+	*credential.BoltStore
+	fail   bool
+	during func()
+}
+
+func (s *failingUserStore) Save(snapshot map[string]string) error {
+	if !s.fail {
+		return s.BoltStore.Save(snapshot)
+	}
+	if s.during != nil {
+		s.during()
+	}
+	return errors.New("disk full")
+}
+
+func TestServer_EphemeralAPI_RollsBackOnlyTheChangedCredential(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	credentials := credential.NewStaticCredentialStore()
+	credentials.SetDigestEnabled(true)
+	credentials.Add("ci", "secret")
+	userStore := &failingUserStore{BoltStore: credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db"))}
+	s := New(&Config{
+		Credentials: credentials,
+		UserStore:   userStore,
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	call := func(method, path, body string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+ephemeralAPIPath+path, strings.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "secret")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	kept, keptSecret, err := credentials.IssueEphemeral(credential.Ephemeral{User: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	revoked, revokedSecret, err := credentials.IssueEphemeral(credential.Ephemeral{User: "ci", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	userStore.fail = true
+
+	assert.Equal(t, http.StatusInternalServerError, call(http.MethodPost, "", `{"username":"ci","ttl":"1h"}`))
+	assert.Len(t, credentials.EphemeralCredentials(), 2)
+
+	assert.Equal(t, http.StatusInternalServerError, call(http.MethodDelete, "/"+revoked.ID, ""))
+	_, ok := credentials.Grant("ci", revokedSecret)
+	assert.True(t, ok)
+
+	// A rollback leaves credentials it did not change alone, even when they
+	// were revoked in the meantime.
+	userStore.during = func() { credentials.RevokeEphemeral(kept.ID) }
+	assert.Equal(t, http.StatusInternalServerError, call(http.MethodPost, "", `{"username":"ci","ttl":"1h"}`))
+	_, ok = credentials.Grant("ci", keptSecret)
+	assert.False(t, ok)
+	_, ok = credentials.DigestSecret("ci")
+	assert.True(t, ok)
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/subtle"
 	"embed"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -21,7 +22,12 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/httpproxy"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
+	"github.com/ryanbekhen/nanoproxy/pkg/pac"
+	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/ryanbekhen/nanoproxy/pkg/upstream"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -55,6 +61,11 @@ type Config struct {
 	LoginWindow      time.Duration
 	LockoutDuration  time.Duration
 	AllowedOrigins   []string
+	UpstreamPools    []*upstream.Pool
+	DNSCache         *resolver.CachingResolver
+	HTTPCache        *httpproxy.Cache
+	PAC              *pac.Generator
+	Inspector        *mitm.Inspector
 	Logger           *zerolog.Logger
 }
 
@@ -88,9 +99,16 @@ type usersViewData struct {
 	Success           string
 	GeneratedUsername string
 	GeneratedPassword string
+	GeneratedToken    string
 	CSRFToken         string
 	ProxyUsers        []proxyUserView
 	TotalUsers        int
+	Credentials       []credentialView
+	Upstreams         []upstreamView
+	DNSCache          *dnsCacheView
+	HTTPCache         *httpCacheView
+	PAC               *pacView
+	Inspection        *inspectionView
 }
 
 type setupViewData struct {
@@ -101,12 +119,70 @@ type proxyUserView struct {
 	Username      string
 	ActiveClients int
 	ClientIP      string
+	EgressIP      string
 	UploadRate    string
 	DownloadRate  string
 	UploadTotal   string
 	DownloadTotal string
-	Status        string
-	StartedAgo    string
+	// CachedTotal is the part of DownloadTotal served from the HTTP cache,
+	// empty when there is none.
+	CachedTotal string
+	Status      string
+	StartedAgo  string
+}
+
+type credentialView struct {
+	User      string
+	Name      string
+	CreatedAt string
+	LastUsed  string
+	Expires   string
+	Expired   bool
+}
+
+type upstreamView struct {
+	Pool      string
+	Name      string
+	Addr      string
+	Status    string
+	Latency   string
+	Successes uint64
+	Failures  uint64
+	LastError string
+	LastCheck string
+}
+
+type inspectionView struct {
+	Fingerprint  string
+	CachedLeaves int
+	HAR          bool
+	HAREntries   int
+}
+
+type dnsCacheView struct {
+	Entries      int
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Coalesced    uint64
+	Evictions    uint64
+	HitRatio     string
+}
+
+type httpCacheView struct {
+	Entries     int
+	Hits        uint64
+	Revalidated uint64
+	Misses      uint64
+	Evictions   uint64
+	Memory      string
+	Disk        string
+	HitRatio    string
+}
+
+type pacView struct {
+	// Users have their own PAC file.
+	Users []string
 }
 
 func New(conf *Config) *Server {
@@ -164,6 +240,16 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/admin/users", s.handleUsers)
 	mux.HandleFunc("/admin/users/rows", s.handleUserRows)
 	mux.HandleFunc("/admin/users/", s.handleUserByName)
+	mux.HandleFunc("/admin/credentials", s.handleCredentials)
+	mux.HandleFunc("/admin/credentials/", s.handleCredentials)
+	mux.HandleFunc(ephemeralAPIPath, s.handleEphemeralAPI)
+	mux.HandleFunc(ephemeralAPIPath+"/", s.handleEphemeralAPI)
+	mux.HandleFunc("/admin/upstreams/rows", s.handleUpstreamRows)
+	mux.HandleFunc("/admin/dns/flush", s.handleDNSFlush)
+	mux.HandleFunc("/admin/http-cache/flush", s.handleHTTPCacheFlush)
+	mux.HandleFunc("/admin/pac", s.handlePACPreview)
+	mux.HandleFunc("/admin/inspection/ca.pem", s.handleInspectionCA)
+	mux.HandleFunc("/admin/inspection/har", s.handleInspectionHAR)
 	return s.withSecurityHeaders(mux)
 }
 
@@ -458,7 +544,7 @@ func (s *Server) handleUserByName(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		previousHash, existed := s.config.Credentials.GetHashed(username)
+		previousPassword, existed := s.config.Credentials.Password(username)
 		if !existed {
 			s.renderUsers(w, usersViewData{Error: "user not found", CSRFToken: rotatedCSRFToken}, http.StatusNotFound)
 			return
@@ -466,7 +552,7 @@ func (s *Server) handleUserByName(w http.ResponseWriter, r *http.Request) {
 
 		s.config.Credentials.Add(username, password)
 		if err := s.persistUsers(); err != nil {
-			s.config.Credentials.SetHashed(username, previousHash)
+			s.config.Credentials.RestorePassword(previousPassword)
 			s.renderUsers(w, usersViewData{Error: "failed to persist users", CSRFToken: rotatedCSRFToken}, http.StatusInternalServerError)
 			return
 		}
@@ -524,11 +610,10 @@ func (s *Server) handleUserByName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	passwordHash, existed := s.config.Credentials.GetHashed(username)
-	s.config.Credentials.Delete(username)
+	removed, existed := s.config.Credentials.Remove(username)
 	if err := s.persistUsers(); err != nil {
 		if existed {
-			s.config.Credentials.SetHashed(username, passwordHash)
+			s.config.Credentials.Restore(removed)
 		}
 		s.renderUsers(w, usersViewData{Error: "failed to persist users", CSRFToken: rotatedCSRFToken}, http.StatusInternalServerError)
 		return
@@ -540,9 +625,384 @@ func (s *Server) handleUserByName(w http.ResponseWriter, r *http.Request) {
 func (s *Server) renderUsers(w http.ResponseWriter, data usersViewData, status int) {
 	data.ProxyUsers = s.proxyUsersWithTraffic()
 	data.TotalUsers = len(data.ProxyUsers)
+	data.Credentials = s.credentialViews()
+	data.Upstreams = s.upstreamStatus()
+	data.DNSCache = s.dnsCacheStatus()
+	data.HTTPCache = s.httpCacheStatus()
+	data.PAC = s.pacStatus()
+	data.Inspection = s.inspectionStatus()
 	s.renderTemplate(w, "users.gohtml", data, status)
 }
 
+// handleCredentials issues named credentials with POST /admin/credentials
+// and revokes them with DELETE /admin/credentials/{user}/{name}.
+func (s *Server) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	var segments []string
+	if relativePath := strings.TrimPrefix(r.URL.Path, "/admin/credentials"); relativePath != "" {
+		segments = strings.Split(strings.TrimPrefix(path.Clean(relativePath), "/"), "/")
+	}
+	issue := r.Method == http.MethodPost && len(segments) == 0
+	revoke := r.Method == http.MethodDelete && len(segments) == 2
+	if !issue && !revoke {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.verifyCSRF(r); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rotatedCSRFToken, err := s.rotateCSRFToken(r)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if revoke {
+		username, name := segments[0], segments[1]
+		revoked, ok := s.config.Credentials.RemoveCredential(username, name)
+		if !ok {
+			s.renderUsers(w, usersViewData{Error: "credential not found", CSRFToken: rotatedCSRFToken}, http.StatusNotFound)
+			return
+		}
+		if err := s.persistUsers(); err != nil {
+			s.config.Credentials.RestoreCredential(revoked)
+			s.renderUsers(w, usersViewData{Error: "failed to persist users", CSRFToken: rotatedCSRFToken}, http.StatusInternalServerError)
+			return
+		}
+		s.renderUsers(w, usersViewData{Success: fmt.Sprintf("Credential %q of %s revoked.", name, username), CSRFToken: rotatedCSRFToken}, http.StatusOK)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	username := strings.TrimSpace(r.FormValue("username"))
+	name := strings.TrimSpace(r.FormValue("name"))
+	if err := validateCredentialName(name); err != nil {
+		s.renderUsers(w, usersViewData{Error: err.Error(), CSRFToken: rotatedCSRFToken}, http.StatusBadRequest)
+		return
+	}
+	var expiresAt time.Time
+	if expiresIn := r.FormValue("expires_in"); expiresIn != "" {
+		ttl, err := time.ParseDuration(expiresIn)
+		if err != nil || ttl <= 0 {
+			s.renderUsers(w, usersViewData{Error: "invalid expiry", CSRFToken: rotatedCSRFToken}, http.StatusBadRequest)
+			return
+		}
+		expiresAt = time.Now().Add(ttl)
+	}
+
+	secret, err := s.config.Credentials.IssueCredential(username, name, expiresAt)
+	switch {
+	case errors.Is(err, credential.ErrUnknownUser):
+		s.renderUsers(w, usersViewData{Error: "user not found", CSRFToken: rotatedCSRFToken}, http.StatusNotFound)
+		return
+	case errors.Is(err, credential.ErrCredentialExists):
+		s.renderUsers(w, usersViewData{Error: "user already has a credential with this name", CSRFToken: rotatedCSRFToken}, http.StatusConflict)
+		return
+	case err != nil:
+		s.renderUsers(w, usersViewData{Error: "failed to generate credential", CSRFToken: rotatedCSRFToken}, http.StatusInternalServerError)
+		return
+	}
+	if err := s.persistUsers(); err != nil {
+		s.config.Credentials.RevokeCredential(username, name)
+		s.renderUsers(w, usersViewData{Error: "failed to persist users", CSRFToken: rotatedCSRFToken}, http.StatusInternalServerError)
+		return
+	}
+
+	s.renderUsers(w, usersViewData{
+		Success:           fmt.Sprintf("Credential %q issued successfully.", name),
+		GeneratedUsername: username,
+		GeneratedToken:    secret,
+		CSRFToken:         rotatedCSRFToken,
+	}, http.StatusOK)
+}
+
+func (s *Server) credentialViews() []credentialView {
+	now := time.Now()
+	var views []credentialView
+	for _, username := range s.config.Credentials.ListUsers() {
+		for _, named := range s.config.Credentials.Credentials(username) {
+			view := credentialView{
+				User:      named.User,
+				Name:      named.Name,
+				CreatedAt: "-",
+				LastUsed:  "never",
+				Expires:   "never",
+				Expired:   named.Expired(now),
+			}
+			if !named.CreatedAt.IsZero() {
+				view.CreatedAt = named.CreatedAt.Local().Format(time.DateOnly)
+			}
+			if !named.LastUsedAt.IsZero() {
+				view.LastUsed = formatStartedAgo(named.LastUsedAt)
+			}
+			if !named.ExpiresAt.IsZero() {
+				view.Expires = named.ExpiresAt.Local().Format("2006-01-02 15:04")
+			}
+			views = append(views, view)
+		}
+	}
+	return views
+}
+
+func (s *Server) handleDNSFlush(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.verifyCSRF(r); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rotatedCSRFToken, err := s.rotateCSRFToken(r)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if s.config.DNSCache == nil {
+		s.renderUsers(w, usersViewData{Error: "DNS cache is disabled", CSRFToken: rotatedCSRFToken}, http.StatusNotFound)
+		return
+	}
+
+	s.config.DNSCache.Flush()
+	s.config.Logger.Info().Msg("DNS cache flushed from admin console")
+	s.renderUsers(w, usersViewData{Success: "DNS cache flushed.", CSRFToken: rotatedCSRFToken}, http.StatusOK)
+}
+
+func (s *Server) dnsCacheStatus() *dnsCacheView {
+	if s.config.DNSCache == nil {
+		return nil
+	}
+
+	stats := s.config.DNSCache.Stats()
+	view := &dnsCacheView{
+		Entries:      stats.Entries,
+		Hits:         stats.Hits,
+		NegativeHits: stats.NegativeHits,
+		Misses:       stats.Misses,
+		Coalesced:    stats.Coalesced,
+		Evictions:    stats.Evictions,
+		HitRatio:     "-",
+	}
+	if lookups := stats.Hits + stats.NegativeHits + stats.Misses + stats.Coalesced; lookups > 0 {
+		view.HitRatio = fmt.Sprintf("%.1f%%", float64(stats.Hits+stats.NegativeHits+stats.Coalesced)*100/float64(lookups))
+	}
+	return view
+}
+
+func (s *Server) handleHTTPCacheFlush(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := s.verifyCSRF(r); err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	rotatedCSRFToken, err := s.rotateCSRFToken(r)
+	if err != nil {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	if s.config.HTTPCache == nil {
+		s.renderUsers(w, usersViewData{Error: "HTTP cache is disabled", CSRFToken: rotatedCSRFToken}, http.StatusNotFound)
+		return
+	}
+
+	s.config.HTTPCache.Flush()
+	s.config.Logger.Info().Msg("HTTP cache flushed from admin console")
+	s.renderUsers(w, usersViewData{Success: "HTTP cache flushed.", CSRFToken: rotatedCSRFToken}, http.StatusOK)
+}
+
+func (s *Server) httpCacheStatus() *httpCacheView {
+	if s.config.HTTPCache == nil {
+		return nil
+	}
+
+	stats := s.config.HTTPCache.Stats()
+	view := &httpCacheView{
+		Entries:     stats.Entries,
+		Hits:        stats.Hits,
+		Revalidated: stats.Revalidated,
+		Misses:      stats.Misses,
+		Evictions:   stats.Evictions,
+		Memory:      formatBytes(uint64(stats.MemoryBytes)),
+		Disk:        formatBytes(uint64(stats.DiskBytes)),
+		HitRatio:    "-",
+	}
+	if requests := stats.Hits + stats.Revalidated + stats.Misses; requests > 0 {
+		view.HitRatio = fmt.Sprintf("%.1f%%", float64(stats.Hits+stats.Revalidated)*100/float64(requests))
+	}
+	return view
+}
+
+// handlePACPreview serves the PAC file of the user named by the user query
+// parameter, or the shared one, as plain text for the admin console.
+func (s *Server) handlePACPreview(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.config.PAC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	script, ok := s.config.PAC.Script(r.Host, r.URL.Query().Get("user"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte(script))
+}
+
+func (s *Server) pacStatus() *pacView {
+	if s.config.PAC == nil {
+		return nil
+	}
+	return &pacView{Users: s.config.PAC.Users()}
+}
+
+// handleInspectionCA serves the CA certificate clients install to trust
+// inspected connections.
+func (s *Server) handleInspectionCA(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.config.Inspector == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="nanoproxy-inspection-ca.pem"`)
+	_, _ = w.Write(s.config.Inspector.Authority().CertificatePEM())
+}
+
+// handleInspectionHAR serves the captured inspected exchanges as a HAR file.
+func (s *Server) handleInspectionHAR(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.config.Inspector == nil || s.config.Inspector.HAR() == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="nanoproxy-%s.har"`, time.Now().UTC().Format("20060102-150405")))
+	if _, err := s.config.Inspector.HAR().WriteTo(w); err != nil {
+		s.config.Logger.Warn().Err(err).Msg("failed to write HAR capture")
+	}
+}
+
+func (s *Server) inspectionStatus() *inspectionView {
+	if s.config.Inspector == nil {
+		return nil
+	}
+
+	authority := s.config.Inspector.Authority()
+	view := &inspectionView{
+		Fingerprint:  authority.Fingerprint(),
+		CachedLeaves: authority.CachedLeaves(),
+	}
+	if har := s.config.Inspector.HAR(); har != nil {
+		view.HAR = true
+		view.HAREntries = har.Len()
+	}
+	return view
+}
+
+func (s *Server) handleUpstreamRows(w http.ResponseWriter, r *http.Request) {
+	if !s.isAuthenticated(r) {
+		s.redirectToLogin(w, r)
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.renderTemplate(w, "upstream_rows.gohtml", usersViewData{Upstreams: s.upstreamStatus()}, http.StatusOK)
+}
+
+func (s *Server) upstreamStatus() []upstreamView {
+	var rows []upstreamView
+	for _, pool := range s.config.UpstreamPools {
+		for _, member := range pool.Status() {
+			row := upstreamView{
+				Pool:      pool.Name(),
+				Name:      member.Name,
+				Addr:      member.Addr,
+				Status:    "Healthy",
+				Latency:   "-",
+				Successes: member.Successes,
+				Failures:  member.Failures,
+				LastError: member.LastError,
+				LastCheck: "never",
+			}
+			switch {
+			case member.CircuitOpen:
+				row.Status = "Circuit open"
+			case !member.Healthy:
+				row.Status = "Unhealthy"
+			}
+			if member.Latency > 0 {
+				row.Latency = member.Latency.Round(time.Millisecond).String()
+			}
+			if !member.LastCheck.IsZero() {
+				row.LastCheck = formatStartedAgo(member.LastCheck)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
 func (s *Server) handleUserRows(w http.ResponseWriter, r *http.Request) {
 	if !s.isAuthenticated(r) {
 		s.redirectToLogin(w, r)
@@ -565,6 +1025,7 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 	byUser := make(map[string]*proxyUserView, len(usernames))
 	startedByUser := make(map[string]time.Time, len(usernames))
 	ipSetByUser := make(map[string]map[string]struct{}, len(usernames))
+	egressSetByUser := make(map[string]map[string]struct{}, len(usernames))
 	totalByUser := make(map[string]traffic.UserTotals)
 
 	for _, username := range usernames {
@@ -572,6 +1033,7 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 			Username:      username,
 			ActiveClients: 0,
 			ClientIP:      "-",
+			EgressIP:      "-",
 			UploadRate:    "0 B/s",
 			DownloadRate:  "0 B/s",
 			UploadTotal:   "0 B",
@@ -582,6 +1044,7 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 		rows = append(rows, row)
 		byUser[username] = &rows[len(rows)-1]
 		ipSetByUser[username] = make(map[string]struct{})
+		egressSetByUser[username] = make(map[string]struct{})
 	}
 
 	if s.config.Tracker == nil {
@@ -601,6 +1064,9 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 		if item.ClientIP != "" {
 			ipSetByUser[item.Username][item.ClientIP] = struct{}{}
 		}
+		if item.EgressIP != "" {
+			egressSetByUser[item.Username][item.EgressIP] = struct{}{}
+		}
 
 		if startedByUser[item.Username].IsZero() || item.StartedAt.Before(startedByUser[item.Username]) {
 			startedByUser[item.Username] = item.StartedAt
@@ -623,12 +1089,10 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 			continue
 		}
 
-		ips := make([]string, 0, len(ipSetByUser[rows[i].Username]))
-		for ip := range ipSetByUser[rows[i].Username] {
-			ips = append(ips, ip)
+		rows[i].ClientIP = joinSorted(ipSetByUser[rows[i].Username])
+		if len(egressSetByUser[rows[i].Username]) > 0 {
+			rows[i].EgressIP = joinSorted(egressSetByUser[rows[i].Username])
 		}
-		sort.Strings(ips)
-		rows[i].ClientIP = strings.Join(ips, ", ")
 		rows[i].StartedAgo = formatStartedAgo(startedByUser[rows[i].Username])
 	}
 
@@ -638,11 +1102,23 @@ func (s *Server) proxyUsersWithTraffic() []proxyUserView {
 		rows[i].DownloadRate = formatByteRate(totals.DownloadBPS)
 		rows[i].UploadTotal = formatBytes(totals.UploadBytes)
 		rows[i].DownloadTotal = formatBytes(totals.DownloadBytes)
+		if totals.CachedBytes > 0 {
+			rows[i].CachedTotal = formatBytes(totals.CachedBytes)
+		}
 	}
 
 	return rows
 }
 
+func joinSorted(set map[string]struct{}) string {
+	items := make([]string, 0, len(set))
+	for item := range set {
+		items = append(items, item)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ", ")
+}
+
 func formatByteRate(n uint64) string {
 	return fmt.Sprintf("%s/s", formatBytes(n))
 }
@@ -700,7 +1176,7 @@ func (s *Server) persistUsers() error {
 		return nil
 	}
 
-	return s.config.UserStore.Save(s.config.Credentials.Snapshot())
+	return credential.Save(s.config.UserStore, s.config.Credentials)
 }
 
 func (s *Server) persistTraffic() error {
@@ -1065,6 +1541,19 @@ func validateUsername(username string) error {
 	return nil
 }
 
+func validateCredentialName(name string) error {
+	if name == "" {
+		return httpError("credential name is required")
+	}
+	if len(name) > maxUsernameLength {
+		return httpError("credential name must be at most 64 characters")
+	}
+	if !usernamePattern.MatchString(name) {
+		return httpError("credential name may only contain letters, numbers, dots, underscores, and hyphens")
+	}
+	return nil
+}
+
 type httpError string
 
 func (e httpError) Error() string {
@@ -1,8 +1,10 @@
 package admin
 
 import (
+	"errors"
 	"html"
 	"io"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
@@ -15,7 +17,12 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/httpproxy"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
+	"github.com/ryanbekhen/nanoproxy/pkg/pac"
+	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/ryanbekhen/nanoproxy/pkg/upstream"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/crypto/bcrypt"
@@ -957,6 +964,32 @@ func TestServer_ProxyUsersWithTraffic_RecentSessionStillActive(t *testing.T) {
 	assert.NotEqual(t, "0 B", rows[0].UploadTotal)
 }
 
+func TestServer_ProxyUsersWithTraffic_EgressIP(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	creds := credential.NewStaticCredentialStore()
+	creds.Add("alice", "password")
+	creds.Add("bob", "password")
+
+	tracker := traffic.NewTracker()
+	for _, ip := range []string{"203.0.113.2", "203.0.113.1"} {
+		sess := tracker.Start("alice", "10.0.0.2")
+		sess.SetEgressIP(ip)
+	}
+	tracker.Start("bob", "10.0.0.3")
+
+	s := New(&Config{
+		Credentials: creds,
+		Tracker:     tracker,
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		Logger:      &logger,
+	})
+
+	rows := s.proxyUsersWithTraffic()
+	require.Len(t, rows, 2)
+	assert.Equal(t, "203.0.113.1, 203.0.113.2", rows[0].EgressIP)
+	assert.Equal(t, "-", rows[1].EgressIP)
+}
+
 func TestServer_NilUserStore_CreateUser(t *testing.T) {
 	logger := zerolog.New(io.Discard)
 	creds := credential.NewStaticCredentialStore()
@@ -1263,3 +1296,352 @@ func extractCSRFToken(t *testing.T, content string) string {
 
 	return matches[1]
 }
+
+func TestServer_UpstreamRows(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	pool, err := upstream.NewPool(upstream.PoolConfig{Name: "egress", FailureThreshold: 1}, []upstream.Member{
+		{Name: "socks5://good:1080", Addr: "good:1080", Dialer: upstream.DialFunc(func(network, addr string) (net.Conn, error) {
+			client, server := net.Pipe()
+			_ = server.Close()
+			return client, nil
+		})},
+		{Name: "socks5://bad:1080", Addr: "bad:1080", Dialer: upstream.DialFunc(func(network, addr string) (net.Conn, error) {
+			return nil, errors.New("connection refused")
+		})},
+	})
+	require.NoError(t, err)
+
+	s := New(&Config{
+		Credentials:   credential.NewStaticCredentialStore(),
+		UserStore:     credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db")),
+		AdminStore:    newSeededAdminStore(t, "admin", "secret"),
+		UpstreamPools: []*upstream.Pool{pool},
+		Logger:        &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	// Round-robin hits the good member first, then the bad one trips its circuit.
+	for i := 0; i < 2; i++ {
+		conn, err := pool.Dial("tcp", "example.com:80")
+		require.NoError(t, err)
+		_ = conn.Close()
+	}
+
+	client, _ := loginHelper(t, ts.URL)
+	resp, err := client.Get(ts.URL + "/admin/upstreams/rows")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	page := string(body)
+	assert.Contains(t, page, "socks5://good:1080")
+	assert.Contains(t, page, "Healthy")
+	assert.Contains(t, page, "Circuit open")
+	assert.Contains(t, page, "connection refused")
+}
+
+func TestServer_UpstreamRows_RequiresAuth(t *testing.T) {
+	_, ts := newAdminServer(t)
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	resp, err := client.Get(ts.URL + "/admin/upstreams/rows")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+}
+
+func TestServer_DNSFlush(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	cache := resolver.NewCachingResolver(&resolver.DNSResolver{}, resolver.CacheConfig{})
+	_, err := cache.Resolve("localhost")
+	require.NoError(t, err)
+
+	s := New(&Config{
+		Credentials: credential.NewStaticCredentialStore(),
+		UserStore:   credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db")),
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		DNSCache:    cache,
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	client, csrfToken := loginHelper(t, ts.URL)
+
+	resp, err := client.Get(ts.URL + "/admin/users")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "DNS cache")
+	assert.Contains(t, string(body), "1 entries")
+
+	resp, err = client.PostForm(ts.URL+"/admin/dns/flush", url.Values{"_csrf": {"wrong"}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, 1, cache.Stats().Entries)
+
+	resp, err = client.PostForm(ts.URL+"/admin/dns/flush", url.Values{"_csrf": {csrfToken}})
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "DNS cache flushed.")
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestServer_HTTPCacheFlush(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	cache, err := httpproxy.NewCache(httpproxy.CacheConfig{})
+	require.NoError(t, err)
+
+	s := New(&Config{
+		Credentials: credential.NewStaticCredentialStore(),
+		UserStore:   credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db")),
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		HTTPCache:   cache,
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	client, csrfToken := loginHelper(t, ts.URL)
+
+	resp, err := client.Get(ts.URL + "/admin/users")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "HTTP cache")
+	assert.Contains(t, string(body), "hit ratio -")
+
+	resp, err = client.PostForm(ts.URL+"/admin/http-cache/flush", url.Values{"_csrf": {"wrong"}})
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, err = client.PostForm(ts.URL+"/admin/http-cache/flush", url.Values{"_csrf": {csrfToken}})
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "HTTP cache flushed.")
+}
+
+func TestServer_PACPreview(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	generator, err := pac.New(pac.Config{
+		File:     pac.File{Users: map[string]pac.User{"alice": {Proxies: []string{"PROXY proxy-eu.example.com:3128"}}}},
+		Host:     "proxy.example.com",
+		HTTPPort: 8080,
+	})
+	require.NoError(t, err)
+
+	s := New(&Config{
+		Credentials: credential.NewStaticCredentialStore(),
+		UserStore:   credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db")),
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		PAC:         generator,
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noFollow.Get(ts.URL + "/admin/pac")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	client, _ := loginHelper(t, ts.URL)
+
+	resp, err = client.Get(ts.URL + "/admin/users")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "Proxy auto-config")
+	assert.Contains(t, string(body), `<option value="alice">alice</option>`)
+
+	resp, err = client.Get(ts.URL + "/admin/pac")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), `return "PROXY proxy.example.com:8080";`)
+
+	resp, err = client.Get(ts.URL + "/admin/pac?user=alice")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), `return "PROXY proxy-eu.example.com:3128";`)
+
+	resp, err = client.Get(ts.URL + "/admin/pac?user=bob")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestServer_Inspection(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	dir := t.TempDir()
+	authority, err := mitm.NewAuthority(mitm.AuthorityConfig{
+		CertFile: filepath.Join(dir, "ca.pem"),
+		KeyFile:  filepath.Join(dir, "ca.key"),
+	})
+	require.NoError(t, err)
+	inspector := mitm.New(mitm.Config{Authority: authority, HAR: mitm.NewHAR(10)})
+	inspector.HAR().Add(mitm.Exchange{Method: http.MethodGet, URL: &url.URL{Scheme: "https", Host: "example.com", Path: "/"}, StatusCode: http.StatusOK})
+
+	s := New(&Config{
+		Credentials: credential.NewStaticCredentialStore(),
+		UserStore:   credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db")),
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		Inspector:   inspector,
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noFollow.Get(ts.URL + "/admin/inspection/ca.pem")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusSeeOther, resp.StatusCode)
+
+	client, _ := loginHelper(t, ts.URL)
+
+	resp, err = client.Get(ts.URL + "/admin/users")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Contains(t, string(body), "HTTPS inspection")
+	assert.Contains(t, string(body), authority.Fingerprint())
+
+	resp, err = client.Get(ts.URL + "/admin/inspection/ca.pem")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-pem-file", resp.Header.Get("Content-Type"))
+	assert.Equal(t, authority.CertificatePEM(), body)
+
+	resp, err = client.Get(ts.URL + "/admin/inspection/har")
+	require.NoError(t, err)
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("Content-Disposition"), ".har")
+	assert.Contains(t, string(body), `"url": "https://example.com/"`)
+}
+
+func TestServer_Inspection_Disabled(t *testing.T) {
+	_, ts := newAdminServer(t)
+	client, _ := loginHelper(t, ts.URL)
+
+	for _, path := range []string{"/admin/inspection/ca.pem", "/admin/inspection/har"} {
+		resp, err := client.Get(ts.URL + path)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, path)
+	}
+}
+
+func TestServer_Credentials(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("ci", "secret")
+	userStore := credential.NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	s := New(&Config{
+		Credentials: credentials,
+		UserStore:   userStore,
+		AdminStore:  newSeededAdminStore(t, "admin", "secret"),
+		Logger:      &logger,
+	})
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	client, csrfToken := loginHelper(t, ts.URL)
+
+	issue := func(name, expiresIn string) (*http.Response, string) {
+		t.Helper()
+		resp, err := client.PostForm(ts.URL+"/admin/credentials", url.Values{
+			"_csrf":      {csrfToken},
+			"username":   {"ci"},
+			"name":       {name},
+			"expires_in": {expiresIn},
+		})
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		csrfToken = extractCSRFToken(t, string(body))
+		return resp, string(body)
+	}
+
+	resp, body := issue("deploy", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "Credential &#34;deploy&#34; issued successfully.")
+	deploy := extractGeneratedPassword(t, body)
+	assert.True(t, credentials.Valid("ci", deploy))
+	assert.True(t, credentials.Valid("ci", "secret"))
+
+	resp, body = issue("nightly", "720h")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	nightly := extractGeneratedPassword(t, body)
+	assert.NotEqual(t, deploy, nightly)
+	assert.Contains(t, body, `id="credential-ci-nightly"`)
+
+	resp, _ = issue("deploy", "")
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	resp, _ = issue("bad name", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	restarted := credential.NewStaticCredentialStore()
+	require.NoError(t, credential.LoadInto(userStore, restarted))
+	user, ok := restarted.UserForToken(nightly)
+	assert.True(t, ok)
+	assert.Equal(t, "ci", user)
+	named := restarted.Credentials("ci")
+	require.Len(t, named, 2)
+	assert.False(t, named[1].ExpiresAt.IsZero())
+
+	revoke := func() *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodDelete, ts.URL+"/admin/credentials/ci/deploy", nil)
+		require.NoError(t, err)
+		req.Header.Set("X-CSRF-Token", csrfToken)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		csrfToken = extractCSRFToken(t, string(body))
+		assert.NotContains(t, string(body), deploy)
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, revoke().StatusCode)
+	assert.False(t, credentials.Valid("ci", deploy))
+	assert.True(t, credentials.Valid("ci", nightly))
+	assert.True(t, credentials.Exists("ci"))
+	assert.Equal(t, http.StatusNotFound, revoke().StatusCode)
+}
@@ -0,0 +1,364 @@
+// Package certauth identifies proxy users by their TLS client certificates.
+// A policy names the certificate authorities trusted to issue them, an
+// optional revocation list, rules mapping certificate fields to usernames
+// and the users allowed to authenticate this way.
+package certauth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/filewatch"
+)
+
+const DefaultReloadInterval = 30 * time.Second
+
+var (
+	ErrRevoked      = errors.New("client certificate is revoked")
+	ErrNoMatch      = errors.New("client certificate matches no mapping rule")
+	ErrUserDisabled = errors.New("user is disabled for certificate authentication")
+)
+
+// Field is the part of a certificate a rule looks at.
+type Field string
+
+const (
+	FieldCommonName         Field = "cn"
+	FieldOrganizationalUnit Field = "ou"
+	FieldEmail              Field = "email"
+	FieldDNS                Field = "dns"
+	FieldURI                Field = "uri"
+)
+
+// ParseField validates a field name. An empty string selects the common
+// name.
+func ParseField(value string) (Field, error) {
+	switch field := Field(value); field {
+	case "":
+		return FieldCommonName, nil
+	case FieldCommonName, FieldOrganizationalUnit, FieldEmail, FieldDNS, FieldURI:
+		return field, nil
+	default:
+		return "", fmt.Errorf("unknown certificate field %q", value)
+	}
+}
+
+func (f Field) values(cert *x509.Certificate) []string {
+	switch f {
+	case FieldCommonName, "":
+		return []string{cert.Subject.CommonName}
+	case FieldOrganizationalUnit:
+		return cert.Subject.OrganizationalUnit
+	case FieldEmail:
+		return cert.EmailAddresses
+	case FieldDNS:
+		return cert.DNSNames
+	case FieldURI:
+		values := make([]string, 0, len(cert.URIs))
+		for _, uri := range cert.URIs {
+			values = append(values, uri.String())
+		}
+		return values
+	}
+	return nil
+}
+
+// Rule maps a certificate field to a username. Match is a regular
+// expression tested against every value of Field; Username is expanded with
+// its submatches ("$1", "${name}") and defaults to the whole value. Without
+// Match, every non-empty value matches.
+type Rule struct {
+	Field    Field  `json:"field"`
+	Match    string `json:"match,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+// Policy is the content of a certificate authentication file. Relative file
+// names are resolved against the directory of the policy file.
+type Policy struct {
+	CAFile  string `json:"ca_file"`
+	CRLFile string `json:"crl_file,omitempty"`
+	// Rules are tried in order; the first one that yields a username wins.
+	// No rules selects the common name.
+	Rules []Rule `json:"rules,omitempty"`
+	// Users enables or disables users for certificate authentication.
+	// Users not listed are enabled unless DisableUnlisted is set.
+	Users           map[string]bool `json:"users,omitempty"`
+	DisableUnlisted bool            `json:"disable_unlisted,omitempty"`
+}
+
+type Config struct {
+	// File is a JSON Policy. It is read again, together with the files it
+	// names, when any of them changes.
+	File string
+	// Policy is used when File is empty.
+	Policy Policy
+	// ReloadInterval is how often the files are checked for changes once
+	// Start has been called.
+	ReloadInterval time.Duration
+	// OnReload, when set, is called after the files changed and were read
+	// again, with the error if they could not be loaded.
+	OnReload func(err error)
+}
+
+type compiledRule struct {
+	field    Field
+	match    *regexp.Regexp
+	username string
+}
+
+type state struct {
+	pool            *x509.CertPool
+	revoked         map[string]struct{}
+	rules           []compiledRule
+	users           map[string]bool
+	disableUnlisted bool
+}
+
+// Authenticator maps verified client certificates to usernames. A reload
+// that fails keeps the previous policy in place.
+type Authenticator struct {
+	config Config
+	state  atomic.Pointer[state]
+	files  *filewatch.Watcher
+}
+
+func New(conf Config) (*Authenticator, error) {
+	if conf.ReloadInterval <= 0 {
+		conf.ReloadInterval = DefaultReloadInterval
+	}
+
+	a := &Authenticator{config: conf, files: filewatch.New(conf.ReloadInterval, conf.OnReload)}
+	if err := a.files.Load(a.load); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// ClientCAs returns the certificate authorities currently trusted to issue
+// client certificates.
+func (a *Authenticator) ClientCAs() *x509.CertPool {
+	return a.state.Load().pool
+}
+
+// Counts returns the number of mapping rules and revoked certificates.
+func (a *Authenticator) Counts() (rules, revoked int) {
+	st := a.state.Load()
+	return len(st.rules), len(st.revoked)
+}
+
+// Identify returns the username of a client certificate that the TLS
+// handshake already verified against ClientCAs.
+func (a *Authenticator) Identify(cert *x509.Certificate) (string, error) {
+	st := a.state.Load()
+	if _, revoked := st.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber.String())]; revoked {
+		return "", fmt.Errorf("%w: serial %s", ErrRevoked, cert.SerialNumber)
+	}
+
+	for _, rule := range st.rules {
+		username := rule.apply(cert)
+		if username == "" {
+			continue
+		}
+		enabled, listed := st.users[username]
+		if listed && !enabled || !listed && st.disableUnlisted {
+			return "", fmt.Errorf("%w: %s", ErrUserDisabled, username)
+		}
+		return username, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoMatch, cert.Subject)
+}
+
+func (r compiledRule) apply(cert *x509.Certificate) string {
+	for _, value := range r.field.values(cert) {
+		if value == "" {
+			continue
+		}
+		if r.match == nil {
+			return value
+		}
+		submatches := r.match.FindStringSubmatchIndex(value)
+		if submatches == nil {
+			continue
+		}
+		template := r.username
+		if template == "" {
+			template = "$0"
+		}
+		if username := string(r.match.ExpandString(nil, template, value, submatches)); username != "" {
+			return username
+		}
+	}
+	return ""
+}
+
+// Start checks the files for changes every ReloadInterval until Close is
+// called.
+func (a *Authenticator) Start() {
+	a.files.Start(a.Reload)
+}
+
+func (a *Authenticator) Close() {
+	a.files.Close()
+}
+
+// Reload reads the files again if any of them changed since the last load.
+// It reports whether a reload was attempted.
+func (a *Authenticator) Reload() (bool, error) {
+	return a.files.Reload(a.load)
+}
+
+func (a *Authenticator) load(watch func(path string)) error {
+	st := &state{}
+
+	policy := a.config.Policy
+	dir := ""
+	if a.config.File != "" {
+		watch(a.config.File)
+		data, err := os.ReadFile(a.config.File)
+		if err != nil {
+			return err
+		}
+		policy = Policy{}
+		if err := json.Unmarshal(data, &policy); err != nil {
+			return fmt.Errorf("%s: %w", a.config.File, err)
+		}
+		dir = filepath.Dir(a.config.File)
+	}
+
+	if policy.CAFile == "" {
+		return errors.New("certificate authentication needs a CA file")
+	}
+	caFile := resolvePath(dir, policy.CAFile)
+	watch(caFile)
+	cas, err := readCertificates(caFile)
+	if err != nil {
+		return err
+	}
+	st.pool = x509.NewCertPool()
+	for _, ca := range cas {
+		st.pool.AddCert(ca)
+	}
+
+	st.revoked = make(map[string]struct{})
+	if policy.CRLFile != "" {
+		crlFile := resolvePath(dir, policy.CRLFile)
+		watch(crlFile)
+		if err := readRevocationList(crlFile, cas, st.revoked); err != nil {
+			return err
+		}
+	}
+
+	rules := policy.Rules
+	if len(rules) == 0 {
+		rules = []Rule{{Field: FieldCommonName}}
+	}
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		st.rules = append(st.rules, compiled)
+	}
+
+	st.users = policy.Users
+	st.disableUnlisted = policy.DisableUnlisted
+	a.state.Store(st)
+	return nil
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	field, err := ParseField(string(rule.Field))
+	if err != nil {
+		return compiledRule{}, err
+	}
+	compiled := compiledRule{field: field, username: rule.Username}
+	if rule.Match != "" {
+		if compiled.match, err = regexp.Compile(rule.Match); err != nil {
+			return compiledRule{}, err
+		}
+	} else if rule.Username != "" {
+		return compiledRule{}, errors.New("username template needs a match expression")
+	}
+	return compiled, nil
+}
+
+func resolvePath(dir, path string) string {
+	if dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+func readCertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return certs, nil
+}
+
+// readRevocationList adds the entries of a PEM or DER certificate
+// revocation list to revoked. The list must be signed by one of cas.
+func readRevocationList(path string, cas []*x509.Certificate, revoked map[string]struct{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if list.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("%s: revocation list is not signed by a trusted CA", path)
+	}
+
+	for _, entry := range list.RevokedCertificateEntries {
+		revoked[revocationKey(list.RawIssuer, entry.SerialNumber.String())] = struct{}{}
+	}
+	return nil
+}
+
+func revocationKey(rawIssuer []byte, serial string) string {
+	return string(rawIssuer) + "/" + serial
+}
@@ -0,0 +1,238 @@
+package certauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, template *x509.Certificate) *x509.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func (ca *testCA) revocationList(t *testing.T, number int64, serials ...int64) []byte {
+	t.Helper()
+
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func writePolicy(t *testing.T, path string, policy Policy) {
+	t.Helper()
+
+	data, err := json.Marshal(policy)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+func TestAuthenticator_Identify(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "clients")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0o600))
+
+	a, err := New(Config{Policy: Policy{
+		CAFile: filepath.Join(dir, "ca.pem"),
+		Rules: []Rule{
+			{Field: FieldURI, Match: `^spiffe://corp/ns/([^/]+)/sa/([^/]+)$`, Username: "$1-$2"},
+			{Field: FieldEmail, Match: `^([^@]+)@corp\.example$`, Username: "$1"},
+			{Field: FieldCommonName},
+		},
+		Users: map[string]bool{"ci-runner": true, "legacy": false},
+	}})
+	require.NoError(t, err)
+	assert.NotNil(t, a.ClientCAs())
+
+	workload, _ := url.Parse("spiffe://corp/ns/ci/sa/runner")
+	username, err := a.Identify(ca.issue(t, 10, &x509.Certificate{Subject: pkix.Name{CommonName: "ignored"}, URIs: []*url.URL{workload}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "ci-runner", username)
+
+	username, err = a.Identify(ca.issue(t, 11, &x509.Certificate{EmailAddresses: []string{"other@example.com", "alice@corp.example"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	username, err = a.Identify(ca.issue(t, 12, &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", username)
+
+	_, err = a.Identify(ca.issue(t, 13, &x509.Certificate{Subject: pkix.Name{CommonName: "legacy"}}))
+	assert.ErrorIs(t, err, ErrUserDisabled)
+
+	_, err = a.Identify(ca.issue(t, 14, &x509.Certificate{}))
+	assert.ErrorIs(t, err, ErrNoMatch)
+}
+
+func TestAuthenticator_DisableUnlisted(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "clients")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0o600))
+
+	a, err := New(Config{Policy: Policy{
+		CAFile:          filepath.Join(dir, "ca.pem"),
+		Users:           map[string]bool{"alice": true},
+		DisableUnlisted: true,
+	}})
+	require.NoError(t, err)
+
+	username, err := a.Identify(ca.issue(t, 2, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	_, err = a.Identify(ca.issue(t, 3, &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}))
+	assert.ErrorIs(t, err, ErrUserDisabled)
+}
+
+func TestAuthenticator_RevocationList(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "clients")
+	other := newTestCA(t, "other")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), append(ca.pem, other.pem...), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clients.crl"), ca.revocationList(t, 1, 20), 0o600))
+
+	a, err := New(Config{Policy: Policy{CAFile: filepath.Join(dir, "ca.pem"), CRLFile: filepath.Join(dir, "clients.crl")}})
+	require.NoError(t, err)
+	rules, revoked := a.Counts()
+	assert.Equal(t, 1, rules)
+	assert.Equal(t, 1, revoked)
+
+	_, err = a.Identify(ca.issue(t, 20, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}))
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	// The same serial from another issuer is a different certificate.
+	username, err := a.Identify(other.issue(t, 20, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", username)
+
+	untrusted := newTestCA(t, "untrusted")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "forged.crl"), untrusted.revocationList(t, 1, 21), 0o600))
+	_, err = New(Config{Policy: Policy{CAFile: filepath.Join(dir, "ca.pem"), CRLFile: filepath.Join(dir, "forged.crl")}})
+	assert.Error(t, err)
+}
+
+func TestAuthenticator_ReloadPolicyFile(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "clients")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clients.crl"), ca.revocationList(t, 1), 0o600))
+	policyFile := filepath.Join(dir, "client-certs.json")
+	writePolicy(t, policyFile, Policy{CAFile: "ca.pem", CRLFile: "clients.crl"})
+
+	var reloads []error
+	a, err := New(Config{File: policyFile, OnReload: func(err error) { reloads = append(reloads, err) }})
+	require.NoError(t, err)
+
+	alice := ca.issue(t, 30, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}})
+	_, err = a.Identify(alice)
+	assert.NoError(t, err)
+
+	reloaded, err := a.Reload()
+	assert.False(t, reloaded)
+	assert.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "clients.crl"), ca.revocationList(t, 2, 30), 0o600))
+	reloaded, err = a.Reload()
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+	_, err = a.Identify(alice)
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	writePolicy(t, policyFile, Policy{CAFile: "ca.pem", Rules: []Rule{{Field: "serial"}}})
+	reloaded, err = a.Reload()
+	assert.True(t, reloaded)
+	assert.Error(t, err)
+	_, err = a.Identify(alice)
+	assert.ErrorIs(t, err, ErrRevoked)
+
+	writePolicy(t, policyFile, Policy{CAFile: "ca.pem", Users: map[string]bool{"alice": false}})
+	reloaded, err = a.Reload()
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+	_, err = a.Identify(alice)
+	assert.ErrorIs(t, err, ErrUserDisabled)
+
+	require.Len(t, reloads, 3)
+	assert.NoError(t, reloads[0])
+	assert.Error(t, reloads[1])
+	assert.NoError(t, reloads[2])
+}
+
+func TestNew_InvalidPolicy(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "clients")
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	for name, policy := range map[string]Policy{
+		"missing CA file":        {},
+		"unreadable CA file":     {CAFile: filepath.Join(dir, "missing.pem")},
+		"unknown field":          {CAFile: caFile, Rules: []Rule{{Field: "serial"}}},
+		"invalid expression":     {CAFile: caFile, Rules: []Rule{{Field: FieldCommonName, Match: "("}}},
+		"template without match": {CAFile: caFile, Rules: []Rule{{Field: FieldCommonName, Username: "svc-$0"}}},
+	} {
+		_, err := New(Config{Policy: policy})
+		assert.Error(t, err, name)
+	}
+}
@@ -3,21 +3,92 @@ package config
 import "time"
 
 type Config struct {
-	Timezone              string        `env:"TZ" envDefault:"Local"`
-	LogLevel              string        `env:"LOG_LEVEL" envDefault:"info"`
-	Network               string        `env:"NETWORK" envDefault:"tcp"`
-	ADDR                  string        `env:"ADDR" envDefault:":1080"`
-	ADDRHttp              string        `env:"ADDR_HTTP" envDefault:":8080"`
-	ADDRAdmin             string        `env:"ADDR_ADMIN" envDefault:":9090"`
-	NoAuthMode            bool          `env:"NO_AUTH_MODE" envDefault:"false"`
-	UserStorePath         string        `env:"USER_STORE_PATH" envDefault:"nanoproxy-data.db"`
-	AdminCookieSecure     bool          `env:"ADMIN_COOKIE_SECURE" envDefault:"false"`
-	AdminMaxLoginAttempts int           `env:"ADMIN_MAX_LOGIN_ATTEMPTS" envDefault:"5"`
-	AdminLoginWindow      time.Duration `env:"ADMIN_LOGIN_WINDOW" envDefault:"5m"`
-	AdminLockoutDuration  time.Duration `env:"ADMIN_LOCKOUT_DURATION" envDefault:"10m"`
-	AdminAllowedOrigins   []string      `env:"ADMIN_ALLOWED_ORIGINS" envSeparator:","`
-	ClientTimeout         time.Duration `env:"CLIENT_TIMEOUT" envDefault:"15s"`
-	DestTimeout           time.Duration `env:"DEST_TIMEOUT" envDefault:"15s"`
-	TorEnabled            bool          `env:"TOR_ENABLED" envDefault:"false"`
-	TorIdentityInterval   time.Duration `env:"TOR_IDENTITY_INTERVAL" envDefault:"10m"`
+	Timezone                   string            `env:"TZ" envDefault:"Local"`
+	LogLevel                   string            `env:"LOG_LEVEL" envDefault:"info"`
+	Network                    string            `env:"NETWORK" envDefault:"tcp"`
+	ADDR                       string            `env:"ADDR" envDefault:":1080"`
+	ADDRHttp                   string            `env:"ADDR_HTTP" envDefault:":8080"`
+	ADDRAdmin                  string            `env:"ADDR_ADMIN" envDefault:":9090"`
+	ADDRHttps                  string            `env:"ADDR_HTTPS"`
+	HTTPSHTTP2                 bool              `env:"HTTPS_HTTP2" envDefault:"false"`
+	TLSCertFile                string            `env:"TLS_CERT_FILE"`
+	TLSKeyFile                 string            `env:"TLS_KEY_FILE"`
+	TLSSelfSignedHosts         []string          `env:"TLS_SELF_SIGNED_HOSTS" envSeparator:","`
+	TLSReloadInterval          time.Duration     `env:"TLS_RELOAD_INTERVAL" envDefault:"30s"`
+	ADDRSocks5TLS              string            `env:"ADDR_SOCKS5_TLS"`
+	SOCKS5TLSClientCA          string            `env:"SOCKS5_TLS_CLIENT_CA"`
+	SOCKS5TLSRequireClientCert bool              `env:"SOCKS5_TLS_REQUIRE_CLIENT_CERT" envDefault:"false"`
+	SOCKS5TLSClientCertUser    string            `env:"SOCKS5_TLS_CLIENT_CERT_USER" envDefault:"cn"`
+	ClientCertAuthFile         string            `env:"CLIENT_CERT_AUTH_FILE"`
+	HTTPSRequireClientCert     bool              `env:"HTTPS_REQUIRE_CLIENT_CERT" envDefault:"false"`
+	NoAuthMode                 bool              `env:"NO_AUTH_MODE" envDefault:"false"`
+	ProxyAuthSchemes           []string          `env:"PROXY_AUTH_SCHEMES" envSeparator:"," envDefault:"basic"`
+	ProxyAuthRealm             string            `env:"PROXY_AUTH_REALM" envDefault:"Restricted area"`
+	UserStorePath              string            `env:"USER_STORE_PATH" envDefault:"nanoproxy-data.db"`
+	AdminCookieSecure          bool              `env:"ADMIN_COOKIE_SECURE" envDefault:"false"`
+	AdminMaxLoginAttempts      int               `env:"ADMIN_MAX_LOGIN_ATTEMPTS" envDefault:"5"`
+	AdminLoginWindow           time.Duration     `env:"ADMIN_LOGIN_WINDOW" envDefault:"5m"`
+	AdminLockoutDuration       time.Duration     `env:"ADMIN_LOCKOUT_DURATION" envDefault:"10m"`
+	AdminAllowedOrigins        []string          `env:"ADMIN_ALLOWED_ORIGINS" envSeparator:","`
+	ClientTimeout              time.Duration     `env:"CLIENT_TIMEOUT" envDefault:"15s"`
+	DestTimeout                time.Duration     `env:"DEST_TIMEOUT" envDefault:"15s"`
+	TorEnabled                 bool              `env:"TOR_ENABLED" envDefault:"false"`
+	TorIdentityInterval        time.Duration     `env:"TOR_IDENTITY_INTERVAL" envDefault:"10m"`
+	UpstreamProxies            []string          `env:"UPSTREAM_PROXIES" envSeparator:","`
+	UpstreamProxiesFile        string            `env:"UPSTREAM_PROXIES_FILE"`
+	UpstreamPoolsFile          string            `env:"UPSTREAM_POOLS_FILE"`
+	RoutingRulesFile           string            `env:"ROUTING_RULES_FILE"`
+	HeaderRulesFile            string            `env:"HEADER_RULES_FILE"`
+	FilterRulesFile            string            `env:"FILTER_RULES_FILE"`
+	FilterReloadInterval       time.Duration     `env:"FILTER_RELOAD_INTERVAL" envDefault:"30s"`
+	ErrorPagesDir              string            `env:"ERROR_PAGES_DIR"`
+	ADDRPac                    string            `env:"ADDR_PAC"`
+	PACProxyHost               string            `env:"PAC_PROXY_HOST"`
+	PACFile                    string            `env:"PAC_FILE"`
+	UsernameParams             bool              `env:"USERNAME_PARAMS" envDefault:"false"`
+	UsernameParamsSep          string            `env:"USERNAME_PARAMS_SEPARATOR" envDefault:"-"`
+	UsernameParamsKeys         []string          `env:"USERNAME_PARAMS_KEYS" envSeparator:"," envDefault:"session,route"`
+	EgressSources              []string          `env:"EGRESS_SOURCES" envSeparator:","`
+	EgressStrategy             string            `env:"EGRESS_STRATEGY" envDefault:"round-robin"`
+	EgressBindings             map[string]string `env:"EGRESS_BINDINGS" envSeparator:"," envKeyValSeparator:"="`
+	EgressStickyTTL            time.Duration     `env:"EGRESS_STICKY_TTL" envDefault:"30m"`
+	DNSServers                 []string          `env:"DNS_SERVERS" envSeparator:","`
+	DNSTimeout                 time.Duration     `env:"DNS_TIMEOUT" envDefault:"5s"`
+	DNSViaOutbound             bool              `env:"DNS_VIA_OUTBOUND" envDefault:"false"`
+	DNSCacheSize               int               `env:"DNS_CACHE_SIZE" envDefault:"4096"`
+	DNSCacheMinTTL             time.Duration     `env:"DNS_CACHE_MIN_TTL" envDefault:"5s"`
+	DNSCacheMaxTTL             time.Duration     `env:"DNS_CACHE_MAX_TTL" envDefault:"1h"`
+	DNSCacheDefaultTTL         time.Duration     `env:"DNS_CACHE_DEFAULT_TTL" envDefault:"1m"`
+	DNSCacheNegativeTTL        time.Duration     `env:"DNS_CACHE_NEGATIVE_TTL" envDefault:"30s"`
+	DNSSplitServers            []string          `env:"DNS_SPLIT_SERVERS" envSeparator:","`
+	DNSHostsFiles              []string          `env:"DNS_HOSTS_FILES" envSeparator:","`
+	DNSBlocklists              []string          `env:"DNS_BLOCKLISTS" envSeparator:","`
+	DNSListsReloadInterval     time.Duration     `env:"DNS_LISTS_RELOAD_INTERVAL" envDefault:"30s"`
+	DNSListenAddr              string            `env:"DNS_LISTEN_ADDR"`
+	DNSAnswerTTL               time.Duration     `env:"DNS_ANSWER_TTL" envDefault:"60s"`
+	DNSClientUsers             map[string]string `env:"DNS_CLIENT_USERS" envSeparator:"," envKeyValSeparator:"="`
+	DNSAllowedClients          []string          `env:"DNS_ALLOWED_CLIENTS" envSeparator:","`
+	DNSMaxConcurrent           int               `env:"DNS_MAX_CONCURRENT" envDefault:"256"`
+	DNSFamily                  string            `env:"DNS_FAMILY" envDefault:"prefer-v4"`
+	HappyEyeballsDelay         time.Duration     `env:"HAPPY_EYEBALLS_DELAY" envDefault:"250ms"`
+	HTTPUpstreamIdleTimeout    time.Duration     `env:"HTTP_UPSTREAM_IDLE_TIMEOUT" envDefault:"90s"`
+	HTTPUpstreamMaxIdle        int               `env:"HTTP_UPSTREAM_MAX_IDLE_PER_HOST" envDefault:"8"`
+	OutboundTLSCAFile          string            `env:"OUTBOUND_TLS_CA_FILE"`
+	OutboundTLSMinVersion      string            `env:"OUTBOUND_TLS_MIN_VERSION" envDefault:"1.2"`
+	OutboundTLSALPN            []string          `env:"OUTBOUND_TLS_ALPN" envSeparator:","`
+	OutboundTLSFile            string            `env:"OUTBOUND_TLS_FILE"`
+	HTTPCacheEnabled           bool              `env:"HTTP_CACHE_ENABLED" envDefault:"false"`
+	HTTPCacheMemoryMB          int64             `env:"HTTP_CACHE_MEMORY_MB" envDefault:"64"`
+	HTTPCacheDir               string            `env:"HTTP_CACHE_DIR"`
+	HTTPCacheDiskMB            int64             `env:"HTTP_CACHE_DISK_MB" envDefault:"1024"`
+	HTTPCacheMaxObjectMB       int64             `env:"HTTP_CACHE_MAX_OBJECT_MB" envDefault:"16"`
+	InspectEnabled             bool              `env:"INSPECT_ENABLED" envDefault:"false"`
+	InspectCACertFile          string            `env:"INSPECT_CA_CERT_FILE" envDefault:"nanoproxy-inspect-ca.pem"`
+	InspectCAKeyFile           string            `env:"INSPECT_CA_KEY_FILE" envDefault:"nanoproxy-inspect-ca.key"`
+	InspectUsers               []string          `env:"INSPECT_USERS" envSeparator:","`
+	InspectDomains             []string          `env:"INSPECT_DOMAINS" envSeparator:","`
+	InspectExcludeDomains      []string          `env:"INSPECT_EXCLUDE_DOMAINS" envSeparator:","`
+	InspectPorts               []int             `env:"INSPECT_PORTS" envSeparator:"," envDefault:"443"`
+	InspectCertCacheSize       int               `env:"INSPECT_CERT_CACHE_SIZE" envDefault:"1024"`
+	InspectHAREntries          int               `env:"INSPECT_HAR_ENTRIES" envDefault:"0"`
 }
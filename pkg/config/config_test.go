@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/caarlos0/env/v10"
 )
@@ -31,3 +32,137 @@ func TestConfig_ParseNoAuthModeFromEnv(t *testing.T) {
 		t.Fatal("expected NO_AUTH_MODE=true from environment")
 	}
 }
+
+func TestConfig_UsernameParamsDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if cfg.UsernameParams {
+		t.Fatal("expected USERNAME_PARAMS default to false")
+	}
+	if cfg.UsernameParamsSep != "-" {
+		t.Fatalf("expected default separator '-', got %q", cfg.UsernameParamsSep)
+	}
+	if len(cfg.UsernameParamsKeys) != 2 || cfg.UsernameParamsKeys[0] != "session" || cfg.UsernameParamsKeys[1] != "route" {
+		t.Fatalf("unexpected default keys: %v", cfg.UsernameParamsKeys)
+	}
+}
+
+func TestConfig_HappyEyeballsDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if cfg.DNSFamily != "prefer-v4" {
+		t.Fatalf("expected default DNS family prefer-v4, got %q", cfg.DNSFamily)
+	}
+	if cfg.HappyEyeballsDelay != 250*time.Millisecond {
+		t.Fatalf("expected default attempt delay 250ms, got %v", cfg.HappyEyeballsDelay)
+	}
+}
+
+func TestConfig_HTTPUpstreamDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if cfg.HTTPUpstreamIdleTimeout != 90*time.Second {
+		t.Fatalf("expected default idle timeout 90s, got %v", cfg.HTTPUpstreamIdleTimeout)
+	}
+	if cfg.HTTPUpstreamMaxIdle != 8 {
+		t.Fatalf("expected default max idle per host 8, got %d", cfg.HTTPUpstreamMaxIdle)
+	}
+}
+
+func TestConfig_ParseEgressFromEnv(t *testing.T) {
+	t.Setenv("EGRESS_SOURCES", "203.0.113.1,2001:db8::/64")
+	t.Setenv("EGRESS_BINDINGS", "alice=203.0.113.1,bob=2001:db8::/64")
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if len(cfg.EgressSources) != 2 || cfg.EgressSources[1] != "2001:db8::/64" {
+		t.Fatalf("unexpected egress sources: %v", cfg.EgressSources)
+	}
+	if cfg.EgressBindings["alice"] != "203.0.113.1" || cfg.EgressBindings["bob"] != "2001:db8::/64" {
+		t.Fatalf("unexpected egress bindings: %v", cfg.EgressBindings)
+	}
+	if cfg.EgressStrategy != "round-robin" {
+		t.Fatalf("expected default egress strategy round-robin, got %q", cfg.EgressStrategy)
+	}
+}
+
+func TestConfig_ParseDNSListsFromEnv(t *testing.T) {
+	t.Setenv("DNS_SPLIT_SERVERS", "*.corp=10.0.0.53|tls://10.0.0.54?servername=dns.corp,lab.example=10.1.0.53")
+	t.Setenv("DNS_BLOCKLISTS", "/etc/nanoproxy/ads.txt,/etc/nanoproxy/malware.txt")
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if len(cfg.DNSSplitServers) != 2 || cfg.DNSSplitServers[0] != "*.corp=10.0.0.53|tls://10.0.0.54?servername=dns.corp" {
+		t.Fatalf("unexpected split servers: %v", cfg.DNSSplitServers)
+	}
+	if len(cfg.DNSBlocklists) != 2 {
+		t.Fatalf("unexpected block lists: %v", cfg.DNSBlocklists)
+	}
+	if cfg.DNSListsReloadInterval != 30*time.Second {
+		t.Fatalf("expected default reload interval 30s, got %v", cfg.DNSListsReloadInterval)
+	}
+}
+
+func TestConfig_ParseDNSServerFromEnv(t *testing.T) {
+	t.Setenv("DNS_LISTEN_ADDR", ":5353")
+	t.Setenv("DNS_CLIENT_USERS", "10.0.0.9=printer,fd00::9=laptop")
+	t.Setenv("DNS_ALLOWED_CLIENTS", "10.0.0.0/8,fd00::9")
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if cfg.DNSListenAddr != ":5353" {
+		t.Fatalf("unexpected DNS listen address: %q", cfg.DNSListenAddr)
+	}
+	if cfg.DNSClientUsers["10.0.0.9"] != "printer" || cfg.DNSClientUsers["fd00::9"] != "laptop" {
+		t.Fatalf("unexpected DNS client users: %v", cfg.DNSClientUsers)
+	}
+	if cfg.DNSAnswerTTL != time.Minute {
+		t.Fatalf("expected default answer TTL 1m, got %v", cfg.DNSAnswerTTL)
+	}
+	if len(cfg.DNSAllowedClients) != 2 || cfg.DNSAllowedClients[1] != "fd00::9" {
+		t.Fatalf("unexpected DNS allowed clients: %v", cfg.DNSAllowedClients)
+	}
+	if cfg.DNSMaxConcurrent != 256 {
+		t.Fatalf("expected default max concurrent 256, got %d", cfg.DNSMaxConcurrent)
+	}
+}
+
+func TestConfig_ProxyAuthDefaults(t *testing.T) {
+	t.Parallel()
+
+	cfg := &Config{}
+	if err := env.Parse(cfg); err != nil {
+		t.Fatalf("parse config: %v", err)
+	}
+
+	if len(cfg.ProxyAuthSchemes) != 1 || cfg.ProxyAuthSchemes[0] != "basic" {
+		t.Fatalf("expected default auth schemes [basic], got %v", cfg.ProxyAuthSchemes)
+	}
+	if cfg.ProxyAuthRealm != "Restricted area" {
+		t.Fatalf("expected default realm %q, got %q", "Restricted area", cfg.ProxyAuthRealm)
+	}
+}
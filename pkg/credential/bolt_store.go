@@ -1,6 +1,7 @@
 package credential
 
 import (
+	"encoding/json"
 	"errors"
 	"os"
 	"path/filepath"
@@ -8,7 +9,18 @@ import (
 	"go.etcd.io/bbolt"
 )
 
-var usersBucket = []byte("users")
+var (
+	usersBucket         = []byte("users")
+	digestSecretsBucket = []byte("digest_secrets")
+	credentialsBucket   = []byte("credentials")
+	ephemeralBucket     = []byte("ephemeral_credentials")
+	// apiTokensBucket held the single API token of each user before named
+	// credentials replaced it.
+	apiTokensBucket = []byte("api_tokens")
+)
+
+// legacyTokenName names the credentials imported from apiTokensBucket.
+const legacyTokenName = "api-token"
 
 type BoltStore struct {
 	path string
@@ -98,3 +110,154 @@ func (b *BoltStore) Save(snapshot map[string]string) error {
 		return nil
 	})
 }
+
+func (b *BoltStore) LoadSecrets() (Secrets, error) {
+	secrets := Secrets{Digest: map[string]DigestSecret{}}
+	if b == nil || b.path == "" {
+		return secrets, nil
+	}
+
+	if _, err := os.Stat(b.path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return secrets, nil
+		}
+		return Secrets{}, err
+	}
+
+	db, err := bbolt.Open(b.path, 0o600, nil)
+	if err != nil {
+		return Secrets{}, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket(digestSecretsBucket); bucket != nil {
+			err := bucket.ForEach(func(k, v []byte) error {
+				var secret DigestSecret
+				if err := json.Unmarshal(v, &secret); err != nil {
+					return err
+				}
+				secrets.Digest[string(k)] = secret
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if bucket := tx.Bucket(credentialsBucket); bucket != nil {
+			err := bucket.ForEach(func(_, v []byte) error {
+				var named NamedCredential
+				if err := json.Unmarshal(v, &named); err != nil {
+					return err
+				}
+				secrets.Credentials = append(secrets.Credentials, named)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if bucket := tx.Bucket(ephemeralBucket); bucket != nil {
+			err := bucket.ForEach(func(_, v []byte) error {
+				var ephemeral Ephemeral
+				if err := json.Unmarshal(v, &ephemeral); err != nil {
+					return err
+				}
+				secrets.Ephemeral = append(secrets.Ephemeral, ephemeral)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if bucket := tx.Bucket(apiTokensBucket); bucket != nil {
+			return bucket.ForEach(func(k, v []byte) error {
+				secrets.Credentials = append(secrets.Credentials, NamedCredential{
+					User:       string(k),
+					Name:       legacyTokenName,
+					SecretHash: string(v),
+				})
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return Secrets{}, err
+	}
+
+	return secrets, nil
+}
+
+func (b *BoltStore) SaveSecrets(secrets Secrets) error {
+	if b == nil || b.path == "" {
+		return nil
+	}
+
+	dir := filepath.Dir(b.path)
+	if dir != "." {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			return err
+		}
+	}
+
+	db, err := bbolt.Open(b.path, 0o600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bbolt.Tx) error {
+		_ = tx.DeleteBucket(digestSecretsBucket)
+		_ = tx.DeleteBucket(credentialsBucket)
+		_ = tx.DeleteBucket(ephemeralBucket)
+		_ = tx.DeleteBucket(apiTokensBucket)
+
+		digestBucket, err := tx.CreateBucket(digestSecretsBucket)
+		if err != nil {
+			return err
+		}
+		for username, secret := range secrets.Digest {
+			encoded, err := json.Marshal(secret)
+			if err != nil {
+				return err
+			}
+			if err := digestBucket.Put([]byte(username), encoded); err != nil {
+				return err
+			}
+		}
+
+		credentialBucket, err := tx.CreateBucket(credentialsBucket)
+		if err != nil {
+			return err
+		}
+		for _, named := range secrets.Credentials {
+			encoded, err := json.Marshal(named)
+			if err != nil {
+				return err
+			}
+			if err := credentialBucket.Put([]byte(named.SecretHash), encoded); err != nil {
+				return err
+			}
+		}
+
+		ephemeralCredentials, err := tx.CreateBucket(ephemeralBucket)
+		if err != nil {
+			return err
+		}
+		for _, ephemeral := range secrets.Ephemeral {
+			encoded, err := json.Marshal(ephemeral)
+			if err != nil {
+				return err
+			}
+			if err := ephemeralCredentials.Put([]byte(ephemeral.ID), encoded); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
@@ -3,6 +3,7 @@ package credential
 import (
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -46,16 +47,57 @@ func (s *CombinedStore) Valid(user, password string) bool {
 }
 
 type StaticCredentialStore struct {
-	store map[string]string
-	mu    sync.RWMutex
+	store  map[string]string
+	digest map[string]DigestSecret
+	// named maps the SHA-256 of each named credential's secret to it.
+	named map[string]*NamedCredential
+	// ephemeral maps the SHA-256 of each ephemeral credential's secret to it.
+	ephemeral map[string]*ephemeralEntry
+	// usageChanged is set when traffic, rather than an admin, changed what
+	// Save would write.
+	usageChanged atomic.Bool
+	realm        string
+	// digestEnabled is set when HTTP Digest authentication is accepted.
+	digestEnabled bool
+	mu            sync.RWMutex
+	// saveMu orders Save calls, so an older snapshot never overwrites a
+	// newer one.
+	saveMu sync.Mutex
 }
 
 func NewStaticCredentialStore() *StaticCredentialStore {
 	return &StaticCredentialStore{
-		store: make(map[string]string),
+		store:     make(map[string]string),
+		digest:    make(map[string]DigestSecret),
+		named:     make(map[string]*NamedCredential),
+		ephemeral: make(map[string]*ephemeralEntry),
 	}
 }
 
+// SetRealm sets the realm digest secrets are derived for. It defaults to
+// DefaultRealm.
+func (s *StaticCredentialStore) SetRealm(realm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.realm = realm
+}
+
+// SetDigestEnabled sets whether plaintext passwords also yield digest
+// secrets. Digest secrets are password equivalents, so while it is off the
+// store keeps bcrypt hashes only and drops the digest secrets it holds or
+// loads.
+func (s *StaticCredentialStore) SetDigestEnabled(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.digestEnabled = enabled
+	if !enabled {
+		s.digest = make(map[string]DigestSecret)
+	}
+}
+
+// Add sets the password of user. When digest secrets are enabled, a
+// plaintext password also yields the user's digest secret; a bcrypt hash
+// removes it, since it no longer matches the password.
 func (s *StaticCredentialStore) Add(user, password string) {
 	hash, err := normalizePassword(password)
 	if err != nil {
@@ -63,6 +105,26 @@ func (s *StaticCredentialStore) Add(user, password string) {
 	}
 
 	s.SetHashed(user, hash)
+	if hash != password && s.digestOn() {
+		s.SetDigestSecret(user, NewDigestSecret(user, s.digestRealm(), password))
+	} else {
+		s.SetDigestSecret(user, DigestSecret{})
+	}
+}
+
+func (s *StaticCredentialStore) digestOn() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.digestEnabled
+}
+
+func (s *StaticCredentialStore) digestRealm() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.realm == "" {
+		return DefaultRealm
+	}
+	return s.realm
 }
 
 func (s *StaticCredentialStore) SetHashed(user, passwordHash string) {
@@ -71,7 +133,13 @@ func (s *StaticCredentialStore) SetHashed(user, passwordHash string) {
 	s.store[user] = passwordHash
 }
 
+// Valid reports whether password is the password of user or the secret of
+// one of the user's named credentials.
 func (s *StaticCredentialStore) Valid(user, password string) bool {
+	if _, ok := s.useCredential(user, password); ok {
+		return true
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -85,15 +153,88 @@ func (s *StaticCredentialStore) Valid(user, password string) bool {
 }
 
 func (s *StaticCredentialStore) Delete(user string) bool {
+	_, ok := s.Remove(user)
+	return ok
+}
+
+// UserSecrets is everything the store keeps for one user.
+type UserSecrets struct {
+	User         string
+	PasswordHash string
+	Digest       DigestSecret
+	Credentials  []NamedCredential
+	Ephemeral    []Ephemeral
+}
+
+// Password returns the password hash and digest secret of user, so that a
+// password change that could not be saved can be undone with
+// RestorePassword.
+func (s *StaticCredentialStore) Password(user string) (UserSecrets, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hash, ok := s.store[user]
+	if !ok {
+		return UserSecrets{}, false
+	}
+	return UserSecrets{User: user, PasswordHash: hash, Digest: s.digest[user]}, true
+}
+
+// RestorePassword sets the password hash and digest secret of a user back
+// to what Password returned, leaving the user's credentials alone.
+func (s *StaticCredentialStore) RestorePassword(secrets UserSecrets) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.restorePasswordLocked(secrets)
+}
 
-	if _, ok := s.store[user]; !ok {
-		return false
+func (s *StaticCredentialStore) restorePasswordLocked(secrets UserSecrets) {
+	s.store[secrets.User] = secrets.PasswordHash
+	if secrets.Digest == (DigestSecret{}) || !s.digestEnabled {
+		delete(s.digest, secrets.User)
+		return
+	}
+	if s.digest == nil {
+		s.digest = make(map[string]DigestSecret)
+	}
+	s.digest[secrets.User] = secrets.Digest
+}
+
+// Remove deletes user with its credentials and returns what it removed, so
+// that a deletion that could not be saved can be undone with Restore.
+func (s *StaticCredentialStore) Remove(user string) (UserSecrets, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash, ok := s.store[user]
+	if !ok {
+		return UserSecrets{}, false
 	}
 
+	removed := UserSecrets{User: user, PasswordHash: hash, Digest: s.digest[user]}
 	delete(s.store, user)
-	return true
+	delete(s.digest, user)
+	removed.Credentials = s.deleteCredentialsLocked(user)
+	removed.Ephemeral = s.deleteEphemeralLocked(user)
+	return removed, true
+}
+
+// Restore puts back a user returned by Remove. It does nothing if the user
+// has been added again in the meantime.
+func (s *StaticCredentialStore) Restore(secrets UserSecrets) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[secrets.User]; ok {
+		return
+	}
+	s.restorePasswordLocked(secrets)
+	for _, named := range secrets.Credentials {
+		s.restoreCredentialLocked(named)
+	}
+	for _, ephemeral := range secrets.Ephemeral {
+		s.restoreEphemeralLocked(ephemeral)
+	}
 }
 
 func (s *StaticCredentialStore) ListUsers() []string {
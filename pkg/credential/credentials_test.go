@@ -2,8 +2,10 @@ package credential
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_CredentialStore_Valid(t *testing.T) {
@@ -44,6 +46,66 @@ func Test_CredentialStore_Delete(t *testing.T) {
 	assert.False(t, s.Delete("foo"))
 }
 
+func Test_CredentialStore_RemoveRestore(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.SetDigestEnabled(true)
+	s.Add("foo", "bar")
+	s.Add("baz", "qux")
+	token, err := s.IssueCredential("foo", "ci", time.Time{})
+	require.NoError(t, err)
+	_, ephemeralSecret, err := s.IssueEphemeral(Ephemeral{User: "foo", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	other, err := s.IssueCredential("baz", "ci", time.Time{})
+	require.NoError(t, err)
+
+	removed, ok := s.Remove("foo")
+	require.True(t, ok)
+	assert.Len(t, removed.Credentials, 1)
+	assert.Len(t, removed.Ephemeral, 1)
+	// Changes to other users while the removal is undone are kept.
+	assert.True(t, s.RevokeCredential("baz", "ci"))
+
+	s.Restore(removed)
+	assert.True(t, s.Valid("foo", "bar"))
+	assert.True(t, s.Valid("foo", token))
+	_, ok = s.Grant("foo", ephemeralSecret)
+	assert.True(t, ok)
+	_, ok = s.DigestSecret("foo")
+	assert.True(t, ok)
+	assert.False(t, s.Valid("baz", other))
+
+	// A user added again in the meantime is left alone.
+	removed, ok = s.Remove("foo")
+	require.True(t, ok)
+	s.Add("foo", "new")
+	s.Restore(removed)
+	assert.True(t, s.Valid("foo", "new"))
+	assert.False(t, s.Valid("foo", token))
+}
+
+func Test_CredentialStore_RestorePassword(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.SetDigestEnabled(true)
+	s.Add("foo", "bar")
+	token, err := s.IssueCredential("foo", "ci", time.Time{})
+	require.NoError(t, err)
+	previous, ok := s.Password("foo")
+	require.True(t, ok)
+	digest, _ := s.DigestSecret("foo")
+
+	s.Add("foo", "baz")
+	s.RevokeCredential("foo", "ci")
+	s.RestorePassword(previous)
+	assert.True(t, s.Valid("foo", "bar"))
+	assert.False(t, s.Valid("foo", "baz"))
+	restored, _ := s.DigestSecret("foo")
+	assert.Equal(t, digest, restored)
+	assert.False(t, s.Valid("foo", token))
+
+	_, ok = s.Password("nobody")
+	assert.False(t, ok)
+}
+
 func Test_CredentialStore_ListUsers(t *testing.T) {
 	s := NewStaticCredentialStore()
 	s.Add("charlie", "secret")
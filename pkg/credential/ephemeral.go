@@ -0,0 +1,368 @@
+package credential
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrGrantExpired    = errors.New("ephemeral credential expired")
+	ErrBudgetExhausted = errors.New("ephemeral credential byte budget exhausted")
+	ErrGrantRevoked    = errors.New("ephemeral credential revoked")
+)
+
+// EphemeralPrefix starts the ID of every ephemeral credential.
+const EphemeralPrefix = "eph_"
+
+// Ephemeral is a short-lived credential minted for one workload. It
+// authenticates its user like a named credential, but only until ExpiresAt,
+// only for Destinations and only for ByteBudget bytes, when they are set.
+type Ephemeral struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	SecretHash string    `json:"secret_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	// Destinations are the hosts the credential may reach; each also covers
+	// its subdomains. Empty allows every host.
+	Destinations []string `json:"destinations,omitempty"`
+	// ByteBudget caps the bytes relayed in both directions. Zero is
+	// unlimited.
+	ByteBudget int64 `json:"byte_budget,omitempty"`
+	BytesUsed  int64 `json:"bytes_used,omitempty"`
+	// SingleUse credentials are removed when they first authenticate.
+	SingleUse bool `json:"single_use,omitempty"`
+}
+
+// Expired reports whether the credential can no longer be used at now.
+func (e Ephemeral) Expired(now time.Time) bool {
+	return !now.Before(e.ExpiresAt)
+}
+
+// GrantStore is implemented by stores that issue ephemeral credentials.
+type GrantStore interface {
+	// Grant authenticates user with the secret of an ephemeral credential,
+	// or whichever user it belongs to when user is empty.
+	Grant(user, secret string) (*Grant, bool)
+}
+
+type ephemeralEntry struct {
+	Ephemeral
+	bytesUsed atomic.Int64
+	revoked   atomic.Bool
+}
+
+func (e *ephemeralEntry) snapshot() Ephemeral {
+	ephemeral := e.Ephemeral
+	ephemeral.Destinations = append([]string(nil), e.Destinations...)
+	ephemeral.BytesUsed = e.bytesUsed.Load()
+	return ephemeral
+}
+
+// Grant is what an ephemeral credential allows the connection it
+// authenticated. A nil Grant allows everything.
+type Grant struct {
+	entry *ephemeralEntry
+	store *StaticCredentialStore
+}
+
+// ID returns the ID of the credential, or "" for a nil Grant.
+func (g *Grant) ID() string {
+	if g == nil {
+		return ""
+	}
+	return g.entry.ID
+}
+
+// User returns the user the credential belongs to.
+func (g *Grant) User() string {
+	if g == nil {
+		return ""
+	}
+	return g.entry.User
+}
+
+// Allows reports whether the credential may reach host.
+func (g *Grant) Allows(host string) bool {
+	if g == nil || len(g.entry.Destinations) == 0 {
+		return true
+	}
+	host = normalizeHost(host)
+	for _, destination := range g.entry.Destinations {
+		if host == destination || strings.HasSuffix(host, "."+destination) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check fails once the credential has expired or spent its budget.
+func (g *Grant) Check() error {
+	_, err := g.remaining()
+	return err
+}
+
+// remaining returns how many more bytes may be relayed, or -1 without a
+// budget.
+func (g *Grant) remaining() (int64, error) {
+	if g == nil {
+		return -1, nil
+	}
+	if g.entry.revoked.Load() {
+		return 0, ErrGrantRevoked
+	}
+	if g.entry.Expired(time.Now()) {
+		return 0, ErrGrantExpired
+	}
+	if g.entry.ByteBudget == 0 {
+		return -1, nil
+	}
+	left := g.entry.ByteBudget - g.entry.bytesUsed.Load()
+	if left <= 0 {
+		return 0, ErrBudgetExhausted
+	}
+	return left, nil
+}
+
+// Reader charges what is read from r against the credential. Reads fail
+// once it expires or its budget is spent, which ends the relay.
+func (g *Grant) Reader(r io.Reader) io.Reader {
+	if g == nil {
+		return r
+	}
+	return &grantReader{grant: g, reader: r}
+}
+
+type grantReader struct {
+	grant  *Grant
+	reader io.Reader
+}
+
+func (r *grantReader) Read(p []byte) (int, error) {
+	left, err := r.grant.remaining()
+	if err != nil {
+		return 0, err
+	}
+	if left >= 0 && int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.grant.entry.bytesUsed.Add(int64(n))
+		r.grant.store.usageChanged.Store(true)
+	}
+	return n, err
+}
+
+// IssueEphemeral mints an ephemeral credential from spec, which names the
+// user, expiry and restrictions. It returns the stored credential and its
+// secret, which is not kept.
+func (s *StaticCredentialStore) IssueEphemeral(spec Ephemeral) (Ephemeral, string, error) {
+	now := time.Now().UTC()
+	if !spec.ExpiresAt.After(now) {
+		return Ephemeral{}, "", fmt.Errorf("%w: expiry is in the past", ErrCredentialInvalid)
+	}
+	if spec.ByteBudget < 0 {
+		return Ephemeral{}, "", fmt.Errorf("%w: negative byte budget", ErrCredentialInvalid)
+	}
+	destinations := make([]string, 0, len(spec.Destinations))
+	for _, destination := range spec.Destinations {
+		if destination = normalizeHost(destination); destination != "" {
+			destinations = append(destinations, destination)
+		}
+	}
+	if len(destinations) != len(spec.Destinations) {
+		return Ephemeral{}, "", fmt.Errorf("%w: empty destination", ErrCredentialInvalid)
+	}
+
+	secret, err := generateToken()
+	if err != nil {
+		return Ephemeral{}, "", err
+	}
+	id, err := generateEphemeralID()
+	if err != nil {
+		return Ephemeral{}, "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[spec.User]; !ok {
+		return Ephemeral{}, "", fmt.Errorf("%w %q", ErrUnknownUser, spec.User)
+	}
+	entry := &ephemeralEntry{Ephemeral: Ephemeral{
+		ID:           id,
+		User:         spec.User,
+		SecretHash:   hashToken(secret),
+		CreatedAt:    now,
+		ExpiresAt:    spec.ExpiresAt.UTC(),
+		Destinations: destinations,
+		ByteBudget:   spec.ByteBudget,
+		SingleUse:    spec.SingleUse,
+	}}
+	if s.ephemeral == nil {
+		s.ephemeral = make(map[string]*ephemeralEntry)
+	}
+	s.ephemeral[entry.SecretHash] = entry
+	return entry.snapshot(), secret, nil
+}
+
+// Grant authenticates with an ephemeral credential, consuming it if it is
+// single-use.
+func (s *StaticCredentialStore) Grant(user, secret string) (*Grant, bool) {
+	if !strings.HasPrefix(secret, TokenPrefix) {
+		return nil, false
+	}
+	secretHash := hashToken(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.ephemeral[secretHash]
+	if !ok || (user != "" && entry.User != user) {
+		return nil, false
+	}
+	if _, exists := s.store[entry.User]; !exists {
+		return nil, false
+	}
+	grant := &Grant{entry: entry, store: s}
+	if grant.Check() != nil {
+		return nil, false
+	}
+	if entry.SingleUse {
+		delete(s.ephemeral, secretHash)
+		s.usageChanged.Store(true)
+	}
+	return grant, true
+}
+
+// RevokeEphemeral removes the ephemeral credential with id and reports
+// whether there was one. Connections it already authenticated stop at their
+// next read.
+func (s *StaticCredentialStore) RevokeEphemeral(id string) bool {
+	_, ok := s.RemoveEphemeral(id)
+	return ok
+}
+
+// RemoveEphemeral revokes the ephemeral credential with id and returns it,
+// so that a revocation that could not be saved can be undone with
+// RestoreEphemeral.
+func (s *StaticCredentialStore) RemoveEphemeral(id string) (Ephemeral, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for secretHash, entry := range s.ephemeral {
+		if entry.ID == id {
+			delete(s.ephemeral, secretHash)
+			entry.revoked.Store(true)
+			return entry.snapshot(), true
+		}
+	}
+	return Ephemeral{}, false
+}
+
+// RestoreEphemeral puts back a credential returned by RemoveEphemeral. It
+// does nothing once its user is gone. Connections the credential
+// authenticated before its removal stay closed.
+func (s *StaticCredentialStore) RestoreEphemeral(ephemeral Ephemeral) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restoreEphemeralLocked(ephemeral)
+}
+
+func (s *StaticCredentialStore) restoreEphemeralLocked(ephemeral Ephemeral) {
+	if _, ok := s.store[ephemeral.User]; !ok {
+		return
+	}
+	if _, ok := s.ephemeral[ephemeral.SecretHash]; ok {
+		return
+	}
+	entry := &ephemeralEntry{Ephemeral: ephemeral}
+	entry.Destinations = append([]string(nil), ephemeral.Destinations...)
+	entry.bytesUsed.Store(ephemeral.BytesUsed)
+	if s.ephemeral == nil {
+		s.ephemeral = make(map[string]*ephemeralEntry)
+	}
+	s.ephemeral[ephemeral.SecretHash] = entry
+}
+
+// EphemeralCredentials returns the ephemeral credentials, ordered by user
+// and creation time.
+func (s *StaticCredentialStore) EphemeralCredentials() []Ephemeral {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ephemeral := make([]Ephemeral, 0, len(s.ephemeral))
+	for _, entry := range s.ephemeral {
+		ephemeral = append(ephemeral, entry.snapshot())
+	}
+	sortEphemeral(ephemeral)
+	return ephemeral
+}
+
+// PurgeExpired removes the ephemeral credentials that expired by now and
+// returns their IDs.
+func (s *StaticCredentialStore) PurgeExpired(now time.Time) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged []string
+	for secretHash, entry := range s.ephemeral {
+		if entry.Expired(now) {
+			delete(s.ephemeral, secretHash)
+			purged = append(purged, entry.ID)
+		}
+	}
+	if len(purged) > 0 {
+		s.usageChanged.Store(true)
+	}
+	sort.Strings(purged)
+	return purged
+}
+
+// deleteEphemeralLocked removes the ephemeral credentials of a deleted
+// user, revoking them so connections already granted through them end. It
+// returns what it removed.
+func (s *StaticCredentialStore) deleteEphemeralLocked(user string) []Ephemeral {
+	var removed []Ephemeral
+	for secretHash, entry := range s.ephemeral {
+		if entry.User == user {
+			entry.revoked.Store(true)
+			delete(s.ephemeral, secretHash)
+			removed = append(removed, entry.snapshot())
+		}
+	}
+	sortEphemeral(removed)
+	return removed
+}
+
+func generateEphemeralID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate credential id: %w", err)
+	}
+	return EphemeralPrefix + hex.EncodeToString(buf), nil
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	host = strings.TrimPrefix(host, "*.")
+	host = strings.TrimPrefix(host, ".")
+	return strings.TrimSuffix(host, ".")
+}
+
+func sortEphemeral(ephemeral []Ephemeral) {
+	sort.Slice(ephemeral, func(i, j int) bool {
+		if ephemeral[i].User != ephemeral[j].User {
+			return ephemeral[i].User < ephemeral[j].User
+		}
+		return ephemeral[i].CreatedAt.Before(ephemeral[j].CreatedAt)
+	})
+}
@@ -0,0 +1,177 @@
+package credential
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStaticCredentialStore_IssueEphemeral(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+
+	_, _, err := s.IssueEphemeral(Ephemeral{User: "nobody", ExpiresAt: time.Now().Add(time.Hour)})
+	assert.ErrorIs(t, err, ErrUnknownUser)
+	_, _, err = s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(-time.Minute)})
+	assert.ErrorIs(t, err, ErrCredentialInvalid)
+	_, _, err = s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour), ByteBudget: -1})
+	assert.ErrorIs(t, err, ErrCredentialInvalid)
+	_, _, err = s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour), Destinations: []string{" "}})
+	assert.ErrorIs(t, err, ErrCredentialInvalid)
+
+	ephemeral, secret, err := s.IssueEphemeral(Ephemeral{
+		User:         "alice",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Destinations: []string{"*.Example.com."},
+	})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(ephemeral.ID, EphemeralPrefix))
+	assert.True(t, strings.HasPrefix(secret, TokenPrefix))
+	assert.Equal(t, []string{"example.com"}, ephemeral.Destinations)
+	assert.NotContains(t, ephemeral.SecretHash, secret)
+
+	// Ephemeral secrets only authenticate through Grant, so proxies that do
+	// not enforce grants reject them.
+	assert.False(t, s.Valid("alice", secret))
+	_, ok := s.UserForToken(secret)
+	assert.False(t, ok)
+
+	_, ok = s.Grant("bob", secret)
+	assert.False(t, ok)
+	grant, ok := s.Grant("alice", secret)
+	require.True(t, ok)
+	assert.Equal(t, ephemeral.ID, grant.ID())
+	assert.Equal(t, "alice", grant.User())
+	grant, ok = s.Grant("", secret)
+	require.True(t, ok)
+	assert.True(t, grant.Allows("example.com"))
+	assert.True(t, grant.Allows("api.example.com"))
+	assert.False(t, grant.Allows("badexample.com"))
+	assert.False(t, grant.Allows("example.org"))
+
+	assert.Len(t, s.EphemeralCredentials(), 1)
+	s.Delete("alice")
+	assert.Empty(t, s.EphemeralCredentials())
+	_, ok = s.Grant("", secret)
+	assert.False(t, ok)
+}
+
+func TestGrant_ByteBudget(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	_, secret, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour), ByteBudget: 10})
+	require.NoError(t, err)
+	grant, ok := s.Grant("alice", secret)
+	require.True(t, ok)
+
+	n, err := io.Copy(io.Discard, grant.Reader(strings.NewReader("0123456")))
+	require.NoError(t, err)
+	assert.EqualValues(t, 7, n)
+
+	// The budget is shared by every reader of the credential and cuts the
+	// relay off once spent.
+	n, err = io.Copy(io.Discard, grant.Reader(strings.NewReader("0123456")))
+	assert.ErrorIs(t, err, ErrBudgetExhausted)
+	assert.EqualValues(t, 3, n)
+	assert.ErrorIs(t, grant.Check(), ErrBudgetExhausted)
+	_, ok = s.Grant("alice", secret)
+	assert.False(t, ok)
+	assert.EqualValues(t, 10, s.EphemeralCredentials()[0].BytesUsed)
+
+	var unrestricted *Grant
+	assert.NoError(t, unrestricted.Check())
+	assert.True(t, unrestricted.Allows("example.com"))
+}
+
+func TestGrant_SingleUseAndRevoke(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	_, single, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour), SingleUse: true})
+	require.NoError(t, err)
+
+	_, ok := s.Grant("alice", single)
+	assert.True(t, ok)
+	_, ok = s.Grant("alice", single)
+	assert.False(t, ok)
+
+	ephemeral, secret, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	grant, ok := s.Grant("alice", secret)
+	require.True(t, ok)
+	assert.True(t, s.RevokeEphemeral(ephemeral.ID))
+	assert.False(t, s.RevokeEphemeral(ephemeral.ID))
+	assert.ErrorIs(t, grant.Check(), ErrGrantRevoked)
+	_, err = grant.Reader(strings.NewReader("data")).Read(make([]byte, 4))
+	assert.ErrorIs(t, err, ErrGrantRevoked)
+}
+
+func TestStaticCredentialStore_RestoreEphemeral(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	ephemeral, secret, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	grant, ok := s.Grant("alice", secret)
+	require.True(t, ok)
+
+	revoked, ok := s.RemoveEphemeral(ephemeral.ID)
+	require.True(t, ok)
+	assert.Equal(t, ephemeral.ID, revoked.ID)
+
+	s.RestoreEphemeral(revoked)
+	_, ok = s.Grant("alice", secret)
+	assert.True(t, ok)
+	// Connections cut by the revocation stay closed.
+	assert.ErrorIs(t, grant.Check(), ErrGrantRevoked)
+
+	// Nothing is restored for a deleted user.
+	revoked, ok = s.RemoveEphemeral(ephemeral.ID)
+	require.True(t, ok)
+	s.Delete("alice")
+	s.RestoreEphemeral(revoked)
+	assert.Empty(t, s.EphemeralCredentials())
+}
+
+func TestGrant_RevokedWhenUserDeleted(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	_, secret, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	grant, ok := s.Grant("alice", secret)
+	require.True(t, ok)
+
+	assert.True(t, s.Delete("alice"))
+	assert.ErrorIs(t, grant.Check(), ErrGrantRevoked)
+	assert.Empty(t, s.EphemeralCredentials())
+}
+
+func TestStaticCredentialStore_PurgeExpired(t *testing.T) {
+	boltStore := NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	short, secret, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	long, _, err := s.IssueEphemeral(Ephemeral{User: "alice", ExpiresAt: time.Now().Add(time.Hour), Destinations: []string{"example.com"}})
+	require.NoError(t, err)
+	require.NoError(t, Save(boltStore, s))
+
+	secrets, err := boltStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.Len(t, secrets.Ephemeral, 2)
+
+	assert.Empty(t, s.PurgeExpired(time.Now()))
+	assert.Equal(t, []string{short.ID}, s.PurgeExpired(time.Now().Add(2*time.Minute)))
+	_, ok := s.Grant("alice", secret)
+	assert.False(t, ok)
+	require.NoError(t, SaveUsage(boltStore, s))
+
+	secrets, err = boltStore.LoadSecrets()
+	require.NoError(t, err)
+	require.Len(t, secrets.Ephemeral, 1)
+	assert.Equal(t, long.ID, secrets.Ephemeral[0].ID)
+	assert.Equal(t, []string{"example.com"}, secrets.Ephemeral[0].Destinations)
+}
@@ -0,0 +1,201 @@
+package credential
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownUser       = errors.New("unknown user")
+	ErrCredentialExists  = errors.New("credential name is already in use")
+	ErrCredentialInvalid = errors.New("invalid credential")
+)
+
+// NamedCredential is an additional secret that authenticates its user, such
+// as the token of one CI job. Each can be revoked on its own and only the
+// SHA-256 of the secret is kept.
+type NamedCredential struct {
+	User       string    `json:"user"`
+	Name       string    `json:"name"`
+	SecretHash string    `json:"secret_hash"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at,omitzero"`
+	// ExpiresAt is zero for credentials that do not expire.
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Expired reports whether the credential can no longer be used at now.
+func (c NamedCredential) Expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+// IssueCredential creates a credential called name for user. The returned
+// secret is not kept, so it cannot be shown again.
+func (s *StaticCredentialStore) IssueCredential(user, name string, expiresAt time.Time) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("%w: name is required", ErrCredentialInvalid)
+	}
+	now := time.Now().UTC()
+	if !expiresAt.IsZero() && !expiresAt.After(now) {
+		return "", fmt.Errorf("%w: expiry is in the past", ErrCredentialInvalid)
+	}
+	secret, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store[user]; !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownUser, user)
+	}
+	for _, named := range s.named {
+		if named.User == user && named.Name == name {
+			return "", fmt.Errorf("%w: %q", ErrCredentialExists, name)
+		}
+	}
+	if s.named == nil {
+		s.named = make(map[string]*NamedCredential)
+	}
+	secretHash := hashToken(secret)
+	s.named[secretHash] = &NamedCredential{
+		User:       user,
+		Name:       name,
+		SecretHash: secretHash,
+		CreatedAt:  now,
+		ExpiresAt:  expiresAt.UTC(),
+	}
+	return secret, nil
+}
+
+// RevokeCredential removes the credential called name of user and reports
+// whether there was one.
+func (s *StaticCredentialStore) RevokeCredential(user, name string) bool {
+	_, ok := s.RemoveCredential(user, name)
+	return ok
+}
+
+// RemoveCredential revokes the credential called name of user and returns
+// it, so that a revocation that could not be saved can be undone with
+// RestoreCredential.
+func (s *StaticCredentialStore) RemoveCredential(user, name string) (NamedCredential, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for secretHash, named := range s.named {
+		if named.User == user && named.Name == name {
+			delete(s.named, secretHash)
+			return *named, true
+		}
+	}
+	return NamedCredential{}, false
+}
+
+// RestoreCredential puts back a credential returned by RemoveCredential. It
+// does nothing once its user is gone or the name has been reused.
+func (s *StaticCredentialStore) RestoreCredential(named NamedCredential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.restoreCredentialLocked(named)
+}
+
+func (s *StaticCredentialStore) restoreCredentialLocked(named NamedCredential) {
+	if _, ok := s.store[named.User]; !ok {
+		return
+	}
+	for _, existing := range s.named {
+		if existing.User == named.User && existing.Name == named.Name {
+			return
+		}
+	}
+	if s.named == nil {
+		s.named = make(map[string]*NamedCredential)
+	}
+	s.named[named.SecretHash] = &named
+}
+
+// Credentials returns the named credentials of user, ordered by name.
+func (s *StaticCredentialStore) Credentials(user string) []NamedCredential {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var credentials []NamedCredential
+	for _, named := range s.named {
+		if named.User == user {
+			credentials = append(credentials, *named)
+		}
+	}
+	sortCredentials(credentials)
+	return credentials
+}
+
+// UserForToken returns the user of an unexpired named credential.
+func (s *StaticCredentialStore) UserForToken(token string) (string, bool) {
+	return s.useCredential("", token)
+}
+
+// lastUsedResolution limits how often use of a credential is recorded.
+const lastUsedResolution = time.Minute
+
+// useCredential looks up the unexpired credential with secret, owned by
+// user unless user is empty, and records that it was used.
+func (s *StaticCredentialStore) useCredential(user, secret string) (string, bool) {
+	if !strings.HasPrefix(secret, TokenPrefix) {
+		return "", false
+	}
+	secretHash := hashToken(secret)
+	now := time.Now().UTC()
+
+	s.mu.RLock()
+	named, ok := s.named[secretHash]
+	recent := false
+	if ok {
+		_, exists := s.store[named.User]
+		ok = exists && (user == "" || named.User == user) && !named.Expired(now)
+		recent = now.Sub(named.LastUsedAt) < lastUsedResolution
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return "", false
+	}
+	if recent {
+		return named.User, true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The credential may have been revoked in between.
+	if named, ok = s.named[secretHash]; !ok {
+		return "", false
+	}
+	named.LastUsedAt = now
+	s.usageChanged.Store(true)
+	return named.User, true
+}
+
+// deleteCredentialsLocked removes the named credentials of a deleted user
+// and returns them.
+func (s *StaticCredentialStore) deleteCredentialsLocked(user string) []NamedCredential {
+	var removed []NamedCredential
+	for secretHash, named := range s.named {
+		if named.User == user {
+			delete(s.named, secretHash)
+			removed = append(removed, *named)
+		}
+	}
+	sortCredentials(removed)
+	return removed
+}
+
+func sortCredentials(credentials []NamedCredential) {
+	sort.Slice(credentials, func(i, j int) bool {
+		if credentials[i].User != credentials[j].User {
+			return credentials[i].User < credentials[j].User
+		}
+		return credentials[i].Name < credentials[j].Name
+	})
+}
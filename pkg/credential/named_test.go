@@ -0,0 +1,142 @@
+package credential
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+)
+
+func TestStaticCredentialStore_NamedCredentials(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+
+	_, err := s.IssueCredential("nobody", "ci", time.Time{})
+	assert.ErrorIs(t, err, ErrUnknownUser)
+	_, err = s.IssueCredential("alice", "", time.Time{})
+	assert.ErrorIs(t, err, ErrCredentialInvalid)
+	_, err = s.IssueCredential("alice", "ci", time.Now().Add(-time.Minute))
+	assert.ErrorIs(t, err, ErrCredentialInvalid)
+
+	deploy, err := s.IssueCredential("alice", "deploy", time.Time{})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(deploy, TokenPrefix))
+	nightly, err := s.IssueCredential("alice", "nightly", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	_, err = s.IssueCredential("alice", "deploy", time.Time{})
+	assert.ErrorIs(t, err, ErrCredentialExists)
+
+	// Every credential and the password authenticate the user, and only
+	// that user.
+	assert.True(t, s.Valid("alice", deploy))
+	assert.True(t, s.Valid("alice", nightly))
+	assert.True(t, s.Valid("alice", "secret"))
+	assert.False(t, s.Valid("bob", deploy))
+	user, ok := s.UserForToken(nightly)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+	_, ok = s.UserForToken(nightly + "x")
+	assert.False(t, ok)
+	_, ok = s.UserForToken("secret")
+	assert.False(t, ok)
+
+	credentials := s.Credentials("alice")
+	require.Len(t, credentials, 2)
+	assert.Equal(t, "deploy", credentials[0].Name)
+	assert.False(t, credentials[0].LastUsedAt.IsZero())
+	assert.True(t, credentials[0].ExpiresAt.IsZero())
+	assert.False(t, credentials[1].ExpiresAt.IsZero())
+	assert.NotContains(t, credentials[0].SecretHash, deploy)
+
+	revoked, ok := s.RemoveCredential("alice", "deploy")
+	require.True(t, ok)
+	assert.False(t, s.RevokeCredential("alice", "deploy"))
+	assert.False(t, s.Valid("alice", deploy))
+	assert.True(t, s.Valid("alice", nightly))
+
+	// Undoing the revocation brings back only that credential.
+	s.RestoreCredential(revoked)
+	assert.True(t, s.Valid("alice", deploy))
+	assert.True(t, s.RevokeCredential("alice", "deploy"))
+
+	s.Delete("alice")
+	_, ok = s.UserForToken(nightly)
+	assert.False(t, ok)
+	assert.Empty(t, s.Credentials("alice"))
+}
+
+func TestStaticCredentialStore_ExpiredCredential(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	secret, err := s.IssueCredential("alice", "ci", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	secrets := s.Secrets()
+	secrets.Credentials[0].ExpiresAt = time.Now().Add(-time.Second)
+	s.ReplaceSecrets(secrets)
+
+	assert.False(t, s.Valid("alice", secret))
+	_, ok := s.UserForToken(secret)
+	assert.False(t, ok)
+	assert.True(t, s.Credentials("alice")[0].Expired(time.Now()))
+}
+
+func TestSaveUsage(t *testing.T) {
+	t.Parallel()
+
+	boltStore := NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	s := NewStaticCredentialStore()
+	s.Add("alice", "secret")
+	secret, err := s.IssueCredential("alice", "ci", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, Save(boltStore, s))
+
+	// Nothing was used since the last save.
+	require.NoError(t, SaveUsage(boltStore, s))
+	loaded, err := boltStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.True(t, loaded.Credentials[0].LastUsedAt.IsZero())
+
+	assert.True(t, s.Valid("alice", secret))
+	require.NoError(t, SaveUsage(boltStore, s))
+	loaded, err = boltStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.False(t, loaded.Credentials[0].LastUsedAt.IsZero())
+	assert.False(t, s.usageChanged.Load())
+}
+
+func TestBoltStore_LoadSecrets_LegacyAPITokens(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "data.db")
+	db, err := bbolt.Open(path, 0o600, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucket(apiTokensBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte("alice"), []byte(hashToken(TokenPrefix+"legacy")))
+	}))
+	require.NoError(t, db.Close())
+
+	boltStore := NewBoltStore(path)
+	require.NoError(t, boltStore.Save(map[string]string{"alice": "hash"}))
+	s := NewStaticCredentialStore()
+	require.NoError(t, LoadInto(boltStore, s))
+	user, ok := s.UserForToken(TokenPrefix + "legacy")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+	assert.Equal(t, legacyTokenName, s.Credentials("alice")[0].Name)
+
+	// Saving moves the token into the credentials bucket.
+	require.NoError(t, Save(boltStore, s))
+	loaded, err := boltStore.LoadSecrets()
+	require.NoError(t, err)
+	require.Len(t, loaded.Credentials, 1)
+	assert.Equal(t, legacyTokenName, loaded.Credentials[0].Name)
+}
@@ -0,0 +1,87 @@
+package credential
+
+import "strings"
+
+const (
+	ParamSession = "session"
+	ParamRoute   = "route"
+
+	DefaultParamSeparator = "-"
+)
+
+// DefaultParamKeys are the parameter names recognised when no explicit list is
+// configured.
+var DefaultParamKeys = []string{ParamSession, ParamRoute}
+
+// UsernameGrammar extracts key/value parameters appended to a proxy username,
+// e.g. "alice-session-abc123-route-tor" yields base user "alice" with
+// session=abc123 and route=tor. The parameter section starts at the first
+// token that is a known key; everything before it is the base username, so
+// base usernames may themselves contain the separator.
+type UsernameGrammar struct {
+	Separator string
+	Keys      []string
+}
+
+// NewUsernameGrammar returns a grammar using the defaults for empty arguments.
+func NewUsernameGrammar(separator string, keys []string) *UsernameGrammar {
+	if separator == "" {
+		separator = DefaultParamSeparator
+	}
+
+	normalized := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key = strings.ToLower(strings.TrimSpace(key)); key != "" {
+			normalized = append(normalized, key)
+		}
+	}
+	if len(normalized) == 0 {
+		normalized = append(normalized, DefaultParamKeys...)
+	}
+
+	return &UsernameGrammar{Separator: separator, Keys: normalized}
+}
+
+// Parse splits raw into the base username and its parameters. When raw does
+// not contain a well-formed parameter section it is returned unchanged with
+// nil parameters. A nil grammar never extracts parameters.
+func (g *UsernameGrammar) Parse(raw string) (string, map[string]string) {
+	if g == nil || g.Separator == "" {
+		return raw, nil
+	}
+
+	tokens := strings.Split(raw, g.Separator)
+	start := -1
+	for i := 1; i < len(tokens); i++ {
+		if g.isKey(tokens[i]) {
+			start = i
+			break
+		}
+	}
+	if start < 0 || (len(tokens)-start)%2 != 0 {
+		return raw, nil
+	}
+
+	params := make(map[string]string, (len(tokens)-start)/2)
+	for i := start; i < len(tokens); i += 2 {
+		key, value := strings.ToLower(tokens[i]), tokens[i+1]
+		if !g.isKey(key) || value == "" {
+			return raw, nil
+		}
+		if _, dup := params[key]; dup {
+			return raw, nil
+		}
+		params[key] = value
+	}
+
+	return strings.Join(tokens[:start], g.Separator), params
+}
+
+func (g *UsernameGrammar) isKey(token string) bool {
+	for _, key := range g.Keys {
+		if strings.EqualFold(token, key) {
+			return true
+		}
+	}
+	return false
+}
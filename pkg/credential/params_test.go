@@ -0,0 +1,57 @@
+package credential
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsernameGrammar_Parse(t *testing.T) {
+	g := NewUsernameGrammar("", nil)
+
+	tests := []struct {
+		raw    string
+		base   string
+		params map[string]string
+	}{
+		{"alice", "alice", nil},
+		{"alice-session-abc123", "alice", map[string]string{"session": "abc123"}},
+		{"alice-session-abc123-route-tor", "alice", map[string]string{"session": "abc123", "route": "tor"}},
+		{"alice-ROUTE-tor", "alice", map[string]string{"route": "tor"}},
+		{"mary-jane-route-tor", "mary-jane", map[string]string{"route": "tor"}},
+		{"mary-jane", "mary-jane", nil},
+		{"alice-session", "alice-session", nil},
+		{"alice-session-abc-unknown", "alice-session-abc-unknown", nil},
+		{"alice-session-a-session-b", "alice-session-a-session-b", nil},
+		{"alice-session--route-tor", "alice-session--route-tor", nil},
+		{"session-abc", "session-abc", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			base, params := g.Parse(tt.raw)
+			assert.Equal(t, tt.base, base)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func TestUsernameGrammar_CustomSeparatorAndKeys(t *testing.T) {
+	g := NewUsernameGrammar("_", []string{" Country ", "session"})
+
+	base, params := g.Parse("alice_country_de_session_x1")
+	assert.Equal(t, "alice", base)
+	assert.Equal(t, map[string]string{"country": "de", "session": "x1"}, params)
+
+	base, params = g.Parse("alice_route_tor")
+	assert.Equal(t, "alice_route_tor", base)
+	assert.Nil(t, params)
+}
+
+func TestUsernameGrammar_Nil(t *testing.T) {
+	var g *UsernameGrammar
+
+	base, params := g.Parse("alice-session-abc")
+	assert.Equal(t, "alice-session-abc", base)
+	assert.Nil(t, params)
+}
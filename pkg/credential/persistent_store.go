@@ -17,5 +17,46 @@ func LoadInto(persistentStore PersistentStore, store *StaticCredentialStore) err
 	}
 
 	store.Replace(snapshot)
+
+	secretStore, ok := persistentStore.(SecretStore)
+	if !ok {
+		return nil
+	}
+	secrets, err := secretStore.LoadSecrets()
+	if err != nil {
+		return err
+	}
+	store.ReplaceSecrets(secrets)
 	return nil
 }
+
+// Save writes the users of store, and their secrets if persistentStore
+// keeps them.
+func Save(persistentStore PersistentStore, store *StaticCredentialStore) error {
+	if store == nil || persistentStore == nil {
+		return nil
+	}
+
+	store.saveMu.Lock()
+	defer store.saveMu.Unlock()
+
+	used := store.usageChanged.Swap(false)
+	err := persistentStore.Save(store.Snapshot())
+	if secretStore, ok := persistentStore.(SecretStore); ok && err == nil {
+		err = secretStore.SaveSecrets(store.Secrets())
+	}
+	if err != nil && used {
+		store.usageChanged.Store(true)
+	}
+	return err
+}
+
+// SaveUsage saves store if traffic changed it since the last save: a named
+// credential was used, or an ephemeral credential spent bytes, was consumed
+// or was purged.
+func SaveUsage(persistentStore PersistentStore, store *StaticCredentialStore) error {
+	if store == nil || persistentStore == nil || !store.usageChanged.Load() {
+		return nil
+	}
+	return Save(persistentStore, store)
+}
@@ -0,0 +1,189 @@
+package credential
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// DefaultRealm is the protection space proxy clients authenticate to. Digest
+// secrets are bound to it, so changing the realm requires new passwords.
+const DefaultRealm = "Restricted area"
+
+// TokenPrefix starts every API token, which makes leaked tokens easy to
+// recognize.
+const TokenPrefix = "np_"
+
+// Digest algorithms of RFC 7616.
+const (
+	DigestMD5    = "MD5"
+	DigestSHA256 = "SHA-256"
+)
+
+// DigestSecret is H(username:realm:password) for each supported algorithm,
+// what an HTTP Digest server needs instead of the password (RFC 7616
+// section 3.4.2).
+type DigestSecret struct {
+	Realm  string `json:"realm"`
+	MD5    string `json:"md5"`
+	SHA256 string `json:"sha256"`
+}
+
+// NewDigestSecret derives the digest secret of a password.
+func NewDigestSecret(user, realm, password string) DigestSecret {
+	return DigestSecret{
+		Realm:  realm,
+		MD5:    DigestHash(DigestMD5, user+":"+realm+":"+password),
+		SHA256: DigestHash(DigestSHA256, user+":"+realm+":"+password),
+	}
+}
+
+// For returns the secret for algorithm, or "" if it is not supported.
+func (d DigestSecret) For(algorithm string) string {
+	switch strings.ToUpper(algorithm) {
+	case DigestMD5:
+		return d.MD5
+	case DigestSHA256:
+		return d.SHA256
+	}
+	return ""
+}
+
+// DigestHash returns the lowercase hex hash of data with algorithm, or ""
+// for an unsupported algorithm.
+func DigestHash(algorithm, data string) string {
+	var h hash.Hash
+	switch strings.ToUpper(algorithm) {
+	case DigestMD5:
+		h = md5.New()
+	case DigestSHA256:
+		h = sha256.New()
+	default:
+		return ""
+	}
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DigestStore is implemented by stores that can authenticate HTTP Digest
+// responses.
+type DigestStore interface {
+	DigestSecret(user string) (DigestSecret, bool)
+}
+
+// TokenStore is implemented by stores that accept bearer tokens.
+type TokenStore interface {
+	UserForToken(token string) (string, bool)
+}
+
+// Secrets are what a store keeps next to the password hashes: the digest
+// secrets, named credentials and ephemeral credentials of each user.
+type Secrets struct {
+	Digest      map[string]DigestSecret
+	Credentials []NamedCredential
+	Ephemeral   []Ephemeral
+}
+
+// SecretStore is implemented by persistent stores that also keep Secrets.
+type SecretStore interface {
+	LoadSecrets() (Secrets, error)
+	SaveSecrets(secrets Secrets) error
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+	return TokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// DigestSecret returns the digest secret of user for the store's realm.
+func (s *StaticCredentialStore) DigestSecret(user string) (DigestSecret, bool) {
+	realm := s.digestRealm()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.store[user]; !ok {
+		return DigestSecret{}, false
+	}
+	secret, ok := s.digest[user]
+	if !ok || secret.Realm != realm {
+		return DigestSecret{}, false
+	}
+	return secret, true
+}
+
+// SetDigestSecret replaces the digest secret of user. The zero secret
+// removes it.
+func (s *StaticCredentialStore) SetDigestSecret(user string, secret DigestSecret) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if secret == (DigestSecret{}) {
+		delete(s.digest, user)
+		return
+	}
+	if s.digest == nil {
+		s.digest = make(map[string]DigestSecret)
+	}
+	s.digest[user] = secret
+}
+
+// Secrets returns a copy of the digest secrets, named credentials and
+// ephemeral credentials.
+func (s *StaticCredentialStore) Secrets() Secrets {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	secrets := Secrets{
+		Digest:      make(map[string]DigestSecret, len(s.digest)),
+		Credentials: make([]NamedCredential, 0, len(s.named)),
+	}
+	for user, secret := range s.digest {
+		secrets.Digest[user] = secret
+	}
+	for _, named := range s.named {
+		secrets.Credentials = append(secrets.Credentials, *named)
+	}
+	sortCredentials(secrets.Credentials)
+	for _, entry := range s.ephemeral {
+		secrets.Ephemeral = append(secrets.Ephemeral, entry.snapshot())
+	}
+	sortEphemeral(secrets.Ephemeral)
+	return secrets
+}
+
+func (s *StaticCredentialStore) ReplaceSecrets(secrets Secrets) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.digest = make(map[string]DigestSecret, len(secrets.Digest))
+	if s.digestEnabled {
+		for user, secret := range secrets.Digest {
+			s.digest[user] = secret
+		}
+	}
+	s.named = make(map[string]*NamedCredential, len(secrets.Credentials))
+	for _, named := range secrets.Credentials {
+		s.named[named.SecretHash] = &named
+	}
+	s.ephemeral = make(map[string]*ephemeralEntry, len(secrets.Ephemeral))
+	for _, ephemeral := range secrets.Ephemeral {
+		entry := &ephemeralEntry{Ephemeral: ephemeral}
+		entry.Destinations = append([]string(nil), ephemeral.Destinations...)
+		entry.bytesUsed.Store(ephemeral.BytesUsed)
+		s.ephemeral[ephemeral.SecretHash] = entry
+	}
+}
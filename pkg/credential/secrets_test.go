@@ -0,0 +1,112 @@
+package credential
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDigestSecret(t *testing.T) {
+	// RFC 7616 section 3.9.1.
+	secret := NewDigestSecret("Mufasa", "http-auth@example.org", "Circle of Life")
+
+	assert.Equal(t, "http-auth@example.org", secret.Realm)
+	assert.Equal(t, "7987c64c30e25f1b74be53f966b49b90f2808aa92faf9a00262392d7b4794232", secret.SHA256)
+	assert.Equal(t, secret.SHA256, secret.For("sha-256"))
+	assert.Equal(t, secret.MD5, secret.For(DigestMD5))
+	assert.Empty(t, secret.For("SHA-512-256"))
+}
+
+func TestStaticCredentialStore_DigestSecret(t *testing.T) {
+	s := NewStaticCredentialStore()
+	s.SetDigestEnabled(true)
+	s.Add("alice", "secret")
+
+	secret, ok := s.DigestSecret("alice")
+	require.True(t, ok)
+	assert.Equal(t, NewDigestSecret("alice", DefaultRealm, "secret"), secret)
+
+	// A bcrypt hash cannot yield a digest secret, and removes the one of
+	// the previous password.
+	s.Add("bob", "bob-old")
+	s.Add("bob", "$2y$05$Xr4Vj6wbsCuf70.Fif2guuX8Ez97GB0VysyCTRL2EMkIikCpY/ugi")
+	_, ok = s.DigestSecret("bob")
+	assert.False(t, ok)
+
+	// Secrets derived for another realm are unusable.
+	s.SetRealm("corp")
+	_, ok = s.DigestSecret("alice")
+	assert.False(t, ok)
+	s.Add("alice", "secret")
+	secret, ok = s.DigestSecret("alice")
+	require.True(t, ok)
+	assert.Equal(t, "corp", secret.Realm)
+
+	assert.True(t, s.Delete("alice"))
+	_, ok = s.DigestSecret("alice")
+	assert.False(t, ok)
+}
+
+func TestSave_PersistsSecrets(t *testing.T) {
+	t.Parallel()
+
+	boltStore := NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	seed := NewStaticCredentialStore()
+	seed.SetDigestEnabled(true)
+	seed.Add("alice", "alice-pass")
+	token, err := seed.IssueCredential("alice", "ci", time.Time{})
+	require.NoError(t, err)
+	require.NoError(t, Save(boltStore, seed))
+
+	secrets, err := boltStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.Equal(t, seed.Secrets(), secrets)
+
+	target := NewStaticCredentialStore()
+	target.SetDigestEnabled(true)
+	require.NoError(t, LoadInto(boltStore, target))
+	assert.True(t, target.Valid("alice", "alice-pass"))
+	user, ok := target.UserForToken(token)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+	secret, ok := target.DigestSecret("alice")
+	assert.True(t, ok)
+	assert.Equal(t, NewDigestSecret("alice", DefaultRealm, "alice-pass"), secret)
+}
+
+func TestSave_DigestDisabled(t *testing.T) {
+	t.Parallel()
+
+	boltStore := NewBoltStore(filepath.Join(t.TempDir(), "data.db"))
+	seed := NewStaticCredentialStore()
+	seed.SetDigestEnabled(true)
+	seed.Add("alice", "alice-pass")
+	require.NoError(t, Save(boltStore, seed))
+
+	// Without Digest, no secrets are derived, loaded or written back.
+	store := NewStaticCredentialStore()
+	require.NoError(t, LoadInto(boltStore, store))
+	_, ok := store.DigestSecret("alice")
+	assert.False(t, ok)
+	store.Add("bob", "bob-pass")
+	_, ok = store.DigestSecret("bob")
+	assert.False(t, ok)
+
+	require.NoError(t, Save(boltStore, store))
+	secrets, err := boltStore.LoadSecrets()
+	require.NoError(t, err)
+	assert.Empty(t, secrets.Digest)
+}
+
+func TestBoltStore_LoadSecrets_FileNotExist(t *testing.T) {
+	t.Parallel()
+
+	store := NewBoltStore(filepath.Join(t.TempDir(), "missing.db"))
+	secrets, err := store.LoadSecrets()
+	require.NoError(t, err)
+	assert.Empty(t, secrets.Digest)
+	assert.Empty(t, secrets.Credentials)
+}
@@ -0,0 +1,379 @@
+// Package dnsserver answers DNS queries from proxy clients with the same
+// resolver chain the proxies use, so names and connections share one policy.
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	DefaultTTL           = time.Minute
+	DefaultIdleTimeout   = 10 * time.Second
+	DefaultMaxConcurrent = 256
+
+	// maxUDPSize is the largest response sent over UDP; larger answers are
+	// truncated so the client retries over TCP.
+	maxUDPSize = 512
+)
+
+type Config struct {
+	Resolver resolver.Resolver
+	Logger   *zerolog.Logger
+	// TTL is the TTL reported in answers.
+	TTL time.Duration
+	// IdleTimeout closes TCP connections that send no query for this long.
+	IdleTimeout time.Duration
+	// UserForClientIP, when set, attributes queries to the proxy user
+	// connecting from the same address.
+	UserForClientIP func(clientIP string) (string, bool)
+	// AllowedClients are the networks whose queries are answered. When
+	// empty, only loopback clients and those UserForClientIP attributes to
+	// a proxy user are, so the server is not an open resolver.
+	AllowedClients []*net.IPNet
+	// MaxConcurrent caps the queries handled at once.
+	MaxConcurrent int
+}
+
+type Server struct {
+	config *Config
+	// slots holds one token per query being handled.
+	slots chan struct{}
+
+	mu       sync.Mutex
+	packet   net.PacketConn
+	listener net.Listener
+}
+
+func New(conf *Config) *Server {
+	if conf.Logger == nil {
+		logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).With().Timestamp().Logger()
+		conf.Logger = &logger
+	}
+
+	if conf.Resolver == nil {
+		conf.Resolver = &resolver.DNSResolver{}
+	}
+
+	if conf.TTL <= 0 {
+		conf.TTL = DefaultTTL
+	}
+
+	if conf.IdleTimeout <= 0 {
+		conf.IdleTimeout = DefaultIdleTimeout
+	}
+
+	if conf.MaxConcurrent <= 0 {
+		conf.MaxConcurrent = DefaultMaxConcurrent
+	}
+
+	return &Server{config: conf, slots: make(chan struct{}, conf.MaxConcurrent)}
+}
+
+// ListenAndServe answers queries on UDP and TCP at addr until one of the
+// listeners fails or Shutdown is called.
+func (s *Server) ListenAndServe(addr string) error {
+	packet, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		_ = packet.Close()
+		return err
+	}
+	return s.Serve(packet, listener)
+}
+
+// Serve answers queries on packet and listener. Either may be nil.
+func (s *Server) Serve(packet net.PacketConn, listener net.Listener) error {
+	s.mu.Lock()
+	s.packet, s.listener = packet, listener
+	s.mu.Unlock()
+
+	errCh := make(chan error, 2)
+	if packet != nil {
+		go func() { errCh <- s.serveUDP(packet) }()
+	}
+	if listener != nil {
+		go func() { errCh <- s.serveTCP(listener) }()
+	}
+	if packet == nil && listener == nil {
+		return errors.New("dnsserver: nothing to serve")
+	}
+
+	err := <-errCh
+	_ = s.Shutdown()
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	if s.packet != nil {
+		errs = append(errs, s.packet.Close())
+	}
+	if s.listener != nil {
+		errs = append(errs, s.listener.Close())
+	}
+	if err := errors.Join(errs...); err != nil && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) serveUDP(packet net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := packet.ReadFrom(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		if !s.allowed(addr) {
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		// Waiting for a free slot stops reading, so excess datagrams queue
+		// in and then overflow the socket buffer instead of piling up here.
+		s.slots <- struct{}{}
+		go func() {
+			defer func() { <-s.slots }()
+			if resp := s.handle(query, addr, "udp"); resp != nil {
+				_, _ = packet.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *Server) serveTCP(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		if !s.allowed(conn.RemoteAddr()) {
+			_ = conn.Close()
+			continue
+		}
+		go s.handleStream(conn)
+	}
+}
+
+// handleStream answers length-prefixed queries (RFC 1035 section 4.2.2)
+// until the client closes the connection or stays idle.
+func (s *Server) handleStream(conn net.Conn) {
+	defer conn.Close()
+
+	var length [2]byte
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(s.config.IdleTimeout))
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		s.slots <- struct{}{}
+		resp := s.handle(query, conn.RemoteAddr(), "tcp")
+		<-s.slots
+		if resp == nil {
+			return
+		}
+		_ = conn.SetWriteDeadline(time.Now().Add(s.config.IdleTimeout))
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// allowed reports whether queries from addr are answered.
+func (s *Server) allowed(addr net.Addr) bool {
+	clientIP := clientIPOf(addr)
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	if len(s.config.AllowedClients) == 0 {
+		if ip.IsLoopback() {
+			return true
+		}
+		if s.config.UserForClientIP == nil {
+			return false
+		}
+		_, ok := s.config.UserForClientIP(clientIP)
+		return ok
+	}
+	for _, network := range s.config.AllowedClients {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handle answers one query. It returns nil when the message is not a query
+// worth answering.
+func (s *Server) handle(query []byte, addr net.Addr, transport string) []byte {
+	start := time.Now()
+
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+
+	clientIP := clientIPOf(addr)
+	logger := s.config.Logger.With().
+		Str("protocol", "dns").
+		Str("transport", transport).
+		Str("client_addr", addr.String())
+	if s.config.UserForClientIP != nil {
+		if username, ok := s.config.UserForClientIP(clientIP); ok {
+			logger = logger.Str("username", username)
+		}
+	}
+	requestLogger := logger.Logger()
+
+	if err != nil || header.OpCode != 0 {
+		rcode := dnsmessage.RCodeFormatError
+		if err == nil {
+			rcode = dnsmessage.RCodeNotImplemented
+		}
+		requestLogger.Warn().Str("rcode", rcodeName(rcode)).Msg("dns query rejected")
+		return reply(responseHeader(header, rcode), nil, nil, 0)
+	}
+
+	name := strings.TrimSuffix(question.Name.String(), ".")
+	ips, rcode, resolveErr := s.resolve(name, question.Type)
+	resp := reply(responseHeader(header, rcode), &question, ips, s.config.TTL)
+	if transport == "udp" && len(resp) > maxUDPSize {
+		truncated := responseHeader(header, rcode)
+		truncated.Truncated = true
+		resp = reply(truncated, &question, nil, 0)
+	}
+
+	event := requestLogger.Info()
+	if rcode == dnsmessage.RCodeServerFailure {
+		event = requestLogger.Error().Err(resolveErr)
+	}
+	event.
+		Str("query_name", name).
+		Str("query_type", strings.TrimPrefix(question.Type.String(), "Type")).
+		Str("rcode", rcodeName(rcode)).
+		Int("answers", len(ips)).
+		Bool("blocked", errors.Is(resolveErr, resolver.ErrBlocked)).
+		Str("latency", time.Since(start).Round(time.Millisecond).String()).
+		Msg("dns query answered")
+	return resp
+}
+
+// resolve looks up name through the resolver chain. Only address queries
+// are supported; other types get NOTIMP.
+func (s *Server) resolve(name string, qtype dnsmessage.Type) ([]net.IP, dnsmessage.RCode, error) {
+	if qtype != dnsmessage.TypeA && qtype != dnsmessage.TypeAAAA {
+		return nil, dnsmessage.RCodeNotImplemented, nil
+	}
+
+	ips, err := s.config.Resolver.ResolveAll(name)
+	if err != nil {
+		// The name exists but DNS_FAMILY filtered out all of its addresses,
+		// which is an empty answer (NODATA), not a missing name.
+		if errors.Is(err, resolver.ErrNoFamilyAddress) {
+			return nil, dnsmessage.RCodeSuccess, nil
+		}
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, dnsmessage.RCodeNameError, err
+		}
+		return nil, dnsmessage.RCodeServerFailure, err
+	}
+
+	matching := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (qtype == dnsmessage.TypeA) {
+			matching = append(matching, ip)
+		}
+	}
+	return matching, dnsmessage.RCodeSuccess, nil
+}
+
+func responseHeader(query dnsmessage.Header, rcode dnsmessage.RCode) dnsmessage.Header {
+	return dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	}
+}
+
+func reply(header dnsmessage.Header, question *dnsmessage.Question, ips []net.IP, ttl time.Duration) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), header)
+	b.EnableCompression()
+	if question != nil {
+		_ = b.StartQuestions()
+		_ = b.Question(*question)
+		_ = b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: uint32(ttl / time.Second)}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil {
+				_ = b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+			} else {
+				_ = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip.To16())})
+			}
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func rcodeName(rcode dnsmessage.RCode) string {
+	return strings.TrimPrefix(rcode.String(), "RCode")
+}
+
+func clientIPOf(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String()
+	case *net.TCPAddr:
+		return a.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
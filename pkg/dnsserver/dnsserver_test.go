@@ -0,0 +1,358 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+type mapResolver map[string][]net.IP
+
+func (m mapResolver) Resolve(host string) (net.IP, error) {
+	ips, err := m.ResolveAll(host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (m mapResolver) ResolveAll(host string) ([]net.IP, error) {
+	switch host {
+	case "ads.example":
+		return nil, &net.DNSError{Err: resolver.ErrBlocked.Error(), UnwrapErr: resolver.ErrBlocked, Name: host, IsNotFound: true}
+	case "broken.example":
+		return nil, &net.DNSError{Err: "upstream timeout", Name: host, IsTemporary: true}
+	}
+	if ips, ok := m[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) entries(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var entries []map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(b.buf.Bytes()), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func startServer(t *testing.T, conf *Config) (udpAddr, tcpAddr string) {
+	t.Helper()
+
+	packet, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	// Same port for both, so truncated UDP answers can be retried over TCP.
+	listener, err := net.Listen("tcp", packet.LocalAddr().String())
+	require.NoError(t, err)
+
+	if conf.Logger == nil {
+		logger := zerolog.New(io.Discard)
+		conf.Logger = &logger
+	}
+	server := New(conf)
+	done := make(chan error, 1)
+	go func() { done <- server.Serve(packet, listener) }()
+	t.Cleanup(func() {
+		require.NoError(t, server.Shutdown())
+		require.NoError(t, <-done)
+	})
+	return packet.LocalAddr().String(), listener.Addr().String()
+}
+
+func newClient(t *testing.T, raw string) *resolver.ServerResolver {
+	t.Helper()
+
+	server, err := resolver.ParseServer(raw, resolver.ServerOptions{Timeout: time.Second})
+	require.NoError(t, err)
+	client, err := resolver.NewServerResolver([]resolver.Server{server})
+	require.NoError(t, err)
+	return client
+}
+
+func TestServer_AnswersAddressQueries(t *testing.T) {
+	upstream := mapResolver{"dual.example": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}
+	udpAddr, tcpAddr := startServer(t, &Config{Resolver: upstream, TTL: 90 * time.Second})
+
+	for _, raw := range []string{"udp://" + udpAddr, "tcp://" + tcpAddr} {
+		client := newClient(t, raw)
+
+		ips, ttl, err := client.ResolveTTL("dual.example")
+		require.NoError(t, err, raw)
+		require.Len(t, ips, 2, raw)
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+		assert.Equal(t, "2001:db8::1", ips[1].String())
+		assert.Equal(t, 90*time.Second, ttl)
+
+		_, err = client.Resolve("missing.example")
+		var dnsErr *net.DNSError
+		require.ErrorAs(t, err, &dnsErr, raw)
+		assert.True(t, dnsErr.IsNotFound)
+	}
+}
+
+func TestServer_BlockedAndFailingNames(t *testing.T) {
+	var logs syncBuffer
+	logger := zerolog.New(&logs)
+	udpAddr, _ := startServer(t, &Config{
+		Resolver: mapResolver{},
+		Logger:   &logger,
+		UserForClientIP: func(clientIP string) (string, bool) {
+			return "alice", clientIP == "127.0.0.1"
+		},
+	})
+	client := newClient(t, "udp://"+udpAddr)
+
+	_, err := client.Resolve("ads.example")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+
+	_, err = client.Resolve("broken.example")
+	assert.ErrorContains(t, err, "ServerFailure")
+
+	require.Eventually(t, func() bool { return len(logs.entries(t)) >= 4 }, time.Second, 10*time.Millisecond)
+	var blocked, failed int
+	for _, entry := range logs.entries(t) {
+		assert.Equal(t, "dns", entry["protocol"])
+		assert.Equal(t, "alice", entry["username"])
+		switch entry["query_name"] {
+		case "ads.example":
+			blocked++
+			assert.Equal(t, true, entry["blocked"])
+			assert.Equal(t, "NameError", entry["rcode"])
+		case "broken.example":
+			failed++
+			assert.Equal(t, "error", entry["level"])
+		}
+	}
+	assert.Equal(t, 2, blocked)
+	assert.Equal(t, 2, failed)
+}
+
+func TestServer_TruncatesLargeUDPAnswers(t *testing.T) {
+	var ips []net.IP
+	for i := 1; i <= 60; i++ {
+		ips = append(ips, net.ParseIP(fmt.Sprintf("198.51.100.%d", i)))
+	}
+	udpAddr, _ := startServer(t, &Config{Resolver: mapResolver{"big.example": ips}})
+
+	query := buildQuery(t, "big.example", dnsmessage.TypeA)
+	resp := exchangeUDP(t, udpAddr, query)
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	require.NoError(t, err)
+	assert.True(t, header.Truncated)
+
+	// The client retries truncated answers over TCP.
+	all, err := newClient(t, "udp://"+udpAddr).ResolveAll("big.example")
+	require.NoError(t, err)
+	assert.Len(t, all, 60)
+}
+
+func TestServer_FamilyFilteredNameIsNoData(t *testing.T) {
+	upstream := mapResolver{"v4.example": {net.ParseIP("192.0.2.1")}}
+	udpAddr, _ := startServer(t, &Config{Resolver: resolver.NewFamilyResolver(upstream, resolver.FamilyIPv6Only)})
+
+	resp := exchangeUDP(t, udpAddr, buildQuery(t, "v4.example", dnsmessage.TypeAAAA))
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	require.NoError(t, err)
+	assert.Equal(t, dnsmessage.RCodeSuccess, header.RCode)
+	require.NoError(t, p.SkipAllQuestions())
+	answers, err := p.AllAnswers()
+	require.NoError(t, err)
+	assert.Empty(t, answers)
+
+	resp = exchangeUDP(t, udpAddr, buildQuery(t, "missing.example", dnsmessage.TypeAAAA))
+	header, err = p.Start(resp)
+	require.NoError(t, err)
+	assert.Equal(t, dnsmessage.RCodeNameError, header.RCode)
+}
+
+func TestServer_RejectsUnsupportedTypes(t *testing.T) {
+	udpAddr, _ := startServer(t, &Config{Resolver: mapResolver{}})
+
+	resp := exchangeUDP(t, udpAddr, buildQuery(t, "example.com", dnsmessage.TypeMX))
+	var p dnsmessage.Parser
+	header, err := p.Start(resp)
+	require.NoError(t, err)
+	assert.Equal(t, dnsmessage.RCodeNotImplemented, header.RCode)
+}
+
+func TestServer_AllowedClients(t *testing.T) {
+	_, docNet, err := net.ParseCIDR("192.0.2.0/24")
+	require.NoError(t, err)
+	remote := &net.UDPAddr{IP: net.ParseIP("198.51.100.7"), Port: 53}
+	member := &net.UDPAddr{IP: net.ParseIP("192.0.2.7"), Port: 53}
+	loopback := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+
+	// By default only loopback and known proxy users are answered.
+	s := New(&Config{Resolver: mapResolver{}})
+	assert.True(t, s.allowed(loopback))
+	assert.False(t, s.allowed(remote))
+
+	s = New(&Config{Resolver: mapResolver{}, UserForClientIP: func(clientIP string) (string, bool) {
+		return "alice", clientIP == "198.51.100.7"
+	}})
+	assert.True(t, s.allowed(remote))
+
+	s = New(&Config{Resolver: mapResolver{}, AllowedClients: []*net.IPNet{docNet}})
+	assert.True(t, s.allowed(member))
+	assert.False(t, s.allowed(loopback))
+	assert.False(t, s.allowed(remote))
+
+	udpAddr, tcpAddr := startServer(t, &Config{
+		Resolver:       mapResolver{"host.example": {net.ParseIP("192.0.2.1")}},
+		AllowedClients: []*net.IPNet{docNet},
+	})
+	conn, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(200*time.Millisecond)))
+	_, err = conn.Write(buildQuery(t, "host.example", dnsmessage.TypeA))
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 512))
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+
+	stream, err := net.Dial("tcp", tcpAddr)
+	require.NoError(t, err)
+	defer stream.Close()
+	require.NoError(t, stream.SetDeadline(time.Now().Add(time.Second)))
+	_, err = stream.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+// blockingResolver holds every lookup until release is closed and records
+// the most lookups in flight at once.
+type blockingResolver struct {
+	release chan struct{}
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+	started  int
+}
+
+func (b *blockingResolver) Resolve(host string) (net.IP, error) {
+	ips, err := b.ResolveAll(host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (b *blockingResolver) ResolveAll(string) ([]net.IP, error) {
+	b.mu.Lock()
+	b.inFlight++
+	b.started++
+	b.peak = max(b.peak, b.inFlight)
+	b.mu.Unlock()
+
+	<-b.release
+
+	b.mu.Lock()
+	b.inFlight--
+	b.mu.Unlock()
+	return []net.IP{net.ParseIP("192.0.2.1")}, nil
+}
+
+func (b *blockingResolver) counts() (started, peak int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.started, b.peak
+}
+
+func TestServer_MaxConcurrent(t *testing.T) {
+	upstream := &blockingResolver{release: make(chan struct{})}
+	udpAddr, _ := startServer(t, &Config{Resolver: upstream, MaxConcurrent: 2})
+
+	conn, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write(buildQuery(t, "host.example", dnsmessage.TypeA))
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		started, _ := upstream.counts()
+		return started == 2
+	}, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	started, _ := upstream.counts()
+	assert.Equal(t, 2, started)
+
+	close(upstream.release)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 512)
+	for i := 0; i < 5; i++ {
+		_, err = conn.Read(buf)
+		require.NoError(t, err)
+	}
+	_, peak := upstream.counts()
+	assert.Equal(t, 2, peak)
+}
+
+func buildQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 42, RecursionDesired: true})
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name + "."), Type: qtype, Class: dnsmessage.ClassINET}))
+	msg, err := b.Finish()
+	require.NoError(t, err)
+	return msg
+}
+
+func exchangeUDP(t *testing.T, addr string, query []byte) []byte {
+	t.Helper()
+
+	conn, err := net.Dial("udp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(time.Second)))
+
+	_, err = conn.Write(query)
+	require.NoError(t, err)
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if errors.Is(err, net.ErrClosed) {
+		t.Fatal("connection closed")
+	}
+	require.NoError(t, err)
+	return buf[:n]
+}
@@ -0,0 +1,289 @@
+package egress
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+)
+
+type Strategy string
+
+const (
+	// StrategyFixed maps every user to the same source address.
+	StrategyFixed Strategy = "fixed"
+	// StrategyRoundRobin cycles through the configured sources.
+	StrategyRoundRobin Strategy = "round-robin"
+	// StrategyRandom picks a new source address for every connection.
+	StrategyRandom Strategy = "random"
+	// StrategySticky keeps one source address per user session until it has
+	// been idle for StickyTTL.
+	StrategySticky Strategy = "sticky"
+)
+
+const (
+	defaultStickyTTL = 30 * time.Minute
+	stickySweepSize  = 1024
+)
+
+var ErrNoSources = errors.New("egress pool has no source addresses")
+
+// Config describes a pool of local source addresses. Sources and binding
+// values are single IP addresses or CIDR prefixes; a prefix yields addresses
+// from anywhere inside it, which requires the host to accept binding to the
+// whole range (e.g. a local route for an IPv6 /64).
+type Config struct {
+	Sources  []string
+	Strategy Strategy
+	// Bindings restricts a username to one source address or prefix.
+	Bindings  map[string]string
+	StickyTTL time.Duration
+	Timeout   time.Duration
+}
+
+type stickyEntry struct {
+	addr    netip.Addr
+	expires time.Time
+}
+
+// Pool selects the local source address for outbound connections. It
+// implements routing.Outbound and records its choice in Request.SourceIP.
+type Pool struct {
+	sources   []netip.Prefix
+	bindings  map[string]netip.Prefix
+	strategy  Strategy
+	stickyTTL time.Duration
+	timeout   time.Duration
+
+	mu     sync.Mutex
+	next   int
+	sticky map[string]stickyEntry
+	now    func() time.Time
+}
+
+func New(conf Config) (*Pool, error) {
+	pool := &Pool{
+		bindings:  make(map[string]netip.Prefix, len(conf.Bindings)),
+		strategy:  conf.Strategy,
+		stickyTTL: conf.StickyTTL,
+		timeout:   conf.Timeout,
+		sticky:    make(map[string]stickyEntry),
+		now:       time.Now,
+	}
+
+	switch pool.strategy {
+	case "":
+		pool.strategy = StrategyRoundRobin
+	case StrategyFixed, StrategyRoundRobin, StrategyRandom, StrategySticky:
+	default:
+		return nil, fmt.Errorf("unknown egress strategy %q", conf.Strategy)
+	}
+	if pool.stickyTTL <= 0 {
+		pool.stickyTTL = defaultStickyTTL
+	}
+
+	for _, raw := range conf.Sources {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		prefix, err := ParseSource(raw)
+		if err != nil {
+			return nil, err
+		}
+		pool.sources = append(pool.sources, prefix)
+	}
+	for username, raw := range conf.Bindings {
+		prefix, err := ParseSource(raw)
+		if err != nil {
+			return nil, fmt.Errorf("binding for %q: %w", username, err)
+		}
+		pool.bindings[username] = prefix
+	}
+	if len(pool.sources) == 0 && len(pool.bindings) == 0 {
+		return nil, ErrNoSources
+	}
+
+	return pool, nil
+}
+
+// ParseSource parses a single address or a CIDR prefix.
+func ParseSource(raw string) (netip.Prefix, error) {
+	raw = strings.TrimSpace(raw)
+	if strings.Contains(raw, "/") {
+		prefix, err := netip.ParsePrefix(raw)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid egress prefix %q: %w", raw, err)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid egress address %q: %w", raw, err)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Strategy returns the selection strategy in use.
+func (p *Pool) Strategy() Strategy {
+	return p.strategy
+}
+
+// Select returns the source address for req. dest is the destination address
+// when known and restricts the choice to the same address family. It returns
+// false when no suitable source exists, in which case the system default
+// source address should be used.
+func (p *Pool) Select(req *routing.Request, dest netip.Addr) (netip.Addr, bool) {
+	var username string
+	if req != nil {
+		username = req.Username
+	}
+
+	candidates := p.sources
+	if prefix, ok := p.bindings[username]; ok {
+		candidates = []netip.Prefix{prefix}
+	}
+	if dest.IsValid() {
+		dest = dest.Unmap()
+		filtered := make([]netip.Prefix, 0, len(candidates))
+		for _, prefix := range candidates {
+			if prefix.Addr().Is4() == dest.Is4() {
+				filtered = append(filtered, prefix)
+			}
+		}
+		candidates = filtered
+	}
+	if len(candidates) == 0 {
+		return netip.Addr{}, false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.strategy {
+	case StrategyFixed:
+		seed := hashKey(username)
+		return addressIn(candidates[seed%uint64(len(candidates))], rand.New(rand.NewPCG(seed, seed))), true
+	case StrategyRandom:
+		return addressIn(candidates[rand.IntN(len(candidates))], nil), true // #nosec G404 -- address rotation, not security sensitive
+	case StrategySticky:
+		return p.stickyAddress(req.AffinityKey(), candidates), true
+	default:
+		prefix := candidates[p.next%len(candidates)]
+		p.next++
+		return addressIn(prefix, nil), true
+	}
+}
+
+func (p *Pool) stickyAddress(key string, candidates []netip.Prefix) netip.Addr {
+	now := p.now()
+	if entry, ok := p.sticky[key]; ok && now.Before(entry.expires) && containsAddr(candidates, entry.addr) {
+		entry.expires = now.Add(p.stickyTTL)
+		p.sticky[key] = entry
+		return entry.addr
+	}
+
+	if len(p.sticky) >= stickySweepSize {
+		for k, entry := range p.sticky {
+			if !now.Before(entry.expires) {
+				delete(p.sticky, k)
+			}
+		}
+	}
+
+	addr := addressIn(candidates[rand.IntN(len(candidates))], nil) // #nosec G404 -- address rotation, not security sensitive
+	p.sticky[key] = stickyEntry{addr: addr, expires: now.Add(p.stickyTTL)}
+	return addr
+}
+
+// DialRoute implements routing.Outbound. The chosen source address is stored
+// in req.SourceIP so the proxies can log and account for it.
+func (p *Pool) DialRoute(req *routing.Request, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.timeout}
+
+	var dest netip.Addr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		dest, _ = netip.ParseAddr(host)
+	}
+	if source, ok := p.Select(req, dest); ok {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+		if req != nil {
+			req.SourceIP = source.AsSlice()
+		}
+	}
+
+	conn, err := dialer.Dial(network, addr)
+	if err != nil && dialer.LocalAddr != nil {
+		return nil, fmt.Errorf("dial from %s: %w", dialer.LocalAddr, err)
+	}
+	return conn, err
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressIn returns an address inside prefix with the host bits taken from r,
+// or from the global source when r is nil. IPv4 prefixes shorter than /31
+// never yield their network or broadcast address, which cannot be bound.
+func addressIn(prefix netip.Prefix, r *rand.Rand) netip.Addr {
+	addr := prefix.Addr()
+	if prefix.Bits() == addr.BitLen() {
+		return addr
+	}
+
+	for {
+		out := withHostBits(prefix, func() byte {
+			if r != nil {
+				return byte(r.Uint32())
+			}
+			return byte(rand.Uint32()) // #nosec G404 -- address rotation, not security sensitive
+		})
+		if !addr.Is4() || prefix.Bits() >= 31 {
+			return out
+		}
+		if out != withHostBits(prefix, func() byte { return 0 }) && out != withHostBits(prefix, func() byte { return 0xff }) {
+			return out
+		}
+	}
+}
+
+// withHostBits returns the address of prefix whose host bits are filled
+// byte by byte from next.
+func withHostBits(prefix netip.Prefix, next func() byte) netip.Addr {
+	addr := prefix.Addr()
+	b := addr.AsSlice()
+	for i := range b {
+		hostBits := addr.BitLen() - prefix.Bits() - (len(b)-1-i)*8
+		if hostBits <= 0 {
+			continue
+		}
+		mask := byte(0xff)
+		if hostBits < 8 {
+			mask = byte(1<<hostBits) - 1
+		}
+		b[i] = b[i]&^mask | next()&mask
+	}
+
+	out, _ := netip.AddrFromSlice(b)
+	return out
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return h.Sum64()
+}
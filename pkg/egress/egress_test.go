@@ -0,0 +1,167 @@
+package egress
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSource(t *testing.T) {
+	prefix, err := ParseSource("203.0.113.7")
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.7/32", prefix.String())
+
+	prefix, err = ParseSource(" 2001:db8::1/64 ")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::/64", prefix.String())
+
+	_, err = ParseSource("not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestNew_Validation(t *testing.T) {
+	_, err := New(Config{})
+	assert.ErrorIs(t, err, ErrNoSources)
+
+	_, err = New(Config{Sources: []string{"203.0.113.1"}, Strategy: "weighted"})
+	assert.Error(t, err)
+
+	_, err = New(Config{Sources: []string{"203.0.113.1"}, Bindings: map[string]string{"alice": "bogus"}})
+	assert.Error(t, err)
+}
+
+func TestPool_RoundRobin(t *testing.T) {
+	pool, err := New(Config{Sources: []string{"203.0.113.1", "203.0.113.2"}})
+	require.NoError(t, err)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		addr, ok := pool.Select(&routing.Request{Username: "alice"}, netip.Addr{})
+		require.True(t, ok)
+		got = append(got, addr.String())
+	}
+	assert.Equal(t, []string{"203.0.113.1", "203.0.113.2", "203.0.113.1"}, got)
+}
+
+func TestPool_FixedPerUser(t *testing.T) {
+	pool, err := New(Config{Sources: []string{"203.0.113.1", "203.0.113.2", "2001:db8::/64"}, Strategy: StrategyFixed})
+	require.NoError(t, err)
+
+	first, ok := pool.Select(&routing.Request{Username: "alice"}, netip.Addr{})
+	require.True(t, ok)
+	for i := 0; i < 5; i++ {
+		addr, _ := pool.Select(&routing.Request{Username: "alice"}, netip.Addr{})
+		assert.Equal(t, first, addr)
+	}
+}
+
+func TestPool_RandomFromIPv6Prefix(t *testing.T) {
+	pool, err := New(Config{Sources: []string{"2001:db8:1:2::/64"}, Strategy: StrategyRandom})
+	require.NoError(t, err)
+
+	prefix := netip.MustParsePrefix("2001:db8:1:2::/64")
+	seen := make(map[netip.Addr]bool)
+	for i := 0; i < 10; i++ {
+		addr, ok := pool.Select(nil, netip.Addr{})
+		require.True(t, ok)
+		assert.True(t, prefix.Contains(addr), addr.String())
+		seen[addr] = true
+	}
+	assert.Greater(t, len(seen), 1)
+}
+
+func TestPool_RandomSkipsNetworkAndBroadcast(t *testing.T) {
+	pool, err := New(Config{Sources: []string{"203.0.113.4/30"}, Strategy: StrategyRandom})
+	require.NoError(t, err)
+
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		addr, ok := pool.Select(nil, netip.Addr{})
+		require.True(t, ok)
+		seen[addr.String()] = true
+	}
+	assert.Equal(t, map[string]bool{"203.0.113.5": true, "203.0.113.6": true}, seen)
+
+	// A /31 has no network or broadcast address, so both are used.
+	pool, err = New(Config{Sources: []string{"203.0.113.8/31"}, Strategy: StrategyRandom})
+	require.NoError(t, err)
+	seen = make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		addr, _ := pool.Select(nil, netip.Addr{})
+		seen[addr.String()] = true
+	}
+	assert.Len(t, seen, 2)
+}
+
+func TestPool_StickyPerSession(t *testing.T) {
+	pool, err := New(Config{Sources: []string{"2001:db8::/64"}, Strategy: StrategySticky, StickyTTL: time.Minute})
+	require.NoError(t, err)
+	now := time.Now()
+	pool.now = func() time.Time { return now }
+
+	first, _ := pool.Select(&routing.Request{Username: "alice", Session: "a"}, netip.Addr{})
+	again, _ := pool.Select(&routing.Request{Username: "alice", Session: "a"}, netip.Addr{})
+	other, _ := pool.Select(&routing.Request{Username: "alice", Session: "b"}, netip.Addr{})
+	assert.Equal(t, first, again)
+	assert.NotEqual(t, first, other)
+
+	now = now.Add(2 * time.Minute)
+	expired, _ := pool.Select(&routing.Request{Username: "alice", Session: "a"}, netip.Addr{})
+	assert.NotEqual(t, first, expired)
+}
+
+func TestPool_FamilyAndBindings(t *testing.T) {
+	pool, err := New(Config{
+		Sources:  []string{"203.0.113.1", "2001:db8::1"},
+		Bindings: map[string]string{"bob": "198.51.100.9"},
+	})
+	require.NoError(t, err)
+
+	addr, ok := pool.Select(&routing.Request{Username: "alice"}, netip.MustParseAddr("2001:db8::53"))
+	require.True(t, ok)
+	assert.Equal(t, "2001:db8::1", addr.String())
+
+	addr, ok = pool.Select(&routing.Request{Username: "alice"}, netip.MustParseAddr("::ffff:192.0.2.1"))
+	require.True(t, ok)
+	assert.Equal(t, "203.0.113.1", addr.String())
+
+	addr, ok = pool.Select(&routing.Request{Username: "bob"}, netip.MustParseAddr("192.0.2.1"))
+	require.True(t, ok)
+	assert.Equal(t, "198.51.100.9", addr.String())
+
+	_, ok = pool.Select(&routing.Request{Username: "bob"}, netip.MustParseAddr("2001:db8::53"))
+	assert.False(t, ok)
+}
+
+func TestPool_DialRouteBindsSourceAddress(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn.RemoteAddr()
+		_ = conn.Close()
+	}()
+
+	pool, err := New(Config{Sources: []string{"127.0.0.2"}, Timeout: time.Second})
+	require.NoError(t, err)
+
+	req := &routing.Request{Username: "alice"}
+	conn, err := pool.DialRoute(req, "tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.Equal(t, "127.0.0.2", req.SourceIP.String())
+	remote := <-accepted
+	assert.Equal(t, "127.0.0.2", remote.(*net.TCPAddr).IP.String())
+}
@@ -0,0 +1,110 @@
+// Package filewatch reads configuration files again when they change. A file
+// has changed when its modification time or size differs from when it was
+// last read, or when it appeared or disappeared.
+package filewatch
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// LoadFunc reads a configuration. It passes every file it depends on to
+// watch before reading it, so a change made while reading is picked up by
+// the next reload.
+type LoadFunc func(watch func(path string)) error
+
+type stamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// Watcher remembers the files read by the last load and reloads them when
+// one of them changes.
+type Watcher struct {
+	interval time.Duration
+	onReload func(err error)
+
+	mu     sync.Mutex
+	stamps map[string]stamp
+
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+// New returns a watcher that checks the files every interval once Start has
+// been called. onReload, when set, is called after the files changed and
+// were read again, with the error if they could not be loaded.
+func New(interval time.Duration, onReload func(err error)) *Watcher {
+	return &Watcher{interval: interval, onReload: onReload, stop: make(chan struct{})}
+}
+
+// Load calls load and remembers the files it watched. They are remembered
+// even when load fails, so a broken file is only read again once it
+// changes.
+func (w *Watcher) Load(load LoadFunc) error {
+	stamps := make(map[string]stamp)
+	err := load(func(path string) { stamps[path] = statFile(path) })
+
+	w.mu.Lock()
+	w.stamps = stamps
+	w.mu.Unlock()
+	return err
+}
+
+// Changed reports whether any file watched by the last load changed since.
+func (w *Watcher) Changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for path, loaded := range w.stamps {
+		if statFile(path) != loaded {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload calls Load if any of the files changed since the last load. It
+// reports whether a reload was attempted.
+func (w *Watcher) Reload(load LoadFunc) (bool, error) {
+	if !w.Changed() {
+		return false, nil
+	}
+
+	err := w.Load(load)
+	if w.onReload != nil {
+		w.onReload(err)
+	}
+	return true, err
+}
+
+// Start calls reload every interval until Close is called.
+func (w *Watcher) Start(reload func() (bool, error)) {
+	go func() {
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				_, _ = reload()
+			}
+		}
+	}()
+}
+
+func (w *Watcher) Close() {
+	w.stopped.Do(func() { close(w.stop) })
+}
+
+// statFile returns the zero stamp for files that cannot be read.
+func statFile(path string) stamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return stamp{}
+	}
+	return stamp{modTime: info.ModTime(), size: info.Size()}
+}
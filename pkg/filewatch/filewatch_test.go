@@ -0,0 +1,115 @@
+package filewatch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func touch(t *testing.T, path, content string, age time.Duration) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	modTime := time.Now().Add(-age)
+	require.NoError(t, os.Chtimes(path, modTime, modTime))
+}
+
+func TestWatcher_Reload(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.txt")
+	list := filepath.Join(dir, "list.txt")
+	touch(t, main, "list", 3*time.Minute)
+	touch(t, list, "one", 3*time.Minute)
+
+	var reloads []error
+	w := New(time.Minute, func(err error) { reloads = append(reloads, err) })
+
+	reads := 0
+	broken := false
+	load := func(watch func(path string)) error {
+		reads++
+		watch(main)
+		if broken {
+			return errors.New("broken")
+		}
+		watch(list)
+		return nil
+	}
+	require.NoError(t, w.Load(load))
+	assert.Equal(t, 1, reads)
+
+	reloaded, err := w.Reload(load)
+	assert.False(t, reloaded)
+	assert.NoError(t, err)
+
+	// Files discovered while loading are watched too.
+	touch(t, list, "one two", 2*time.Minute)
+	reloaded, err = w.Reload(load)
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+
+	// A failed load is not retried until a file changes again.
+	broken = true
+	touch(t, main, "broken", time.Minute)
+	reloaded, err = w.Reload(load)
+	assert.True(t, reloaded)
+	assert.Error(t, err)
+	reloaded, err = w.Reload(load)
+	assert.False(t, reloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, reads)
+
+	broken = false
+	touch(t, main, "fixed", 0)
+	reloaded, err = w.Reload(load)
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+
+	require.Len(t, reloads, 3)
+	assert.NoError(t, reloads[0])
+	assert.Error(t, reloads[1])
+	assert.NoError(t, reloads[2])
+}
+
+func TestWatcher_MissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.txt")
+	w := New(time.Minute, nil)
+
+	load := func(watch func(path string)) error {
+		watch(path)
+		_, err := os.ReadFile(path)
+		return err
+	}
+	assert.Error(t, w.Load(load))
+	assert.False(t, w.Changed())
+
+	touch(t, path, "now", 0)
+	assert.True(t, w.Changed())
+	reloaded, err := w.Reload(load)
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+}
+
+func TestWatcher_Start(t *testing.T) {
+	w := New(time.Millisecond, nil)
+	calls := make(chan struct{}, 1)
+	w.Start(func() (bool, error) {
+		select {
+		case calls <- struct{}{}:
+		default:
+		}
+		return false, nil
+	})
+	defer w.Close()
+
+	select {
+	case <-calls:
+	case <-time.After(time.Second):
+		t.Fatal("reload was not called")
+	}
+	w.Close()
+}
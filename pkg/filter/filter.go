@@ -0,0 +1,231 @@
+// Package filter blocks requests by destination domain, URL prefix and
+// regular expression. Entries are grouped into named categories, and
+// policies choose which categories are blocked for which users.
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/filewatch"
+)
+
+var ErrBlocked = errors.New("blocked by content filter")
+
+// DefaultReloadInterval is how often the files are checked for changes when
+// Config.ReloadInterval is zero.
+const DefaultReloadInterval = 30 * time.Second
+
+// File is the on-disk filter configuration.
+type File struct {
+	Categories map[string]Category `json:"categories"`
+	Policies   []Policy            `json:"policies"`
+	// BlockPage is an html/template file rendered for blocked HTTP
+	// requests with a Page. Empty selects the built-in page.
+	BlockPage string `json:"block_page,omitempty"`
+}
+
+// Category lists what it blocks inline and in list files.
+//
+// A domain blocks itself and every name below it, while "*.example.com"
+// only blocks the names below. A URL prefix such as "example.com/ads/"
+// blocks the URLs starting with it, whatever their scheme. Regular
+// expressions are matched against the whole URL.
+//
+// List files hold one entry per line and "#" starts a comment. Lines
+// written as "/expression/" are regular expressions, lines with a "/" are
+// URL prefixes and other lines are domains. Lines in hosts format, as used
+// by common ad and malware lists, block their names.
+type Category struct {
+	Domains []string `json:"domains,omitempty"`
+	URLs    []string `json:"urls,omitempty"`
+	Regexes []string `json:"regexes,omitempty"`
+	Lists   []string `json:"lists,omitempty"`
+}
+
+// Policy blocks categories for the users it names, or for every user when
+// Users is empty. The first policy naming a user applies; users without one
+// are not filtered.
+type Policy struct {
+	Users []string `json:"users,omitempty"`
+	Block []string `json:"block"`
+}
+
+// LoadFile reads a JSON filter configuration file.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse filter rules file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Config names the filter configuration file.
+type Config struct {
+	File string
+	// ReloadInterval is how often the configuration, list and block page
+	// files are checked for changes once Start has been called.
+	ReloadInterval time.Duration
+	// OnReload, when set, reports each reload of changed rule, list or
+	// block page files; err is nil when the new rules are in use.
+	OnReload func(err error)
+}
+
+// Request is a request to check. URL is nil for tunnels, such as CONNECT
+// and SOCKS5 connections, which are filtered by domain only.
+type Request struct {
+	Username string
+	Host     string
+	URL      *url.URL
+}
+
+// Block describes why a request was blocked.
+type Block struct {
+	Category string
+	// Rule is the domain, URL prefix or regular expression that matched.
+	Rule string
+}
+
+// rules is one loaded configuration.
+type rules struct {
+	categories map[string]*category
+	policies   []compiledPolicy
+	page       *template.Template
+}
+
+// Filter checks requests against the configured categories. The files are
+// reloaded when they change; files that fail to load keep the previous
+// rules in place.
+type Filter struct {
+	config Config
+
+	mu    sync.RWMutex
+	rules *rules
+
+	files *filewatch.Watcher
+}
+
+// New loads the filter configuration.
+func New(conf Config) (*Filter, error) {
+	if conf.ReloadInterval <= 0 {
+		conf.ReloadInterval = DefaultReloadInterval
+	}
+
+	f := &Filter{config: conf, files: filewatch.New(conf.ReloadInterval, conf.OnReload)}
+	if err := f.files.Load(f.load); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Check reports whether req is blocked for its user, and why. A nil Filter
+// blocks nothing.
+func (f *Filter) Check(req Request) (Block, bool) {
+	if f == nil {
+		return Block{}, false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, policy := range f.rules.policies {
+		if !policy.matches(req.Username) {
+			continue
+		}
+		for _, name := range policy.block {
+			if rule, ok := f.rules.categories[name].match(req); ok {
+				return Block{Category: name, Rule: rule}, true
+			}
+		}
+		break
+	}
+	return Block{}, false
+}
+
+// Counts returns the number of categories and of their entries.
+func (f *Filter) Counts() (categories, entries int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, c := range f.rules.categories {
+		entries += c.entries
+	}
+	return len(f.rules.categories), entries
+}
+
+// Start watches the rule files for changes until Close is called.
+func (f *Filter) Start() {
+	f.files.Start(f.Reload)
+}
+
+func (f *Filter) Close() {
+	f.files.Close()
+}
+
+// Reload reloads the rules if the rule file, or a list or block page it
+// names, changed. It reports whether a reload was attempted.
+func (f *Filter) Reload() (bool, error) {
+	return f.files.Reload(f.load)
+}
+
+func (f *Filter) load(watch func(path string)) error {
+	watch(f.config.File)
+	file, err := LoadFile(f.config.File)
+	if err != nil {
+		return err
+	}
+	loaded, err := compile(*file, watch)
+	if err != nil {
+		return fmt.Errorf("filter rules file %s: %w", f.config.File, err)
+	}
+
+	f.mu.Lock()
+	f.rules = loaded
+	f.mu.Unlock()
+	return nil
+}
+
+// compile reads the list and block page files of file, passing each to
+// watch first, and compiles its rules.
+func compile(file File, watch func(path string)) (*rules, error) {
+	loaded := &rules{
+		categories: make(map[string]*category, len(file.Categories)),
+		page:       defaultBlockPage,
+	}
+	for name, c := range file.Categories {
+		compiled, err := compileCategory(c, watch)
+		if err != nil {
+			return nil, fmt.Errorf("category %s: %w", name, err)
+		}
+		loaded.categories[name] = compiled
+	}
+
+	for i, policy := range file.Policies {
+		compiled, err := compilePolicy(policy, loaded.categories)
+		if err != nil {
+			return nil, fmt.Errorf("policy %d: %w", i+1, err)
+		}
+		loaded.policies = append(loaded.policies, compiled)
+	}
+
+	if file.BlockPage != "" {
+		watch(file.BlockPage)
+		page, err := template.ParseFiles(file.BlockPage)
+		if err != nil {
+			return nil, fmt.Errorf("block page: %w", err)
+		}
+		loaded.page = page
+	}
+	return loaded, nil
+}
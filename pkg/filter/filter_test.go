@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	require.NoError(t, err)
+	return u
+}
+
+func TestFilter_Check(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ads.txt"), `# ad servers
+0.0.0.0 localhost
+0.0.0.0 tracker.example
+*.cdn.example
+example.org/banners/
+/\/ads\/[0-9]+$/
+`)
+	rulesPath := filepath.Join(dir, "filter.json")
+	writeFile(t, rulesPath, `{
+  "categories": {
+    "ads": {"domains": ["Ads.Example."], "lists": ["`+filepath.Join(dir, "ads.txt")+`"]},
+    "social": {"urls": ["https://example.com/social"], "regexes": ["[?&]utm_source="]}
+  },
+  "policies": [
+    {"users": ["kid"], "block": ["social", "ads"]},
+    {"users": ["admin"], "block": []},
+    {"block": ["ads"]}
+  ]
+}`)
+
+	f, err := New(Config{File: rulesPath})
+	require.NoError(t, err)
+	categories, entries := f.Counts()
+	assert.Equal(t, 2, categories)
+	assert.Equal(t, 7, entries)
+
+	for _, tc := range []struct {
+		username string
+		host     string
+		url      string
+		category string
+		rule     string
+	}{
+		{username: "alice", host: "ads.example", category: "ads", rule: "ads.example"},
+		{username: "alice", host: "www.ads.example", category: "ads", rule: "ads.example"},
+		{username: "alice", host: "tracker.example", category: "ads", rule: "tracker.example"},
+		{username: "alice", host: "img.cdn.example", category: "ads", rule: "*.cdn.example"},
+		{username: "alice", host: "cdn.example"},
+		{username: "alice", host: "localhost"},
+		{username: "alice", url: "http://example.org/banners/top.png", category: "ads", rule: "example.org/banners/"},
+		{username: "alice", url: "http://example.net/ads/42", category: "ads", rule: `\/ads\/[0-9]+$`},
+		{username: "alice", url: "http://example.com/social/feed"},
+		{username: "kid", url: "http://EXAMPLE.com:8080/social/feed", category: "social", rule: "example.com/social"},
+		{username: "kid", url: "http://example.net/?utm_source=x", category: "social", rule: "[?&]utm_source="},
+		{username: "kid", host: "ads.example", category: "ads", rule: "ads.example"},
+		{username: "admin", host: "ads.example"},
+		// Tunnels are only filtered by domain.
+		{username: "kid", host: "example.com"},
+	} {
+		req := Request{Username: tc.username, Host: tc.host}
+		if tc.url != "" {
+			req.URL = mustParseURL(t, tc.url)
+			req.Host = req.URL.Hostname()
+		}
+		block, blocked := f.Check(req)
+		assert.Equal(t, tc.category != "", blocked, "%+v", tc)
+		assert.Equal(t, Block{Category: tc.category, Rule: tc.rule}, block, "%+v", tc)
+	}
+
+	var nilFilter *Filter
+	_, blocked := nilFilter.Check(Request{Host: "ads.example"})
+	assert.False(t, blocked)
+}
+
+func TestFilter_Reload(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "list.txt")
+	writeFile(t, listPath, "one.example\n")
+	rulesPath := filepath.Join(dir, "filter.json")
+	writeFile(t, rulesPath, `{"categories": {"blocked": {"lists": ["`+listPath+`"]}}, "policies": [{"block": ["blocked"]}]}`)
+
+	var reloadErr error
+	reloads := 0
+	f, err := New(Config{File: rulesPath, OnReload: func(err error) { reloads++; reloadErr = err }})
+	require.NoError(t, err)
+
+	reloaded, err := f.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writeFile(t, listPath, "two.example\nthree.example\n")
+	require.NoError(t, os.Chtimes(listPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	reloaded, err = f.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	_, blocked := f.Check(Request{Host: "one.example"})
+	assert.False(t, blocked)
+	_, blocked = f.Check(Request{Host: "two.example"})
+	assert.True(t, blocked)
+
+	// A broken list keeps the previous rules.
+	writeFile(t, listPath, "/[/\n")
+	require.NoError(t, os.Chtimes(listPath, time.Now().Add(2*time.Minute), time.Now().Add(2*time.Minute)))
+	_, err = f.Reload()
+	assert.Error(t, err)
+	assert.Error(t, reloadErr)
+	assert.Equal(t, 2, reloads)
+
+	// It is not read again until it changes.
+	reloaded, err = f.Reload()
+	assert.NoError(t, err)
+	assert.False(t, reloaded)
+	assert.Equal(t, 2, reloads)
+	_, blocked = f.Check(Request{Host: "two.example"})
+	assert.True(t, blocked)
+}
+
+func TestNew_RejectsInvalidRules(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filter.json")
+	for _, rules := range []string{
+		`{`,
+		`{"categories": {"a": {"domains": ["bad domain/"]}}}`,
+		`{"categories": {"a": {"regexes": ["("]}}}`,
+		`{"categories": {"a": {"urls": ["http://"]}}}`,
+		`{"categories": {"a": {"lists": ["` + filepath.Join(dir, "missing.txt") + `"]}}}`,
+		`{"policies": [{"block": ["unknown"]}]}`,
+		`{"block_page": "` + filepath.Join(dir, "missing.html") + `"}`,
+	} {
+		writeFile(t, path, rules)
+		_, err := New(Config{File: path})
+		assert.Error(t, err, rules)
+	}
+}
+
+func TestFilter_WriteBlockPage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "filter.json")
+	writeFile(t, path, `{}`)
+	f, err := New(Config{File: path})
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	f.WriteBlockPage(rec, Page{URL: "http://ads.example/<script>", Category: "ads"})
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rec.Header().Get("Content-Type"))
+	assert.Contains(t, rec.Body.String(), "http://ads.example/&lt;script&gt;")
+	assert.Contains(t, rec.Body.String(), "ads")
+
+	pagePath := filepath.Join(dir, "block.html")
+	writeFile(t, pagePath, `<p>{{.Username}} may not visit {{.Host}} ({{.Category}})</p>`)
+	writeFile(t, path, `{"block_page": "`+pagePath+`"}`)
+	f, err = New(Config{File: path})
+	require.NoError(t, err)
+	rec = httptest.NewRecorder()
+	f.WriteBlockPage(rec, Page{Host: "ads.example", Username: "kid", Category: "ads"})
+	assert.Equal(t, "<p>kid may not visit ads.example (ads)</p>", rec.Body.String())
+}
@@ -0,0 +1,42 @@
+package filter
+
+import (
+	"bytes"
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed blockpage.gohtml
+var defaultBlockPageSource string
+
+var defaultBlockPage = template.Must(template.New("blockpage").Parse(defaultBlockPageSource))
+
+// Page is the data a block page template is rendered with.
+type Page struct {
+	URL      string
+	Host     string
+	Username string
+	ClientIP string
+	Category string
+	Rule     string
+}
+
+// WriteBlockPage answers a blocked HTTP request with the block page. A
+// template that fails to render falls back to plain text.
+func (f *Filter) WriteBlockPage(w http.ResponseWriter, page Page) {
+	f.mu.RLock()
+	tmpl := f.rules.page
+	f.mu.RUnlock()
+
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, page); err != nil {
+		http.Error(w, "Forbidden: "+ErrBlocked.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusForbidden)
+	_, _ = w.Write(body.Bytes())
+}
@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type category struct {
+	domains  domainSet
+	prefixes []string
+	regexes  []*regexp.Regexp
+	entries  int
+}
+
+// match returns the entry of the category that matches req. URL prefixes
+// and regular expressions only apply to requests with a URL.
+func (c *category) match(req Request) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	if rule, ok := c.domains.lookup(req.Host); ok {
+		return rule, true
+	}
+	if req.URL == nil {
+		return "", false
+	}
+
+	target := urlKey(req.URL)
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(target, prefix) {
+			return prefix, true
+		}
+	}
+	full := req.URL.String()
+	for _, re := range c.regexes {
+		if re.MatchString(full) {
+			return re.String(), true
+		}
+	}
+	return "", false
+}
+
+func compileCategory(c Category, watch func(path string)) (*category, error) {
+	compiled := &category{domains: domainSet{exact: make(map[string]bool), wildcard: make(map[string]bool)}}
+	for _, domain := range c.Domains {
+		if err := compiled.addDomain(domain); err != nil {
+			return nil, err
+		}
+	}
+	for _, prefix := range c.URLs {
+		if err := compiled.addPrefix(prefix); err != nil {
+			return nil, err
+		}
+	}
+	for _, expr := range c.Regexes {
+		if err := compiled.addRegex(expr); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range c.Lists {
+		watch(path)
+		if err := compiled.addList(path); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+// addList adds the entries of a list file.
+func (c *category) addList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		if err := c.addLine(scanner.Text()); err != nil {
+			return fmt.Errorf("%s: line %d: %w", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *category) addLine(text string) error {
+	text = strings.TrimSpace(text)
+	if expr, ok := strings.CutPrefix(text, "/"); ok && len(expr) > 1 && strings.HasSuffix(expr, "/") {
+		// Regular expressions may contain "#", so they are taken whole.
+		return c.addRegex(strings.TrimSuffix(expr, "/"))
+	}
+
+	text, _, _ = strings.Cut(text, "#")
+	fields := strings.Fields(text)
+	switch {
+	case len(fields) == 0:
+		return nil
+	case len(fields) > 1 && net.ParseIP(fields[0]) != nil:
+		for _, name := range fields[1:] {
+			if hostsListNames[name] || strings.HasPrefix(name, "ip6-") {
+				continue
+			}
+			if err := c.addDomain(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	case len(fields) > 1:
+		return fmt.Errorf("unexpected entry %q", text)
+	case strings.Contains(fields[0], "/"):
+		return c.addPrefix(fields[0])
+	default:
+		return c.addDomain(fields[0])
+	}
+}
+
+// hostsListNames are the local names found at the top of block lists in
+// hosts format. They are not blocked.
+var hostsListNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"0.0.0.0":               true,
+}
+
+func (c *category) addDomain(domain string) error {
+	name := normalizeHost(domain)
+	suffix, wildcard := strings.CutPrefix(name, "*.")
+	if !validDomain(suffix) {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	if !wildcard {
+		c.domains.exact[suffix] = true
+	}
+	c.domains.wildcard[suffix] = true
+	c.entries++
+	return nil
+}
+
+func (c *category) addPrefix(prefix string) error {
+	raw := strings.TrimSpace(prefix)
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("invalid URL prefix %q", prefix)
+	}
+	c.prefixes = append(c.prefixes, urlKey(parsed))
+	c.entries++
+	return nil
+}
+
+func (c *category) addRegex(expr string) error {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid regular expression %q: %w", expr, err)
+	}
+	c.regexes = append(c.regexes, re)
+	c.entries++
+	return nil
+}
+
+// urlKey is the form URLs are compared in against prefixes: the host in
+// lower case, without scheme and port, followed by the path and query.
+func urlKey(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+	return normalizeHost(u.Hostname()) + path
+}
+
+// domainSet holds blocked domains. exact names block themselves; wildcard
+// names block every name below them.
+type domainSet struct {
+	exact    map[string]bool
+	wildcard map[string]bool
+}
+
+// lookup returns the entry blocking host.
+func (s domainSet) lookup(host string) (string, bool) {
+	host = normalizeHost(host)
+	if s.exact[host] {
+		return host, true
+	}
+	for rest := host; ; {
+		_, suffix, ok := strings.Cut(rest, ".")
+		if !ok {
+			return "", false
+		}
+		if s.wildcard[suffix] {
+			if s.exact[suffix] {
+				return suffix, true
+			}
+			return "*." + suffix, true
+		}
+		rest = suffix
+	}
+}
+
+type compiledPolicy struct {
+	users map[string]struct{}
+	block []string
+}
+
+func compilePolicy(policy Policy, categories map[string]*category) (compiledPolicy, error) {
+	compiled := compiledPolicy{}
+	for _, name := range policy.Block {
+		if _, ok := categories[name]; !ok {
+			return compiledPolicy{}, fmt.Errorf("unknown category %q", name)
+		}
+		compiled.block = append(compiled.block, name)
+	}
+	if len(policy.Users) > 0 {
+		compiled.users = make(map[string]struct{}, len(policy.Users))
+		for _, user := range policy.Users {
+			compiled.users[strings.TrimSpace(user)] = struct{}{}
+		}
+	}
+	return compiled, nil
+}
+
+func (p compiledPolicy) matches(username string) bool {
+	if len(p.users) == 0 {
+		return true
+	}
+	_, ok := p.users[username]
+	return ok
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// validDomain reports whether name is a domain name.
+func validDomain(name string) bool {
+	if name == "" || len(name) > 253 || strings.ContainsAny(name, "*/:") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
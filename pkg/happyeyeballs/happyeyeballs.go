@@ -0,0 +1,93 @@
+// Package happyeyeballs races connection attempts to several addresses as
+// described in RFC 8305 section 5.
+package happyeyeballs
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// DefaultDelay is the recommended Connection Attempt Delay.
+const DefaultDelay = 250 * time.Millisecond
+
+var ErrNoAddresses = errors.New("no addresses to dial")
+
+type attemptResult struct {
+	index int
+	conn  net.Conn
+	err   error
+}
+
+// Dial starts attempt(0) and, whenever the running attempts have not
+// succeeded after delay or one of them fails, the next attempt, until
+// attempts have been started. The first successful connection is returned
+// together with the index of its attempt; connections that succeed later are
+// closed. Callers order the attempts, typically by interleaving address
+// families. When every attempt fails the error of the first one is returned.
+func Dial(attempts int, delay time.Duration, attempt func(i int) (net.Conn, error)) (net.Conn, int, error) {
+	if attempts <= 0 {
+		return nil, -1, ErrNoAddresses
+	}
+	if delay <= 0 {
+		delay = DefaultDelay
+	}
+
+	results := make(chan attemptResult, attempts)
+	next, pending := 0, 0
+	start := func() {
+		go func(i int) {
+			conn, err := attempt(i)
+			results <- attemptResult{index: i, conn: conn, err: err}
+		}(next)
+		next++
+		pending++
+	}
+
+	errs := make([]error, attempts)
+	start()
+	for pending > 0 {
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next < attempts {
+			timer = time.NewTimer(delay)
+			timeout = timer.C
+		}
+
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if timer != nil {
+					timer.Stop()
+				}
+				go closeLosers(results, pending)
+				return result.conn, result.index, nil
+			}
+			errs[result.index] = result.err
+			if next < attempts {
+				start()
+			}
+		case <-timeout:
+			start()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, -1, err
+		}
+	}
+	return nil, -1, ErrNoAddresses
+}
+
+func closeLosers(results <-chan attemptResult, pending int) {
+	for ; pending > 0; pending-- {
+		if result := <-results; result.conn != nil {
+			_ = result.conn.Close()
+		}
+	}
+}
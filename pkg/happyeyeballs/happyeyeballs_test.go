@@ -0,0 +1,80 @@
+package happyeyeballs
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeRecorder struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestDial_FailureStartsNextAttempt(t *testing.T) {
+	refused := errors.New("connection refused")
+	start := time.Now()
+
+	conn, index, err := Dial(3, time.Hour, func(i int) (net.Conn, error) {
+		if i == 0 {
+			return nil, refused
+		}
+		return &closeRecorder{}, nil
+	})
+	require.NoError(t, err)
+	assert.NotNil(t, conn)
+	assert.Equal(t, 1, index)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestDial_DelayStartsNextAttempt(t *testing.T) {
+	release := make(chan struct{})
+	slow := &closeRecorder{}
+
+	conn, index, err := Dial(2, 10*time.Millisecond, func(i int) (net.Conn, error) {
+		if i == 0 {
+			<-release
+			return slow, nil
+		}
+		return &closeRecorder{}, nil
+	})
+	require.NoError(t, err)
+	assert.NotSame(t, slow, conn)
+	assert.Equal(t, 1, index)
+
+	close(release)
+	assert.Eventually(t, slow.closed.Load, time.Second, 5*time.Millisecond)
+}
+
+func TestDial_ReturnsFirstError(t *testing.T) {
+	first := errors.New("first")
+	var mu sync.Mutex
+	var started []int
+
+	_, index, err := Dial(3, time.Millisecond, func(i int) (net.Conn, error) {
+		mu.Lock()
+		started = append(started, i)
+		mu.Unlock()
+		if i == 0 {
+			return nil, first
+		}
+		return nil, errors.New("later")
+	})
+	assert.ErrorIs(t, err, first)
+	assert.Equal(t, -1, index)
+	assert.ElementsMatch(t, []int{0, 1, 2}, started)
+
+	_, _, err = Dial(0, 0, nil)
+	assert.ErrorIs(t, err, ErrNoAddresses)
+}
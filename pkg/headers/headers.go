@@ -0,0 +1,192 @@
+// Package headers rewrites the headers of forwarded HTTP requests and their
+// responses according to per-user and per-destination rules.
+package headers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultVia is the pseudonym this proxy adds to Via headers.
+const DefaultVia = "nanoproxy"
+
+// File is the on-disk header rule configuration.
+type File struct {
+	// Via is the pseudonym added to Via headers. Empty selects DefaultVia.
+	Via   string `json:"via,omitempty"`
+	Rules []Rule `json:"rules"`
+}
+
+// LoadFile reads a JSON header rule configuration file.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse header rules file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Request describes a request about to be forwarded.
+type Request struct {
+	// Host is the destination host name or address, without port.
+	Host     string
+	Username string
+	ClientIP string
+	// Scheme is the scheme of the request target, http or https.
+	Scheme     string
+	ProtoMajor int
+	ProtoMinor int
+}
+
+// Policy holds the header rules. Unlike routing rules, every matching rule
+// applies, in order, so general rules can be refined by later ones.
+type Policy struct {
+	via   string
+	rules []compiledRule
+}
+
+// New validates the rules of file.
+func New(file File) (*Policy, error) {
+	policy := &Policy{via: strings.TrimSpace(file.Via)}
+	if policy.via == "" {
+		policy.via = DefaultVia
+	}
+	if strings.ContainsAny(policy.via, ",\r\n") {
+		return nil, fmt.Errorf("invalid via pseudonym %q", file.Via)
+	}
+	for i, rule := range file.Rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		policy.rules = append(policy.rules, compiled)
+	}
+	return policy, nil
+}
+
+// For returns the rewrite for req, or nil when no rule matches.
+func (p *Policy) For(req Request) *Rewrite {
+	if p == nil {
+		return nil
+	}
+
+	var rewrite *Rewrite
+	for _, rule := range p.rules {
+		if !rule.matches(&req) {
+			continue
+		}
+		if rewrite == nil {
+			rewrite = &Rewrite{req: req, via: p.via, forwarding: ForwardingPreserve}
+		}
+		if rule.forwarding != "" {
+			rewrite.forwarding = rule.forwarding
+		}
+		if rule.userAgent != "" {
+			rewrite.userAgent = rule.userAgent
+		}
+		rewrite.request = append(rewrite.request, rule.request)
+		rewrite.response = append(rewrite.response, rule.response)
+	}
+	if rewrite != nil {
+		rewrite.replacer = strings.NewReplacer(
+			"{user}", req.Username,
+			"{client_ip}", req.ClientIP,
+			"{host}", req.Host,
+		)
+	}
+	return rewrite
+}
+
+// Rewrite is what the matching rules do to one request and its response.
+// A nil Rewrite leaves headers unchanged.
+type Rewrite struct {
+	req        Request
+	via        string
+	forwarding Forwarding
+	userAgent  string
+	request    []Actions
+	response   []Actions
+	replacer   *strings.Replacer
+}
+
+// Request rewrites the headers of the forwarded request.
+func (rw *Rewrite) Request(header http.Header) {
+	if rw == nil {
+		return
+	}
+
+	switch rw.forwarding {
+	case ForwardingAppend:
+		client := "unknown"
+		if ip := net.ParseIP(rw.req.ClientIP); ip != nil {
+			client = ip.String()
+		}
+		if prior := strings.Join(header.Values("X-Forwarded-For"), ", "); prior != "" {
+			client = prior + ", " + client
+		}
+		header.Set("X-Forwarded-For", client)
+		header.Add("Forwarded", "for="+forwardedNode(rw.req.ClientIP)+";proto="+rw.req.Scheme)
+		header.Add("Via", rw.viaEntry())
+	case ForwardingAnonymize:
+		header.Del("X-Forwarded-For")
+		header.Set("Forwarded", "for=unknown")
+		header.Set("Via", rw.viaEntry())
+	case ForwardingStrip:
+		header.Del("X-Forwarded-For")
+		header.Del("Forwarded")
+		header.Del("Via")
+	}
+
+	for _, actions := range rw.request {
+		actions.apply(header, rw.replacer)
+	}
+	if rw.userAgent != "" {
+		header.Set("User-Agent", rw.userAgent)
+	}
+}
+
+// Response rewrites the headers of the response sent back to the client.
+func (rw *Rewrite) Response(header http.Header) {
+	if rw == nil {
+		return
+	}
+
+	for _, actions := range rw.response {
+		actions.apply(header, rw.replacer)
+	}
+}
+
+// viaEntry is the Via entry of this proxy for the request's protocol.
+func (rw *Rewrite) viaEntry() string {
+	switch {
+	case rw.req.ProtoMajor == 2:
+		return "2 " + rw.via
+	case rw.req.ProtoMajor > 0:
+		return fmt.Sprintf("%d.%d %s", rw.req.ProtoMajor, rw.req.ProtoMinor, rw.via)
+	default:
+		return "1.1 " + rw.via
+	}
+}
+
+// forwardedNode formats a client address as a Forwarded node (RFC 7239
+// section 6), which quotes IPv6 addresses in brackets.
+func forwardedNode(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() == nil:
+		return `"[` + ip.String() + `]"`
+	default:
+		return ip.String()
+	}
+}
@@ -0,0 +1,118 @@
+package headers
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy_For(t *testing.T) {
+	policy, err := New(File{Rules: []Rule{
+		{Forwarding: ForwardingAnonymize, Request: Actions{Remove: []string{"cookie"}}},
+		{Users: []string{"alice"}, Request: Actions{Set: map[string]string{"X-Proxy-User": "{user}@{client_ip}"}}},
+		{Domains: []string{"*.Example.com"}, UserAgent: "nanoproxy/1.0", Response: Actions{Remove: []string{"Server"}, Add: map[string]string{"X-Served-For": "{host}"}}},
+	}})
+	require.NoError(t, err)
+
+	var nilPolicy *Policy
+	assert.Nil(t, nilPolicy.For(Request{Host: "example.com"}))
+
+	header := http.Header{
+		"Cookie":          {"session=1"},
+		"X-Forwarded-For": {"10.0.0.1"},
+		"Via":             {"1.1 internal-gw"},
+		"User-Agent":      {"curl/8.0"},
+	}
+	rewrite := policy.For(Request{Host: "api.example.com", Username: "alice", ClientIP: "192.0.2.1", Scheme: "https", ProtoMajor: 1, ProtoMinor: 1})
+	rewrite.Request(header)
+	assert.Equal(t, http.Header{
+		"Forwarded":    {"for=unknown"},
+		"Via":          {"1.1 nanoproxy"},
+		"User-Agent":   {"nanoproxy/1.0"},
+		"X-Proxy-User": {"alice@192.0.2.1"},
+	}, header)
+
+	response := http.Header{"Server": {"nginx"}}
+	rewrite.Response(response)
+	assert.Equal(t, http.Header{"X-Served-For": {"api.example.com"}}, response)
+
+	// Only the first rule matches other users and destinations.
+	header = http.Header{"User-Agent": {"curl/8.0"}}
+	policy.For(Request{Host: "example.org", Username: "bob"}).Request(header)
+	assert.Equal(t, "curl/8.0", header.Get("User-Agent"))
+	assert.Empty(t, header.Get("X-Proxy-User"))
+}
+
+func TestRewrite_Forwarding(t *testing.T) {
+	newRewrite := func(forwarding Forwarding, clientIP string, protoMajor int) *Rewrite {
+		t.Helper()
+		policy, err := New(File{Via: "edge", Rules: []Rule{{Forwarding: forwarding}}})
+		require.NoError(t, err)
+		return policy.For(Request{ClientIP: clientIP, Scheme: "http", ProtoMajor: protoMajor, ProtoMinor: 0})
+	}
+	sent := func() http.Header {
+		return http.Header{
+			"X-Forwarded-For": {"10.0.0.1"},
+			"Forwarded":       {"for=10.0.0.1"},
+			"Via":             {"1.1 internal-gw"},
+		}
+	}
+
+	header := sent()
+	newRewrite(ForwardingAppend, "192.0.2.1", 1).Request(header)
+	assert.Equal(t, "10.0.0.1, 192.0.2.1", header.Get("X-Forwarded-For"))
+	assert.Equal(t, []string{"for=10.0.0.1", "for=192.0.2.1;proto=http"}, header.Values("Forwarded"))
+	assert.Equal(t, []string{"1.1 internal-gw", "1.0 edge"}, header.Values("Via"))
+
+	header = http.Header{}
+	newRewrite(ForwardingAppend, "2001:db8::1", 2).Request(header)
+	assert.Equal(t, "2001:db8::1", header.Get("X-Forwarded-For"))
+	assert.Equal(t, `for="[2001:db8::1]";proto=http`, header.Get("Forwarded"))
+	assert.Equal(t, "2 edge", header.Get("Via"))
+
+	header = sent()
+	newRewrite(ForwardingStrip, "192.0.2.1", 1).Request(header)
+	assert.Empty(t, header)
+
+	header = sent()
+	newRewrite(ForwardingPreserve, "192.0.2.1", 1).Request(header)
+	assert.Equal(t, sent(), header)
+}
+
+func TestNew_RejectsInvalidRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{Forwarding: "hide"},
+		{Request: Actions{Remove: []string{"Host"}}},
+		{Request: Actions{Set: map[string]string{"content-length": "0"}}},
+		{Response: Actions{Add: map[string]string{"Transfer-Encoding": "chunked"}}},
+		{Request: Actions{Set: map[string]string{"Bad Name": "x"}}},
+	} {
+		_, err := New(File{Rules: []Rule{rule}})
+		assert.Error(t, err, "%+v", rule)
+	}
+	_, err := New(File{Via: "a, b"})
+	assert.Error(t, err)
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headers.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+  "via": "edge",
+  "rules": [{"domains": ["example.com"], "forwarding": "strip", "request": {"set": {"X-Team": "data"}}}]
+}`), 0o600))
+
+	file, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "edge", file.Via)
+	require.Len(t, file.Rules, 1)
+	assert.Equal(t, ForwardingStrip, file.Rules[0].Forwarding)
+	assert.Equal(t, map[string]string{"X-Team": "data"}, file.Rules[0].Request.Set)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
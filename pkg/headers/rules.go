@@ -0,0 +1,187 @@
+package headers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+)
+
+// Forwarding selects what a forwarded request reveals about the client and
+// the proxies it passed through in X-Forwarded-For, Forwarded (RFC 7239) and
+// Via (RFC 9110 section 7.6.3).
+type Forwarding string
+
+const (
+	// ForwardingPreserve passes on what the client sent. It is the default.
+	ForwardingPreserve Forwarding = "preserve"
+	// ForwardingAppend adds the client address and this proxy, as a
+	// transparent proxy would.
+	ForwardingAppend Forwarding = "append"
+	// ForwardingAnonymize replaces the headers with ones that only reveal
+	// that the request was proxied.
+	ForwardingAnonymize Forwarding = "anonymize"
+	// ForwardingStrip removes the headers.
+	ForwardingStrip Forwarding = "strip"
+)
+
+// Actions rewrite the headers of a message. They are applied in the order
+// Remove, Set, Add. Values of Set and Add may contain the placeholders
+// {user}, {client_ip} and {host}.
+type Actions struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// Rule rewrites the headers of requests matching every non-empty criterion.
+// Within a criterion, any listed value may match.
+type Rule struct {
+	Domains []string `json:"domains,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	// Forwarding is left as it is when empty.
+	Forwarding Forwarding `json:"forwarding,omitempty"`
+	// UserAgent replaces the User-Agent of requests when set.
+	UserAgent string  `json:"user_agent,omitempty"`
+	Request   Actions `json:"request,omitzero"`
+	Response  Actions `json:"response,omitzero"`
+}
+
+// protectedHeaders frame the message or belong to the connection, so rules
+// may not touch them.
+var protectedHeaders = map[string]bool{
+	"Host":                true,
+	"Content-Length":      true,
+	"Transfer-Encoding":   true,
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Upgrade":             true,
+}
+
+type compiledRule struct {
+	domains    []string
+	users      map[string]struct{}
+	forwarding Forwarding
+	userAgent  string
+	request    Actions
+	response   Actions
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{
+		forwarding: Forwarding(strings.ToLower(strings.TrimSpace(string(rule.Forwarding)))),
+		userAgent:  rule.UserAgent,
+	}
+	switch compiled.forwarding {
+	case "", ForwardingPreserve, ForwardingAppend, ForwardingAnonymize, ForwardingStrip:
+	default:
+		return compiledRule{}, fmt.Errorf("unknown forwarding mode %q", rule.Forwarding)
+	}
+
+	for _, domain := range rule.Domains {
+		if d := normalizeDomain(domain); d != "" {
+			compiled.domains = append(compiled.domains, d)
+		}
+	}
+
+	if len(rule.Users) > 0 {
+		compiled.users = make(map[string]struct{}, len(rule.Users))
+		for _, user := range rule.Users {
+			compiled.users[strings.TrimSpace(user)] = struct{}{}
+		}
+	}
+
+	var err error
+	if compiled.request, err = compileActions(rule.Request); err != nil {
+		return compiledRule{}, fmt.Errorf("request: %w", err)
+	}
+	if compiled.response, err = compileActions(rule.Response); err != nil {
+		return compiledRule{}, fmt.Errorf("response: %w", err)
+	}
+	return compiled, nil
+}
+
+// compileActions canonicalizes the header names of actions and rejects
+// protected ones.
+func compileActions(actions Actions) (Actions, error) {
+	var compiled Actions
+	for _, name := range actions.Remove {
+		key, err := headerKey(name)
+		if err != nil {
+			return Actions{}, err
+		}
+		compiled.Remove = append(compiled.Remove, key)
+	}
+	for name, value := range actions.Set {
+		key, err := headerKey(name)
+		if err != nil {
+			return Actions{}, err
+		}
+		if compiled.Set == nil {
+			compiled.Set = make(map[string]string, len(actions.Set))
+		}
+		compiled.Set[key] = value
+	}
+	for name, value := range actions.Add {
+		key, err := headerKey(name)
+		if err != nil {
+			return Actions{}, err
+		}
+		if compiled.Add == nil {
+			compiled.Add = make(map[string]string, len(actions.Add))
+		}
+		compiled.Add[key] = value
+	}
+	return compiled, nil
+}
+
+func headerKey(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t:\r\n") {
+		return "", fmt.Errorf("invalid header name %q", name)
+	}
+	key := http.CanonicalHeaderKey(name)
+	if protectedHeaders[key] {
+		return "", fmt.Errorf("header %s cannot be rewritten", key)
+	}
+	return key, nil
+}
+
+func (r compiledRule) matches(req *Request) bool {
+	if len(r.domains) > 0 && !routing.MatchDomain(r.domains, req.Host) {
+		return false
+	}
+	if len(r.users) > 0 {
+		if _, ok := r.users[req.Username]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// apply rewrites header with the actions, expanding placeholders with
+// replacer.
+func (a Actions) apply(header http.Header, replacer *strings.Replacer) {
+	for _, key := range a.Remove {
+		header.Del(key)
+	}
+	for key, value := range a.Set {
+		header.Set(key, replacer.Replace(value))
+	}
+	for key, value := range a.Add {
+		header.Add(key, replacer.Replace(value))
+	}
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.TrimPrefix(domain, ".")
+	return strings.TrimSuffix(domain, ".")
+}
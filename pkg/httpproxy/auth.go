@@ -0,0 +1,301 @@
+package httpproxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+)
+
+// AuthScheme is a Proxy-Authorization scheme the proxy accepts.
+type AuthScheme string
+
+const (
+	AuthBasic  AuthScheme = "basic"
+	AuthDigest AuthScheme = "digest"
+	AuthBearer AuthScheme = "bearer"
+)
+
+// DigestNonceLifetime is how long a Digest nonce is accepted. Clients
+// answering with an older one are challenged again with stale=true and
+// retry without asking the user.
+const DigestNonceLifetime = 5 * time.Minute
+
+var errStaleNonce = errors.New("stale digest nonce")
+
+// digestAlgorithms are offered in order of preference (RFC 7616 section
+// 3.7).
+var digestAlgorithms = []string{credential.DigestSHA256, credential.DigestMD5}
+
+// ParseAuthScheme parses the name of an authentication scheme.
+func ParseAuthScheme(name string) (AuthScheme, error) {
+	switch scheme := AuthScheme(strings.ToLower(strings.TrimSpace(name))); scheme {
+	case AuthBasic, AuthDigest, AuthBearer:
+		return scheme, nil
+	}
+	return "", fmt.Errorf("unknown authentication scheme %q", name)
+}
+
+func (s *Server) authSchemes() []AuthScheme {
+	if len(s.config.AuthSchemes) == 0 {
+		return []AuthScheme{AuthBasic}
+	}
+	return s.config.AuthSchemes
+}
+
+func (s *Server) accepts(scheme AuthScheme) bool {
+	for _, accepted := range s.authSchemes() {
+		if accepted == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) realm() string {
+	if s.config.Realm == "" {
+		return credential.DefaultRealm
+	}
+	return s.config.Realm
+}
+
+// requireAuthentication answers a request that failed authentication with
+// a challenge for every accepted scheme.
+func (s *Server) requireAuthentication(w http.ResponseWriter, r *http.Request, err error) {
+	realm := quoteAuthParam(s.realm())
+	for _, scheme := range s.authSchemes() {
+		switch scheme {
+		case AuthBasic:
+			w.Header().Add("Proxy-Authenticate", "Basic realm="+realm)
+		case AuthDigest:
+			nonce := s.nonces.issue()
+			stale := ""
+			if errors.Is(err, errStaleNonce) {
+				stale = ", stale=true"
+			}
+			for _, algorithm := range digestAlgorithms {
+				w.Header().Add("Proxy-Authenticate", fmt.Sprintf(`Digest realm=%s, qop="auth", algorithm=%s, nonce="%s"%s`, realm, algorithm, nonce, stale))
+			}
+		case AuthBearer:
+			w.Header().Add("Proxy-Authenticate", "Bearer realm="+realm)
+		}
+	}
+	s.writeError(w, r, proxyError{
+		status:      http.StatusProxyAuthRequired,
+		errorType:   errorHTTPRequestDenied,
+		category:    "Proxy authentication required",
+		message:     "Proxy authentication required or unauthorized",
+		destination: r.Host,
+	})
+}
+
+// authenticateBearer returns the owner of a named or ephemeral credential
+// used as a bearer token.
+func (s *Server) authenticateBearer(token string) (string, *credential.Grant, error) {
+	token = strings.TrimSpace(token)
+	if grants, ok := s.config.Credentials.(credential.GrantStore); ok {
+		if grant, ok := grants.Grant("", token); ok {
+			return grant.User(), grant, nil
+		}
+	}
+	tokens, ok := s.config.Credentials.(credential.TokenStore)
+	if !ok {
+		return "", nil, ErrInvalidProxyAuthorization
+	}
+	if username, ok := tokens.UserForToken(token); ok {
+		return username, nil, nil
+	}
+	return "", nil, ErrInvalidProxyCredentials
+}
+
+// authenticateDigest verifies a Digest response (RFC 7616) and returns the
+// username it was computed for.
+func (s *Server) authenticateDigest(r *http.Request, credentials string) (string, error) {
+	digests, ok := s.config.Credentials.(credential.DigestStore)
+	if !ok {
+		return "", ErrInvalidProxyAuthorization
+	}
+
+	params := parseAuthParams(credentials)
+	username, nonce, uri, cnonce, nc := params["username"], params["nonce"], params["uri"], params["cnonce"], params["nc"]
+	if username == "" || nonce == "" || cnonce == "" || nc == "" || params["response"] == "" {
+		return "", fmt.Errorf("%w: incomplete digest response", ErrInvalidProxyAuthorization)
+	}
+	if params["qop"] != "auth" {
+		return "", fmt.Errorf("%w: unsupported qop %q", ErrInvalidProxyAuthorization, params["qop"])
+	}
+	if strings.EqualFold(params["userhash"], "true") {
+		return "", fmt.Errorf("%w: hashed usernames are not supported", ErrInvalidProxyAuthorization)
+	}
+	if params["realm"] != s.realm() {
+		return "", ErrInvalidProxyCredentials
+	}
+	if !digestURIMatches(uri, r) {
+		return "", fmt.Errorf("%w: digest uri does not match the request", ErrInvalidProxyAuthorization)
+	}
+
+	algorithm := strings.ToUpper(params["algorithm"])
+	if algorithm == "" {
+		algorithm = credential.DigestMD5
+	}
+	base, session := strings.CutSuffix(algorithm, "-SESS")
+	if credential.DigestHash(base, "") == "" {
+		return "", fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidProxyAuthorization, params["algorithm"])
+	}
+
+	secret, ok := digests.DigestSecret(username)
+	if !ok {
+		return "", ErrInvalidProxyCredentials
+	}
+	ha1 := secret.For(base)
+	if session {
+		ha1 = credential.DigestHash(base, ha1+":"+nonce+":"+cnonce)
+	}
+	ha2 := credential.DigestHash(base, r.Method+":"+uri)
+	expected := credential.DigestHash(base, strings.Join([]string{ha1, nonce, nc, cnonce, "auth", ha2}, ":"))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(params["response"]))) != 1 {
+		return "", ErrInvalidProxyCredentials
+	}
+
+	// Only a correct response can learn that its nonce is stale, so the
+	// client knows it may retry with the same credentials.
+	if err := s.nonces.use(nonce, nc); err != nil {
+		return "", err
+	}
+	return username, nil
+}
+
+// digestURIMatches reports whether the uri of a Digest response names the
+// request target. Clients differ in whether they send the absolute URI or
+// only its path for absolute-form requests.
+func digestURIMatches(uri string, r *http.Request) bool {
+	if uri == r.RequestURI {
+		return true
+	}
+	target, err := url.Parse(r.RequestURI)
+	return err == nil && target.IsAbs() && uri == target.RequestURI()
+}
+
+// parseAuthParams parses the comma separated auth-params of a credentials
+// header (RFC 9110 section 11.2).
+func parseAuthParams(credentials string) map[string]string {
+	params := make(map[string]string)
+	for rest := strings.TrimSpace(credentials); rest != ""; {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		value = strings.TrimLeft(value, " \t")
+
+		if strings.HasPrefix(value, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(value) && value[i] != '"'; i++ {
+				if value[i] == '\\' && i+1 < len(value) {
+					i++
+				}
+				b.WriteByte(value[i])
+			}
+			params[name] = b.String()
+			rest = value[min(i+1, len(value)):]
+		} else {
+			end := strings.IndexByte(value, ',')
+			if end < 0 {
+				end = len(value)
+			}
+			params[name] = strings.TrimSpace(value[:end])
+			rest = value[end:]
+		}
+		rest = strings.TrimLeft(rest, " \t,")
+	}
+	return params
+}
+
+func quoteAuthParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+// digestNonces issues nonces that carry their creation time and a MAC, so
+// they need no server-side state until used, and remembers the nonce counts
+// already seen to reject replayed responses.
+type digestNonces struct {
+	key []byte
+
+	mu   sync.Mutex
+	seen map[string]map[string]struct{}
+}
+
+func newDigestNonces() *digestNonces {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return &digestNonces{key: key, seen: make(map[string]map[string]struct{})}
+}
+
+func (n *digestNonces) issue() string {
+	return n.sign(time.Now())
+}
+
+func (n *digestNonces) sign(issued time.Time) string {
+	buf := make([]byte, 8, 8+sha256.Size)
+	binary.BigEndian.PutUint64(buf, uint64(issued.UnixNano()))
+	mac := hmac.New(sha256.New, n.key)
+	mac.Write(buf)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(buf))
+}
+
+// use records the nonce count of a verified response. It fails for
+// nonces the proxy did not issue, expired nonces and replayed counts.
+func (n *digestNonces) use(nonce, nc string) error {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+sha256.Size {
+		return fmt.Errorf("%w: unknown nonce", ErrInvalidProxyCredentials)
+	}
+	issued := time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8])))
+	if !hmac.Equal([]byte(n.sign(issued)), []byte(nonce)) {
+		return fmt.Errorf("%w: unknown nonce", ErrInvalidProxyCredentials)
+	}
+	if time.Since(issued) > DigestNonceLifetime {
+		return errStaleNonce
+	}
+	if _, err := strconv.ParseUint(nc, 16, 32); err != nil {
+		return fmt.Errorf("%w: invalid nonce count", ErrInvalidProxyAuthorization)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	counts, ok := n.seen[nonce]
+	if !ok {
+		n.pruneLocked()
+		counts = make(map[string]struct{})
+		n.seen[nonce] = counts
+	}
+	if _, replayed := counts[strings.ToLower(nc)]; replayed {
+		return fmt.Errorf("%w: replayed nonce count", ErrInvalidProxyCredentials)
+	}
+	counts[strings.ToLower(nc)] = struct{}{}
+	return nil
+}
+
+// pruneLocked forgets nonces that can no longer be used.
+func (n *digestNonces) pruneLocked() {
+	for nonce := range n.seen {
+		raw, _ := base64.RawURLEncoding.DecodeString(nonce)
+		if time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8])))) > DigestNonceLifetime {
+			delete(n.seen, nonce)
+		}
+	}
+}
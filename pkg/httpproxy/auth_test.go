@@ -0,0 +1,217 @@
+package httpproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAuthTestServer(t *testing.T, schemes ...AuthScheme) (*Server, *credential.StaticCredentialStore, *httptest.Server) {
+	t.Helper()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	t.Cleanup(backend.Close)
+
+	store := credential.NewStaticCredentialStore()
+	store.SetDigestEnabled(slices.Contains(schemes, AuthDigest))
+	store.Add("alice", "secret")
+	logger := zerolog.New(io.Discard)
+	server := New(&Config{Logger: &logger, Credentials: store, AuthSchemes: schemes})
+	t.Cleanup(server.CloseIdleConnections)
+	return server, store, backend
+}
+
+func proxyGet(server *Server, target, authorization string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	if authorization != "" {
+		req.Header.Set("Proxy-Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	return rec
+}
+
+func digestAuthorization(username, password, realm, algorithm, nonce, nc, uri string) string {
+	base, session := strings.CutSuffix(algorithm, "-sess")
+	cnonce := "0a4f113b"
+	ha1 := credential.DigestHash(base, username+":"+realm+":"+password)
+	if session {
+		ha1 = credential.DigestHash(base, ha1+":"+nonce+":"+cnonce)
+	}
+	ha2 := credential.DigestHash(base, http.MethodGet+":"+uri)
+	response := credential.DigestHash(base, strings.Join([]string{ha1, nonce, nc, cnonce, "auth", ha2}, ":"))
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=%s, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+		username, realm, nonce, uri, algorithm, nc, cnonce, response)
+}
+
+func TestServer_RequireAuthentication_OffersEnabledSchemes(t *testing.T) {
+	server, _, backend := newAuthTestServer(t, AuthDigest, AuthBasic, AuthBearer)
+
+	rec := proxyGet(server, backend.URL, "")
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+	challenges := rec.Header().Values("Proxy-Authenticate")
+	require.Len(t, challenges, 4)
+	assert.Regexp(t, `^Digest realm="Restricted area", qop="auth", algorithm=SHA-256, nonce="[A-Za-z0-9_-]+"$`, challenges[0])
+	assert.Contains(t, challenges[1], "algorithm=MD5")
+	assert.Equal(t, `Basic realm="Restricted area"`, challenges[2])
+	assert.Equal(t, `Bearer realm="Restricted area"`, challenges[3])
+
+	basicOnly, _, _ := newAuthTestServer(t)
+	rec = proxyGet(basicOnly, backend.URL, "")
+	assert.Equal(t, []string{`Basic realm="Restricted area"`}, rec.Header().Values("Proxy-Authenticate"))
+}
+
+func TestServer_AuthenticateRequest_Digest(t *testing.T) {
+	server, _, backend := newAuthTestServer(t, AuthDigest)
+	target := backend.URL + "/path?q=1"
+
+	rec := proxyGet(server, target, "")
+	params := parseAuthParams(strings.TrimPrefix(rec.Header().Get("Proxy-Authenticate"), "Digest "))
+	nonce := params["nonce"]
+	require.NotEmpty(t, nonce)
+
+	rec = proxyGet(server, target, digestAuthorization("alice", "secret", credential.DefaultRealm, "SHA-256", nonce, "00000001", target))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+
+	// The same nonce count cannot be used twice.
+	rec = proxyGet(server, target, digestAuthorization("alice", "secret", credential.DefaultRealm, "SHA-256", nonce, "00000001", target))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	// Clients may send only the path of an absolute-form target.
+	rec = proxyGet(server, target, digestAuthorization("alice", "secret", credential.DefaultRealm, "MD5-sess", nonce, "00000002", "/path?q=1"))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = proxyGet(server, target, digestAuthorization("alice", "wrong", credential.DefaultRealm, "SHA-256", nonce, "00000003", target))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+	rec = proxyGet(server, target, digestAuthorization("alice", "secret", credential.DefaultRealm, "SHA-256", nonce, "00000004", backend.URL+"/other"))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+	rec = proxyGet(server, target, digestAuthorization("alice", "secret", credential.DefaultRealm, "SHA-256", "forged", "00000005", target))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	// Basic is not accepted unless enabled.
+	rec = proxyGet(server, target, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+}
+
+func TestServer_AuthenticateRequest_DigestStaleNonce(t *testing.T) {
+	server, _, backend := newAuthTestServer(t, AuthDigest)
+	nonce := server.nonces.sign(time.Now().Add(-DigestNonceLifetime - time.Minute))
+
+	rec := proxyGet(server, backend.URL+"/", digestAuthorization("alice", "secret", credential.DefaultRealm, "SHA-256", nonce, "00000001", backend.URL+"/"))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+	challenge := rec.Header().Get("Proxy-Authenticate")
+	assert.True(t, strings.HasSuffix(challenge, ", stale=true"), challenge)
+
+	// A wrong password does not learn that the nonce is stale.
+	rec = proxyGet(server, backend.URL+"/", digestAuthorization("alice", "wrong", credential.DefaultRealm, "SHA-256", nonce, "00000001", backend.URL+"/"))
+	assert.NotContains(t, rec.Header().Get("Proxy-Authenticate"), "stale")
+}
+
+func TestServer_AuthenticateRequest_Bearer(t *testing.T) {
+	server, store, backend := newAuthTestServer(t, AuthBasic, AuthBearer)
+	token, err := store.IssueCredential("alice", "ci", time.Time{})
+	require.NoError(t, err)
+
+	rec := proxyGet(server, backend.URL, "Bearer "+token)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = proxyGet(server, backend.URL, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:secret")))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	// A named credential also works as the password.
+	rec = proxyGet(server, backend.URL, "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:"+token)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	store.RevokeCredential("alice", "ci")
+	rec = proxyGet(server, backend.URL, "Bearer "+token)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+}
+
+func TestServer_AuthenticateRequest_Ephemeral(t *testing.T) {
+	server, store, backend := newAuthTestServer(t, AuthBasic, AuthBearer)
+	expiresAt := time.Now().Add(time.Hour)
+
+	// Destinations are enforced after authentication.
+	_, scoped, err := store.IssueEphemeral(credential.Ephemeral{User: "alice", ExpiresAt: expiresAt, Destinations: []string{"127.0.0.1"}})
+	require.NoError(t, err)
+	rec := proxyGet(server, backend.URL, "Bearer "+scoped)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = proxyGet(server, "http://example.com/", "Basic "+base64.StdEncoding.EncodeToString([]byte("alice:"+scoped)))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = proxyGet(server, backend.URL, "Basic "+base64.StdEncoding.EncodeToString([]byte("bob:"+scoped)))
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	// A spent budget ends authentication.
+	_, budgeted, err := store.IssueEphemeral(credential.Ephemeral{User: "alice", ExpiresAt: expiresAt, ByteBudget: 2})
+	require.NoError(t, err)
+	rec = proxyGet(server, backend.URL, "Bearer "+budgeted)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "ok", rec.Body.String())
+	rec = proxyGet(server, backend.URL, "Bearer "+budgeted)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+
+	_, single, err := store.IssueEphemeral(credential.Ephemeral{User: "alice", ExpiresAt: expiresAt, SingleUse: true})
+	require.NoError(t, err)
+	rec = proxyGet(server, backend.URL, "Bearer "+single)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = proxyGet(server, backend.URL, "Bearer "+single)
+	assert.Equal(t, http.StatusProxyAuthRequired, rec.Code)
+}
+
+func TestServer_AuthenticateRequest_UsernameContainsParamKey(t *testing.T) {
+	server, store, _ := newAuthTestServer(t)
+	server.config.UsernameParams = credential.NewUsernameGrammar("", nil)
+	store.Add("ops-session-bot", "bot-secret")
+
+	basic := func(username, password string) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(username+":"+password)))
+		return req
+	}
+
+	username, params, _, err := server.authenticateRequest(basic("ops-session-bot", "bot-secret"))
+	require.NoError(t, err)
+	assert.Equal(t, "ops-session-bot", username)
+	assert.Empty(t, params)
+
+	username, params, _, err = server.authenticateRequest(basic("alice-session-bot", "secret"))
+	require.NoError(t, err)
+	assert.Equal(t, "alice", username)
+	assert.Equal(t, map[string]string{"session": "bot"}, params)
+
+	_, _, _, err = server.authenticateRequest(basic("ops-session-bot", "secret"))
+	assert.ErrorIs(t, err, ErrInvalidProxyCredentials)
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`username="Mufasa", realm="a \"quoted\", realm",nc=00000001 , qop=auth, empty=""`)
+
+	assert.Equal(t, map[string]string{
+		"username": "Mufasa",
+		"realm":    `a "quoted", realm`,
+		"nc":       "00000001",
+		"qop":      "auth",
+		"empty":    "",
+	}, params)
+}
+
+func TestParseAuthScheme(t *testing.T) {
+	scheme, err := ParseAuthScheme(" Digest ")
+	require.NoError(t, err)
+	assert.Equal(t, AuthDigest, scheme)
+
+	_, err = ParseAuthScheme("ntlm")
+	assert.Error(t, err)
+}
@@ -0,0 +1,878 @@
+package httpproxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMemoryBytes    = 64 << 20
+	DefaultCacheDiskBytes      = 1 << 30
+	DefaultCacheMaxObjectBytes = 16 << 20
+)
+
+// heuristicFreshnessLimit caps the freshness a cache assigns to responses
+// without explicit expiry (RFC 9111 section 4.2.2).
+const heuristicFreshnessLimit = 24 * time.Hour
+
+const cacheFileSuffix = ".cache"
+
+// CacheConfig controls Cache. Zero values select the defaults.
+type CacheConfig struct {
+	// MemoryBytes bounds the response bodies kept in memory.
+	MemoryBytes int64
+	// Dir, when set, also keeps responses on disk, where they survive
+	// restarts, up to DiskBytes.
+	Dir       string
+	DiskBytes int64
+	// MaxObjectBytes is the largest response body that is cached.
+	MaxObjectBytes int64
+}
+
+// CacheStats are counters reported by Cache. Revalidated counts stale
+// responses the destination confirmed to be unchanged, which are served
+// from the cache like hits.
+type CacheStats struct {
+	Hits        uint64
+	Revalidated uint64
+	Misses      uint64
+	Evictions   uint64
+	Entries     int
+	MemoryBytes int64
+	DiskBytes   int64
+}
+
+// cacheResult is how the cache took part in answering a request.
+type cacheResult string
+
+const (
+	cacheBypass      cacheResult = ""
+	cacheMiss        cacheResult = "miss"
+	cacheHit         cacheResult = "hit"
+	cacheRevalidated cacheResult = "revalidated"
+)
+
+// served reports whether the response body came from the cache.
+func (r cacheResult) served() bool {
+	return r == cacheHit || r == cacheRevalidated
+}
+
+// cacheMeta is what is stored about a response besides its body.
+type cacheMeta struct {
+	Key          string      `json:"key"`
+	URL          string      `json:"url"`
+	Vary         []string    `json:"vary,omitempty"`
+	StatusCode   int         `json:"status_code"`
+	Header       http.Header `json:"header"`
+	RequestTime  time.Time   `json:"request_time"`
+	ResponseTime time.Time   `json:"response_time"`
+	Size         int64       `json:"size"`
+}
+
+type cacheEntry struct {
+	meta cacheMeta
+	// body is nil while the entry is only on disk.
+	body     []byte
+	memElem  *list.Element
+	diskElem *list.Element
+}
+
+// cachedURL tracks the variants stored for one URL and the request headers
+// they vary on (RFC 9111 section 4.1).
+type cachedURL struct {
+	vary []string
+	keys map[string]struct{}
+}
+
+// Cache is a shared HTTP cache (RFC 9111) for plain HTTP responses. Bodies
+// are kept in a memory LRU and, when a directory is configured, in a disk
+// LRU as well.
+type Cache struct {
+	config CacheConfig
+	now    func() time.Time
+
+	mu          sync.Mutex
+	entries     map[string]*cacheEntry
+	urls        map[string]*cachedURL
+	memory      *list.List
+	disk        *list.List
+	memoryBytes int64
+	diskBytes   int64
+	stats       CacheStats
+}
+
+// NewCache creates a cache and loads the responses kept in conf.Dir.
+func NewCache(conf CacheConfig) (*Cache, error) {
+	if conf.MemoryBytes <= 0 {
+		conf.MemoryBytes = DefaultCacheMemoryBytes
+	}
+	if conf.DiskBytes <= 0 {
+		conf.DiskBytes = DefaultCacheDiskBytes
+	}
+	if conf.MaxObjectBytes <= 0 {
+		conf.MaxObjectBytes = DefaultCacheMaxObjectBytes
+	}
+
+	c := &Cache{
+		config:  conf,
+		now:     time.Now,
+		entries: make(map[string]*cacheEntry),
+		urls:    make(map[string]*cachedURL),
+		memory:  list.New(),
+		disk:    list.New(),
+	}
+	if conf.Dir != "" {
+		if err := os.MkdirAll(conf.Dir, 0o750); err != nil {
+			return nil, err
+		}
+		if err := c.loadDisk(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// loadDisk indexes the responses stored in the cache directory, the most
+// recently written first.
+func (c *Cache) loadDisk() error {
+	files, err := filepath.Glob(filepath.Join(c.config.Dir, "*"+cacheFileSuffix))
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		meta    cacheMeta
+		modTime time.Time
+	}
+	var loaded []stored
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		meta, err := readCacheMeta(file)
+		if err != nil || c.cacheFile(meta.Key) != file {
+			_ = os.Remove(file)
+			continue
+		}
+		loaded = append(loaded, stored{meta: meta, modTime: info.ModTime()})
+	}
+	sort.Slice(loaded, func(i, j int) bool { return loaded[i].modTime.Before(loaded[j].modTime) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, s := range loaded {
+		entry := &cacheEntry{meta: s.meta}
+		c.addLocked(entry)
+		entry.diskElem = c.disk.PushFront(entry)
+		c.diskBytes += entry.meta.Size
+	}
+	c.evictDiskLocked()
+	return nil
+}
+
+// roundTrip answers req from the cache where RFC 9111 allows it, and
+// otherwise sends it with next and stores the response if it may be reused.
+func (c *Cache) roundTrip(req *http.Request, next func(*http.Request) (*http.Response, error)) (*http.Response, cacheResult, error) {
+	if req.Method != http.MethodGet {
+		resp, err := next(req)
+		if err == nil && !isSafeMethod(req.Method) && resp.StatusCode < http.StatusBadRequest {
+			// Unsafe requests that succeeded may have changed the resource
+			// (RFC 9111 section 4.4).
+			c.invalidate(req.URL, resp)
+		}
+		return resp, cacheBypass, err
+	}
+
+	requestDirectives := parseCacheControl(req.Header)
+	if _, ok := requestDirectives["no-store"]; ok || req.Header.Get("Range") != "" {
+		resp, err := next(req)
+		return resp, cacheBypass, err
+	}
+
+	key := cacheURL(req.URL)
+	entry, body := c.lookup(key, req.Header)
+	if entry != nil {
+		now := c.now()
+		age := currentAge(entry.meta, now)
+		if isFresh(entry.meta, requestDirectives, req.Header, age) {
+			c.count(func(stats *CacheStats) { stats.Hits++ })
+			return cachedResponse(req, entry.meta, body, age), cacheHit, nil
+		}
+
+		if conditional := validationRequest(req, entry.meta); conditional != nil {
+			requestTime := c.now()
+			resp, err := next(conditional)
+			if err != nil {
+				return nil, cacheMiss, err
+			}
+			if resp.StatusCode == http.StatusNotModified {
+				_ = resp.Body.Close()
+				meta := c.freshen(entry, resp, requestTime, c.now())
+				c.count(func(stats *CacheStats) { stats.Revalidated++ })
+				return cachedResponse(req, meta, body, currentAge(meta, c.now())), cacheRevalidated, nil
+			}
+			c.count(func(stats *CacheStats) { stats.Misses++ })
+			return c.fill(req, resp, requestTime), cacheMiss, nil
+		}
+	}
+
+	requestTime := c.now()
+	resp, err := next(req)
+	c.count(func(stats *CacheStats) { stats.Misses++ })
+	if err != nil {
+		return nil, cacheMiss, err
+	}
+	return c.fill(req, resp, requestTime), cacheMiss, nil
+}
+
+// lookup returns the variant of key selected by header, and its body.
+func (c *Cache) lookup(key string, header http.Header) (*cacheEntry, []byte) {
+	c.mu.Lock()
+	cached, ok := c.urls[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	entry := c.entries[variantKey(key, cached.vary, header)]
+	if entry == nil {
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if entry.memElem != nil {
+		c.memory.MoveToFront(entry.memElem)
+	}
+	if entry.diskElem != nil {
+		c.disk.MoveToFront(entry.diskElem)
+	}
+	snapshot := &cacheEntry{meta: entry.meta}
+	snapshot.meta.Header = entry.meta.Header.Clone()
+	body := entry.body
+	c.mu.Unlock()
+
+	if body != nil {
+		return snapshot, body
+	}
+	body, err := readCacheBody(c.cacheFile(snapshot.meta.Key))
+	if err != nil {
+		c.remove(snapshot.meta.Key)
+		return nil, nil
+	}
+
+	// Responses read from disk are kept in memory while they are in use.
+	c.mu.Lock()
+	if current := c.entries[snapshot.meta.Key]; current == entry && entry.memElem == nil {
+		entry.body = body
+		entry.memElem = c.memory.PushFront(entry)
+		c.memoryBytes += entry.meta.Size
+		c.evictMemoryLocked()
+	}
+	c.mu.Unlock()
+	return snapshot, body
+}
+
+// fill returns resp with a body that stores the response once it has been
+// read completely, if it may be cached.
+func (c *Cache) fill(req *http.Request, resp *http.Response, requestTime time.Time) *http.Response {
+	vary, ok := storable(req, resp)
+	if !ok || resp.ContentLength > c.config.MaxObjectBytes {
+		return resp
+	}
+
+	key := cacheURL(req.URL)
+	meta := cacheMeta{
+		Key:          variantKey(key, vary, req.Header),
+		URL:          key,
+		Vary:         vary,
+		StatusCode:   resp.StatusCode,
+		Header:       resp.Header.Clone(),
+		RequestTime:  requestTime,
+		ResponseTime: c.now(),
+	}
+	// A response that is never fresh and cannot be validated is of no use.
+	if freshnessLifetime(meta) <= 0 && meta.Header.Get("ETag") == "" && meta.Header.Get("Last-Modified") == "" {
+		return resp
+	}
+	resp.Body = &cacheFill{
+		ReadCloser: resp.Body,
+		limit:      c.config.MaxObjectBytes,
+		length:     resp.ContentLength,
+		commit: func(body []byte) {
+			meta.Size = int64(len(body))
+			c.store(meta, body)
+		},
+	}
+	return resp
+}
+
+// store adds a response, replacing the one stored under the same key.
+// With a cache directory it is written to disk first, so a body too large
+// for memory can still be kept.
+func (c *Cache) store(meta cacheMeta, body []byte) {
+	onDisk := c.config.Dir != "" && meta.Size <= c.config.DiskBytes &&
+		writeCacheFile(c.cacheFile(meta.Key), meta, body) == nil
+	entry := &cacheEntry{meta: meta}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old := c.entries[meta.Key]; old != nil {
+		// The file, if any, already holds the new response.
+		c.unlinkLocked(old)
+	}
+	c.addLocked(entry)
+	if onDisk {
+		entry.diskElem = c.disk.PushFront(entry)
+		c.diskBytes += meta.Size
+	}
+	if meta.Size <= c.config.MemoryBytes {
+		entry.body = body
+		entry.memElem = c.memory.PushFront(entry)
+		c.memoryBytes += meta.Size
+	}
+	switch {
+	case entry.memElem == nil && entry.diskElem == nil:
+		c.unlinkLocked(entry)
+	default:
+		c.evictMemoryLocked()
+		c.evictDiskLocked()
+	}
+}
+
+// freshen updates a stored response with the header fields of the 304
+// response that validated it (RFC 9111 section 4.3.4) and returns the
+// updated metadata.
+func (c *Cache) freshen(entry *cacheEntry, resp *http.Response, requestTime, responseTime time.Time) cacheMeta {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stored := c.entries[entry.meta.Key]
+	if stored == nil {
+		stored = entry
+	}
+	for key, values := range resp.Header {
+		switch http.CanonicalHeaderKey(key) {
+		case "Content-Length", "Content-Encoding", "Content-Range", "Transfer-Encoding":
+			continue
+		}
+		stored.meta.Header[key] = values
+	}
+	stored.meta.RequestTime = requestTime
+	stored.meta.ResponseTime = responseTime
+
+	meta := stored.meta
+	meta.Header = stored.meta.Header.Clone()
+	return meta
+}
+
+// invalidate removes the responses for the target of an unsafe request and
+// the same-origin URLs in its Location and Content-Location headers.
+func (c *Cache) invalidate(target *url.URL, resp *http.Response) {
+	targets := []string{cacheURL(target)}
+	for _, header := range []string{"Location", "Content-Location"} {
+		if value := resp.Header.Get(header); value != "" {
+			if ref, err := target.Parse(value); err == nil && strings.EqualFold(ref.Host, target.Host) {
+				targets = append(targets, cacheURL(ref))
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range targets {
+		if cached, ok := c.urls[key]; ok {
+			for variant := range cached.keys {
+				c.deleteLocked(c.entries[variant])
+			}
+		}
+	}
+}
+
+func (c *Cache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry := c.entries[key]; entry != nil {
+		c.deleteLocked(entry)
+	}
+}
+
+// Flush drops every cached response.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, entry := range c.entries {
+		c.deleteLocked(entry)
+	}
+}
+
+// Stats returns the cache counters.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.MemoryBytes = c.memoryBytes
+	stats.DiskBytes = c.diskBytes
+	return stats
+}
+
+func (c *Cache) count(update func(stats *CacheStats)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	update(&c.stats)
+}
+
+func (c *Cache) addLocked(entry *cacheEntry) {
+	c.entries[entry.meta.Key] = entry
+	cached, ok := c.urls[entry.meta.URL]
+	if !ok {
+		cached = &cachedURL{keys: make(map[string]struct{})}
+		c.urls[entry.meta.URL] = cached
+	}
+	cached.vary = entry.meta.Vary
+	cached.keys[entry.meta.Key] = struct{}{}
+}
+
+// deleteLocked removes an entry and its file.
+func (c *Cache) deleteLocked(entry *cacheEntry) {
+	if entry.diskElem != nil {
+		_ = os.Remove(c.cacheFile(entry.meta.Key))
+	}
+	c.unlinkLocked(entry)
+}
+
+// unlinkLocked removes an entry but leaves its file alone.
+func (c *Cache) unlinkLocked(entry *cacheEntry) {
+	if entry.memElem != nil {
+		c.memory.Remove(entry.memElem)
+		c.memoryBytes -= entry.meta.Size
+		entry.memElem, entry.body = nil, nil
+	}
+	if entry.diskElem != nil {
+		c.disk.Remove(entry.diskElem)
+		c.diskBytes -= entry.meta.Size
+		entry.diskElem = nil
+	}
+	delete(c.entries, entry.meta.Key)
+	if cached, ok := c.urls[entry.meta.URL]; ok {
+		delete(cached.keys, entry.meta.Key)
+		if len(cached.keys) == 0 {
+			delete(c.urls, entry.meta.URL)
+		}
+	}
+}
+
+// evictMemoryLocked drops the least recently used bodies from memory until
+// they fit. Entries also on disk stay cached.
+func (c *Cache) evictMemoryLocked() {
+	for c.memoryBytes > c.config.MemoryBytes {
+		entry := c.memory.Back().Value.(*cacheEntry)
+		if entry.diskElem == nil {
+			c.deleteLocked(entry)
+			c.stats.Evictions++
+			continue
+		}
+		c.memory.Remove(entry.memElem)
+		c.memoryBytes -= entry.meta.Size
+		entry.memElem, entry.body = nil, nil
+	}
+}
+
+func (c *Cache) evictDiskLocked() {
+	for c.diskBytes > c.config.DiskBytes {
+		entry := c.disk.Back().Value.(*cacheEntry)
+		if entry.memElem == nil {
+			c.deleteLocked(entry)
+			c.stats.Evictions++
+			continue
+		}
+		c.disk.Remove(entry.diskElem)
+		c.diskBytes -= entry.meta.Size
+		entry.diskElem = nil
+		_ = os.Remove(c.cacheFile(entry.meta.Key))
+	}
+}
+
+func (c *Cache) cacheFile(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.config.Dir, hex.EncodeToString(sum[:])+cacheFileSuffix)
+}
+
+// cacheFill stores a response once its body was read to the end. Bodies
+// that are cut short or outgrow the limit are not stored.
+type cacheFill struct {
+	io.ReadCloser
+	limit  int64
+	length int64
+	buf    bytes.Buffer
+	failed bool
+	commit func(body []byte)
+}
+
+func (f *cacheFill) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if f.failed {
+		return n, err
+	}
+	if int64(f.buf.Len()+n) > f.limit {
+		f.failed = true
+		f.buf = bytes.Buffer{}
+		return n, err
+	}
+	f.buf.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		f.failed = true
+		if f.length < 0 || f.length == int64(f.buf.Len()) {
+			f.commit(append([]byte{}, f.buf.Bytes()...))
+		}
+		f.buf = bytes.Buffer{}
+	}
+	return n, err
+}
+
+// cacheableStatus are the status codes whose responses are stored, the
+// ones RFC 9110 section 15.1 defines as heuristically cacheable.
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// storable reports whether a shared cache may store resp (RFC 9111 section
+// 3) and returns the request headers it varies on.
+func storable(req *http.Request, resp *http.Response) ([]string, bool) {
+	if !cacheableStatus[resp.StatusCode] {
+		return nil, false
+	}
+	directives := parseCacheControl(resp.Header)
+	_, noStore := directives["no-store"]
+	_, private := directives["private"]
+	if noStore || private {
+		return nil, false
+	}
+	// Cookies are specific to the client that received them.
+	if resp.Header.Get("Set-Cookie") != "" {
+		return nil, false
+	}
+	// A request carrying cookies usually gets a response personalised for
+	// that client, even when the origin forgets to mark it private.
+	if req.Header.Get("Cookie") != "" {
+		if _, public := directives["public"]; !public {
+			return nil, false
+		}
+	}
+	if req.Header.Get("Authorization") != "" {
+		_, public := directives["public"]
+		_, sMaxAge := directives["s-maxage"]
+		_, mustRevalidate := directives["must-revalidate"]
+		if !public && !sMaxAge && !mustRevalidate {
+			return nil, false
+		}
+	}
+
+	var vary []string
+	for _, value := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				vary = append(vary, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// isFresh reports whether a stored response may be served without
+// validation, given the request's directives.
+func isFresh(meta cacheMeta, requestDirectives map[string]string, requestHeader http.Header, age time.Duration) bool {
+	if _, ok := requestDirectives["no-cache"]; ok {
+		return false
+	}
+	if len(requestDirectives) == 0 && strings.EqualFold(requestHeader.Get("Pragma"), "no-cache") {
+		return false
+	}
+	if _, ok := parseCacheControl(meta.Header)["no-cache"]; ok {
+		return false
+	}
+
+	lifetime := freshnessLifetime(meta)
+	if maxAge, ok := directiveSeconds(requestDirectives, "max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := directiveSeconds(requestDirectives, "min-fresh"); ok && lifetime-age < minFresh {
+		return false
+	}
+	return age < lifetime
+}
+
+// freshnessLifetime follows RFC 9111 section 4.2.1.
+func freshnessLifetime(meta cacheMeta) time.Duration {
+	directives := parseCacheControl(meta.Header)
+	if sMaxAge, ok := directiveSeconds(directives, "s-maxage"); ok {
+		return sMaxAge
+	}
+	if maxAge, ok := directiveSeconds(directives, "max-age"); ok {
+		return maxAge
+	}
+	date := responseDate(meta)
+	if expires := meta.Header.Get("Expires"); expires != "" {
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil {
+			return 0
+		}
+		return expiresAt.Sub(date)
+	}
+	if lastModified, err := http.ParseTime(meta.Header.Get("Last-Modified")); err == nil && lastModified.Before(date) {
+		return min(date.Sub(lastModified)/10, heuristicFreshnessLimit)
+	}
+	return 0
+}
+
+// currentAge follows RFC 9111 section 4.2.3.
+func currentAge(meta cacheMeta, now time.Time) time.Duration {
+	apparentAge := max(0, meta.ResponseTime.Sub(responseDate(meta)))
+	ageValue, _ := strconv.ParseInt(strings.TrimSpace(meta.Header.Get("Age")), 10, 64)
+	correctedAge := time.Duration(max(0, ageValue))*time.Second + meta.ResponseTime.Sub(meta.RequestTime)
+	return max(apparentAge, correctedAge) + now.Sub(meta.ResponseTime)
+}
+
+func responseDate(meta cacheMeta) time.Time {
+	if date, err := http.ParseTime(meta.Header.Get("Date")); err == nil {
+		return date
+	}
+	return meta.ResponseTime
+}
+
+// validationRequest turns req into a conditional request for a stale
+// response, or returns nil if the response has no validators.
+func validationRequest(req *http.Request, meta cacheMeta) *http.Request {
+	etag, lastModified := meta.Header.Get("ETag"), meta.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return nil
+	}
+	conditional := req.Clone(req.Context())
+	for _, header := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		conditional.Header.Del(header)
+	}
+	if etag != "" {
+		conditional.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		conditional.Header.Set("If-Modified-Since", lastModified)
+	}
+	return conditional
+}
+
+// notModifiedHeaders are sent with a 304 generated from a stored response
+// (RFC 9110 section 15.4.5).
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// cachedResponse builds the response to req from a stored one, answering
+// the client's own conditional request where it matches.
+func cachedResponse(req *http.Request, meta cacheMeta, body []byte, age time.Duration) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", meta.StatusCode, http.StatusText(meta.StatusCode)),
+		StatusCode:    meta.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        meta.Header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+	if meta.StatusCode == http.StatusOK && notModified(req.Header, meta.Header) {
+		header := make(http.Header, len(notModifiedHeaders))
+		for _, key := range notModifiedHeaders {
+			if values := meta.Header.Values(key); len(values) > 0 {
+				header[key] = values
+			}
+		}
+		resp.Status, resp.StatusCode = "304 Not Modified", http.StatusNotModified
+		resp.Header, resp.Body, resp.ContentLength = header, http.NoBody, 0
+	}
+	resp.Header.Set("Age", strconv.FormatInt(int64(age/time.Second), 10))
+	return resp
+}
+
+// notModified evaluates If-None-Match and If-Modified-Since against a
+// stored response (RFC 9110 section 13.2.2).
+func notModified(requestHeader, responseHeader http.Header) bool {
+	if ifNoneMatch := requestHeader.Get("If-None-Match"); ifNoneMatch != "" {
+		etag := strings.TrimPrefix(responseHeader.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(ifNoneMatch, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ifModifiedSince, err := http.ParseTime(requestHeader.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(responseHeader.Get("Last-Modified"))
+	return err == nil && !lastModified.After(ifModifiedSince)
+}
+
+// parseCacheControl returns the Cache-Control directives of header with
+// lowercase names and unquoted values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	return directives
+}
+
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	value, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		// Invalid values are treated as already expired.
+		return 0, true
+	}
+	return time.Duration(min(seconds, int64(1<<31))) * time.Second, true
+}
+
+// cacheURL is the primary cache key of a request target.
+func cacheURL(target *url.URL) string {
+	key := *target
+	key.Scheme = strings.ToLower(key.Scheme)
+	key.Host = strings.ToLower(key.Host)
+	key.Fragment, key.RawFragment = "", ""
+	if key.Path == "" {
+		key.Path = "/"
+	}
+	return key.String()
+}
+
+// variantKey identifies the variant of url selected by the values of the
+// vary headers in header.
+func variantKey(url string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return url
+	}
+	var b strings.Builder
+	b.WriteString(url)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// writeCacheFile stores a response as the length of its JSON metadata, the
+// metadata and the body. It is written to a temporary file first so that
+// readers never see a partial one.
+func writeCacheFile(path string, meta cacheMeta, body []byte) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	for _, part := range [][]byte{size[:], data, body} {
+		if _, err := tmp.Write(part); err != nil {
+			_ = tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func readCacheMeta(path string) (cacheMeta, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return cacheMeta{}, err
+	}
+	defer file.Close()
+
+	var size [4]byte
+	if _, err := io.ReadFull(file, size[:]); err != nil {
+		return cacheMeta{}, err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := io.ReadFull(file, data); err != nil {
+		return cacheMeta{}, err
+	}
+	var meta cacheMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return cacheMeta{}, err
+	}
+	return meta, nil
+}
+
+func readCacheBody(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	offset := 4 + int64(binary.BigEndian.Uint32(data[:4]))
+	if offset > int64(len(data)) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return data[offset:], nil
+}
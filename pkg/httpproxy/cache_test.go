@@ -0,0 +1,309 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cacheOrigin answers cache round trips with handler and counts them.
+type cacheOrigin struct {
+	t        *testing.T
+	requests []*http.Request
+	handler  func(req *http.Request) *http.Response
+}
+
+func (o *cacheOrigin) next(req *http.Request) (*http.Response, error) {
+	o.requests = append(o.requests, req)
+	resp := o.handler(req)
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	return resp, nil
+}
+
+func (o *cacheOrigin) get(c *Cache, header http.Header) (*http.Response, cacheResult, string) {
+	o.t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	resp, result, err := c.roundTrip(req, o.next)
+	require.NoError(o.t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(o.t, err)
+	require.NoError(o.t, resp.Body.Close())
+	return resp, result, string(body)
+}
+
+func originResponse(status int, header http.Header, body string) *http.Response {
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func newTestCache(t *testing.T, conf CacheConfig) (*Cache, *time.Time) {
+	t.Helper()
+	c, err := NewCache(conf)
+	require.NoError(t, err)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func TestCache_FreshnessAndAge(t *testing.T) {
+	c, now := newTestCache(t, CacheConfig{})
+	origin := &cacheOrigin{t: t, handler: func(*http.Request) *http.Response {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "hello")
+	}}
+
+	_, result, body := origin.get(c, nil)
+	assert.Equal(t, cacheMiss, result)
+	assert.Equal(t, "hello", body)
+
+	*now = now.Add(10 * time.Second)
+	resp, result, body := origin.get(c, nil)
+	assert.Equal(t, cacheHit, result)
+	assert.Equal(t, "hello", body)
+	assert.Equal(t, "10", resp.Header.Get("Age"))
+	assert.Len(t, origin.requests, 1)
+
+	// Request directives can ask for a fresher response.
+	_, result, _ = origin.get(c, http.Header{"Cache-Control": {"max-age=5"}})
+	assert.Equal(t, cacheMiss, result)
+	_, result, _ = origin.get(c, http.Header{"Pragma": {"no-cache"}})
+	assert.Equal(t, cacheMiss, result)
+
+	*now = now.Add(2 * time.Minute)
+	_, result, _ = origin.get(c, nil)
+	assert.Equal(t, cacheMiss, result)
+	assert.Len(t, origin.requests, 4)
+
+	stats := c.Stats()
+	assert.EqualValues(t, 1, stats.Hits)
+	assert.EqualValues(t, 4, stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+	assert.EqualValues(t, 5, stats.MemoryBytes)
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	c, now := newTestCache(t, CacheConfig{})
+	origin := &cacheOrigin{t: t, handler: func(req *http.Request) *http.Response {
+		if req.Header.Get("If-None-Match") == `"v1"` {
+			return originResponse(http.StatusNotModified, http.Header{"Cache-Control": {"max-age=30"}, "X-Checked": {"yes"}}, "")
+		}
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}}, "body")
+	}}
+
+	origin.get(c, nil)
+	resp, result, body := origin.get(c, nil)
+	assert.Equal(t, cacheRevalidated, result)
+	assert.Equal(t, "body", body)
+	assert.Equal(t, "yes", resp.Header.Get("X-Checked"))
+	require.Len(t, origin.requests, 2)
+	assert.Equal(t, `"v1"`, origin.requests[1].Header.Get("If-None-Match"))
+
+	// The 304 made the response fresh again.
+	*now = now.Add(10 * time.Second)
+	_, result, _ = origin.get(c, nil)
+	assert.Equal(t, cacheHit, result)
+	assert.Len(t, origin.requests, 2)
+
+	// Conditional requests from the client are answered from the cache.
+	resp, result, body = origin.get(c, http.Header{"If-None-Match": {`W/"v1"`}})
+	assert.Equal(t, cacheHit, result)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	assert.Empty(t, body)
+	assert.EqualValues(t, 1, c.Stats().Revalidated)
+}
+
+func TestCache_Vary(t *testing.T) {
+	c, _ := newTestCache(t, CacheConfig{})
+	origin := &cacheOrigin{t: t, handler: func(req *http.Request) *http.Response {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"accept-language"}}, req.Header.Get("Accept-Language"))
+	}}
+
+	_, _, body := origin.get(c, http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, "en", body)
+	_, result, body := origin.get(c, http.Header{"Accept-Language": {"de"}})
+	assert.Equal(t, cacheMiss, result)
+	assert.Equal(t, "de", body)
+	_, result, body = origin.get(c, http.Header{"Accept-Language": {"en"}})
+	assert.Equal(t, cacheHit, result)
+	assert.Equal(t, "en", body)
+	assert.Equal(t, 2, c.Stats().Entries)
+}
+
+func TestCache_DoesNotStore(t *testing.T) {
+	for name, tc := range map[string]struct {
+		request  http.Header
+		response http.Header
+		status   int
+	}{
+		"no-store":        {response: http.Header{"Cache-Control": {"no-store, max-age=60"}}},
+		"private":         {response: http.Header{"Cache-Control": {"private, max-age=60"}}},
+		"set-cookie":      {response: http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"id=1"}}},
+		"vary-star":       {response: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}},
+		"no-freshness":    {response: http.Header{}},
+		"status":          {response: http.Header{"Cache-Control": {"max-age=60"}}, status: http.StatusInternalServerError},
+		"authorization":   {request: http.Header{"Authorization": {"Basic Zm9vOmJhcg=="}}, response: http.Header{"Cache-Control": {"max-age=60"}}},
+		"cookie":          {request: http.Header{"Cookie": {"session=1"}}, response: http.Header{"Cache-Control": {"max-age=60"}}},
+		"request-nostore": {request: http.Header{"Cache-Control": {"no-store"}}, response: http.Header{"Cache-Control": {"max-age=60"}}},
+		"range":           {request: http.Header{"Range": {"bytes=0-1"}}, response: http.Header{"Cache-Control": {"max-age=60"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			c, _ := newTestCache(t, CacheConfig{})
+			origin := &cacheOrigin{t: t, handler: func(*http.Request) *http.Response {
+				status := tc.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				return originResponse(status, tc.response.Clone(), "data")
+			}}
+			origin.get(c, tc.request)
+			assert.Zero(t, c.Stats().Entries)
+		})
+	}
+}
+
+func TestCache_StoresPublicResponseToCookieRequest(t *testing.T) {
+	c, _ := newTestCache(t, CacheConfig{})
+	origin := &cacheOrigin{t: t, handler: func(*http.Request) *http.Response {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"public, max-age=60"}}, "data")
+	}}
+	origin.get(c, http.Header{"Cookie": {"session=1"}})
+	assert.Equal(t, 1, c.Stats().Entries)
+}
+
+func TestCache_LimitsAndInvalidation(t *testing.T) {
+	c, _ := newTestCache(t, CacheConfig{MemoryBytes: 10, MaxObjectBytes: 8})
+	body := "12345"
+	origin := &cacheOrigin{t: t, handler: func(req *http.Request) *http.Response {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, body)
+	}}
+	get := func(path string) cacheResult {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		resp, result, err := c.roundTrip(req, origin.next)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return result
+	}
+
+	get("/a")
+	get("/b")
+	get("/c")
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.EqualValues(t, 1, stats.Evictions)
+	assert.Equal(t, cacheMiss, get("/a"))
+	assert.Equal(t, cacheHit, get("/c"))
+
+	body = "123456789"
+	get("/large")
+	assert.Equal(t, cacheMiss, get("/large"))
+
+	req := httptest.NewRequest(http.MethodPost, "http://example.com/c", strings.NewReader("x"))
+	_, result, err := c.roundTrip(req, origin.next)
+	require.NoError(t, err)
+	assert.Equal(t, cacheBypass, result)
+	body = "12345"
+	assert.Equal(t, cacheMiss, get("/c"))
+
+	c.Flush()
+	assert.Zero(t, c.Stats().Entries)
+	assert.Zero(t, c.Stats().MemoryBytes)
+}
+
+func TestCache_IncompleteBodyIsNotStored(t *testing.T) {
+	c, _ := newTestCache(t, CacheConfig{})
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	resp, _, err := c.roundTrip(req, func(*http.Request) (*http.Response, error) {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, "partial body"), nil
+	})
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = resp.Body.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Zero(t, c.Stats().Entries)
+}
+
+func TestCache_Disk(t *testing.T) {
+	dir := t.TempDir()
+	c, _ := newTestCache(t, CacheConfig{Dir: dir, MemoryBytes: 4})
+	origin := &cacheOrigin{t: t, handler: func(*http.Request) *http.Response {
+		return originResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=600"}}, "on disk")
+	}}
+	origin.get(c, nil)
+
+	// The body does not fit in memory but stays cached on disk.
+	stats := c.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Zero(t, stats.MemoryBytes)
+	assert.EqualValues(t, 7, stats.DiskBytes)
+	_, result, body := origin.get(c, nil)
+	assert.Equal(t, cacheHit, result)
+	assert.Equal(t, "on disk", body)
+
+	// Stored responses survive a restart.
+	restarted, _ := newTestCache(t, CacheConfig{Dir: dir})
+	assert.Equal(t, 1, restarted.Stats().Entries)
+	_, result, body = origin.get(restarted, nil)
+	assert.Equal(t, cacheHit, result)
+	assert.Equal(t, "on disk", body)
+	assert.Len(t, origin.requests, 1)
+
+	restarted.Flush()
+	again, _ := newTestCache(t, CacheConfig{Dir: dir})
+	assert.Zero(t, again.Stats().Entries)
+}
+
+func TestServer_HandleHTTP_Cache(t *testing.T) {
+	var hits int
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "cached body")
+	}))
+	defer backend.Close()
+
+	cache, err := NewCache(CacheConfig{})
+	require.NoError(t, err)
+	tracker := traffic.NewTracker()
+	logger := zerolog.New(io.Discard)
+	server := New(&Config{Logger: &logger, Cache: cache, Tracker: tracker})
+	defer server.CloseIdleConnections()
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, backend.URL+"/", nil)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "cached body", rec.Body.String())
+		if i == 1 {
+			age, err := strconv.Atoi(rec.Header().Get("Age"))
+			require.NoError(t, err)
+			assert.GreaterOrEqual(t, age, 0)
+		}
+	}
+	assert.Equal(t, 1, hits)
+
+	totals := tracker.TotalsByUser()["anonymous"]
+	assert.EqualValues(t, 22, totals.DownloadBytes)
+	assert.EqualValues(t, 11, totals.CachedBytes)
+}
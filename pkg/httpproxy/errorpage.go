@@ -0,0 +1,327 @@
+package httpproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/outboundtls"
+)
+
+//go:embed templates/*.gohtml
+var errorTemplatesFS embed.FS
+
+// proxyStatusName identifies the proxy in Proxy-Status headers.
+const proxyStatusName = "nanoproxy"
+
+// ErrorPage is the data error page templates are rendered with.
+type ErrorPage struct {
+	Status     int
+	StatusText string
+	// Category is a short description of the failure, such as "DNS
+	// failure" or "Blocked by routing policy".
+	Category string
+	Message  string
+	// Destination is the host or URL the client asked for, if known.
+	Destination string
+	// ErrorType is the RFC 9209 error type sent in the Proxy-Status header.
+	ErrorType string
+	RequestID string
+}
+
+// ErrorPages renders the pages sent for proxy failures. The template named
+// after the status code, such as "502.gohtml", is used when there is one
+// and "error.gohtml" otherwise.
+type ErrorPages struct {
+	tmpl *template.Template
+}
+
+// defaultErrorPages are the built-in pages, used when Config.ErrorPages is
+// nil.
+var defaultErrorPages = &ErrorPages{tmpl: template.Must(parseBuiltinErrorPages())}
+
+func parseBuiltinErrorPages() (*template.Template, error) {
+	return template.ParseFS(errorTemplatesFS, "templates/*.gohtml")
+}
+
+// NewErrorPages loads the built-in error page templates and the templates
+// in dir, which replace the built-in ones of the same name. An empty dir
+// keeps the built-in templates.
+func NewErrorPages(dir string) (*ErrorPages, error) {
+	tmpl, err := parseBuiltinErrorPages()
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return &ErrorPages{tmpl: tmpl}, nil
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.gohtml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no error page templates in %s", dir)
+	}
+	if tmpl, err = tmpl.ParseFiles(files...); err != nil {
+		return nil, fmt.Errorf("parse error page templates: %w", err)
+	}
+	return &ErrorPages{tmpl: tmpl}, nil
+}
+
+// write answers a request with the page for e. Clients that do not accept
+// HTML, and templates that fail to render, get plain text.
+func (p *ErrorPages) write(w http.ResponseWriter, r *http.Request, e proxyError) {
+	page := ErrorPage{
+		Status:      e.status,
+		StatusText:  http.StatusText(e.status),
+		Category:    e.category,
+		Message:     e.message,
+		Destination: e.destination,
+		ErrorType:   e.errorType,
+		RequestID:   requestIDOf(r),
+	}
+	w.Header().Set("Proxy-Status", e.proxyStatus())
+	w.Header().Set("X-Request-Id", page.RequestID)
+
+	if p != nil && acceptsHTML(r) {
+		tmpl := p.tmpl.Lookup(strconv.Itoa(e.status) + ".gohtml")
+		if tmpl == nil {
+			tmpl = p.tmpl.Lookup("error.gohtml")
+		}
+		var body bytes.Buffer
+		if tmpl != nil && tmpl.Execute(&body, page) == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(e.status)
+			_, _ = w.Write(body.Bytes())
+			return
+		}
+	}
+
+	http.Error(w, e.message+"\nRequest ID: "+page.RequestID, e.status)
+}
+
+func acceptsHTML(r *http.Request) bool {
+	return r != nil && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// RFC 9209 error types.
+const (
+	errorDNSTimeout             = "dns_timeout"
+	errorDNSError               = "dns_error"
+	errorDestinationUnavailable = "destination_unavailable"
+	errorConnectionRefused      = "connection_refused"
+	errorConnectionTerminated   = "connection_terminated"
+	errorConnectionTimeout      = "connection_timeout"
+	errorConnectionReadTimeout  = "connection_read_timeout"
+	errorConnectionWriteTimeout = "connection_write_timeout"
+	errorHTTPRequestError       = "http_request_error"
+	errorHTTPRequestDenied      = "http_request_denied"
+	errorHTTPResponseIncomplete = "http_response_incomplete"
+	errorHTTPUpgradeFailed      = "http_upgrade_failed"
+	errorProxyInternalError     = "proxy_internal_error"
+	errorTLSProtocolError       = "tls_protocol_error"
+	errorTLSCertificateError    = "tls_certificate_error"
+	errorTLSAlertReceived       = "tls_alert_received"
+)
+
+// proxyError is a failure the proxy answers with an error page.
+type proxyError struct {
+	status      int
+	errorType   string
+	category    string
+	message     string
+	destination string
+	// rcode is the DNS response code of dns_error failures, if known.
+	rcode string
+}
+
+// proxyStatus is the Proxy-Status header value of e (RFC 9209).
+func (e proxyError) proxyStatus() string {
+	value := proxyStatusName + "; error=" + e.errorType
+	if e.rcode != "" {
+		value += "; rcode=" + sfString(e.rcode)
+	}
+	details := e.message
+	if _, after, ok := strings.Cut(details, ": "); ok {
+		details = after
+	}
+	if details != "" {
+		value += "; details=" + sfString(details)
+	}
+	return value
+}
+
+// sfString encodes s as a structured field string (RFC 8941), dropping the
+// characters it cannot hold.
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		if c < 0x20 || c > 0x7e {
+			continue
+		}
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// deniedError is a request refused by a policy.
+func deniedError(category, message, destination string) proxyError {
+	return proxyError{
+		status:      http.StatusForbidden,
+		errorType:   errorHTTPRequestDenied,
+		category:    category,
+		message:     message,
+		destination: destination,
+	}
+}
+
+// internalError is a failure of the proxy itself.
+func internalError(destination string) proxyError {
+	return proxyError{
+		status:      http.StatusServiceUnavailable,
+		errorType:   errorProxyInternalError,
+		category:    "Proxy error",
+		message:     "Service unavailable",
+		destination: destination,
+	}
+}
+
+// resolveError is a destination name that could not be resolved.
+func resolveError(err error, destination string) proxyError {
+	e := proxyError{
+		status:      http.StatusBadGateway,
+		errorType:   errorDNSError,
+		category:    "DNS failure",
+		message:     "Bad gateway: failed to resolve target host",
+		destination: destination,
+	}
+	var dnsErr *net.DNSError
+	switch {
+	case isTimeout(err):
+		e.status, e.errorType = http.StatusGatewayTimeout, errorDNSTimeout
+		e.message = "Gateway timeout: failed to resolve target host"
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		e.rcode = "NXDOMAIN"
+	}
+	return e
+}
+
+// connectError is a connection to the destination that could not be
+// established. status is the status of failures other than timeouts.
+func connectError(err error, status int, message, destination string) proxyError {
+	e := proxyError{
+		status:      status,
+		errorType:   errorDestinationUnavailable,
+		category:    "Connection failed",
+		message:     message,
+		destination: destination,
+	}
+	switch {
+	case isTimeout(err):
+		e.status, e.errorType, e.category = http.StatusGatewayTimeout, errorConnectionTimeout, "Connection timed out"
+		e.message = "Gateway timeout: failed to connect to target"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		e.errorType, e.category = errorConnectionRefused, "Connection refused"
+	}
+	return e
+}
+
+// exchangeError is a request that failed after the connection to the
+// destination was established; sent tells whether the request was sent.
+func exchangeError(err error, sent bool, destination string) proxyError {
+	e := proxyError{
+		status:      http.StatusBadGateway,
+		errorType:   errorConnectionTerminated,
+		category:    "Connection failed",
+		message:     "Bad gateway: failed to send request",
+		destination: destination,
+	}
+	if sent {
+		e.errorType, e.category = errorHTTPResponseIncomplete, "Invalid response"
+		e.message = "Bad gateway: failed to read response"
+	}
+	if isTimeout(err) {
+		e.status, e.category = http.StatusGatewayTimeout, "Response timed out"
+		e.errorType, e.message = errorConnectionWriteTimeout, "Gateway timeout: failed to send request"
+		if sent {
+			e.errorType, e.message = errorConnectionReadTimeout, "Gateway timeout: failed to read response"
+		}
+	}
+	return e
+}
+
+// tlsError is a failed TLS handshake with the destination. It reports false
+// for other errors.
+func tlsError(err error, destination string) (proxyError, bool) {
+	e := proxyError{
+		status:      http.StatusBadGateway,
+		errorType:   errorTLSProtocolError,
+		category:    "TLS handshake failed",
+		message:     "Bad gateway: TLS handshake with target failed",
+		destination: destination,
+	}
+	var (
+		alertErr  tls.AlertError
+		recordErr tls.RecordHeaderError
+	)
+	switch {
+	case isTimeout(err):
+		return proxyError{}, false
+	case outboundtls.IsCertificateError(err):
+		e.errorType, e.category = errorTLSCertificateError, "Certificate verification failed"
+		e.message = "Bad gateway: target certificate verification failed"
+	case errors.As(err, &alertErr):
+		e.errorType = errorTLSAlertReceived
+	case errors.As(err, &recordErr), errors.Is(err, errTLSHandshake):
+	default:
+		return proxyError{}, false
+	}
+	return e, true
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives r an identifier, logged with the request and shown on
+// its error pages.
+func withRequestID(r *http.Request) *http.Request {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, hex.EncodeToString(id)))
+}
+
+func requestIDOf(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,130 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ErrorPages(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	server := New(&Config{
+		Logger: &logger,
+		Resolver: resolverFunc(func(host string) (net.IP, error) {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "http://missing.example/path", nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusBadGateway, rr.Code)
+	assert.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, `nanoproxy; error=dns_error; rcode="NXDOMAIN"; details="failed to resolve target host"`, rr.Header().Get("Proxy-Status"))
+	requestID := rr.Header().Get("X-Request-Id")
+	assert.Len(t, requestID, 16)
+	body := rr.Body.String()
+	assert.Contains(t, body, "<h1>DNS failure</h1>")
+	assert.Contains(t, body, "http://missing.example/path")
+	assert.Contains(t, body, requestID)
+
+	// Clients that do not ask for HTML get plain text.
+	req = httptest.NewRequest(http.MethodGet, "http://missing.example/path", nil)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+
+	assert.Equal(t, "text/plain; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "Bad gateway: failed to resolve target host\nRequest ID: "+rr.Header().Get("X-Request-Id")+"\n", rr.Body.String())
+	assert.NotEqual(t, requestID, rr.Header().Get("X-Request-Id"))
+}
+
+func TestServer_ErrorPages_Authentication(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+	server := New(&Config{Logger: &logger, Credentials: &MockCredentialStore{}})
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Accept", "text/html")
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusProxyAuthRequired, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Proxy-Authenticate"))
+	assert.Equal(t, `nanoproxy; error=http_request_denied; details="Proxy authentication required or unauthorized"`, rr.Header().Get("Proxy-Status"))
+	assert.Contains(t, rr.Body.String(), "Sign in with your proxy username and password")
+}
+
+func TestNewErrorPages(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "error.gohtml"), []byte(`<p>Acme proxy: {{.Category}} ({{.RequestID}})</p>`), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "504.gohtml"), []byte(`<p>Too slow: {{.Destination}}</p>`), 0o600))
+
+	pages, err := NewErrorPages(dir)
+	require.NoError(t, err)
+
+	req := withRequestID(httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	req.Header.Set("Accept", "text/html")
+
+	rr := httptest.NewRecorder()
+	pages.write(rr, req, deniedError("Blocked by routing policy", "Forbidden: blocked by routing policy", "example.com"))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "<p>Acme proxy: Blocked by routing policy ("+requestIDOf(req)+")</p>", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	pages.write(rr, req, connectError(errTimeout{}, http.StatusBadGateway, "Bad gateway: failed to send request", "<example.com>"))
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+	assert.Equal(t, "<p>Too slow: &lt;example.com&gt;</p>", rr.Body.String())
+
+	// The built-in page for other statuses is kept.
+	rr = httptest.NewRecorder()
+	pages.write(rr, req, proxyError{status: http.StatusProxyAuthRequired, errorType: errorHTTPRequestDenied, message: "Proxy authentication required"})
+	assert.Contains(t, rr.Body.String(), "Sign in with your proxy username and password")
+
+	_, err = NewErrorPages(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "error.gohtml"), []byte(`{{.Category`), 0o600))
+	_, err = NewErrorPages(dir)
+	assert.Error(t, err)
+}
+
+func TestProxyErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		failure   proxyError
+		status    int
+		errorType string
+	}{
+		{name: "dns timeout", failure: resolveError(&net.DNSError{Err: "timeout", IsTimeout: true}, ""), status: http.StatusGatewayTimeout, errorType: errorDNSTimeout},
+		{name: "dns error", failure: resolveError(errors.New("server misbehaving"), ""), status: http.StatusBadGateway, errorType: errorDNSError},
+		{name: "refused", failure: connectError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, http.StatusServiceUnavailable, "Service unavailable", ""), status: http.StatusServiceUnavailable, errorType: errorConnectionRefused},
+		{name: "connect timeout", failure: connectError(errTimeout{}, http.StatusServiceUnavailable, "Service unavailable", ""), status: http.StatusGatewayTimeout, errorType: errorConnectionTimeout},
+		{name: "unreachable", failure: connectError(errors.New("no route to host"), http.StatusBadGateway, "Bad gateway", ""), status: http.StatusBadGateway, errorType: errorDestinationUnavailable},
+		{name: "write failed", failure: exchangeError(io.ErrClosedPipe, false, ""), status: http.StatusBadGateway, errorType: errorConnectionTerminated},
+		{name: "write timeout", failure: exchangeError(errTimeout{}, false, ""), status: http.StatusGatewayTimeout, errorType: errorConnectionWriteTimeout},
+		{name: "read failed", failure: exchangeError(io.ErrUnexpectedEOF, true, ""), status: http.StatusBadGateway, errorType: errorHTTPResponseIncomplete},
+		{name: "read timeout", failure: exchangeError(errTimeout{}, true, ""), status: http.StatusGatewayTimeout, errorType: errorConnectionReadTimeout},
+	} {
+		assert.Equal(t, tc.status, tc.failure.status, tc.name)
+		assert.Equal(t, tc.errorType, tc.failure.errorType, tc.name)
+	}
+
+	assert.Equal(t, `nanoproxy; error=http_request_error; details="say \"hi\" \\ bye"`,
+		proxyError{errorType: errorHTTPRequestError, message: "Bad request: say \"hi\" \\ bye\n"}.proxyStatus())
+}
+
+type errTimeout struct{}
+
+func (errTimeout) Error() string   { return "i/o timeout" }
+func (errTimeout) Timeout() bool   { return true }
+func (errTimeout) Temporary() bool { return true }
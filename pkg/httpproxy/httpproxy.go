@@ -1,8 +1,7 @@
 package httpproxy
 
 import (
-	"bufio"
-	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -13,11 +12,18 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/filter"
+	"github.com/ryanbekhen/nanoproxy/pkg/happyeyeballs"
+	"github.com/ryanbekhen/nanoproxy/pkg/headers"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
+	"github.com/ryanbekhen/nanoproxy/pkg/outboundtls"
 	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
 )
 
@@ -41,16 +47,71 @@ type Config struct {
 	Dial              func(network, addr string) (net.Conn, error)
 	Resolver          resolver.Resolver
 	Tracker           *traffic.Tracker
+	Router            *routing.Router
+	// DialRemote tells that Dial reaches destinations through Tor or an
+	// upstream proxy, which resolve CONNECT host names themselves. It is
+	// ignored when Router is set.
+	DialRemote bool
+	// UsernameParams, when set, extracts parameters appended to the proxy
+	// username (see credential.UsernameGrammar).
+	UsernameParams *credential.UsernameGrammar
+	// ConnectionAttemptDelay is how long a connection attempt may run before
+	// the next resolved address is tried in parallel (RFC 8305). Zero selects
+	// happyeyeballs.DefaultDelay.
+	ConnectionAttemptDelay time.Duration
+	// IdleConnTimeout is how long an idle upstream connection is kept for
+	// reuse. Zero selects DefaultIdleConnTimeout.
+	IdleConnTimeout time.Duration
+	// MaxIdleConnsPerHost limits the idle upstream connections kept per
+	// destination for each route, user and session. Zero selects
+	// DefaultMaxIdleConnsPerHost.
+	MaxIdleConnsPerHost int
+	// ClientCertUsername, when set, maps the verified certificate of a
+	// client on a TLS listener to a username. Such clients need no
+	// Proxy-Authorization header; an error leaves them to the other
+	// authentication schemes.
+	ClientCertUsername func(cert *x509.Certificate) (string, error)
+	// Inspector, when set, decrypts the CONNECT tunnels its rules select
+	// and forwards the requests inside them like plain proxy requests.
+	Inspector *mitm.Inspector
+	// AuthSchemes are the Proxy-Authorization schemes accepted from
+	// clients and offered in challenges, in that order. Empty selects
+	// Basic only. Digest needs a credential.DigestStore and Bearer a
+	// credential.TokenStore as Credentials.
+	AuthSchemes []AuthScheme
+	// Realm is the protection space of the challenges. Empty selects
+	// credential.DefaultRealm.
+	Realm string
+	// Headers, when set, rewrites the headers of forwarded requests and
+	// their responses, including those of inspected tunnels.
+	Headers *headers.Policy
+	// Cache, when set, stores and reuses the responses to plain HTTP
+	// requests. Requests inside inspected tunnels are not cached.
+	Cache *Cache
+	// Filter, when set, blocks requests by the content categories of their
+	// user: HTTP requests get its block page and CONNECT requests are
+	// refused.
+	Filter *filter.Filter
+	// ErrorPages renders the pages sent for failures. Nil selects the
+	// built-in pages.
+	ErrorPages *ErrorPages
+	// OutboundTLS, when set, configures the TLS connections to the
+	// destinations of https requests, including those of inspected
+	// tunnels. Nil trusts the system roots and speaks TLS 1.2 or later.
+	OutboundTLS *outboundtls.Client
 }
 
 type Server struct {
-	config *Config
+	config     *Config
+	transports *transportPool
+	nonces     *digestNonces
 }
 
 var (
 	ErrMissingProxyAuthorization = errors.New("missing proxy authorization header")
 	ErrInvalidProxyAuthorization = errors.New("invalid proxy authorization header")
 	ErrInvalidProxyCredentials   = errors.New("invalid credentials")
+	ErrClientCertificateRejected = errors.New("client certificate rejected")
 )
 
 func New(conf *Config) *Server {
@@ -71,14 +132,29 @@ func New(conf *Config) *Server {
 		conf.ClientConnTimeout = 5 * time.Second
 	}
 
+	if conf.IdleConnTimeout <= 0 {
+		conf.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+
+	if conf.MaxIdleConnsPerHost <= 0 {
+		conf.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+
+	if conf.ErrorPages == nil {
+		conf.ErrorPages = defaultErrorPages
+	}
+
 	server := &Server{
 		config: conf,
+		nonces: newDigestNonces(),
 	}
+	server.transports = newTransportPool(conf.IdleConnTimeout, server.newTransport)
 
 	return server
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = withRequestID(r)
 	if r.Method == http.MethodConnect {
 		s.handleConnect(w, r)
 	} else {
@@ -86,93 +162,207 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) authenticateRequest(r *http.Request) (string, error) {
+// authenticateRequest returns the base username, any username parameters
+// and, for ephemeral credentials, what the credential grants.
+func (s *Server) authenticateRequest(r *http.Request) (string, map[string]string, *credential.Grant, error) {
+	username, certErr := s.clientCertUsername(r)
+	if username != "" {
+		return username, nil, nil, nil
+	}
 	if s.config.Credentials == nil {
-		return "anonymous", nil
+		return "anonymous", nil, nil, nil
 	}
 
 	authHeader := r.Header.Get("Proxy-Authorization")
 	if authHeader == "" {
-		return "", ErrMissingProxyAuthorization
+		if certErr != nil {
+			return "", nil, nil, certErr
+		}
+		return "", nil, nil, ErrMissingProxyAuthorization
 	}
 
-	if strings.HasPrefix(authHeader, "Basic ") {
-		encodedCreds := strings.TrimPrefix(authHeader, "Basic ")
-		decoded, err := base64.StdEncoding.DecodeString(encodedCreds)
+	scheme, credentials, _ := strings.Cut(authHeader, " ")
+	switch {
+	case strings.EqualFold(scheme, "Basic") && s.accepts(AuthBasic):
+		decoded, err := base64.StdEncoding.DecodeString(credentials)
 		if err != nil {
-			return "", fmt.Errorf("%w: %v", ErrInvalidProxyAuthorization, err)
+			return "", nil, nil, fmt.Errorf("%w: %v", ErrInvalidProxyAuthorization, err)
 		}
 
 		parts := strings.SplitN(string(decoded), ":", 2)
 		if len(parts) != 2 {
-			return "", ErrInvalidProxyAuthorization
+			return "", nil, nil, ErrInvalidProxyAuthorization
 		}
 
-		username, password := parts[0], parts[1]
-		if s.config.Credentials.Valid(username, password) {
-			return username, nil
+		// The whole username is tried before the base username UsernameParams
+		// extracts, so accounts whose name contains a parameter key keep
+		// working.
+		if grant, ok := s.validBasic(parts[0], parts[1]); ok {
+			return parts[0], nil, grant, nil
+		}
+		if username, params := s.config.UsernameParams.Parse(parts[0]); username != parts[0] {
+			if grant, ok := s.validBasic(username, parts[1]); ok {
+				return username, params, grant, nil
+			}
 		}
-		return "", ErrInvalidProxyCredentials
+		return "", nil, nil, ErrInvalidProxyCredentials
+	case strings.EqualFold(scheme, "Digest") && s.accepts(AuthDigest):
+		username, err := s.authenticateDigest(r, credentials)
+		return username, nil, nil, err
+	case strings.EqualFold(scheme, "Bearer") && s.accepts(AuthBearer):
+		username, grant, err := s.authenticateBearer(credentials)
+		return username, nil, grant, err
 	}
 
-	return "", ErrInvalidProxyAuthorization
+	return "", nil, nil, ErrInvalidProxyAuthorization
+}
+
+// validBasic checks password, or the secret of an ephemeral credential, for
+// user.
+func (s *Server) validBasic(user, password string) (*credential.Grant, bool) {
+	if grants, ok := s.config.Credentials.(credential.GrantStore); ok {
+		if grant, ok := grants.Grant(user, password); ok {
+			return grant, true
+		}
+	}
+	return nil, s.config.Credentials.Valid(user, password)
+}
+
+// clientCertUsername returns the user named by the verified certificate of
+// a client on a TLS listener, if there is one.
+func (s *Server) clientCertUsername(r *http.Request) (string, error) {
+	if s.config.ClientCertUsername == nil || r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", nil
+	}
+	username, err := s.config.ClientCertUsername(r.TLS.PeerCertificates[0])
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrClientCertificateRejected, err)
+	}
+	return username, nil
 }
 
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	requestLogger := s.requestLogger(r)
-	username, err := s.authenticateRequest(r)
+	username, params, grant, err := s.authenticateRequest(r)
 	if err != nil {
 		requestLogger.Error().
 			Err(err).
 			Msg("proxy authentication failed")
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Restricted area\"")
-		http.Error(w, "Proxy authentication required or unauthorized", http.StatusProxyAuthRequired)
+		s.requireAuthentication(w, r, err)
 		return
 	}
 	requestLogger = requestLogger.With().Str("username", username).Str("dest_addr", r.Host).Logger()
+	sessionTag := params[credential.ParamSession]
+	if sessionTag != "" {
+		requestLogger = requestLogger.With().Str("session", sessionTag).Logger()
+	}
+	if grant != nil {
+		requestLogger = requestLogger.With().Str("credential", grant.ID()).Logger()
+	}
 	if s.config.Credentials != nil {
 		requestLogger.Debug().Msg("proxy authentication succeeded")
 	} else {
 		requestLogger.Debug().Msg("connect request accepted without authentication")
 	}
+	if !grant.Allows(hostnameOf(r.Host)) {
+		requestLogger.Warn().Msg("connect blocked by credential restrictions")
+		s.writeError(w, r, deniedError("Access denied", "Forbidden: destination not allowed for this credential", r.Host))
+		return
+	}
+	if block, blocked := s.config.Filter.Check(filter.Request{Username: username, Host: hostnameOf(r.Host)}); blocked {
+		requestLogger.Warn().
+			Str("category", block.Category).
+			Str("rule", block.Rule).
+			Msg("connect blocked by content filter")
+		s.writeError(w, r, deniedError("Blocked by content filter", "Forbidden: "+filter.ErrBlocked.Error(), r.Host))
+		return
+	}
 	session := s.startSession(username, r.RemoteAddr)
 	defer session.Close()
+	if sessionTag != "" {
+		session.SetTag(sessionTag)
+	}
+	if grant != nil {
+		session.SetCredential(grant.ID())
+	}
+
+	if port, err := strconv.Atoi(portOf(r.Host)); err == nil && s.Inspects(username, hostnameOf(r.Host), port) {
+		clientConn, err := acceptTunnel(w, r)
+		if err != nil {
+			requestLogger.Error().
+				Err(err).
+				Msg("failed to hijack client connection")
+			s.writeError(w, r, internalError(r.Host))
+			return
+		}
+		defer clientConn.Close()
+
+		s.intercept(clientConn, mitm.Target{
+			Username:   username,
+			Params:     params,
+			Host:       hostnameOf(r.Host),
+			Port:       port,
+			ClientAddr: r.RemoteAddr,
+			Session:    session,
+			Grant:      grant,
+		}, requestLogger)
+		return
+	}
+
+	route, routeRequest, outbound := s.selectRoute(hostnameOf(r.Host), r.Host, username, params, r.RemoteAddr)
+	if route != "" {
+		requestLogger = requestLogger.With().Str("route", route).Logger()
+		session.SetRoute(route)
+	}
+	addrs, err := s.resolveConnectTarget(r.Host, s.resolvesLocally(route), requestLogger)
+	if errors.Is(err, resolver.ErrBlocked) {
+		requestLogger.Warn().Err(err).Msg("connect blocked by DNS policy")
+		s.writeError(w, r, deniedError("Blocked by DNS policy", "Forbidden: blocked by DNS policy", r.Host))
+		return
+	}
 
 	startTime := time.Now()
-	requestLogger.Debug().Msg("dialing connect target")
-	serverConn, err := s.config.Dial("tcp", r.Host)
+	requestLogger.Debug().Int("addresses", len(addrs)).Msg("dialing connect target")
+	serverConn, connectedAddr, err := s.dialTarget(addrs, routeRequest, outbound)
 	latency := time.Since(startTime).Milliseconds()
+	if errors.Is(err, routing.ErrBlackholed) || errors.Is(err, routing.ErrRouteNotAllowed) {
+		requestLogger.Warn().Err(err).Msg("connect blocked by routing policy")
+		s.writeError(w, r, deniedError("Blocked by routing policy", "Forbidden: blocked by routing policy", r.Host))
+		return
+	}
 	if err != nil {
 		requestLogger.Error().
 			Str("latency", fmt.Sprintf("%dms", latency)).
 			Err(err).
 			Msg("connect failed")
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		s.writeError(w, r, connectError(err, http.StatusServiceUnavailable, "Service unavailable", r.Host))
 		return
 	}
 	defer serverConn.Close()
+	requestLogger = withEgressIP(requestLogger, routeRequest, session)
+	requestLogger = requestLogger.With().Str("connected_addr", connectedAddr).Logger()
 
-	clientConn, _, err := w.(http.Hijacker).Hijack()
+	clientConn, err := acceptTunnel(w, r)
 	if err != nil {
 		requestLogger.Error().
 			Err(err).
 			Msg("failed to hijack client connection")
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		s.writeError(w, r, internalError(r.Host))
 		return
 	}
 	defer clientConn.Close()
 
-	_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
-
 	uploadCh := make(chan struct{}, 1)
 	go func() {
-		n, _ := io.Copy(serverConn, clientConn)
+		n, _ := io.Copy(serverConn, grant.Reader(clientConn))
 		session.AddUpload(n)
+		endIfSpent(grant, clientConn, serverConn)
 		uploadCh <- struct{}{}
 	}()
 
-	n, _ := io.Copy(clientConn, serverConn)
+	n, _ := io.Copy(clientConn, grant.Reader(serverConn))
 	session.AddDownload(n)
+	endIfSpent(grant, clientConn, serverConn)
 	<-uploadCh
 
 	requestLogger.Info().
@@ -184,16 +374,22 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	requestLogger := s.requestLogger(r)
-	username, err := s.authenticateRequest(r)
+	username, params, grant, err := s.authenticateRequest(r)
 	if err != nil {
 		requestLogger.Error().
 			Err(err).
 			Msg("proxy authentication failed")
-		w.Header().Set("Proxy-Authenticate", "Basic realm=\"Restricted area\"")
-		http.Error(w, "Proxy authentication required or unauthorized", http.StatusProxyAuthRequired)
+		s.requireAuthentication(w, r, err)
 		return
 	}
 	requestLogger = requestLogger.With().Str("username", username).Logger()
+	sessionTag := params[credential.ParamSession]
+	if sessionTag != "" {
+		requestLogger = requestLogger.With().Str("session", sessionTag).Logger()
+	}
+	if grant != nil {
+		requestLogger = requestLogger.With().Str("credential", grant.ID()).Logger()
+	}
 	if s.config.Credentials != nil {
 		requestLogger.Debug().Msg("proxy authentication succeeded")
 	} else {
@@ -201,6 +397,12 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	session := s.startSession(username, r.RemoteAddr)
 	defer session.Close()
+	if sessionTag != "" {
+		session.SetTag(sessionTag)
+	}
+	if grant != nil {
+		session.SetCredential(grant.ID())
+	}
 
 	startTime := time.Now()
 
@@ -210,66 +412,207 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 			Str("dest_addr", r.URL.String()).
 			Err(err).
 			Msg("invalid proxy target url")
-		http.Error(w, "Invalid target URL", http.StatusBadRequest)
+		s.writeError(w, r, proxyError{
+			status:      http.StatusBadRequest,
+			errorType:   errorHTTPRequestError,
+			category:    "Invalid request",
+			message:     "Invalid target URL",
+			destination: r.URL.String(),
+		})
+		return
+	}
+	if !grant.Allows(targetURL.Hostname()) {
+		requestLogger.Warn().
+			Str("dest_addr", targetURL.String()).
+			Msg("request blocked by credential restrictions")
+		s.writeError(w, r, deniedError("Access denied", "Forbidden: destination not allowed for this credential", targetURL.String()))
 		return
 	}
+
+	s.forwardHTTP(w, r, proxyRequest{
+		username:  username,
+		params:    params,
+		session:   session,
+		grant:     grant,
+		target:    targetURL,
+		logger:    requestLogger,
+		startTime: startTime,
+	})
+}
+
+// proxyRequest is an authenticated request on its way to its destination.
+type proxyRequest struct {
+	username  string
+	params    map[string]string
+	session   *traffic.Session
+	target    *url.URL
+	logger    zerolog.Logger
+	startTime time.Time
+	// inspected is set for requests decrypted from an inspected tunnel.
+	inspected bool
+	// grant is what the ephemeral credential of the request allows, if it
+	// was authenticated with one.
+	grant *credential.Grant
+	// rewrite applies the header rules matching the request.
+	rewrite *headers.Rewrite
+}
+
+// forwardHTTP sends a request to its destination through the selected route
+// and copies the response back to the client.
+func (s *Server) forwardHTTP(w http.ResponseWriter, r *http.Request, req proxyRequest) {
+	requestLogger, session, targetURL, startTime := req.logger, req.session, req.target, req.startTime
 	requestLogger = requestLogger.With().Str("dest_addr", targetURL.String()).Logger()
 
+	if req.inspected {
+		requestLogger = requestLogger.With().Bool("inspected", true).Logger()
+	}
+
+	if block, blocked := s.config.Filter.Check(filter.Request{Username: req.username, Host: targetURL.Hostname(), URL: targetURL}); blocked {
+		requestLogger.Warn().
+			Str("category", block.Category).
+			Str("rule", block.Rule).
+			Msg("request blocked by content filter")
+		blocked := deniedError("Blocked by content filter", "Forbidden: "+filter.ErrBlocked.Error(), targetURL.String())
+		w.Header().Set("Proxy-Status", blocked.proxyStatus())
+		w.Header().Set("X-Request-Id", requestIDOf(r))
+		s.config.Filter.WriteBlockPage(w, filter.Page{
+			URL:      targetURL.String(),
+			Host:     targetURL.Hostname(),
+			Username: req.username,
+			ClientIP: extractClientIP(r.RemoteAddr),
+			Category: block.Category,
+			Rule:     block.Rule,
+		})
+		return
+	}
+
+	// The transport may still be sending the body while the response is
+	// read, so the count is shared with its goroutine.
+	var uploadBytes atomic.Int64
 	proxyReqBody := &countingReadCloser{
-		ReadCloser: r.Body,
+		ReadCloser: grantReadCloser(req.grant, r.Body),
 		onRead: func(n int64) {
+			uploadBytes.Add(n)
 			session.AddUpload(n)
 		},
 	}
 
-	resolvedAddr, err := resolveProxyTargetAddr(targetURL, s.config.Resolver)
-	if err != nil {
-		latency := time.Since(startTime).Milliseconds()
-		requestLogger.Error().
-			Str("latency", fmt.Sprintf("%dms", latency)).
-			Err(err).
-			Msg("failed to resolve target host")
-		http.Error(w, "Bad gateway: failed to resolve target host", http.StatusBadGateway)
-		return
+	// The route is chosen from the name, so that Tor and upstream proxies
+	// get it unresolved, as for CONNECT.
+	hostport := net.JoinHostPort(targetURL.Hostname(), proxyTargetPort(targetURL))
+	route, routeRequest, outbound := s.selectRoute(targetURL.Hostname(), hostport, req.username, req.params, r.RemoteAddr)
+	if route != "" {
+		requestLogger = requestLogger.With().Str("route", route).Logger()
+		session.SetRoute(route)
 	}
-	requestLogger.Debug().Str("resolved_addr", resolvedAddr).Msg("resolved proxy target")
 
-	serverConn, err := dialProxyTarget(targetURL, resolvedAddr, s.config.Dial, s.config.ClientConnTimeout)
+	var (
+		addrs []string
+		err   error
+	)
+	if s.resolvesLocally(route) {
+		addrs, err = resolveProxyTargetAddrs(targetURL, s.config.Resolver)
+	} else {
+		addrs, err = s.resolveConnectTarget(hostport, false, requestLogger)
+	}
+	if errors.Is(err, resolver.ErrBlocked) {
+		requestLogger.Warn().Err(err).Msg("request blocked by DNS policy")
+		s.writeError(w, r, deniedError("Blocked by DNS policy", "Forbidden: blocked by DNS policy", targetURL.String()))
+		return
+	}
 	if err != nil {
 		latency := time.Since(startTime).Milliseconds()
 		requestLogger.Error().
 			Str("latency", fmt.Sprintf("%dms", latency)).
 			Err(err).
-			Msg("failed to connect to target")
-		http.Error(w, "Bad gateway: failed to send request", http.StatusBadGateway)
+			Msg("failed to resolve target host")
+		s.writeError(w, r, resolveError(err, targetURL.String()))
 		return
 	}
-	defer serverConn.Close()
+	if s.resolvesLocally(route) {
+		requestLogger.Debug().Str("resolved_addr", addrs[0]).Int("addresses", len(addrs)).Msg("resolved proxy target")
+	}
 
+	exchange := &upstreamExchange{plan: &dialPlan{
+		addrs:        addrs,
+		routeRequest: routeRequest,
+		outbound:     outbound,
+		http1Only:    upgradeProtocol(r) != "",
+	}}
 	proxyReq := buildOutboundProxyRequest(r, targetURL, proxyReqBody)
+	req.rewrite = s.config.Headers.For(headers.Request{
+		Host:       targetURL.Hostname(),
+		Username:   req.username,
+		ClientIP:   extractClientIP(r.RemoteAddr),
+		Scheme:     targetURL.Scheme,
+		ProtoMajor: r.ProtoMajor,
+		ProtoMinor: r.ProtoMinor,
+	})
+	req.rewrite.Request(proxyReq.Header)
 	requestLogger.Debug().Msg("forwarding proxy request")
-	if err := proxyReq.Write(serverConn); err != nil {
-		latency := time.Since(startTime).Milliseconds()
-		requestLogger.Error().
-			Str("latency", fmt.Sprintf("%dms", latency)).
-			Err(err).
-			Msg("failed to send request")
-		http.Error(w, "Bad gateway: failed to send request", http.StatusBadGateway)
+	transport := s.transports.get(poolKey(route, req.username, req.params[credential.ParamSession]))
+	var (
+		resp   *http.Response
+		cached cacheResult
+	)
+	if s.cacheable(r, req, route) {
+		resp, cached, err = s.config.Cache.roundTrip(proxyReq, func(outReq *http.Request) (*http.Response, error) {
+			return exchange.roundTrip(transport, outReq)
+		})
+		if cached != cacheBypass {
+			requestLogger = requestLogger.With().Str("cache", string(cached)).Logger()
+		}
+	} else {
+		resp, err = exchange.roundTrip(transport, proxyReq)
+	}
+	if errors.Is(err, routing.ErrBlackholed) || errors.Is(err, routing.ErrRouteNotAllowed) {
+		requestLogger.Warn().Err(err).Msg("request blocked by routing policy")
+		s.writeError(w, r, deniedError("Blocked by routing policy", "Forbidden: blocked by routing policy", targetURL.String()))
 		return
 	}
-
-	resp, err := http.ReadResponse(bufio.NewReader(serverConn), proxyReq)
-	latency := time.Since(startTime).Milliseconds()
+	if exchange.conn != nil {
+		if routeRequest != nil {
+			routeRequest.SourceIP = exchange.conn.sourceIP
+		}
+		requestLogger = withEgressIP(requestLogger, routeRequest, session)
+		requestLogger = requestLogger.With().
+			Str("connected_addr", exchange.conn.addr).
+			Bool("reused_conn", exchange.reused).
+			Logger()
+	}
 	if err != nil {
+		message := "failed to connect to target"
+		failure := connectError(err, http.StatusBadGateway, "Bad gateway: failed to send request", targetURL.String())
+		switch {
+		case exchange.sent():
+			message = "failed to read response"
+			failure = exchangeError(err, true, targetURL.String())
+		case exchange.conn != nil:
+			message = "failed to send request"
+			failure = exchangeError(err, false, targetURL.String())
+		}
+		if tlsFailure, ok := tlsError(err, targetURL.String()); ok {
+			message, failure = "TLS handshake with target failed", tlsFailure
+			if tlsFailure.errorType == errorTLSCertificateError {
+				message = "target certificate verification failed"
+			}
+		}
+		latency := time.Since(startTime).Milliseconds()
 		requestLogger.Error().
 			Str("latency", fmt.Sprintf("%dms", latency)).
 			Err(err).
-			Msg("failed to read response")
-		http.Error(w, "Bad gateway: failed to read response", http.StatusBadGateway)
+			Msg(message)
+		s.writeError(w, r, failure)
+		return
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		req.logger = requestLogger
+		s.switchProtocols(w, r, resp, req, exchange, &uploadBytes)
 		return
 	}
 	defer resp.Body.Close()
 
+	removeConnectionHeaders(resp.Header)
 	for _, key := range hopHeaders {
 		resp.Header.Del(key)
 	}
@@ -279,19 +622,164 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header()[key] = values
 		}
 	}
+	req.rewrite.Response(w.Header())
 
 	w.WriteHeader(resp.StatusCode)
-	n, _ := io.Copy(w, resp.Body)
-	session.AddDownload(n)
+	n, err := io.Copy(w, req.grant.Reader(resp.Body))
+	if cached.served() {
+		session.AddCached(n)
+	} else {
+		session.AddDownload(n)
+	}
+	if req.inspected {
+		s.recordExchange(r, req, resp, exchange, uploadBytes.Load(), n)
+	}
+	if err != nil {
+		// The status line is already out, so the only way to tell the client
+		// the body is incomplete is to drop its connection instead of
+		// keeping it alive.
+		requestLogger.Error().
+			Int("status_code", resp.StatusCode).
+			Str("latency", time.Since(startTime).Round(time.Millisecond).String()).
+			Int64("download_bytes", n).
+			Err(err).
+			Msg("failed to copy response body")
+		panic(http.ErrAbortHandler)
+	}
 
 	requestLogger.Info().
 		Int("status_code", resp.StatusCode).
 		Str("latency", time.Since(startTime).Round(time.Millisecond).String()).
-		Uint64("upload_bytes", session.UploadBytes()).
-		Uint64("download_bytes", session.DownloadBytes()).
+		Int64("upload_bytes", uploadBytes.Load()).
+		Int64("download_bytes", n).
 		Msg("request completed")
 }
 
+// cacheable reports whether the response to a request may come from or go
+// to the cache. Only plain HTTP requests on routes that reach the
+// destination qualify, so a cached response is never served where the
+// routing policy would have refused the request.
+func (s *Server) cacheable(r *http.Request, req proxyRequest, route string) bool {
+	if s.config.Cache == nil || req.inspected || req.target.Scheme != "http" || upgradeProtocol(r) != "" {
+		return false
+	}
+	if route == "" {
+		return true
+	}
+	_, ok := s.config.Router.Outbound(route)
+	return ok && route != routing.RouteBlackhole
+}
+
+// selectRoute returns the route name, routing request and outbound for a
+// destination. The route name is empty and the request nil when no router is
+// configured, in which case the outbound is the configured dial function.
+// hostname is the host the client asked for and addr is the host:port that
+// will actually be dialed. params are the username parameters, which may
+// request a route and carry a session tag for sticky selection.
+func (s *Server) selectRoute(hostname, addr, username string, params map[string]string, remoteAddr string) (string, *routing.Request, routing.Outbound) {
+	if s.config.Router == nil {
+		dial := s.config.Dial
+		if dial == nil {
+			dial = (&net.Dialer{Timeout: s.config.DestConnTimeout}).Dial
+		}
+		return "", nil, routing.DialFunc(dial)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	routeRequest := &routing.Request{
+		Host:     hostname,
+		IP:       net.ParseIP(host),
+		Port:     port,
+		Username: username,
+		ClientIP: net.ParseIP(extractClientIP(remoteAddr)),
+		Session:  params[credential.ParamSession],
+		Route:    params[credential.ParamRoute],
+	}
+	if net.ParseIP(hostname) != nil {
+		routeRequest.Host = ""
+	}
+
+	route, outbound := s.config.Router.Select(routeRequest)
+	return route, routeRequest, outbound
+}
+
+// dialTarget races connections to addrs as described in RFC 8305 and returns
+// the winning connection and address. Attempts run concurrently, so each one
+// dials with its own copy of routeRequest and the source address chosen for
+// the winner is copied back.
+func (s *Server) dialTarget(addrs []string, routeRequest *routing.Request, outbound routing.Outbound) (net.Conn, string, error) {
+	attempts := make([]*routing.Request, len(addrs))
+	conn, winner, err := happyeyeballs.Dial(len(addrs), s.config.ConnectionAttemptDelay, func(i int) (net.Conn, error) {
+		if routeRequest == nil {
+			return outbound.DialRoute(nil, "tcp", addrs[i])
+		}
+		attempt := *routeRequest
+		attempts[i] = &attempt
+		return outbound.DialRoute(&attempt, "tcp", addrs[i])
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if routeRequest != nil {
+		routeRequest.SourceIP = attempts[winner].SourceIP
+	}
+	return conn, addrs[winner], nil
+}
+
+// resolveConnectTarget resolves the host of hostport when local is set.
+// Otherwise, and when the name cannot be resolved locally, it is passed on
+// unresolved, so that an upstream proxy or Tor resolves it; only names
+// refused by the DNS policy return an error.
+func (s *Server) resolveConnectTarget(hostport string, local bool, logger zerolog.Logger) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return []string{hostport}, nil
+	}
+	if !local {
+		if blocker, ok := s.config.Resolver.(resolver.Blocker); ok && blocker.Blocked(host) {
+			return nil, fmt.Errorf("%s: %w", host, resolver.ErrBlocked)
+		}
+		return []string{hostport}, nil
+	}
+
+	addrs, err := resolveTargetAddrs(host, port, s.config.Resolver)
+	if errors.Is(err, resolver.ErrBlocked) {
+		return nil, err
+	}
+	if err != nil {
+		logger.Debug().Err(err).Msg("dialing connect target by name")
+		return []string{hostport}, nil
+	}
+	logger.Debug().Str("resolved_addr", addrs[0]).Int("addresses", len(addrs)).Msg("resolved connect target")
+	return addrs, nil
+}
+
+// resolvesLocally reports whether destinations on route are resolved by
+// the proxy: only connections dialed directly are. Tor and upstream proxies
+// get the host name, so it is not leaked to the local DNS servers and
+// parents can apply their own name-based policies.
+func (s *Server) resolvesLocally(route string) bool {
+	if s.config.Router == nil {
+		return !s.config.DialRemote
+	}
+	return route == routing.RouteDirect
+}
+
+// withEgressIP records the source address chosen by the outbound, if any.
+func withEgressIP(logger zerolog.Logger, routeRequest *routing.Request, session *traffic.Session) zerolog.Logger {
+	if routeRequest == nil || routeRequest.SourceIP == nil {
+		return logger
+	}
+	egressIP := routeRequest.SourceIP.String()
+	session.SetEgressIP(egressIP)
+	return logger.With().Str("egress_ip", egressIP).Logger()
+}
+
 func (s *Server) startSession(username, remoteAddr string) *traffic.Session {
 	if s.config.Tracker == nil {
 		return nil
@@ -299,6 +787,22 @@ func (s *Server) startSession(username, remoteAddr string) *traffic.Session {
 	return s.config.Tracker.Start(username, extractClientIP(remoteAddr))
 }
 
+func hostnameOf(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+func portOf(hostport string) string {
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return ""
+	}
+	return port
+}
+
 func extractClientIP(remoteAddr string) string {
 	host, _, err := net.SplitHostPort(remoteAddr)
 	if err != nil {
@@ -307,9 +811,17 @@ func extractClientIP(remoteAddr string) string {
 	return host
 }
 
+// writeError answers a failed request with its error page.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, e proxyError) {
+	s.config.ErrorPages.write(w, r, e)
+}
+
 func (s *Server) requestLogger(r *http.Request) zerolog.Logger {
 	logger := s.config.Logger.With().Str("protocol", "http")
 	if r != nil {
+		if id := requestIDOf(r); id != "" {
+			logger = logger.Str("request_id", id)
+		}
 		logger = logger.Str("http_method", r.Method)
 		if r.RemoteAddr != "" {
 			logger = logger.Str("client_addr", r.RemoteAddr)
@@ -318,30 +830,43 @@ func (s *Server) requestLogger(r *http.Request) zerolog.Logger {
 	return logger.Logger()
 }
 
-func resolveProxyTargetAddr(targetURL *url.URL, res resolver.Resolver) (string, error) {
-	hostname := targetURL.Hostname()
-	port := targetURL.Port()
-	if port == "" {
-		if targetURL.Scheme == "https" {
-			port = "443"
-		} else {
-			port = "80"
-		}
+func resolveProxyTargetAddrs(targetURL *url.URL, res resolver.Resolver) ([]string, error) {
+	return resolveTargetAddrs(targetURL.Hostname(), proxyTargetPort(targetURL), res)
+}
+
+// proxyTargetPort returns the port of targetURL, or the default one of its
+// scheme.
+func proxyTargetPort(targetURL *url.URL) string {
+	if port := targetURL.Port(); port != "" {
+		return port
 	}
+	if targetURL.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
 
-	var ipStr string
+// resolveTargetAddrs returns host:port for every address of hostname in the
+// order the resolver prefers.
+func resolveTargetAddrs(hostname, port string, res resolver.Resolver) ([]string, error) {
 	// If hostname is already a valid IP address, use it directly without DNS.
 	if ip := net.ParseIP(hostname); ip != nil {
-		ipStr = ip.String()
-	} else {
-		resolved, err := res.Resolve(hostname)
-		if err != nil {
-			return "", fmt.Errorf("resolve %q: %w", hostname, err)
-		}
-		ipStr = resolved.String()
+		return []string{net.JoinHostPort(ip.String(), port)}, nil
 	}
 
-	return net.JoinHostPort(ipStr, port), nil
+	ips, err := res.ResolveAll(hostname)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: hostname, IsNotFound: true}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("resolve %q: %w", hostname, err)
+	}
+
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return addrs, nil
 }
 
 func normalizeProxyTargetURL(r *http.Request) (*url.URL, error) {
@@ -350,6 +875,17 @@ func normalizeProxyTargetURL(r *http.Request) (*url.URL, error) {
 	}
 
 	rawURL := r.URL
+	if r.ProtoMajor == 2 && rawURL.Scheme == "" && rawURL.Host == "" {
+		// HTTP/2 carries the target in the :scheme and :authority
+		// pseudo-headers; the server only exposes the scheme through r.TLS.
+		target := *rawURL
+		target.Scheme = "http"
+		if r.TLS != nil {
+			target.Scheme = "https"
+		}
+		target.Host = r.Host
+		rawURL = &target
+	}
 	scheme := strings.ToLower(strings.TrimSpace(rawURL.Scheme))
 	if scheme != "http" && scheme != "https" {
 		return nil, fmt.Errorf("unsupported url scheme: %q", rawURL.Scheme)
@@ -404,6 +940,8 @@ func normalizeProxyTargetURL(r *http.Request) (*url.URL, error) {
 func buildOutboundProxyRequest(r *http.Request, targetURL *url.URL, body io.ReadCloser) *http.Request {
 	proxyReq := r.Clone(r.Context())
 	proxyReq.URL = &url.URL{
+		Scheme:   targetURL.Scheme,
+		Host:     targetURL.Host,
 		Path:     targetURL.Path,
 		RawPath:  targetURL.RawPath,
 		RawQuery: targetURL.RawQuery,
@@ -411,11 +949,14 @@ func buildOutboundProxyRequest(r *http.Request, targetURL *url.URL, body io.Read
 	proxyReq.Host = targetURL.Host
 	proxyReq.RequestURI = ""
 	proxyReq.Body = body
-	proxyReq.Close = true
+	// Connection management is hop-by-hop: whether the client keeps its
+	// connection open has no bearing on the pooled upstream connection.
+	proxyReq.Close = false
 	proxyReq.Header = make(http.Header, len(r.Header))
 
+	connectionHeaders := connectionHeaderNames(r.Header)
 	for key, values := range r.Header {
-		if isHopHeader(key) {
+		if isHopHeader(key) || connectionHeaders[http.CanonicalHeaderKey(key)] {
 			continue
 		}
 
@@ -423,38 +964,11 @@ func buildOutboundProxyRequest(r *http.Request, targetURL *url.URL, body io.Read
 			proxyReq.Header.Add(key, value)
 		}
 	}
-
-	return proxyReq
-}
-
-func dialProxyTarget(targetURL *url.URL, resolvedAddr string, dial func(network, addr string) (net.Conn, error), timeout time.Duration) (net.Conn, error) {
-	conn, err := dial("tcp", resolvedAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	if timeout > 0 {
-		_ = conn.SetDeadline(time.Now().Add(timeout))
-	}
-
-	if targetURL.Scheme != "https" {
-		return conn, nil
+	if protocol := upgradeProtocol(r); protocol != "" {
+		addUpgradeHeaders(proxyReq, r, protocol)
 	}
 
-	tlsConn := tls.Client(conn, &tls.Config{
-		ServerName: targetURL.Hostname(),
-		MinVersion: tls.VersionTLS12,
-	})
-	if err := tlsConn.Handshake(); err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
-
-	if timeout > 0 {
-		_ = tlsConn.SetDeadline(time.Now().Add(timeout))
-	}
-
-	return tlsConn, nil
+	return proxyReq
 }
 
 type countingReadCloser struct {
@@ -470,6 +984,28 @@ func (c *countingReadCloser) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// grantReadCloser charges what is read from body against grant.
+func grantReadCloser(grant *credential.Grant, body io.ReadCloser) io.ReadCloser {
+	if grant == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{grant.Reader(body), body}
+}
+
+// endIfSpent closes both ends of a relay once its credential expired or
+// spent its budget, so the other direction stops as well.
+func endIfSpent(grant *credential.Grant, conns ...io.Closer) {
+	if grant.Check() == nil {
+		return
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
 func isHopHeader(header string) bool {
 	header = strings.ToLower(header)
 	for _, h := range hopHeaders {
@@ -479,3 +1015,23 @@ func isHopHeader(header string) bool {
 	}
 	return false
 }
+
+// connectionHeaderNames returns the headers listed in the Connection header,
+// which only apply to the current hop (RFC 9110 section 7.6.1).
+func connectionHeaderNames(header http.Header) map[string]bool {
+	names := make(map[string]bool)
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[http.CanonicalHeaderKey(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+func removeConnectionHeaders(header http.Header) {
+	for name := range connectionHeaderNames(header) {
+		header.Del(name)
+	}
+}
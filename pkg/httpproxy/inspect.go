@@ -0,0 +1,170 @@
+package httpproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
+)
+
+// Inspects reports whether the CONNECT tunnel of username to host:port is
+// selected for inspection. It is always false without an inspector.
+func (s *Server) Inspects(username, host string, port int) bool {
+	return s.config.Inspector != nil && s.config.Inspector.Inspects(username, host, port)
+}
+
+// Intercept serves a tunnel accepted by another proxy frontend, such as a
+// SOCKS5 CONNECT, as if it had been opened with an HTTP CONNECT request.
+func (s *Server) Intercept(conn net.Conn, target mitm.Target) {
+	logger := s.config.Logger.With().
+		Str("protocol", "http").
+		Str("client_addr", target.ClientAddr).
+		Str("username", target.Username).
+		Str("dest_addr", net.JoinHostPort(target.Host, strconv.Itoa(target.Port))).
+		Logger()
+	s.intercept(conn, target, logger)
+}
+
+// intercept terminates TLS on the client side of an inspected tunnel and
+// forwards the decrypted requests like plain proxy requests. Tunnels that do
+// not carry HTTPS are relayed to the destination unchanged.
+func (s *Server) intercept(conn net.Conn, target mitm.Target, logger zerolog.Logger) {
+	tlsConn, replay, err := s.config.Inspector.Accept(conn, target.Host)
+	if err != nil {
+		logger.Warn().Err(err).Msg("inspection handshake failed")
+		return
+	}
+	if tlsConn == nil {
+		logger.Debug().Msg("tunnel does not carry HTTPS; relaying without inspection")
+		s.relayTunnel(replay, target, logger)
+		return
+	}
+	defer tlsConn.Close()
+
+	state := tlsConn.ConnectionState()
+	logger.Debug().
+		Str("server_name", state.ServerName).
+		Str("alpn", state.NegotiatedProtocol).
+		Msg("inspecting tunnel")
+
+	mitm.Serve(tlsConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(r)
+		requestLogger := s.requestLogger(r).With().Str("username", target.Username).Logger()
+		if sessionTag := target.Params[credential.ParamSession]; sessionTag != "" {
+			requestLogger = requestLogger.With().Str("session", sessionTag).Logger()
+		}
+		s.forwardHTTP(w, r, proxyRequest{
+			username:  target.Username,
+			params:    target.Params,
+			session:   target.Session,
+			grant:     target.Grant,
+			target:    inspectedURL(target, r),
+			logger:    requestLogger,
+			startTime: time.Now(),
+			inspected: true,
+		})
+	}))
+}
+
+// inspectedURL is the destination of a request decrypted from a tunnel. The
+// tunnel's destination is authoritative, whatever Host the request names.
+func inspectedURL(target mitm.Target, r *http.Request) *url.URL {
+	host := target.Host
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	if target.Port != 443 {
+		host = net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	}
+
+	targetURL := &url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.EscapedPath(),
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	if targetURL.Path == "" {
+		targetURL.Path = "/"
+	}
+	return targetURL
+}
+
+// relayTunnel connects conn to the destination of target and copies data
+// both ways until either side is done.
+func (s *Server) relayTunnel(conn net.Conn, target mitm.Target, logger zerolog.Logger) {
+	hostport := net.JoinHostPort(target.Host, strconv.Itoa(target.Port))
+	route, routeRequest, outbound := s.selectRoute(target.Host, hostport, target.Username, target.Params, target.ClientAddr)
+	if route != "" {
+		logger = logger.With().Str("route", route).Logger()
+		target.Session.SetRoute(route)
+	}
+	addrs, err := s.resolveConnectTarget(hostport, s.resolvesLocally(route), logger)
+	if err != nil {
+		logger.Warn().Err(err).Msg("connect blocked by DNS policy")
+		return
+	}
+
+	serverConn, connectedAddr, err := s.dialTarget(addrs, routeRequest, outbound)
+	if err != nil {
+		logger.Error().Err(err).Msg("connect failed")
+		return
+	}
+	defer serverConn.Close()
+	logger = withEgressIP(logger, routeRequest, target.Session)
+
+	startTime := time.Now()
+	uploadCh := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(serverConn, target.Grant.Reader(conn))
+		target.Session.AddUpload(n)
+		endIfSpent(target.Grant, conn, serverConn)
+		uploadCh <- n
+	}()
+	download, _ := io.Copy(conn, target.Grant.Reader(serverConn))
+	target.Session.AddDownload(download)
+	_ = conn.Close()
+	upload := <-uploadCh
+
+	logger.Info().
+		Str("connected_addr", connectedAddr).
+		Str("latency", time.Since(startTime).Round(time.Millisecond).String()).
+		Int64("upload_bytes", upload).
+		Int64("download_bytes", download).
+		Msg("connect completed")
+}
+
+// recordExchange adds an inspected request and its response to the HAR
+// capture, if enabled.
+func (s *Server) recordExchange(r *http.Request, req proxyRequest, resp *http.Response, exchange *upstreamExchange, uploadBytes, downloadBytes int64) {
+	har := s.config.Inspector.HAR()
+	if har == nil {
+		return
+	}
+
+	var serverAddr string
+	if exchange.conn != nil {
+		serverAddr = hostnameOf(exchange.conn.addr)
+	}
+	har.Add(mitm.Exchange{
+		StartedAt:        req.startTime,
+		Duration:         time.Since(req.startTime),
+		Username:         req.username,
+		Method:           r.Method,
+		URL:              req.target,
+		Proto:            r.Proto,
+		RequestHeader:    r.Header.Clone(),
+		RequestBodySize:  uploadBytes,
+		StatusCode:       resp.StatusCode,
+		ResponseProto:    resp.Proto,
+		ResponseHeader:   resp.Header.Clone(),
+		ResponseBodySize: downloadBytes,
+		ServerAddr:       serverAddr,
+	})
+}
@@ -0,0 +1,248 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+)
+
+const (
+	DefaultIdleConnTimeout     = 90 * time.Second
+	DefaultMaxIdleConnsPerHost = 8
+)
+
+// dialPlan is what handleHTTP decided about the destination of a request:
+// the resolved addresses and the outbound of the selected route. It travels
+// to the transport's dialer in the request context.
+type dialPlan struct {
+	addrs        []string
+	routeRequest *routing.Request
+	outbound     routing.Outbound
+	// http1Only keeps h2 out of the protocols offered to the destination,
+	// for requests that switch protocols.
+	http1Only bool
+}
+
+type dialPlanKey struct{}
+
+// upstreamConn remembers which address a pooled connection reached and the
+// source address it was dialed from, so that requests reusing it can log
+// them.
+type upstreamConn struct {
+	net.Conn
+	addr        string
+	sourceIP    net.IP
+	writeFailed atomic.Bool
+}
+
+func (c *upstreamConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil {
+		c.writeFailed.Store(true)
+	}
+	return n, err
+}
+
+// upstreamConnOf unwraps the connection reported by httptrace.
+func upstreamConnOf(conn net.Conn) *upstreamConn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	c, _ := conn.(*upstreamConn)
+	return c
+}
+
+type pooledTransport struct {
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+// transportPool holds one keep-alive transport per route, user and session,
+// so a connection is only reused by requests that would have dialed it the
+// same way. Transports unused for longer than the idle timeout are dropped.
+type transportPool struct {
+	newTransport func() *http.Transport
+	idleTimeout  time.Duration
+
+	mu         sync.Mutex
+	transports map[string]*pooledTransport
+	lastPrune  time.Time
+}
+
+func newTransportPool(idleTimeout time.Duration, newTransport func() *http.Transport) *transportPool {
+	return &transportPool{
+		newTransport: newTransport,
+		idleTimeout:  idleTimeout,
+		transports:   make(map[string]*pooledTransport),
+		lastPrune:    time.Now(),
+	}
+}
+
+func poolKey(route, username, session string) string {
+	return route + "\x00" + username + "\x00" + session
+}
+
+func (p *transportPool) get(key string) *http.Transport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(p.lastPrune) > p.idleTimeout {
+		p.prune(now)
+	}
+
+	pooled, ok := p.transports[key]
+	if !ok {
+		pooled = &pooledTransport{transport: p.newTransport()}
+		p.transports[key] = pooled
+	}
+	pooled.lastUsed = now
+	return pooled.transport
+}
+
+func (p *transportPool) prune(now time.Time) {
+	for key, pooled := range p.transports {
+		if now.Sub(pooled.lastUsed) > p.idleTimeout {
+			pooled.transport.CloseIdleConnections()
+			delete(p.transports, key)
+		}
+	}
+	p.lastPrune = now
+}
+
+func (p *transportPool) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.transports)
+}
+
+func (p *transportPool) closeIdleConnections() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pooled := range p.transports {
+		pooled.transport.CloseIdleConnections()
+	}
+}
+
+func (s *Server) newTransport() *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           s.dialPlanned,
+		TLSClientConfig:       &tls.Config{MinVersion: tls.VersionTLS12},
+		TLSHandshakeTimeout:   s.config.ClientConnTimeout,
+		ResponseHeaderTimeout: s.config.ClientConnTimeout,
+		IdleConnTimeout:       s.config.IdleConnTimeout,
+		MaxIdleConnsPerHost:   s.config.MaxIdleConnsPerHost,
+		// The client negotiates its own encoding; the proxy passes bodies
+		// through untouched.
+		DisableCompression: true,
+	}
+	if s.config.OutboundTLS != nil {
+		transport.DialTLSContext = s.dialPlannedTLS
+		transport.ForceAttemptHTTP2 = s.config.OutboundTLS.OffersHTTP2()
+	}
+	return transport
+}
+
+// dialPlanned dials a new upstream connection for the request that carries
+// the dial plan in its context, through the outbound of the selected route.
+func (s *Server) dialPlanned(ctx context.Context, _, addr string) (net.Conn, error) {
+	plan, ok := ctx.Value(dialPlanKey{}).(*dialPlan)
+	if !ok {
+		return nil, fmt.Errorf("no dial plan for %s", addr)
+	}
+
+	// The transport may finish the dial after the request gave up on it, so
+	// it works on its own copy of the routing request.
+	var routeRequest *routing.Request
+	if plan.routeRequest != nil {
+		attempt := *plan.routeRequest
+		routeRequest = &attempt
+	}
+
+	conn, connectedAddr, err := s.dialTarget(plan.addrs, routeRequest, plan.outbound)
+	if err != nil {
+		return nil, err
+	}
+	upstream := &upstreamConn{Conn: conn, addr: connectedAddr}
+	if routeRequest != nil {
+		upstream.sourceIP = routeRequest.SourceIP
+	}
+	return upstream, nil
+}
+
+// errTLSHandshake wraps failed handshakes with destinations.
+var errTLSHandshake = errors.New("TLS handshake with target failed")
+
+// dialPlannedTLS dials like dialPlanned and completes a TLS handshake with
+// the settings of Config.OutboundTLS for the destination.
+func (s *Server) dialPlannedTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := s.dialPlanned(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := s.config.OutboundTLS.Config(hostnameOf(addr))
+	if plan, _ := ctx.Value(dialPlanKey{}).(*dialPlan); plan != nil && plan.http1Only {
+		conf.NextProtos = slices.DeleteFunc(conf.NextProtos, func(protocol string) bool { return protocol == "h2" })
+	}
+	handshakeCtx, cancel := context.WithTimeout(ctx, s.config.ClientConnTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, conf)
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %w", errTLSHandshake, err)
+	}
+	return tlsConn, nil
+}
+
+// CloseIdleConnections closes the idle upstream connections kept for reuse.
+func (s *Server) CloseIdleConnections() {
+	s.transports.closeIdleConnections()
+}
+
+// upstreamExchange forwards one request through a pooled transport and
+// records which connection carried it, so failures can be reported at the
+// right stage.
+type upstreamExchange struct {
+	plan   *dialPlan
+	conn   *upstreamConn
+	reused bool
+	wrote  atomic.Bool
+}
+
+// sent reports whether the request reached the destination. It is only
+// meaningful once roundTrip has returned.
+func (e *upstreamExchange) sent() bool {
+	// httptrace reports the request as written before the transport flushes
+	// it, so a failed flush only shows on the connection.
+	return e.wrote.Load() && e.conn != nil && !e.conn.writeFailed.Load()
+}
+
+func (e *upstreamExchange) roundTrip(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			e.conn = upstreamConnOf(info.Conn)
+			e.reused = info.Reused
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				e.wrote.Store(true)
+			}
+		},
+	}
+	ctx := context.WithValue(req.Context(), dialPlanKey{}, e.plan)
+	return transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, trace)))
+}
@@ -0,0 +1,120 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// acceptTunnel answers a CONNECT request and returns the client side of the
+// tunnel. HTTP/1 connections are taken over from the server; on HTTP/2 the
+// tunnel is the request stream itself (RFC 9113 section 8.5).
+func acceptTunnel(w http.ResponseWriter, r *http.Request) (net.Conn, error) {
+	if r.ProtoMajor == 2 {
+		controller := http.NewResponseController(w)
+		// Server timeouts would otherwise cut the stream off mid-tunnel.
+		_ = controller.SetReadDeadline(time.Time{})
+		_ = controller.SetWriteDeadline(time.Time{})
+		w.WriteHeader(http.StatusOK)
+		if err := controller.Flush(); err != nil {
+			return nil, err
+		}
+		return &streamTunnel{
+			body:       r.Body,
+			w:          w,
+			controller: controller,
+			localAddr:  tunnelAddr(r.Host),
+			remoteAddr: tunnelAddr(r.RemoteAddr),
+		}, nil
+	}
+
+	clientConn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// The server's read and write timeouts still apply to the taken over
+	// connection and would end long-lived tunnels.
+	_ = clientConn.SetDeadline(time.Time{})
+	_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if buffered.Reader.Buffered() > 0 {
+		// The client did not wait for the reply before sending tunnel data.
+		return &hijackedConn{Conn: clientConn, reader: buffered.Reader}, nil
+	}
+	return clientConn, nil
+}
+
+// hijackedConn reads what the server had already buffered before reading
+// from the connection.
+type hijackedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *hijackedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// streamTunnel adapts an HTTP/2 CONNECT stream: the request body carries
+// client data and every write to the response is flushed as it happens.
+type streamTunnel struct {
+	body       io.ReadCloser
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func (t *streamTunnel) Read(p []byte) (int, error) {
+	return t.body.Read(p)
+}
+
+func (t *streamTunnel) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, t.controller.Flush()
+}
+
+// Close stops reading from the client; the stream ends when the handler
+// returns.
+func (t *streamTunnel) Close() error {
+	return t.body.Close()
+}
+
+func (t *streamTunnel) LocalAddr() net.Addr {
+	return t.localAddr
+}
+
+func (t *streamTunnel) RemoteAddr() net.Addr {
+	return t.remoteAddr
+}
+
+func (t *streamTunnel) SetDeadline(deadline time.Time) error {
+	if err := t.controller.SetReadDeadline(deadline); err != nil {
+		return err
+	}
+	return t.controller.SetWriteDeadline(deadline)
+}
+
+func (t *streamTunnel) SetReadDeadline(deadline time.Time) error {
+	return t.controller.SetReadDeadline(deadline)
+}
+
+func (t *streamTunnel) SetWriteDeadline(deadline time.Time) error {
+	return t.controller.SetWriteDeadline(deadline)
+}
+
+// tunnelAddr is the address of an end of a stream tunnel, as reported by
+// the HTTP/2 server.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "tcp"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,145 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var errUpgradeMismatch = errors.New("destination switched to a protocol the client did not ask for")
+
+// upgradeProtocol returns the protocol an HTTP/1 request asks to switch to
+// (RFC 9110 section 7.8), or "" for ordinary requests. HTTP/2 has no
+// Upgrade mechanism.
+func upgradeProtocol(r *http.Request) string {
+	if r.ProtoMajor != 1 || !connectionHeaderNames(r.Header)["Upgrade"] {
+		return ""
+	}
+	return r.Header.Get("Upgrade")
+}
+
+// responseUpgradeProtocol is the protocol a 101 response switched to.
+func responseUpgradeProtocol(resp *http.Response) string {
+	if !connectionHeaderNames(resp.Header)["Upgrade"] {
+		return ""
+	}
+	return resp.Header.Get("Upgrade")
+}
+
+// addUpgradeHeaders restores the hop-by-hop headers of an upgrade request,
+// which the destination needs to switch protocols.
+func addUpgradeHeaders(proxyReq *http.Request, r *http.Request, protocol string) {
+	connection := []string{"Upgrade"}
+	proxyReq.Header.Set("Upgrade", protocol)
+	// h2c upgrades carry the client's settings in a connection-specific
+	// header (RFC 7540 section 3.2.1).
+	if strings.EqualFold(protocol, "h2c") && r.Header.Get("HTTP2-Settings") != "" {
+		proxyReq.Header.Set("HTTP2-Settings", r.Header.Get("HTTP2-Settings"))
+		connection = append(connection, "HTTP2-Settings")
+	}
+	proxyReq.Header.Set("Connection", strings.Join(connection, ", "))
+}
+
+// switchProtocols completes an upgrade the destination accepted: it sends
+// the 101 response to the client, takes over its connection and relays data
+// both ways until either side is done.
+func (s *Server) switchProtocols(w http.ResponseWriter, r *http.Request, resp *http.Response, req proxyRequest, exchange *upstreamExchange, uploadBytes *atomic.Int64) {
+	requestLogger, session := req.logger, req.session
+
+	protocol := responseUpgradeProtocol(resp)
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok || !strings.EqualFold(protocol, upgradeProtocol(r)) {
+		_ = resp.Body.Close()
+		err := errUpgradeMismatch
+		if !ok {
+			err = fmt.Errorf("%T does not support protocol switches", resp.Body)
+		}
+		requestLogger.Error().
+			Str("upgrade", protocol).
+			Err(err).
+			Msg("failed to switch protocols")
+		s.writeError(w, r, proxyError{
+			status:      http.StatusBadGateway,
+			errorType:   errorHTTPUpgradeFailed,
+			category:    "Protocol switch failed",
+			message:     "Bad gateway: failed to switch protocols",
+			destination: req.target.String(),
+		})
+		return
+	}
+	defer upstream.Close()
+	requestLogger = requestLogger.With().Str("upgrade", protocol).Logger()
+
+	clientConn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		requestLogger.Error().
+			Err(err).
+			Msg("failed to hijack client connection")
+		s.writeError(w, r, internalError(req.target.String()))
+		return
+	}
+	defer clientConn.Close()
+	// The server's timeouts would otherwise end the upgraded connection.
+	_ = clientConn.SetDeadline(time.Time{})
+
+	removeConnectionHeaders(resp.Header)
+	header := make(http.Header, len(resp.Header)+2)
+	for key, values := range resp.Header {
+		if !isHopHeader(key) {
+			header[key] = values
+		}
+	}
+	req.rewrite.Response(header)
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", protocol)
+	switched := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+	}
+	if err := switched.Write(buffered.Writer); err == nil {
+		err = buffered.Writer.Flush()
+	}
+	if err != nil {
+		requestLogger.Error().
+			Err(err).
+			Msg("failed to send switching protocols response")
+		return
+	}
+
+	var client net.Conn = clientConn
+	if buffered.Reader.Buffered() > 0 {
+		// The client did not wait for the 101 before speaking the new protocol.
+		client = &hijackedConn{Conn: clientConn, reader: buffered.Reader}
+	}
+
+	uploadCh := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(upstream, req.grant.Reader(client))
+		session.AddUpload(n)
+		// Upgraded protocols have no half-close, so the connection ends
+		// with either side.
+		_ = upstream.Close()
+		uploadCh <- n
+	}()
+	download, _ := io.Copy(client, req.grant.Reader(upstream))
+	session.AddDownload(download)
+	_ = clientConn.Close()
+	upload := uploadBytes.Load() + <-uploadCh
+
+	if req.inspected {
+		s.recordExchange(r, req, resp, exchange, upload, download)
+	}
+	requestLogger.Info().
+		Int("status_code", resp.StatusCode).
+		Str("latency", time.Since(req.startTime).Round(time.Millisecond).String()).
+		Int64("upload_bytes", upload).
+		Int64("download_bytes", download).
+		Msg("upgrade completed")
+}
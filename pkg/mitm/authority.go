@@ -0,0 +1,285 @@
+package mitm
+
+import (
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheSize    = 1024
+	DefaultLeafValidity = 24 * time.Hour
+	caValidity          = 5 * 365 * 24 * time.Hour
+	// leafRenewMargin is how long before it expires a cached leaf
+	// certificate is replaced.
+	leafRenewMargin = time.Hour
+)
+
+var ErrCAIncomplete = errors.New("both an inspection CA certificate and key file are required")
+
+type AuthorityConfig struct {
+	// CertFile and KeyFile hold the PEM certificate and private key of the
+	// inspection CA. When neither file exists, a CA is generated and written
+	// to them so clients only need to trust it once.
+	CertFile string
+	KeyFile  string
+	// CacheSize is how many leaf certificates are kept. Zero selects
+	// DefaultCacheSize.
+	CacheSize int
+	// LeafValidity is how long minted leaf certificates are valid. Zero
+	// selects DefaultLeafValidity.
+	LeafValidity time.Duration
+}
+
+// Authority mints leaf certificates for inspected hosts from a local CA and
+// caches them.
+type Authority struct {
+	config    AuthorityConfig
+	cert      *x509.Certificate
+	key       crypto.Signer
+	leafKey   *ecdsa.PrivateKey
+	generated bool
+
+	mu     sync.Mutex
+	leaves map[string]*list.Element
+	order  *list.List
+}
+
+type cachedLeaf struct {
+	host string
+	cert *tls.Certificate
+}
+
+func NewAuthority(conf AuthorityConfig) (*Authority, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" {
+		return nil, ErrCAIncomplete
+	}
+	if conf.CacheSize <= 0 {
+		conf.CacheSize = DefaultCacheSize
+	}
+	if conf.LeafValidity <= 0 {
+		conf.LeafValidity = DefaultLeafValidity
+	}
+
+	a := &Authority{
+		config: conf,
+		leaves: make(map[string]*list.Element),
+		order:  list.New(),
+	}
+
+	_, certErr := os.Stat(conf.CertFile)
+	_, keyErr := os.Stat(conf.KeyFile)
+	switch {
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		if err := a.generate(); err != nil {
+			return nil, err
+		}
+	case errors.Is(certErr, os.ErrNotExist) || errors.Is(keyErr, os.ErrNotExist):
+		return nil, ErrCAIncomplete
+	default:
+		if err := a.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	a.leafKey = leafKey
+	return a, nil
+}
+
+func (a *Authority) load() error {
+	pair, err := tls.LoadX509KeyPair(a.config.CertFile, a.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", a.config.CertFile, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !cert.IsCA {
+		return fmt.Errorf("%s is not a CA certificate", a.config.CertFile)
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return fmt.Errorf("%s: unsupported private key", a.config.KeyFile)
+	}
+	a.cert, a.key = cert, key
+	return nil
+}
+
+func (a *Authority) generate() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "nanoproxy inspection CA", Organization: []string{"nanoproxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(a.config.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(a.config.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		return err
+	}
+	a.cert, a.key, a.generated = cert, key, true
+	return nil
+}
+
+// Generated reports whether the CA was created at startup rather than
+// loaded.
+func (a *Authority) Generated() bool {
+	return a.generated
+}
+
+// Certificate returns the CA certificate clients have to trust.
+func (a *Authority) Certificate() *x509.Certificate {
+	return a.cert
+}
+
+// CertificatePEM returns the CA certificate in PEM form, for download.
+func (a *Authority) CertificatePEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw})
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the CA certificate in hex.
+func (a *Authority) Fingerprint() string {
+	sum := sha256.Sum256(a.cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// CachedLeaves returns the number of leaf certificates in the cache.
+func (a *Authority) CachedLeaves() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.order.Len()
+}
+
+// Leaf returns a certificate for host signed by the CA, minting one when
+// the cache holds none that is still valid for a while.
+func (a *Authority) Leaf(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" {
+		return nil, errors.New("leaf certificate needs a host name")
+	}
+
+	now := time.Now()
+	a.mu.Lock()
+	if elem, ok := a.leaves[host]; ok {
+		cached := elem.Value.(*cachedLeaf)
+		if now.Add(leafRenewMargin).Before(cached.cert.Leaf.NotAfter) {
+			a.order.MoveToFront(elem)
+			a.mu.Unlock()
+			return cached.cert, nil
+		}
+		a.order.Remove(elem)
+		delete(a.leaves, host)
+	}
+	a.mu.Unlock()
+
+	cert, err := a.mint(host, now)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.leaves[host]; ok {
+		a.order.Remove(elem)
+	}
+	a.leaves[host] = a.order.PushFront(&cachedLeaf{host: host, cert: cert})
+	for a.order.Len() > a.config.CacheSize {
+		oldest := a.order.Back()
+		a.order.Remove(oldest)
+		delete(a.leaves, oldest.Value.(*cachedLeaf).host)
+	}
+	return cert, nil
+}
+
+func (a *Authority) mint(host string, now time.Time) (*tls.Certificate, error) {
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(a.config.LeafValidity)
+	if notAfter.After(a.cert.NotAfter) {
+		notAfter = a.cert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &a.leafKey.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  a.leafKey,
+		Leaf:        leaf,
+	}, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
@@ -0,0 +1,103 @@
+package mitm
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthority(t *testing.T, conf AuthorityConfig) *Authority {
+	t.Helper()
+
+	dir := t.TempDir()
+	if conf.CertFile == "" {
+		conf.CertFile = filepath.Join(dir, "ca.pem")
+		conf.KeyFile = filepath.Join(dir, "ca.key")
+	}
+	authority, err := NewAuthority(conf)
+	require.NoError(t, err)
+	return authority
+}
+
+func TestNewAuthority_GeneratesAndReusesCA(t *testing.T) {
+	dir := t.TempDir()
+	conf := AuthorityConfig{CertFile: filepath.Join(dir, "ca.pem"), KeyFile: filepath.Join(dir, "ca.key")}
+
+	generated, err := NewAuthority(conf)
+	require.NoError(t, err)
+	assert.True(t, generated.Generated())
+	assert.True(t, generated.Certificate().IsCA)
+	assert.Len(t, generated.Fingerprint(), 64)
+
+	info, err := os.Stat(conf.KeyFile)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	certPEM, err := os.ReadFile(conf.CertFile)
+	require.NoError(t, err)
+	assert.Equal(t, certPEM, generated.CertificatePEM())
+
+	loaded, err := NewAuthority(conf)
+	require.NoError(t, err)
+	assert.False(t, loaded.Generated())
+	assert.Equal(t, generated.Fingerprint(), loaded.Fingerprint())
+}
+
+func TestNewAuthority_RequiresBothFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "ca.pem")
+
+	_, err := NewAuthority(AuthorityConfig{CertFile: certFile})
+	assert.ErrorIs(t, err, ErrCAIncomplete)
+
+	require.NoError(t, os.WriteFile(certFile, []byte("certificate"), 0o600))
+	_, err = NewAuthority(AuthorityConfig{CertFile: certFile, KeyFile: filepath.Join(dir, "ca.key")})
+	assert.ErrorIs(t, err, ErrCAIncomplete)
+}
+
+func TestAuthority_Leaf(t *testing.T) {
+	authority := newTestAuthority(t, AuthorityConfig{CacheSize: 2, LeafValidity: 2 * time.Hour})
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+
+	leaf, err := authority.Leaf("Example.COM.")
+	require.NoError(t, err)
+	_, err = leaf.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	assert.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(2*time.Hour), leaf.Leaf.NotAfter, time.Minute)
+
+	cached, err := authority.Leaf("example.com")
+	require.NoError(t, err)
+	assert.Same(t, leaf, cached)
+
+	ipLeaf, err := authority.Leaf("192.0.2.10")
+	require.NoError(t, err)
+	_, err = ipLeaf.Leaf.Verify(x509.VerifyOptions{DNSName: "192.0.2.10", Roots: roots})
+	assert.NoError(t, err)
+
+	_, err = authority.Leaf("other.example")
+	require.NoError(t, err)
+	assert.Equal(t, 2, authority.CachedLeaves())
+
+	// The least recently used leaf was evicted and is minted again.
+	again, err := authority.Leaf("example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, leaf, again)
+
+	_, err = authority.Leaf("")
+	assert.Error(t, err)
+}
+
+func TestAuthority_LeafRenewedBeforeExpiry(t *testing.T) {
+	authority := newTestAuthority(t, AuthorityConfig{LeafValidity: 30 * time.Minute})
+
+	first, err := authority.Leaf("example.com")
+	require.NoError(t, err)
+	second, err := authority.Leaf("example.com")
+	require.NoError(t, err)
+	assert.NotSame(t, first, second)
+}
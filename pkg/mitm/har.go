@@ -0,0 +1,254 @@
+package mitm
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultHAREntries = 1000
+
+// Exchange is one inspected request and its response.
+type Exchange struct {
+	StartedAt        time.Time
+	Duration         time.Duration
+	Username         string
+	Method           string
+	URL              *url.URL
+	Proto            string
+	RequestHeader    http.Header
+	RequestBodySize  int64
+	StatusCode       int
+	ResponseProto    string
+	ResponseHeader   http.Header
+	ResponseBodySize int64
+	ServerAddr       string
+}
+
+// HAR keeps the most recent inspected exchanges and writes them as an HTTP
+// Archive (HAR 1.2). Bodies are not recorded.
+type HAR struct {
+	limit int
+
+	mu        sync.Mutex
+	exchanges []Exchange
+	next      int
+}
+
+// NewHAR returns a recorder keeping up to limit exchanges. Zero or less
+// selects DefaultHAREntries.
+func NewHAR(limit int) *HAR {
+	if limit <= 0 {
+		limit = DefaultHAREntries
+	}
+	return &HAR{limit: limit}
+}
+
+func (h *HAR) Add(exchange Exchange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.exchanges) < h.limit {
+		h.exchanges = append(h.exchanges, exchange)
+		return
+	}
+	h.exchanges[h.next] = exchange
+	h.next = (h.next + 1) % h.limit
+}
+
+func (h *HAR) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.exchanges)
+}
+
+// Exchanges returns the recorded exchanges, oldest first.
+func (h *HAR) Exchanges() []Exchange {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	exchanges := make([]Exchange, 0, len(h.exchanges))
+	exchanges = append(exchanges, h.exchanges[h.next:]...)
+	return append(exchanges, h.exchanges[:h.next]...)
+}
+
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Username        string      `json:"_username,omitempty"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []harPair   `json:"headers"`
+	QueryString []harPair   `json:"queryString"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harCookie `json:"cookies"`
+	Headers     []harPair   `json:"headers"`
+	Content     harBody     `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harCookie struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPair struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harBody struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// WriteTo writes the recorded exchanges as a HAR document.
+func (h *HAR) WriteTo(w io.Writer) (int64, error) {
+	doc := harLog{Log: harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "nanoproxy", Version: buildVersion()},
+		Entries: []harEntry{},
+	}}
+	for _, exchange := range h.Exchanges() {
+		doc.Log.Entries = append(doc.Log.Entries, harEntryOf(exchange))
+	}
+
+	counter := &countingWriter{Writer: w}
+	encoder := json.NewEncoder(counter)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(doc)
+	return counter.n, err
+}
+
+func harEntryOf(exchange Exchange) harEntry {
+	millis := float64(exchange.Duration) / float64(time.Millisecond)
+	entry := harEntry{
+		StartedDateTime: exchange.StartedAt.UTC().Format(time.RFC3339Nano),
+		Time:            millis,
+		Request: harRequest{
+			Method:      exchange.Method,
+			HTTPVersion: exchange.Proto,
+			Cookies:     harCookies((&http.Request{Header: exchange.RequestHeader}).Cookies()),
+			Headers:     harHeaders(exchange.RequestHeader),
+			QueryString: []harPair{},
+			HeadersSize: -1,
+			BodySize:    exchange.RequestBodySize,
+		},
+		Response: harResponse{
+			Status:      exchange.StatusCode,
+			StatusText:  http.StatusText(exchange.StatusCode),
+			HTTPVersion: exchange.ResponseProto,
+			Cookies:     harCookies((&http.Response{Header: exchange.ResponseHeader}).Cookies()),
+			Headers:     harHeaders(exchange.ResponseHeader),
+			Content: harBody{
+				Size:     exchange.ResponseBodySize,
+				MimeType: exchange.ResponseHeader.Get("Content-Type"),
+			},
+			RedirectURL: exchange.ResponseHeader.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    exchange.ResponseBodySize,
+		},
+		Timings:         harTimings{Send: 0, Wait: millis, Receive: 0},
+		ServerIPAddress: exchange.ServerAddr,
+		Username:        exchange.Username,
+	}
+	if exchange.URL != nil {
+		entry.Request.URL = exchange.URL.String()
+		for name, values := range exchange.URL.Query() {
+			for _, value := range values {
+				entry.Request.QueryString = append(entry.Request.QueryString, harPair{Name: name, Value: value})
+			}
+		}
+		sort.Slice(entry.Request.QueryString, func(a, b int) bool {
+			return entry.Request.QueryString[a].Name < entry.Request.QueryString[b].Name
+		})
+	}
+	return entry
+}
+
+func harHeaders(header http.Header) []harPair {
+	pairs := []harPair{}
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			pairs = append(pairs, harPair{Name: name, Value: value})
+		}
+	}
+	return pairs
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	pairs := []harCookie{}
+	for _, cookie := range cookies {
+		pairs = append(pairs, harCookie{Name: cookie.Name, Value: cookie.Value})
+	}
+	return pairs
+}
+
+func buildVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "devel"
+}
+
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n += int64(n)
+	return n, err
+}
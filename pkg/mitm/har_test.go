@@ -0,0 +1,96 @@
+package mitm
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHAR_KeepsMostRecentExchanges(t *testing.T) {
+	har := NewHAR(2)
+	for _, method := range []string{"GET", "POST", "PUT"} {
+		har.Add(Exchange{Method: method})
+	}
+
+	assert.Equal(t, 2, har.Len())
+	exchanges := har.Exchanges()
+	require.Len(t, exchanges, 2)
+	assert.Equal(t, "POST", exchanges[0].Method)
+	assert.Equal(t, "PUT", exchanges[1].Method)
+}
+
+func TestHAR_WriteTo(t *testing.T) {
+	har := NewHAR(0)
+	target, err := url.Parse("https://api.example.com/items?page=2")
+	require.NoError(t, err)
+	har.Add(Exchange{
+		StartedAt:        time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Duration:         1500 * time.Millisecond,
+		Username:         "qa",
+		Method:           http.MethodGet,
+		URL:              target,
+		Proto:            "HTTP/2.0",
+		RequestHeader:    http.Header{"Cookie": {"session=abc"}, "Accept": {"application/json"}},
+		StatusCode:       http.StatusOK,
+		ResponseProto:    "HTTP/1.1",
+		ResponseHeader:   http.Header{"Content-Type": {"application/json"}},
+		ResponseBodySize: 42,
+		ServerAddr:       "192.0.2.10",
+	})
+
+	var buf bytes.Buffer
+	n, err := har.WriteTo(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, int64(buf.Len()), n)
+
+	var doc struct {
+		Log struct {
+			Version string `json:"version"`
+			Creator struct {
+				Name string `json:"name"`
+			} `json:"creator"`
+			Entries []struct {
+				StartedDateTime string  `json:"startedDateTime"`
+				Time            float64 `json:"time"`
+				Username        string  `json:"_username"`
+				ServerIPAddress string  `json:"serverIPAddress"`
+				Request         struct {
+					URL         string    `json:"url"`
+					Cookies     []harPair `json:"cookies"`
+					Headers     []harPair `json:"headers"`
+					QueryString []harPair `json:"queryString"`
+				} `json:"request"`
+				Response struct {
+					Status  int `json:"status"`
+					Content struct {
+						Size     int64  `json:"size"`
+						MimeType string `json:"mimeType"`
+					} `json:"content"`
+				} `json:"response"`
+			} `json:"entries"`
+		} `json:"log"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &doc))
+
+	assert.Equal(t, "1.2", doc.Log.Version)
+	assert.Equal(t, "nanoproxy", doc.Log.Creator.Name)
+	require.Len(t, doc.Log.Entries, 1)
+	entry := doc.Log.Entries[0]
+	assert.Equal(t, "2026-01-02T03:04:05Z", entry.StartedDateTime)
+	assert.Equal(t, 1500.0, entry.Time)
+	assert.Equal(t, "qa", entry.Username)
+	assert.Equal(t, "192.0.2.10", entry.ServerIPAddress)
+	assert.Equal(t, "https://api.example.com/items?page=2", entry.Request.URL)
+	assert.Equal(t, []harPair{{Name: "session", Value: "abc"}}, entry.Request.Cookies)
+	assert.Equal(t, []harPair{{Name: "Accept", Value: "application/json"}, {Name: "Cookie", Value: "session=abc"}}, entry.Request.Headers)
+	assert.Equal(t, []harPair{{Name: "page", Value: "2"}}, entry.Request.QueryString)
+	assert.Equal(t, http.StatusOK, entry.Response.Status)
+	assert.Equal(t, int64(42), entry.Response.Content.Size)
+	assert.Equal(t, "application/json", entry.Response.Content.MimeType)
+}
@@ -0,0 +1,277 @@
+// Package mitm implements the HTTPS inspection mode. CONNECT tunnels
+// selected by user and domain rules are terminated with leaf certificates
+// minted from a local CA, so the requests inside them can be handled like
+// plain HTTP proxy requests.
+package mitm
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
+)
+
+const (
+	// clientHelloTimeout bounds how long a client may take to start the TLS
+	// handshake of an inspected tunnel.
+	clientHelloTimeout = 10 * time.Second
+	idleTimeout        = 60 * time.Second
+)
+
+// Target describes a CONNECT tunnel handed over for inspection.
+type Target struct {
+	Username string
+	// Params are the username parameters of the client.
+	Params     map[string]string
+	Host       string
+	Port       int
+	ClientAddr string
+	// Session, when set, is the traffic session of the tunnel that the
+	// inspected requests are accounted to.
+	Session *traffic.Session
+	// Grant, when set, restricts the tunnel to what the ephemeral credential
+	// of the client allows.
+	Grant *credential.Grant
+}
+
+// Interceptor serves the CONNECT tunnels selected for inspection.
+type Interceptor interface {
+	// Inspects reports whether the tunnel of username to host:port is to be
+	// inspected.
+	Inspects(username, host string, port int) bool
+	// Intercept serves conn, whose client was already told the tunnel is
+	// established, until the client is done with it.
+	Intercept(conn net.Conn, target Target)
+}
+
+type Config struct {
+	Authority *Authority
+	// Users are the users whose tunnels are inspected. Empty selects every
+	// user.
+	Users []string
+	// Domains are the destinations inspected, with their subdomains. Empty
+	// selects every destination.
+	Domains []string
+	// ExcludeDomains are never inspected, e.g. for clients that pin
+	// certificates.
+	ExcludeDomains []string
+	// Ports are the destination ports inspected. Empty selects 443.
+	Ports []int
+	// HAR, when set, records the inspected exchanges.
+	HAR *HAR
+}
+
+type Inspector struct {
+	config Config
+}
+
+func New(conf Config) *Inspector {
+	conf.Domains = normalizeDomains(conf.Domains)
+	conf.ExcludeDomains = normalizeDomains(conf.ExcludeDomains)
+	if len(conf.Ports) == 0 {
+		conf.Ports = []int{443}
+	}
+	return &Inspector{config: conf}
+}
+
+func (i *Inspector) Authority() *Authority {
+	return i.config.Authority
+}
+
+func (i *Inspector) HAR() *HAR {
+	return i.config.HAR
+}
+
+// Inspects reports whether the rules select the tunnel of username to
+// host:port.
+func (i *Inspector) Inspects(username, host string, port int) bool {
+	if !slices.Contains(i.config.Ports, port) {
+		return false
+	}
+	if len(i.config.Users) > 0 && !slices.Contains(i.config.Users, username) {
+		return false
+	}
+	if matchDomain(i.config.ExcludeDomains, host) {
+		return false
+	}
+	return len(i.config.Domains) == 0 || matchDomain(i.config.Domains, host)
+}
+
+// Accept reads the TLS ClientHello from conn. When the client speaks TLS and
+// offers HTTP, Accept terminates TLS with a certificate for the requested
+// server name, or host when it sent none, and returns the decrypted
+// connection. Otherwise it returns nil and a connection that replays what
+// was read, to be tunnelled unchanged.
+func (i *Inspector) Accept(conn net.Conn, host string) (*tls.Conn, net.Conn, error) {
+	_ = conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	hello, replay := peekClientHello(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if hello == nil || !offersHTTP(hello.SupportedProtos) {
+		return nil, replay, nil
+	}
+
+	serverName := hello.ServerName
+	if serverName == "" {
+		serverName = host
+	}
+	leaf, err := i.config.Authority.Leaf(serverName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConn := tls.Server(replay, &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{*leaf},
+		NextProtos:   []string{"h2", "http/1.1"},
+	})
+	_ = tlsConn.SetDeadline(time.Now().Add(clientHelloTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	_ = tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil, nil
+}
+
+// offersHTTP reports whether a client offering protos over ALPN can be
+// served HTTP. A client without ALPN is taken to speak HTTP/1.1.
+func offersHTTP(protos []string) bool {
+	return len(protos) == 0 || slices.Contains(protos, "h2") || slices.Contains(protos, "http/1.1")
+}
+
+// Serve serves the HTTP/1.1 or HTTP/2 requests the client sends over an
+// accepted connection with handler, until the client closes it or leaves it
+// idle.
+func Serve(conn *tls.Conn, handler http.Handler) {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+
+	listener := newConnListener(conn)
+	server := &http.Server{
+		Handler:           handler,
+		Protocols:         protocols,
+		ReadHeaderTimeout: clientHelloTimeout,
+		IdleTimeout:       idleTimeout,
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ConnState: func(_ net.Conn, state http.ConnState) {
+			if state == http.StateClosed || state == http.StateHijacked {
+				listener.Close()
+			}
+		},
+	}
+	_ = server.Serve(listener)
+}
+
+// connListener hands out a single connection and then blocks until it is
+// closed.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+	close  sync.Once
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	l.close.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+var errPeeked = errors.New("client hello peeked")
+
+// peekClientHello parses the ClientHello on conn without answering it. It
+// returns nil when the client does not speak TLS, and in any case a
+// connection that replays the bytes read.
+func peekClientHello(conn net.Conn) (*tls.ClientHelloInfo, net.Conn) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(&recordingConn{Conn: conn, read: &read}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &tls.ClientHelloInfo{
+				ServerName:      info.ServerName,
+				SupportedProtos: slices.Clone(info.SupportedProtos),
+			}
+			return nil, errPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errPeeked) {
+		hello = nil
+	}
+	return hello, &replayConn{Conn: conn, reader: io.MultiReader(&read, conn)}
+}
+
+// recordingConn keeps what is read from the connection and discards what is
+// written, so a handshake can inspect the client without the client noticing.
+type recordingConn struct {
+	net.Conn
+	read *bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Write(p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+type replayConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func normalizeDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		domain = strings.TrimPrefix(domain, "*.")
+		domain = strings.Trim(domain, ".")
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+func matchDomain(suffixes []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
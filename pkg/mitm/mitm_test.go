@@ -0,0 +1,137 @@
+package mitm
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector_Inspects(t *testing.T) {
+	inspector := New(Config{
+		Users:          []string{"qa"},
+		Domains:        []string{"*.Example.com."},
+		ExcludeDomains: []string{"pinned.example.com"},
+	})
+
+	assert.True(t, inspector.Inspects("qa", "example.com", 443))
+	assert.True(t, inspector.Inspects("qa", "api.example.com", 443))
+	assert.False(t, inspector.Inspects("qa", "api.example.com", 8443))
+	assert.False(t, inspector.Inspects("qa", "pinned.example.com", 443))
+	assert.False(t, inspector.Inspects("qa", "example.org", 443))
+	assert.False(t, inspector.Inspects("alice", "example.com", 443))
+
+	everything := New(Config{Ports: []int{443, 8443}})
+	assert.True(t, everything.Inspects("alice", "example.org", 8443))
+	assert.False(t, everything.Inspects("alice", "example.org", 80))
+}
+
+func TestInspector_AcceptAndServe(t *testing.T) {
+	authority := newTestAuthority(t, AuthorityConfig{})
+	inspector := New(Config{Authority: authority})
+	roots := x509.NewCertPool()
+	roots.AddCert(authority.Certificate())
+
+	for _, proto := range []string{"http/1.1", "h2"} {
+		t.Run(proto, func(t *testing.T) {
+			clientSide, proxySide := net.Pipe()
+			defer clientSide.Close()
+
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				tlsConn, replay, err := inspector.Accept(proxySide, "fallback.example")
+				if !assert.NoError(t, err) || !assert.Nil(t, replay) {
+					return
+				}
+				assert.Equal(t, proto, tlsConn.ConnectionState().NegotiatedProtocol)
+				Serve(tlsConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					_, _ = io.WriteString(w, r.Proto+" "+r.Host+r.URL.Path)
+				}))
+			}()
+
+			transport := &http.Transport{
+				DialTLSContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					conn := tls.Client(clientSide, &tls.Config{ServerName: "api.example.com", RootCAs: roots, NextProtos: []string{proto}})
+					return conn, conn.Handshake()
+				},
+				ForceAttemptHTTP2: proto == "h2",
+			}
+			resp, err := (&http.Client{Transport: transport, Timeout: 5 * time.Second}).Get("https://api.example.com/path")
+			require.NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			wantProto := "HTTP/1.1"
+			if proto == "h2" {
+				wantProto = "HTTP/2.0"
+			}
+			assert.Equal(t, wantProto+" api.example.com/path", string(body))
+
+			transport.CloseIdleConnections()
+			_ = clientSide.Close()
+			<-served
+		})
+	}
+}
+
+func TestInspector_AcceptReplaysOtherTraffic(t *testing.T) {
+	inspector := New(Config{Authority: newTestAuthority(t, AuthorityConfig{})})
+
+	t.Run("not TLS", func(t *testing.T) {
+		clientSide, proxySide := net.Pipe()
+		defer clientSide.Close()
+
+		go func() { _, _ = clientSide.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n")) }()
+
+		tlsConn, replay, err := inspector.Accept(proxySide, "example.com")
+		require.NoError(t, err)
+		assert.Nil(t, tlsConn)
+		data := make([]byte, len("SSH-2.0-OpenSSH_9.6\r\n"))
+		_, err = io.ReadFull(replay, data)
+		require.NoError(t, err)
+		assert.Equal(t, "SSH-2.0-OpenSSH_9.6\r\n", string(data))
+	})
+
+	t.Run("TLS without HTTP", func(t *testing.T) {
+		clientSide, proxySide := net.Pipe()
+		defer clientSide.Close()
+
+		hello := make(chan []byte, 1)
+		go func() {
+			conn := tls.Client(&capturingConn{Conn: clientSide, written: hello}, &tls.Config{ServerName: "mqtt.example.com", NextProtos: []string{"mqtt"}})
+			_ = conn.Handshake()
+		}()
+
+		tlsConn, replay, err := inspector.Accept(proxySide, "example.com")
+		require.NoError(t, err)
+		assert.Nil(t, tlsConn)
+		sent := <-hello
+		replayed := make([]byte, len(sent))
+		_, err = io.ReadFull(replay, replayed)
+		require.NoError(t, err)
+		assert.Equal(t, sent, replayed)
+	})
+}
+
+// capturingConn reports the first write, the ClientHello, to written.
+type capturingConn struct {
+	net.Conn
+	written chan []byte
+	done    bool
+}
+
+func (c *capturingConn) Write(p []byte) (int, error) {
+	if !c.done {
+		c.done = true
+		c.written <- append([]byte(nil), p...)
+	}
+	return c.Conn.Write(p)
+}
@@ -0,0 +1,251 @@
+// Package outboundtls configures the TLS connections the proxy opens to
+// destinations: the certificate authorities trusted, the minimum version and
+// the application protocols offered, and per-destination client
+// certificates and server names.
+package outboundtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+)
+
+// File is the on-disk per-destination TLS configuration.
+type File struct {
+	Destinations []Destination `json:"destinations"`
+}
+
+// Destination overrides the TLS settings for the destinations it names. The
+// first destination matching a host applies.
+type Destination struct {
+	// Domains match themselves and every name below them.
+	Domains []string `json:"domains"`
+	// ServerName replaces the destination host in SNI and certificate
+	// verification.
+	ServerName string `json:"server_name,omitempty"`
+	// CertFile and KeyFile are the client certificate presented when the
+	// destination asks for one.
+	CertFile string `json:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty"`
+	// CAFile is a PEM bundle trusted for these destinations in addition to
+	// the shared roots.
+	CAFile string `json:"ca_file,omitempty"`
+	// MinVersion and ALPN replace the shared settings when set.
+	MinVersion string   `json:"min_version,omitempty"`
+	ALPN       []string `json:"alpn,omitempty"`
+}
+
+// LoadFile reads a JSON per-destination TLS configuration file.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse outbound TLS file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Config holds the settings shared by every destination.
+type Config struct {
+	// CAFile is a PEM bundle trusted in addition to the system roots, such
+	// as the certificate authority of internal services.
+	CAFile string
+	// MinVersion is "1.2" or "1.3". Empty selects TLS 1.2.
+	MinVersion string
+	// ALPN lists the application protocols offered, such as "h2" and
+	// "http/1.1", in order of preference. Empty offers none, which speaks
+	// HTTP/1.1.
+	ALPN         []string
+	Destinations []Destination
+}
+
+// Client builds the TLS configurations of connections to destinations.
+type Client struct {
+	base         *tls.Config
+	destinations []destination
+}
+
+type destination struct {
+	domains []string
+	config  *tls.Config
+	// serverName is empty when the destination host is used.
+	serverName string
+}
+
+// New loads the certificate files named by conf.
+func New(conf Config) (*Client, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if conf.CAFile != "" {
+		if err := appendCAFile(roots, conf.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	minVersion, err := ParseVersion(conf.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	alpn, err := parseALPN(conf.ALPN)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{base: &tls.Config{RootCAs: roots, MinVersion: minVersion, NextProtos: alpn}}
+	for i, d := range conf.Destinations {
+		compiled, err := c.compileDestination(d)
+		if err != nil {
+			return nil, fmt.Errorf("destination %d: %w", i+1, err)
+		}
+		c.destinations = append(c.destinations, compiled)
+	}
+	return c, nil
+}
+
+// Config returns the TLS configuration for a connection to host. The
+// configuration is a copy the caller may change.
+func (c *Client) Config(host string) *tls.Config {
+	conf, serverName := c.base, host
+	for _, d := range c.destinations {
+		if routing.MatchDomain(d.domains, host) {
+			conf = d.config
+			if d.serverName != "" {
+				serverName = d.serverName
+			}
+			break
+		}
+	}
+	conf = conf.Clone()
+	conf.ServerName = serverName
+	return conf
+}
+
+// OffersHTTP2 reports whether h2 is offered to any destination.
+func (c *Client) OffersHTTP2() bool {
+	if slices.Contains(c.base.NextProtos, "h2") {
+		return true
+	}
+	for _, d := range c.destinations {
+		if slices.Contains(d.config.NextProtos, "h2") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) compileDestination(d Destination) (destination, error) {
+	compiled := destination{serverName: strings.TrimSpace(d.ServerName)}
+	for _, domain := range d.Domains {
+		if name := normalizeDomain(domain); name != "" {
+			compiled.domains = append(compiled.domains, name)
+		}
+	}
+	if len(compiled.domains) == 0 {
+		return destination{}, errors.New("no domains")
+	}
+
+	conf := c.base.Clone()
+	if d.CAFile != "" {
+		conf.RootCAs = conf.RootCAs.Clone()
+		if err := appendCAFile(conf.RootCAs, d.CAFile); err != nil {
+			return destination{}, err
+		}
+	}
+	if d.CertFile != "" || d.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(d.CertFile, d.KeyFile)
+		if err != nil {
+			return destination{}, fmt.Errorf("client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	if d.MinVersion != "" {
+		version, err := ParseVersion(d.MinVersion)
+		if err != nil {
+			return destination{}, err
+		}
+		conf.MinVersion = version
+	}
+	if len(d.ALPN) > 0 {
+		alpn, err := parseALPN(d.ALPN)
+		if err != nil {
+			return destination{}, err
+		}
+		conf.NextProtos = alpn
+	}
+	compiled.config = conf
+	return compiled, nil
+}
+
+// ParseVersion parses a minimum TLS version, "1.2" or "1.3". An empty string
+// selects TLS 1.2.
+func ParseVersion(value string) (uint16, error) {
+	switch strings.TrimSpace(value) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS version %q", value)
+	}
+}
+
+// parseALPN validates application protocol names. Only the protocols the
+// proxy can speak to destinations are accepted.
+func parseALPN(protocols []string) ([]string, error) {
+	var alpn []string
+	for _, protocol := range protocols {
+		switch protocol = strings.TrimSpace(protocol); protocol {
+		case "":
+		case "h2", "http/1.1":
+			if !slices.Contains(alpn, protocol) {
+				alpn = append(alpn, protocol)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported ALPN protocol %q", protocol)
+		}
+	}
+	return alpn, nil
+}
+
+func appendCAFile(pool *x509.CertPool, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", path)
+	}
+	return nil
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.TrimPrefix(domain, ".")
+	return strings.TrimSuffix(domain, ".")
+}
+
+// IsCertificateError reports whether err is a failure to verify the
+// certificate of a destination.
+func IsCertificateError(err error) bool {
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
@@ -0,0 +1,125 @@
+package outboundtls
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/tlscert"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyPair(t *testing.T, dir, host string) (string, string, *x509.Certificate) {
+	t.Helper()
+
+	cert, err := tlscert.GenerateSelfSigned([]string{host}, time.Hour)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, host+".pem")
+	keyFile := filepath.Join(dir, host+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile, cert.Leaf
+}
+
+func TestClient_Config(t *testing.T) {
+	dir := t.TempDir()
+	sharedCA, _, sharedLeaf := writeKeyPair(t, dir, "shared.internal")
+	apiCA, _, apiLeaf := writeKeyPair(t, dir, "api.internal")
+	clientCert, clientKey, _ := writeKeyPair(t, dir, "client.internal")
+
+	client, err := New(Config{
+		CAFile:     sharedCA,
+		MinVersion: "1.3",
+		ALPN:       []string{"http/1.1"},
+		Destinations: []Destination{{
+			Domains:    []string{"*.API.internal."},
+			ServerName: "api.internal",
+			CertFile:   clientCert,
+			KeyFile:    clientKey,
+			CAFile:     apiCA,
+			MinVersion: "1.2",
+			ALPN:       []string{"h2", "http/1.1", "h2"},
+		}},
+	})
+	require.NoError(t, err)
+	assert.True(t, client.OffersHTTP2())
+
+	shared := client.Config("www.example.com")
+	assert.Equal(t, "www.example.com", shared.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), shared.MinVersion)
+	assert.Equal(t, []string{"http/1.1"}, shared.NextProtos)
+	assert.Empty(t, shared.Certificates)
+	_, err = sharedLeaf.Verify(x509.VerifyOptions{Roots: shared.RootCAs})
+	assert.NoError(t, err)
+	_, err = apiLeaf.Verify(x509.VerifyOptions{Roots: shared.RootCAs})
+	assert.Error(t, err)
+
+	api := client.Config("eu.api.internal")
+	assert.Equal(t, "api.internal", api.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS12), api.MinVersion)
+	assert.Equal(t, []string{"h2", "http/1.1"}, api.NextProtos)
+	assert.Len(t, api.Certificates, 1)
+	_, err = apiLeaf.Verify(x509.VerifyOptions{Roots: api.RootCAs})
+	assert.NoError(t, err)
+	_, err = sharedLeaf.Verify(x509.VerifyOptions{Roots: api.RootCAs})
+	assert.NoError(t, err)
+
+	// Configurations are copies.
+	api.ServerName = "changed"
+	assert.Equal(t, "api.internal", client.Config("api.internal").ServerName)
+}
+
+func TestNew_RejectsInvalidConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeKeyPair(t, dir, "client.internal")
+	notPEM := filepath.Join(dir, "not.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0o600))
+
+	for name, conf := range map[string]Config{
+		"missing ca":        {CAFile: filepath.Join(dir, "missing.pem")},
+		"empty ca":          {CAFile: notPEM},
+		"version":           {MinVersion: "1.1"},
+		"alpn":              {ALPN: []string{"spdy/3"}},
+		"no domains":        {Destinations: []Destination{{ServerName: "api.internal"}}},
+		"key without cert":  {Destinations: []Destination{{Domains: []string{"a.internal"}, KeyFile: keyFile}}},
+		"mismatched key":    {Destinations: []Destination{{Domains: []string{"a.internal"}, CertFile: certFile, KeyFile: certFile}}},
+		"destination alpn":  {Destinations: []Destination{{Domains: []string{"a.internal"}, ALPN: []string{"h3"}}}},
+		"destination range": {Destinations: []Destination{{Domains: []string{"a.internal"}, MinVersion: "1.0"}}},
+	} {
+		_, err := New(conf)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbound-tls.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"destinations": [{"domains": ["api.internal"], "server_name": "gateway.internal", "alpn": ["h2"]}]}`), 0o600))
+
+	file, err := LoadFile(path)
+	require.NoError(t, err)
+	require.Len(t, file.Destinations, 1)
+	assert.Equal(t, []string{"api.internal"}, file.Destinations[0].Domains)
+	assert.Equal(t, "gateway.internal", file.Destinations[0].ServerName)
+	assert.Equal(t, []string{"h2"}, file.Destinations[0].ALPN)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
+
+func TestIsCertificateError(t *testing.T) {
+	assert.True(t, IsCertificateError(fmt.Errorf("dial: %w", &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}})))
+	assert.True(t, IsCertificateError(x509.HostnameError{Host: "example.com"}))
+	assert.False(t, IsCertificateError(errors.New("connection reset")))
+}
@@ -0,0 +1,332 @@
+// Package pac generates proxy auto-config files (PAC) that send browsers to
+// the proxy listeners, except for bypassed destinations, which they reach
+// directly. The same script is served for Web Proxy Auto-Discovery (WPAD).
+package pac
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of PAC files.
+const ContentType = "application/x-ns-proxy-autoconfig"
+
+// File is the on-disk PAC configuration.
+type File struct {
+	Bypass Bypass `json:"bypass"`
+	// Users get their own PAC file at /users/{name}/proxy.pac.
+	Users map[string]User `json:"users,omitempty"`
+}
+
+// Bypass lists the destinations browsers reach directly.
+type Bypass struct {
+	// Domains bypass themselves and every name below them. A leading "*."
+	// is ignored.
+	Domains []string `json:"domains,omitempty"`
+	// CIDRs bypass destinations whose IPv4 address is in one of the
+	// ranges. Browsers resolve the name to check them.
+	CIDRs []string `json:"cidrs,omitempty"`
+	// PlainHosts bypasses names without a dot, such as "intranet".
+	PlainHosts bool `json:"plain_hosts,omitempty"`
+}
+
+// User customizes the PAC file of one user.
+type User struct {
+	// Proxies replace the listeners of the proxy, as PAC directives such as
+	// "PROXY proxy-eu.example.com:8080" or "SOCKS5 10.0.0.1:1080".
+	Proxies []string `json:"proxies,omitempty"`
+	// Bypass is added to the global bypass.
+	Bypass Bypass `json:"bypass"`
+}
+
+// LoadFile reads a JSON PAC configuration file.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse PAC file %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// Config describes the listeners PAC files point to.
+type Config struct {
+	File File
+	// Host is the public name or address of the listeners. Empty uses the
+	// host the PAC file was requested from.
+	Host string
+	// HTTPSPort, HTTPPort and SOCKS5Port are the ports of the HTTPS proxy,
+	// HTTP proxy and SOCKS5 listeners, in the order browsers try them.
+	// Zero leaves a listener out.
+	HTTPSPort  int
+	HTTPPort   int
+	SOCKS5Port int
+}
+
+type rules struct {
+	domains    []string
+	nets       []*net.IPNet
+	plainHosts bool
+}
+
+type userRules struct {
+	proxies []string
+	bypass  rules
+}
+
+// Generator writes the PAC files.
+type Generator struct {
+	config Config
+	bypass rules
+	users  map[string]userRules
+}
+
+// New validates the PAC configuration.
+func New(conf Config) (*Generator, error) {
+	if conf.HTTPSPort == 0 && conf.HTTPPort == 0 && conf.SOCKS5Port == 0 {
+		return nil, fmt.Errorf("no proxy listener to point to")
+	}
+	conf.Host = strings.TrimSpace(conf.Host)
+	if conf.Host != "" && !validHost(conf.Host) {
+		return nil, fmt.Errorf("invalid proxy host %q", conf.Host)
+	}
+
+	g := &Generator{config: conf, users: make(map[string]userRules, len(conf.File.Users))}
+	var err error
+	if g.bypass, err = compileBypass(conf.File.Bypass); err != nil {
+		return nil, fmt.Errorf("bypass: %w", err)
+	}
+	for name, user := range conf.File.Users {
+		compiled, err := compileUser(user, g.bypass)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", name, err)
+		}
+		g.users[name] = compiled
+	}
+	return g, nil
+}
+
+// Users returns the names of the users with their own PAC file, sorted.
+func (g *Generator) Users() []string {
+	users := make([]string, 0, len(g.users))
+	for name := range g.users {
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Script returns the PAC file of username, or the shared one when username
+// is empty. requestHost is the host the file was requested from, used when
+// Config.Host is empty. It returns false for users without their own file.
+func (g *Generator) Script(requestHost, username string) (string, bool) {
+	bypass, proxies := g.bypass, g.listeners(requestHost)
+	if username != "" {
+		user, ok := g.users[username]
+		if !ok {
+			return "", false
+		}
+		bypass = user.bypass
+		if len(user.proxies) > 0 {
+			proxies = user.proxies
+		}
+	}
+	return script(bypass, proxies), true
+}
+
+// ServeHTTP serves /proxy.pac, /wpad.dat and /users/{name}/proxy.pac.
+func (g *Generator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var username string
+	switch path := r.URL.Path; {
+	case path == "/proxy.pac" || path == "/wpad.dat":
+	case strings.HasPrefix(path, "/users/") && strings.HasSuffix(path, "/proxy.pac"):
+		username = strings.TrimSuffix(strings.TrimPrefix(path, "/users/"), "/proxy.pac")
+		if username == "" || strings.Contains(username, "/") {
+			http.NotFound(w, r)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	content, ok := g.Script(r.Host, username)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("Cache-Control", "max-age=300")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write([]byte(content))
+}
+
+// listeners returns the PAC directives of the proxy listeners.
+func (g *Generator) listeners(requestHost string) []string {
+	host := g.config.Host
+	if host == "" {
+		host = requestHost
+		if h, _, err := net.SplitHostPort(requestHost); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if !validHost(host) {
+			host = "localhost"
+		}
+	}
+
+	var proxies []string
+	if g.config.HTTPSPort != 0 {
+		proxies = append(proxies, "HTTPS "+net.JoinHostPort(host, strconv.Itoa(g.config.HTTPSPort)))
+	}
+	if g.config.HTTPPort != 0 {
+		proxies = append(proxies, "PROXY "+net.JoinHostPort(host, strconv.Itoa(g.config.HTTPPort)))
+	}
+	if g.config.SOCKS5Port != 0 {
+		proxies = append(proxies, "SOCKS5 "+net.JoinHostPort(host, strconv.Itoa(g.config.SOCKS5Port)))
+	}
+	return proxies
+}
+
+// script writes FindProxyForURL. Names are matched before addresses so that
+// bypassed names are not resolved, and the name is resolved at most once.
+func script(bypass rules, proxies []string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("  host = host.toLowerCase();\n")
+	if bypass.plainHosts {
+		b.WriteString("  if (isPlainHostName(host)) return \"DIRECT\";\n")
+	}
+	for _, domain := range bypass.domains {
+		fmt.Fprintf(&b, "  if (host == %q || dnsDomainIs(host, %q)) return \"DIRECT\";\n", domain, "."+domain)
+	}
+	if len(bypass.nets) > 0 {
+		b.WriteString("  var addr = dnsResolve(host);\n")
+		b.WriteString("  if (addr) {\n")
+		for _, ipNet := range bypass.nets {
+			fmt.Fprintf(&b, "    if (isInNet(addr, %q, %q)) return \"DIRECT\";\n", ipNet.IP.String(), net.IP(ipNet.Mask).String())
+		}
+		b.WriteString("  }\n")
+	}
+	fmt.Fprintf(&b, "  return %q;\n", strings.Join(proxies, "; "))
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func compileUser(user User, global rules) (userRules, error) {
+	compiled := userRules{}
+	for _, proxy := range user.Proxies {
+		directive, err := parseDirective(proxy)
+		if err != nil {
+			return userRules{}, err
+		}
+		compiled.proxies = append(compiled.proxies, directive)
+	}
+
+	own, err := compileBypass(user.Bypass)
+	if err != nil {
+		return userRules{}, fmt.Errorf("bypass: %w", err)
+	}
+	compiled.bypass = rules{
+		domains:    append(append([]string(nil), global.domains...), own.domains...),
+		nets:       append(append([]*net.IPNet(nil), global.nets...), own.nets...),
+		plainHosts: global.plainHosts || own.plainHosts,
+	}
+	return compiled, nil
+}
+
+func compileBypass(bypass Bypass) (rules, error) {
+	compiled := rules{plainHosts: bypass.PlainHosts}
+	for _, domain := range bypass.Domains {
+		name := strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), "."), "*.")
+		name = strings.TrimPrefix(name, ".")
+		if !validHost(name) {
+			return rules{}, fmt.Errorf("invalid domain %q", domain)
+		}
+		compiled.domains = append(compiled.domains, name)
+	}
+	for _, cidr := range bypass.CIDRs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return rules{}, err
+		}
+		if ipNet.IP.To4() == nil {
+			// isInNet only handles IPv4 addresses.
+			return rules{}, fmt.Errorf("%s: only IPv4 ranges are supported", cidr)
+		}
+		ipNet.IP = ipNet.IP.To4()
+		ipNet.Mask = ipNet.Mask[len(ipNet.Mask)-net.IPv4len:]
+		compiled.nets = append(compiled.nets, ipNet)
+	}
+	return compiled, nil
+}
+
+// directiveTypes are the proxy types browsers understand in PAC results.
+var directiveTypes = map[string]bool{
+	"PROXY":  true,
+	"HTTP":   true,
+	"HTTPS":  true,
+	"SOCKS":  true,
+	"SOCKS4": true,
+	"SOCKS5": true,
+}
+
+// parseDirective validates a PAC directive such as "PROXY host:port".
+func parseDirective(directive string) (string, error) {
+	fields := strings.Fields(directive)
+	if len(fields) == 1 && strings.EqualFold(fields[0], "DIRECT") {
+		return "DIRECT", nil
+	}
+	if len(fields) != 2 || !directiveTypes[strings.ToUpper(fields[0])] {
+		return "", fmt.Errorf("invalid proxy %q", directive)
+	}
+	host, port, err := net.SplitHostPort(fields[1])
+	if err != nil || !validHost(strings.Trim(host, "[]")) {
+		return "", fmt.Errorf("invalid proxy %q", directive)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return "", fmt.Errorf("invalid proxy %q", directive)
+	}
+	return strings.ToUpper(fields[0]) + " " + fields[1], nil
+}
+
+// validHost reports whether host is a name or address that can be written
+// into a script.
+func validHost(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
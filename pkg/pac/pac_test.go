@@ -0,0 +1,135 @@
+package pac
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerator_Script(t *testing.T) {
+	g, err := New(Config{
+		File: File{
+			Bypass: Bypass{Domains: []string{"Corp.Example.", "*.internal"}, CIDRs: []string{"10.0.0.0/8"}, PlainHosts: true},
+			Users: map[string]User{
+				"alice": {Bypass: Bypass{Domains: []string{"lab.example"}}},
+				"bob":   {Proxies: []string{"proxy proxy-eu.example.com:3128", "DIRECT"}},
+			},
+		},
+		Host:       "proxy.example.com",
+		HTTPSPort:  8443,
+		HTTPPort:   8080,
+		SOCKS5Port: 1080,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, g.Users())
+
+	script, ok := g.Script("ignored:80", "")
+	require.True(t, ok)
+	assert.Contains(t, script, "function FindProxyForURL(url, host) {")
+	assert.Contains(t, script, `if (isPlainHostName(host)) return "DIRECT";`)
+	assert.Contains(t, script, `if (host == "corp.example" || dnsDomainIs(host, ".corp.example")) return "DIRECT";`)
+	assert.Contains(t, script, `dnsDomainIs(host, ".internal")`)
+	assert.Contains(t, script, `if (isInNet(addr, "10.0.0.0", "255.0.0.0")) return "DIRECT";`)
+	assert.Contains(t, script, `return "HTTPS proxy.example.com:8443; PROXY proxy.example.com:8080; SOCKS5 proxy.example.com:1080";`)
+	assert.NotContains(t, script, "lab.example")
+
+	script, ok = g.Script("", "alice")
+	require.True(t, ok)
+	assert.Contains(t, script, `dnsDomainIs(host, ".corp.example")`)
+	assert.Contains(t, script, `dnsDomainIs(host, ".lab.example")`)
+	assert.Contains(t, script, `return "HTTPS proxy.example.com:8443;`)
+
+	script, ok = g.Script("", "bob")
+	require.True(t, ok)
+	assert.Contains(t, script, `return "PROXY proxy-eu.example.com:3128; DIRECT";`)
+
+	_, ok = g.Script("", "carol")
+	assert.False(t, ok)
+}
+
+func TestGenerator_ScriptUsesRequestHost(t *testing.T) {
+	g, err := New(Config{HTTPPort: 8080})
+	require.NoError(t, err)
+
+	script, _ := g.Script("gateway.lan:8000", "")
+	assert.Contains(t, script, `return "PROXY gateway.lan:8080";`)
+	assert.NotContains(t, script, "dnsResolve")
+
+	script, _ = g.Script("[fd00::1]:8000", "")
+	assert.Contains(t, script, `return "PROXY [fd00::1]:8080";`)
+
+	script, _ = g.Script(`evil"host`, "")
+	assert.Contains(t, script, `return "PROXY localhost:8080";`)
+}
+
+func TestGenerator_ServeHTTP(t *testing.T) {
+	g, err := New(Config{
+		File:       File{Users: map[string]User{"alice": {}}},
+		Host:       "proxy.example.com",
+		SOCKS5Port: 1080,
+	})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{method: http.MethodGet, path: "/proxy.pac", status: http.StatusOK},
+		{method: http.MethodGet, path: "/wpad.dat", status: http.StatusOK},
+		{method: http.MethodHead, path: "/wpad.dat", status: http.StatusOK},
+		{method: http.MethodGet, path: "/users/alice/proxy.pac", status: http.StatusOK},
+		{method: http.MethodGet, path: "/users/bob/proxy.pac", status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/users//proxy.pac", status: http.StatusNotFound},
+		{method: http.MethodGet, path: "/", status: http.StatusNotFound},
+		{method: http.MethodPost, path: "/proxy.pac", status: http.StatusMethodNotAllowed},
+	} {
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, nil))
+		assert.Equal(t, tc.status, rec.Code, "%s %s", tc.method, tc.path)
+		if tc.status != http.StatusOK {
+			continue
+		}
+		assert.Equal(t, ContentType, rec.Header().Get("Content-Type"))
+		if tc.method == http.MethodHead {
+			assert.Empty(t, rec.Body.String())
+		} else {
+			assert.Contains(t, rec.Body.String(), `return "SOCKS5 proxy.example.com:1080";`)
+		}
+	}
+}
+
+func TestNew_RejectsInvalidConfig(t *testing.T) {
+	for name, conf := range map[string]Config{
+		"no listener":  {},
+		"bad host":     {Host: "proxy.example.com; DIRECT", HTTPPort: 8080},
+		"bad domain":   {File: File{Bypass: Bypass{Domains: []string{`a"b`}}}, HTTPPort: 8080},
+		"bad cidr":     {File: File{Bypass: Bypass{CIDRs: []string{"10.0.0.0/33"}}}, HTTPPort: 8080},
+		"ipv6 cidr":    {File: File{Bypass: Bypass{CIDRs: []string{"fd00::/8"}}}, HTTPPort: 8080},
+		"bad type":     {File: File{Users: map[string]User{"a": {Proxies: []string{"FTP host:21"}}}}, HTTPPort: 8080},
+		"missing port": {File: File{Users: map[string]User{"a": {Proxies: []string{"PROXY host"}}}}, HTTPPort: 8080},
+	} {
+		_, err := New(conf)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pac.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"bypass": {"domains": ["corp.example"], "cidrs": ["192.168.0.0/16"]}, "users": {"alice": {"proxies": ["SOCKS5 10.0.0.1:1080"]}}}`), 0o600))
+
+	file, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"corp.example"}, file.Bypass.Domains)
+	assert.Equal(t, []string{"192.168.0.0/16"}, file.Bypass.CIDRs)
+	assert.Equal(t, []string{"SOCKS5 10.0.0.1:1080"}, file.Users["alice"].Proxies)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{`), 0o600))
+	_, err = LoadFile(path)
+	assert.Error(t, err)
+}
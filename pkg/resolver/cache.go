@@ -0,0 +1,246 @@
+package resolver
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheSize   = 4096
+	DefaultMinTTL      = 5 * time.Second
+	DefaultMaxTTL      = time.Hour
+	DefaultTTL         = time.Minute
+	DefaultNegativeTTL = 30 * time.Second
+)
+
+// TTLResolver is implemented by resolvers that know how long their answers
+// may be cached. A zero TTL means the upstream did not report one.
+type TTLResolver interface {
+	ResolveTTL(host string) ([]net.IP, time.Duration, error)
+}
+
+// CacheConfig controls CachingResolver. Zero values select the defaults.
+type CacheConfig struct {
+	// Size is the maximum number of cached names.
+	Size int
+	// MinTTL and MaxTTL clamp the TTLs reported by the upstream.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// DefaultTTL is used when the upstream does not report a TTL.
+	DefaultTTL time.Duration
+	// NegativeTTL is how long "no such host" answers are cached.
+	NegativeTTL time.Duration
+}
+
+// CacheStats are counters reported by CachingResolver.
+type CacheStats struct {
+	Hits         uint64
+	NegativeHits uint64
+	Misses       uint64
+	Coalesced    uint64
+	Evictions    uint64
+	Entries      int
+}
+
+type cacheEntry struct {
+	host    string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type inflight struct {
+	done chan struct{}
+	ips  []net.IP
+	err  error
+}
+
+// CachingResolver caches answers from an upstream resolver in a bounded LRU
+// and coalesces concurrent lookups for the same name.
+type CachingResolver struct {
+	upstream Resolver
+	config   CacheConfig
+	now      func() time.Time
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*inflight
+	stats    CacheStats
+}
+
+func NewCachingResolver(upstream Resolver, conf CacheConfig) *CachingResolver {
+	if upstream == nil {
+		upstream = &DNSResolver{}
+	}
+	if conf.Size <= 0 {
+		conf.Size = DefaultCacheSize
+	}
+	if conf.MinTTL <= 0 {
+		conf.MinTTL = DefaultMinTTL
+	}
+	if conf.MaxTTL <= 0 {
+		conf.MaxTTL = DefaultMaxTTL
+	}
+	if conf.MaxTTL < conf.MinTTL {
+		conf.MaxTTL = conf.MinTTL
+	}
+	if conf.DefaultTTL <= 0 {
+		conf.DefaultTTL = DefaultTTL
+	}
+	if conf.NegativeTTL <= 0 {
+		conf.NegativeTTL = DefaultNegativeTTL
+	}
+
+	return &CachingResolver{
+		upstream: upstream,
+		config:   conf,
+		now:      time.Now,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		inflight: make(map[string]*inflight),
+	}
+}
+
+func (c *CachingResolver) Resolve(destAddr string) (net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return ip, nil
+	}
+
+	ips, err := c.lookup(normalizeHost(destAddr))
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (c *CachingResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return c.lookup(normalizeHost(destAddr))
+}
+
+func (c *CachingResolver) lookup(host string) ([]net.IP, error) {
+	c.mu.Lock()
+	if elem, ok := c.entries[host]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(elem)
+			if entry.err != nil {
+				c.stats.NegativeHits++
+			} else {
+				c.stats.Hits++
+			}
+			c.mu.Unlock()
+			return entry.ips, entry.err
+		}
+		c.removeElement(elem)
+	}
+
+	if call, ok := c.inflight[host]; ok {
+		c.stats.Coalesced++
+		c.mu.Unlock()
+		<-call.done
+		return call.ips, call.err
+	}
+
+	c.stats.Misses++
+	call := &inflight{done: make(chan struct{})}
+	c.inflight[host] = call
+	c.mu.Unlock()
+
+	ips, ttl, err := c.resolveUpstream(host)
+	call.ips, call.err = ips, err
+
+	c.mu.Lock()
+	delete(c.inflight, host)
+	switch {
+	case err == nil:
+		c.store(&cacheEntry{host: host, ips: ips, expires: c.now().Add(c.clampTTL(ttl))})
+	case isNotFound(err):
+		c.store(&cacheEntry{host: host, err: err, expires: c.now().Add(c.config.NegativeTTL)})
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return ips, err
+}
+
+func (c *CachingResolver) resolveUpstream(host string) ([]net.IP, time.Duration, error) {
+	if ttlResolver, ok := c.upstream.(TTLResolver); ok {
+		ips, ttl, err := ttlResolver.ResolveTTL(host)
+		if err == nil && len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return ips, ttl, err
+	}
+
+	ips, err := c.upstream.ResolveAll(host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, 0, err
+}
+
+func (c *CachingResolver) clampTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = c.config.DefaultTTL
+	}
+	if ttl < c.config.MinTTL {
+		return c.config.MinTTL
+	}
+	if ttl > c.config.MaxTTL {
+		return c.config.MaxTTL
+	}
+	return ttl
+}
+
+func (c *CachingResolver) store(entry *cacheEntry) {
+	if elem, ok := c.entries[entry.host]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[entry.host] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.config.Size {
+		c.removeElement(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *CachingResolver) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry).host)
+}
+
+// Flush drops every cached answer. Lookups in flight are not affected.
+func (c *CachingResolver) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns the cache counters.
+func (c *CachingResolver) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	return stats
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
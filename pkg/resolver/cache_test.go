@@ -0,0 +1,190 @@
+package resolver
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubResolver struct {
+	calls atomic.Int32
+	ttl   time.Duration
+	err   error
+	delay time.Duration
+	ips   []net.IP
+}
+
+func (s *stubResolver) Resolve(host string) (net.IP, error) {
+	ips, _, err := s.ResolveTTL(host)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (s *stubResolver) ResolveAll(host string) ([]net.IP, error) {
+	ips, _, err := s.ResolveTTL(host)
+	return ips, err
+}
+
+func (s *stubResolver) ResolveTTL(host string) ([]net.IP, time.Duration, error) {
+	s.calls.Add(1)
+	if s.delay > 0 {
+		time.Sleep(s.delay)
+	}
+	if s.err != nil {
+		return nil, 0, s.err
+	}
+	if s.ips != nil {
+		return s.ips, s.ttl, nil
+	}
+	return []net.IP{net.ParseIP("192.0.2.1")}, s.ttl, nil
+}
+
+func newTestCache(upstream Resolver, conf CacheConfig) (*CachingResolver, *time.Time) {
+	cache := NewCachingResolver(upstream, conf)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, &now
+}
+
+func TestCachingResolver_HonoursTTL(t *testing.T) {
+	upstream := &stubResolver{ttl: 20 * time.Second}
+	cache, now := newTestCache(upstream, CacheConfig{})
+
+	for i := 0; i < 3; i++ {
+		ip, err := cache.Resolve("Example.COM.")
+		require.NoError(t, err)
+		assert.Equal(t, "192.0.2.1", ip.String())
+	}
+	assert.Equal(t, int32(1), upstream.calls.Load())
+
+	*now = now.Add(21 * time.Second)
+	_, err := cache.Resolve("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), upstream.calls.Load())
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, 1, stats.Entries)
+}
+
+func TestCachingResolver_ClampsTTL(t *testing.T) {
+	cache := NewCachingResolver(&stubResolver{}, CacheConfig{MinTTL: 10 * time.Second, MaxTTL: time.Minute, DefaultTTL: 30 * time.Second})
+
+	assert.Equal(t, 10*time.Second, cache.clampTTL(time.Second))
+	assert.Equal(t, time.Minute, cache.clampTTL(24*time.Hour))
+	assert.Equal(t, 30*time.Second, cache.clampTTL(0))
+	assert.Equal(t, 45*time.Second, cache.clampTTL(45*time.Second))
+}
+
+func TestCachingResolver_NegativeCache(t *testing.T) {
+	upstream := &stubResolver{err: &net.DNSError{Err: "no such host", Name: "missing.example", IsNotFound: true}}
+	cache, now := newTestCache(upstream, CacheConfig{NegativeTTL: 10 * time.Second})
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.Resolve("missing.example")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, int32(1), upstream.calls.Load())
+	assert.Equal(t, uint64(1), cache.Stats().NegativeHits)
+
+	*now = now.Add(11 * time.Second)
+	_, _ = cache.Resolve("missing.example")
+	assert.Equal(t, int32(2), upstream.calls.Load())
+}
+
+func TestCachingResolver_DoesNotCacheTemporaryErrors(t *testing.T) {
+	upstream := &stubResolver{err: errors.New("i/o timeout")}
+	cache, _ := newTestCache(upstream, CacheConfig{})
+
+	_, _ = cache.Resolve("flaky.example")
+	_, _ = cache.Resolve("flaky.example")
+	assert.Equal(t, int32(2), upstream.calls.Load())
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCachingResolver_CoalescesConcurrentLookups(t *testing.T) {
+	upstream := &stubResolver{delay: 50 * time.Millisecond}
+	cache := NewCachingResolver(upstream, CacheConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ip, err := cache.Resolve("example.com")
+			assert.NoError(t, err)
+			assert.Equal(t, "192.0.2.1", ip.String())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), upstream.calls.Load())
+	stats := cache.Stats()
+	assert.Equal(t, uint64(10), stats.Misses+stats.Coalesced+stats.Hits)
+}
+
+func TestCachingResolver_LRUEviction(t *testing.T) {
+	upstream := &stubResolver{}
+	cache := NewCachingResolver(upstream, CacheConfig{Size: 2})
+
+	_, _ = cache.Resolve("a.example")
+	_, _ = cache.Resolve("b.example")
+	_, _ = cache.Resolve("a.example") // a becomes most recently used
+	_, _ = cache.Resolve("c.example") // evicts b
+
+	stats := cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(1), stats.Evictions)
+
+	calls := upstream.calls.Load()
+	_, _ = cache.Resolve("a.example")
+	assert.Equal(t, calls, upstream.calls.Load())
+	_, _ = cache.Resolve("b.example")
+	assert.Equal(t, calls+1, upstream.calls.Load())
+}
+
+func TestCachingResolver_FlushAndLiterals(t *testing.T) {
+	upstream := &stubResolver{}
+	cache := NewCachingResolver(upstream, CacheConfig{})
+
+	ip, err := cache.Resolve("203.0.113.9")
+	require.NoError(t, err)
+	assert.Equal(t, "203.0.113.9", ip.String())
+	assert.Equal(t, int32(0), upstream.calls.Load())
+
+	_, _ = cache.Resolve("example.com")
+	cache.Flush()
+	assert.Equal(t, 0, cache.Stats().Entries)
+	_, _ = cache.Resolve("example.com")
+	assert.Equal(t, int32(2), upstream.calls.Load())
+}
+
+func TestCachingResolver_PlainUpstream(t *testing.T) {
+	cache := NewCachingResolver(nil, CacheConfig{})
+
+	ip, err := cache.Resolve("localhost")
+	require.NoError(t, err)
+	assert.NotNil(t, ip)
+}
+
+func TestCachingResolver_ResolveAll(t *testing.T) {
+	upstream := &stubResolver{ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}
+	cache, _ := newTestCache(upstream, CacheConfig{})
+
+	for i := 0; i < 2; i++ {
+		ips, err := cache.ResolveAll("example.com")
+		require.NoError(t, err)
+		require.Len(t, ips, 2)
+		assert.Equal(t, "2001:db8::1", ips[1].String())
+	}
+	assert.Equal(t, int32(1), upstream.calls.Load())
+}
@@ -0,0 +1,220 @@
+package resolver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	ErrNoServers         = errors.New("no DNS servers configured")
+	ErrMalformedResponse = errors.New("malformed DNS response")
+)
+
+// ServerResolver resolves names by querying DNS servers directly instead of
+// using the host resolver. Servers are tried in order; a failing server is
+// skipped, but an authoritative "no such host" answer ends the lookup.
+type ServerResolver struct {
+	servers []Server
+}
+
+func NewServerResolver(servers []Server) (*ServerResolver, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServers
+	}
+	return &ServerResolver{servers: servers}, nil
+}
+
+func (r *ServerResolver) Resolve(destAddr string) (net.IP, error) {
+	ips, _, err := r.ResolveTTL(destAddr)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (r *ServerResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	ips, _, err := r.ResolveTTL(destAddr)
+	return ips, err
+}
+
+type lookupResult struct {
+	ips []net.IP
+	ttl time.Duration
+	err error
+}
+
+// ResolveTTL looks up A and AAAA records in parallel and returns the IPv4
+// addresses first. The lookup succeeds when either family has an answer; the
+// TTL is the smaller of the two.
+func (r *ServerResolver) ResolveTTL(host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	v6 := make(chan lookupResult, 1)
+	go func() {
+		ips, ttl, err := r.lookup(host, dnsmessage.TypeAAAA)
+		v6 <- lookupResult{ips: ips, ttl: ttl, err: err}
+	}()
+	ips, ttl, err := r.lookup(host, dnsmessage.TypeA)
+	v4 := lookupResult{ips: ips, ttl: ttl, err: err}
+
+	var result lookupResult
+	for _, part := range []lookupResult{v4, <-v6} {
+		if len(part.ips) == 0 {
+			if part.err != nil && !isNotFound(part.err) && result.err == nil {
+				result.err = part.err
+			}
+			continue
+		}
+		if len(result.ips) == 0 || part.ttl < result.ttl {
+			result.ttl = part.ttl
+		}
+		result.ips = append(result.ips, part.ips...)
+	}
+
+	if len(result.ips) > 0 {
+		return result.ips, result.ttl, nil
+	}
+	if result.err != nil {
+		return nil, 0, result.err
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *ServerResolver) lookup(host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		ips, ttl, err := query(server, host, qtype)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		lastErr = fmt.Errorf("%s: %w", server, err)
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, IsTemporary: true}
+}
+
+func query(server Server, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := randomID()
+	if _, ok := server.(*DoHServer); ok {
+		// RFC 8484 section 4.1: a zero ID keeps GET requests cache friendly.
+		id = 0
+	}
+	msg, err := buildQuery(id, host, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := server.Exchange(msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseResponse(resp, id, host)
+}
+
+func buildQuery(id uint16, host string, qtype dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(fqdn(host))
+	if err != nil {
+		return nil, fmt.Errorf("invalid name %q: %w", host, err)
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseResponse extracts the addresses and the smallest TTL from a response.
+// Answers of the other address family and CNAME records are skipped, so the
+// addresses at the end of a CNAME chain are returned.
+func parseResponse(msg []byte, id uint16, host string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+	if !header.Response || header.ID != id {
+		return nil, 0, fmt.Errorf("%w: unexpected message id or flags", ErrMalformedResponse)
+	}
+
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("server returned %s", header.RCode)
+	}
+	if header.Truncated {
+		return nil, 0, errTruncated
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	for {
+		rh, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+		}
+
+		var ip net.IP
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, fmt.Errorf("%w: %v", ErrMalformedResponse, err)
+			}
+			continue
+		}
+
+		recordTTL := time.Duration(rh.TTL) * time.Second
+		if len(ips) == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		ips = append(ips, ip)
+	}
+
+	return ips, ttl, nil
+}
+
+func fqdn(host string) string {
+	if strings.HasSuffix(host, ".") {
+		return host
+	}
+	return host + "."
+}
+
+func randomID() uint16 {
+	var b [2]byte
+	_, _ = rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
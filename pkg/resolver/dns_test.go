@@ -0,0 +1,299 @@
+package resolver
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubAnswer answers example.com with two A records, v6.example with an AAAA
+// record only, dual.example with one of each and everything else with
+// NXDOMAIN.
+func stubAnswer(t *testing.T, query []byte) []byte {
+	t.Helper()
+
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	require.NoError(t, err)
+	question, err := p.Question()
+	require.NoError(t, err)
+
+	header.Response = true
+	b := dnsmessage.NewBuilder(nil, header)
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 120}
+
+	name := question.Name.String()
+	if name != "example.com." && name != "v6.example." && name != "dual.example." {
+		header.RCode = dnsmessage.RCodeNameError
+		b = dnsmessage.NewBuilder(nil, header)
+	}
+	require.NoError(t, b.StartQuestions())
+	require.NoError(t, b.Question(question))
+	require.NoError(t, b.StartAnswers())
+
+	switch {
+	case name == "example.com." && question.Type == dnsmessage.TypeA:
+		require.NoError(t, b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}))
+		rh.TTL = 60
+		require.NoError(t, b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 2}}))
+	case (name == "v6.example." || name == "dual.example.") && question.Type == dnsmessage.TypeAAAA:
+		require.NoError(t, b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}}))
+	case name == "dual.example." && question.Type == dnsmessage.TypeA:
+		rh.TTL = 300
+		require.NoError(t, b.AResource(rh, dnsmessage.AResource{A: [4]byte{192, 0, 2, 3}}))
+	}
+
+	msg, err := b.Finish()
+	require.NoError(t, err)
+	return msg
+}
+
+func startUDPStub(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(stubAnswer(t, buf[:n]), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func serveStream(t *testing.T, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, int(length[0])<<8|int(length[1]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := stubAnswer(t, query)
+			_, _ = conn.Write(append([]byte{byte(len(resp) >> 8), byte(len(resp))}, resp...))
+		}()
+	}
+}
+
+func startTCPStub(t *testing.T, tlsConfig *tls.Config) string {
+	t.Helper()
+
+	var listener net.Listener
+	var err error
+	if tlsConfig != nil {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go serveStream(t, listener)
+	return listener.Addr().String()
+}
+
+func startDoHStub(t *testing.T, methods *[]string) *httptest.Server {
+	t.Helper()
+
+	var mu sync.Mutex
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*methods = append(*methods, r.Method)
+		mu.Unlock()
+		var query []byte
+		var err error
+		if r.Method == http.MethodGet {
+			query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			assert.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+			query, err = io.ReadAll(r.Body)
+		}
+		if !assert.NoError(t, err) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(stubAnswer(t, query))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestServerResolver(t *testing.T, raws []string, opts ServerOptions) *ServerResolver {
+	t.Helper()
+
+	servers, err := ParseServers(raws, opts)
+	require.NoError(t, err)
+	r, err := NewServerResolver(servers)
+	require.NoError(t, err)
+	return r
+}
+
+func assertExampleAnswer(t *testing.T, r *ServerResolver) {
+	t.Helper()
+
+	ips, ttl, err := r.ResolveTTL("example.com")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	assert.Equal(t, "192.0.2.1", ips[0].String())
+	assert.Equal(t, 60*time.Second, ttl)
+
+	_, _, err = r.ResolveTTL("missing.example")
+	assert.True(t, isNotFound(err), "expected not found, got %v", err)
+}
+
+func TestServerResolver_UDP(t *testing.T) {
+	r := newTestServerResolver(t, []string{startUDPStub(t)}, ServerOptions{Timeout: time.Second})
+	assertExampleAnswer(t, r)
+
+	ip, err := r.Resolve("v6.example")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip.String())
+}
+
+func TestServerResolver_BothFamilies(t *testing.T) {
+	r := newTestServerResolver(t, []string{startUDPStub(t)}, ServerOptions{Timeout: time.Second})
+
+	ips, ttl, err := r.ResolveTTL("dual.example")
+	require.NoError(t, err)
+	require.Len(t, ips, 2)
+	assert.Equal(t, "192.0.2.3", ips[0].String())
+	assert.Equal(t, "2001:db8::1", ips[1].String())
+	assert.Equal(t, 120*time.Second, ttl)
+
+	ips, err = r.ResolveAll("v6.example")
+	require.NoError(t, err)
+	require.Len(t, ips, 1)
+	assert.Equal(t, "2001:db8::1", ips[0].String())
+}
+
+func TestServerResolver_TCP(t *testing.T) {
+	r := newTestServerResolver(t, []string{"tcp://" + startTCPStub(t, nil)}, ServerOptions{Timeout: time.Second})
+	assertExampleAnswer(t, r)
+}
+
+func TestServerResolver_DoT(t *testing.T) {
+	var methods []string
+	doh := startDoHStub(t, &methods)
+	addr := startTCPStub(t, doh.TLS)
+
+	r := newTestServerResolver(t, []string{"tls://" + addr}, ServerOptions{
+		Timeout:   time.Second,
+		TLSConfig: doh.Client().Transport.(*http.Transport).TLSClientConfig,
+	})
+	assertExampleAnswer(t, r)
+}
+
+func TestServerResolver_DoHPostAndGet(t *testing.T) {
+	var methods []string
+	doh := startDoHStub(t, &methods)
+	opts := ServerOptions{Timeout: time.Second, TLSConfig: doh.Client().Transport.(*http.Transport).TLSClientConfig}
+
+	assertExampleAnswer(t, newTestServerResolver(t, []string{doh.URL + "/dns-query"}, opts))
+	assert.Contains(t, methods, http.MethodPost)
+	assert.NotContains(t, methods, http.MethodGet)
+
+	methods = nil
+	getURL := "https+get://" + doh.Listener.Addr().String() + "/dns-query"
+	assertExampleAnswer(t, newTestServerResolver(t, []string{getURL}, opts))
+	assert.Contains(t, methods, http.MethodGet)
+	assert.NotContains(t, methods, http.MethodPost)
+}
+
+func TestServerResolver_Failover(t *testing.T) {
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	deadAddr := dead.Addr().String()
+	_ = dead.Close()
+
+	r := newTestServerResolver(t, []string{"tcp://" + deadAddr, "tcp://" + startTCPStub(t, nil)}, ServerOptions{Timeout: time.Second})
+	assertExampleAnswer(t, r)
+
+	r = newTestServerResolver(t, []string{"tcp://" + deadAddr}, ServerOptions{Timeout: time.Second})
+	_, err = r.Resolve("example.com")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsTemporary)
+}
+
+func TestServerResolver_UsesDialer(t *testing.T) {
+	addr := startTCPStub(t, nil)
+	var dialed atomic.Int32
+	dial := func(network, target string) (net.Conn, error) {
+		dialed.Add(1)
+		assert.Equal(t, "tcp", network)
+		return net.Dial(network, addr)
+	}
+
+	// udp:// is carried over TCP when a dialer is configured.
+	r := newTestServerResolver(t, []string{"udp://dns.invalid:53"}, ServerOptions{Timeout: time.Second, Dial: dial})
+	assertExampleAnswer(t, r)
+	assert.Greater(t, dialed.Load(), int32(0))
+}
+
+func TestParseServer(t *testing.T) {
+	server, err := ParseServer("9.9.9.9", ServerOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "udp://9.9.9.9:53", server.String())
+
+	server, err = ParseServer("tls://1.1.1.1?servername=one.one.one.one", ServerOptions{})
+	require.NoError(t, err)
+	dot := server.(*DoTServer)
+	assert.Equal(t, "1.1.1.1:853", dot.Addr)
+	assert.Equal(t, "one.one.one.one", dot.ServerName)
+
+	server, err = ParseServer("https+get://dns.google/dns-query", ServerOptions{})
+	require.NoError(t, err)
+	assert.True(t, server.(*DoHServer).UseGET)
+	assert.Equal(t, "https://dns.google/dns-query", server.String())
+
+	_, err = ParseServer("quic://dns.adguard.com", ServerOptions{})
+	assert.ErrorIs(t, err, ErrUnsupportedServer)
+
+	_, err = NewServerResolver(nil)
+	assert.ErrorIs(t, err, ErrNoServers)
+}
+
+func TestCachingResolver_UsesServerTTL(t *testing.T) {
+	r := newTestServerResolver(t, []string{startUDPStub(t)}, ServerOptions{Timeout: time.Second})
+	cache, now := newTestCache(r, CacheConfig{})
+
+	_, err := cache.Resolve("example.com")
+	require.NoError(t, err)
+	*now = now.Add(59 * time.Second)
+	_, err = cache.Resolve("example.com")
+	require.NoError(t, err)
+	*now = now.Add(2 * time.Second)
+	_, err = cache.Resolve("example.com")
+	require.NoError(t, err)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+}
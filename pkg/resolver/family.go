@@ -0,0 +1,129 @@
+package resolver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrNoFamilyAddress is wrapped by FamilyResolver errors for names that
+// resolve, but to no address of the configured family.
+var ErrNoFamilyAddress = errors.New("no address in the configured family")
+
+// Family selects which address families are used and in which order they
+// are tried.
+type Family string
+
+const (
+	FamilyIPv4Only Family = "ipv4-only"
+	FamilyIPv6Only Family = "ipv6-only"
+	FamilyPreferV4 Family = "prefer-v4"
+	FamilyPreferV6 Family = "prefer-v6"
+)
+
+// ParseFamily parses a family name. An empty string selects FamilyPreferV4,
+// which matches the behaviour of resolvers that return a single address.
+func ParseFamily(raw string) (Family, error) {
+	switch family := Family(strings.ToLower(strings.TrimSpace(raw))); family {
+	case "":
+		return FamilyPreferV4, nil
+	case FamilyIPv4Only, FamilyIPv6Only, FamilyPreferV4, FamilyPreferV6:
+		return family, nil
+	default:
+		return "", fmt.Errorf("unknown address family %q", raw)
+	}
+}
+
+// OrderAddresses filters ips by family and, for the prefer modes, interleaves
+// the two families starting with the preferred one (RFC 8305 section 4), so
+// that a broken family costs at most one connection attempt delay.
+// Duplicates are removed and the input slice is not modified.
+func OrderAddresses(ips []net.IP, family Family) []net.IP {
+	var v4, v6 []net.IP
+	seen := make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		key := string(ip.To16())
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch family {
+	case FamilyIPv4Only:
+		return v4
+	case FamilyIPv6Only:
+		return v6
+	case FamilyPreferV6:
+		return interleave(v6, v4)
+	default:
+		return interleave(v4, v6)
+	}
+}
+
+func interleave(first, second []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// FamilyResolver applies a Family to the answers of another resolver.
+type FamilyResolver struct {
+	upstream Resolver
+	family   Family
+}
+
+func NewFamilyResolver(upstream Resolver, family Family) *FamilyResolver {
+	if upstream == nil {
+		upstream = &DNSResolver{}
+	}
+	if family == "" {
+		family = FamilyPreferV4
+	}
+	return &FamilyResolver{upstream: upstream, family: family}
+}
+
+// Blocked reports whether the upstream resolver refuses host by policy.
+func (f *FamilyResolver) Blocked(host string) bool {
+	blocker, ok := f.upstream.(Blocker)
+	return ok && blocker.Blocked(host)
+}
+
+// Family returns the configured family preference.
+func (f *FamilyResolver) Family() Family {
+	return f.family
+}
+
+func (f *FamilyResolver) Resolve(destAddr string) (net.IP, error) {
+	ips, err := f.ResolveAll(destAddr)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (f *FamilyResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	ips, err := f.upstream.ResolveAll(destAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips = OrderAddresses(ips, f.family)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("no %s address", f.family), Name: destAddr, UnwrapErr: ErrNoFamilyAddress, IsNotFound: true}
+	}
+	return ips, nil
+}
@@ -0,0 +1,67 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func ipStrings(ips []net.IP) []string {
+	out := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		out = append(out, ip.String())
+	}
+	return out
+}
+
+func TestOrderAddresses(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::2"),
+	}
+
+	assert.Equal(t, []string{"192.0.2.1", "2001:db8::1", "192.0.2.2", "2001:db8::2", "192.0.2.3"},
+		ipStrings(OrderAddresses(ips, FamilyPreferV4)))
+	assert.Equal(t, []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"},
+		ipStrings(OrderAddresses(ips, FamilyPreferV6)))
+	assert.Equal(t, []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"},
+		ipStrings(OrderAddresses(ips, FamilyIPv4Only)))
+	assert.Equal(t, []string{"2001:db8::1", "2001:db8::2"},
+		ipStrings(OrderAddresses(ips, FamilyIPv6Only)))
+}
+
+func TestParseFamily(t *testing.T) {
+	family, err := ParseFamily("")
+	require.NoError(t, err)
+	assert.Equal(t, FamilyPreferV4, family)
+
+	family, err = ParseFamily(" Prefer-V6 ")
+	require.NoError(t, err)
+	assert.Equal(t, FamilyPreferV6, family)
+
+	_, err = ParseFamily("ipv5")
+	assert.Error(t, err)
+}
+
+func TestFamilyResolver(t *testing.T) {
+	upstream := &stubResolver{ips: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}}
+
+	ip, err := NewFamilyResolver(upstream, FamilyPreferV6).Resolve("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip.String())
+
+	ips, err := NewFamilyResolver(upstream, FamilyIPv4Only).ResolveAll("example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1"}, ipStrings(ips))
+
+	upstream.ips = []net.IP{net.ParseIP("192.0.2.1")}
+	_, err = NewFamilyResolver(upstream, FamilyIPv6Only).Resolve("example.com")
+	assert.True(t, isNotFound(err), "expected not found, got %v", err)
+	assert.ErrorIs(t, err, ErrNoFamilyAddress)
+}
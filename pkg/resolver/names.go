@@ -0,0 +1,78 @@
+package resolver
+
+import "strings"
+
+// nameTable maps domain names to values. Keys are either exact names or
+// wildcards of the form "*.example.com", which match every name below
+// example.com but not example.com itself.
+type nameTable[T any] struct {
+	exact    map[string]T
+	wildcard map[string]T
+}
+
+func newNameTable[T any]() *nameTable[T] {
+	return &nameTable[T]{exact: make(map[string]T), wildcard: make(map[string]T)}
+}
+
+func (t *nameTable[T]) table(pattern string) (map[string]T, string) {
+	pattern = normalizeHost(pattern)
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return t.wildcard, suffix
+	}
+	return t.exact, pattern
+}
+
+// set stores value under pattern.
+func (t *nameTable[T]) set(pattern string, value T) {
+	table, key := t.table(pattern)
+	table[key] = value
+}
+
+// get returns the value stored under pattern itself, without matching
+// wildcards.
+func (t *nameTable[T]) get(pattern string) (T, bool) {
+	table, key := t.table(pattern)
+	value, ok := table[key]
+	return value, ok
+}
+
+// lookup returns the value for host. An exact entry wins over wildcards and
+// a longer wildcard suffix wins over a shorter one.
+func (t *nameTable[T]) lookup(host string) (T, bool) {
+	host = normalizeHost(host)
+	if value, ok := t.exact[host]; ok {
+		return value, true
+	}
+	for i := strings.IndexByte(host, '.'); i >= 0; {
+		suffix := host[i+1:]
+		if value, ok := t.wildcard[suffix]; ok {
+			return value, true
+		}
+		next := strings.IndexByte(suffix, '.')
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	var zero T
+	return zero, false
+}
+
+func (t *nameTable[T]) len() int {
+	return len(t.exact) + len(t.wildcard)
+}
+
+// validPattern reports whether pattern is a domain name, optionally with a
+// leading "*." wildcard label.
+func validPattern(pattern string) bool {
+	name := strings.TrimPrefix(normalizeHost(pattern), "*.")
+	if name == "" || len(name) > 253 || strings.Contains(name, "*") {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,249 @@
+package resolver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/filewatch"
+)
+
+var ErrBlocked = errors.New("blocked by DNS policy")
+
+// Blocker is implemented by resolvers that can tell whether a name is refused
+// by policy without resolving it.
+type Blocker interface {
+	Blocked(host string) bool
+}
+
+// PolicyConfig lists the files read by PolicyResolver.
+//
+// Hosts files use the /etc/hosts format ("address name [name...]") and the
+// names may be wildcards such as "*.corp.example". Block lists hold one
+// domain per line; a domain blocks itself and every name below it, while
+// "*.example.com" only blocks the names below. Lines in hosts format, as used
+// by common ad and malware lists, are accepted and their names blocked. In
+// both formats "#" starts a comment.
+type PolicyConfig struct {
+	HostsFiles []string
+	BlockLists []string
+	// ReloadInterval is how often the files are checked for changes once
+	// Start has been called.
+	ReloadInterval time.Duration
+	// OnReload, when set, is called after the files changed and were read
+	// again, with the error if they could not be loaded.
+	OnReload func(err error)
+}
+
+// PolicyResolver answers names from hosts overrides and refuses blocked
+// names before passing everything else to the upstream resolver. The files
+// are reloaded when they change; a file that fails to load keeps the
+// previous rules in place.
+type PolicyResolver struct {
+	upstream Resolver
+	config   PolicyConfig
+
+	mu      sync.RWMutex
+	hosts   *nameTable[[]net.IP]
+	blocked *nameTable[struct{}]
+
+	files *filewatch.Watcher
+}
+
+func NewPolicyResolver(upstream Resolver, conf PolicyConfig) (*PolicyResolver, error) {
+	if upstream == nil {
+		upstream = &DNSResolver{}
+	}
+	if conf.ReloadInterval <= 0 {
+		conf.ReloadInterval = 30 * time.Second
+	}
+
+	p := &PolicyResolver{
+		upstream: upstream,
+		config:   conf,
+		files:    filewatch.New(conf.ReloadInterval, conf.OnReload),
+	}
+	if err := p.files.Load(p.load); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *PolicyResolver) Resolve(destAddr string) (net.IP, error) {
+	ips, err := p.ResolveAll(destAddr)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+func (p *PolicyResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ips, matched, err := p.lookup(destAddr)
+	if matched {
+		return ips, err
+	}
+	return p.upstream.ResolveAll(destAddr)
+}
+
+// lookup applies the block lists and hosts overrides. It returns false when
+// neither matched and the upstream should be asked.
+func (p *PolicyResolver) lookup(host string) ([]net.IP, bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if _, blocked := p.blocked.lookup(host); blocked {
+		return nil, true, &net.DNSError{Err: ErrBlocked.Error(), UnwrapErr: ErrBlocked, Name: host, IsNotFound: true}
+	}
+	if ips, ok := p.hosts.lookup(host); ok {
+		return ips, true, nil
+	}
+	return nil, false, nil
+}
+
+// Blocked reports whether host is refused by the block lists.
+func (p *PolicyResolver) Blocked(host string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	_, blocked := p.blocked.lookup(host)
+	return blocked
+}
+
+// Counts returns the number of hosts overrides and block list entries.
+func (p *PolicyResolver) Counts() (hosts, blocked int) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.hosts.len(), p.blocked.len()
+}
+
+// Start checks the files for changes every ReloadInterval until Close is
+// called.
+func (p *PolicyResolver) Start() {
+	p.files.Start(p.Reload)
+}
+
+func (p *PolicyResolver) Close() {
+	p.files.Close()
+}
+
+// Reload reads the files again if any of them changed since the last load.
+// It reports whether a reload was attempted.
+func (p *PolicyResolver) Reload() (bool, error) {
+	return p.files.Reload(p.load)
+}
+
+func (p *PolicyResolver) load(watch func(path string)) error {
+	hosts := newNameTable[[]net.IP]()
+	for _, path := range p.config.HostsFiles {
+		watch(path)
+		if err := readFile(path, func(r io.Reader) error { return parseHosts(r, hosts) }); err != nil {
+			return err
+		}
+	}
+
+	blocked := newNameTable[struct{}]()
+	for _, path := range p.config.BlockLists {
+		watch(path)
+		if err := readFile(path, func(r io.Reader) error { return parseBlockList(r, blocked) }); err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	p.hosts, p.blocked = hosts, blocked
+	p.mu.Unlock()
+	return nil
+}
+
+func readFile(path string, parse func(io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := parse(f); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// parseHosts adds the entries of a hosts file to table. Repeated names
+// collect all of their addresses.
+func parseHosts(r io.Reader, table *nameTable[[]net.IP]) error {
+	return scanLines(r, func(fields []string) error {
+		if len(fields) < 2 {
+			return fmt.Errorf("expected an address and at least one name")
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return fmt.Errorf("invalid address %q", fields[0])
+		}
+		for _, name := range fields[1:] {
+			if !validPattern(name) {
+				return fmt.Errorf("invalid name %q", name)
+			}
+			ips, _ := table.get(name)
+			table.set(name, append(ips, ip))
+		}
+		return nil
+	})
+}
+
+// hostsListNames are the local names found at the top of block lists in
+// hosts format. They are not blocked.
+var hostsListNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"0.0.0.0":               true,
+}
+
+func parseBlockList(r io.Reader, table *nameTable[struct{}]) error {
+	return scanLines(r, func(fields []string) error {
+		names := fields
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			names = fields[1:]
+		}
+		for _, name := range names {
+			if len(names) < len(fields) && (hostsListNames[name] || strings.HasPrefix(name, "ip6-")) {
+				continue
+			}
+			if !validPattern(name) {
+				return fmt.Errorf("invalid name %q", name)
+			}
+			table.set(name, struct{}{})
+			if !strings.HasPrefix(name, "*.") {
+				table.set("*."+name, struct{}{})
+			}
+		}
+		return nil
+	})
+}
+
+func scanLines(r io.Reader, handle func(fields []string) error) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := handle(fields); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,136 @@
+package resolver
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+}
+
+func TestPolicyResolver_HostsOverrides(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	writeFile(t, hostsPath, `
+# internal names
+10.0.0.5     git.corp.example wiki.corp.example
+fd00::5      git.corp.example
+10.0.0.9     *.corp.example
+10.0.0.10    *.build.corp.example
+`)
+
+	upstream := &stubResolver{}
+	p, err := NewPolicyResolver(upstream, PolicyConfig{HostsFiles: []string{hostsPath}})
+	require.NoError(t, err)
+
+	ips, err := p.ResolveAll("GIT.corp.example.")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5", "fd00::5"}, ipStrings(ips))
+
+	ip, err := p.Resolve("ci.corp.example")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.9", ip.String())
+
+	ip, err = p.Resolve("runner.build.corp.example")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.10", ip.String())
+
+	assert.Equal(t, int32(0), upstream.calls.Load())
+
+	// The wildcard does not cover the domain itself.
+	ip, err = p.Resolve("corp.example")
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ip.String())
+	assert.Equal(t, int32(1), upstream.calls.Load())
+}
+
+func TestPolicyResolver_BlockLists(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "ads.txt")
+	writeFile(t, listPath, `
+127.0.0.1 localhost
+0.0.0.0 tracker.example   # hosts format
+ads.example
+*.malware.example
+`)
+
+	p, err := NewPolicyResolver(&stubResolver{}, PolicyConfig{BlockLists: []string{listPath}})
+	require.NoError(t, err)
+
+	for _, host := range []string{"tracker.example", "ads.example", "cdn.ads.example", "x.malware.example"} {
+		_, err := p.Resolve(host)
+		assert.ErrorIs(t, err, ErrBlocked, host)
+		assert.True(t, isNotFound(err), host)
+		assert.True(t, p.Blocked(host), host)
+	}
+	for _, host := range []string{"localhost", "malware.example", "example.com"} {
+		_, err := p.Resolve(host)
+		assert.NoError(t, err, host)
+	}
+
+	hosts, blocked := p.Counts()
+	assert.Equal(t, 0, hosts)
+	assert.Equal(t, 5, blocked)
+
+	// Wrapping resolvers expose the block lists.
+	family := NewFamilyResolver(p, FamilyPreferV4)
+	assert.True(t, family.Blocked("cdn.ads.example"))
+	assert.False(t, family.Blocked("example.com"))
+	assert.False(t, NewFamilyResolver(&stubResolver{}, FamilyPreferV4).Blocked("ads.example"))
+}
+
+func TestPolicyResolver_Reload(t *testing.T) {
+	dir := t.TempDir()
+	listPath := filepath.Join(dir, "block.txt")
+	writeFile(t, listPath, "ads.example\n")
+
+	var reloads []error
+	p, err := NewPolicyResolver(&stubResolver{}, PolicyConfig{
+		BlockLists: []string{listPath},
+		OnReload:   func(err error) { reloads = append(reloads, err) },
+	})
+	require.NoError(t, err)
+	assert.True(t, p.Blocked("ads.example"))
+
+	reloaded, err := p.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded)
+
+	writeFile(t, listPath, "tracker.example\nanother.example\n")
+	require.NoError(t, os.Chtimes(listPath, time.Now(), time.Now().Add(time.Minute)))
+	reloaded, err = p.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.False(t, p.Blocked("ads.example"))
+	assert.True(t, p.Blocked("tracker.example"))
+
+	// A broken file keeps the previous rules.
+	writeFile(t, listPath, "bad..name\n")
+	require.NoError(t, os.Chtimes(listPath, time.Now(), time.Now().Add(2*time.Minute)))
+	_, err = p.Reload()
+	assert.ErrorContains(t, err, "line 1")
+	assert.True(t, p.Blocked("tracker.example"))
+	require.Len(t, reloads, 2)
+	assert.NoError(t, reloads[0])
+	assert.Error(t, reloads[1])
+}
+
+func TestNewPolicyResolver_Errors(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "hosts")
+	writeFile(t, hostsPath, "not-an-ip example.com\n")
+
+	_, err := NewPolicyResolver(nil, PolicyConfig{HostsFiles: []string{hostsPath}})
+	assert.ErrorContains(t, err, "invalid address")
+
+	_, err = NewPolicyResolver(nil, PolicyConfig{BlockLists: []string{filepath.Join(dir, "missing")}})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
@@ -1,11 +1,15 @@
 package resolver
 
 import (
+	"context"
 	"net"
 )
 
 type Resolver interface {
 	Resolve(destAddr string) (net.IP, error)
+	// ResolveAll returns every address of destAddr, in the order they
+	// should be tried.
+	ResolveAll(destAddr string) ([]net.IP, error)
 }
 
 type DNSResolver struct{}
@@ -18,3 +22,20 @@ func (d *DNSResolver) Resolve(destAddr string) (net.IP, error) {
 
 	return addr.IP, err
 }
+
+func (d *DNSResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), destAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
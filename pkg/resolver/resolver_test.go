@@ -23,3 +23,14 @@ func Test_Resolver_Resolve_Error(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, ip)
 }
+
+func Test_Resolver_ResolveAll(t *testing.T) {
+	r := &DNSResolver{}
+	ips, err := r.ResolveAll("localhost")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, ips)
+
+	ips, err = r.ResolveAll("192.0.2.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "192.0.2.1", ips[0].String())
+}
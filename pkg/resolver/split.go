@@ -0,0 +1,95 @@
+package resolver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// SplitRule sends the names in one domain to its own DNS servers.
+type SplitRule struct {
+	Domain  string
+	Servers []string
+}
+
+// ParseSplitRule parses "domain=server[|server...]". The domain may be
+// written as "corp", ".corp" or "*.corp"; all three match corp and every name
+// below it.
+func ParseSplitRule(raw string) (SplitRule, error) {
+	domain, servers, ok := strings.Cut(strings.TrimSpace(raw), "=")
+	if !ok {
+		return SplitRule{}, fmt.Errorf("split DNS rule %q: expected domain=server", raw)
+	}
+
+	rule := SplitRule{Domain: splitDomain(domain)}
+	if !validPattern(rule.Domain) {
+		return SplitRule{}, fmt.Errorf("split DNS rule %q: invalid domain", raw)
+	}
+	for _, server := range strings.Split(servers, "|") {
+		if server = strings.TrimSpace(server); server != "" {
+			rule.Servers = append(rule.Servers, server)
+		}
+	}
+	if len(rule.Servers) == 0 {
+		return SplitRule{}, fmt.Errorf("split DNS rule %q: no servers", raw)
+	}
+	return rule, nil
+}
+
+func splitDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSpace(domain), "*")
+	return normalizeHost(strings.TrimPrefix(domain, "."))
+}
+
+// SplitResolver picks a resolver by domain suffix. The longest matching
+// domain wins; names outside every domain go to the fallback resolver.
+type SplitResolver struct {
+	domains  *nameTable[Resolver]
+	fallback Resolver
+}
+
+func NewSplitResolver(fallback Resolver) *SplitResolver {
+	if fallback == nil {
+		fallback = &DNSResolver{}
+	}
+	return &SplitResolver{domains: newNameTable[Resolver](), fallback: fallback}
+}
+
+// Add routes domain and every name below it to r.
+func (s *SplitResolver) Add(domain string, r Resolver) {
+	domain = splitDomain(domain)
+	s.domains.set(domain, r)
+	s.domains.set("*."+domain, r)
+}
+
+func (s *SplitResolver) resolverFor(host string) Resolver {
+	if r, ok := s.domains.lookup(host); ok {
+		return r
+	}
+	return s.fallback
+}
+
+func (s *SplitResolver) Resolve(destAddr string) (net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return ip, nil
+	}
+	return s.resolverFor(destAddr).Resolve(destAddr)
+}
+
+func (s *SplitResolver) ResolveAll(destAddr string) ([]net.IP, error) {
+	if ip := net.ParseIP(destAddr); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return s.resolverFor(destAddr).ResolveAll(destAddr)
+}
+
+// ResolveTTL passes on the TTL of the selected resolver when it reports one.
+func (s *SplitResolver) ResolveTTL(host string) ([]net.IP, time.Duration, error) {
+	r := s.resolverFor(host)
+	if ttlResolver, ok := r.(TTLResolver); ok {
+		return ttlResolver.ResolveTTL(host)
+	}
+	ips, err := r.ResolveAll(host)
+	return ips, 0, err
+}
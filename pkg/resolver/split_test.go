@@ -0,0 +1,60 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSplitRule(t *testing.T) {
+	rule, err := ParseSplitRule("*.corp=10.0.0.53|tls://10.0.0.54?servername=dns.corp")
+	require.NoError(t, err)
+	assert.Equal(t, "corp", rule.Domain)
+	assert.Equal(t, []string{"10.0.0.53", "tls://10.0.0.54?servername=dns.corp"}, rule.Servers)
+
+	rule, err = ParseSplitRule(".Lab.Example.=10.1.0.53")
+	require.NoError(t, err)
+	assert.Equal(t, "lab.example", rule.Domain)
+
+	for _, raw := range []string{"corp", "corp=", "=10.0.0.53", "a..b=10.0.0.53"} {
+		_, err := ParseSplitRule(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestSplitResolver(t *testing.T) {
+	corp := &stubResolver{ips: []net.IP{net.ParseIP("10.0.0.1")}, ttl: 10 * time.Second}
+	lab := &stubResolver{ips: []net.IP{net.ParseIP("10.1.0.1")}}
+	public := &stubResolver{}
+
+	r := NewSplitResolver(public)
+	r.Add("*.corp", corp)
+	r.Add("lab.corp", lab)
+
+	cases := map[string]string{
+		"corp":          "10.0.0.1",
+		"git.corp":      "10.0.0.1",
+		"lab.corp":      "10.1.0.1",
+		"ci.lab.corp.":  "10.1.0.1",
+		"example.com":   "192.0.2.1",
+		"corp.example":  "192.0.2.1",
+		"notcorp":       "192.0.2.1",
+		"203.0.113.7":   "203.0.113.7",
+		"wiki.corp.":    "10.0.0.1",
+		"a.b.c.corp":    "10.0.0.1",
+		"LAB.CORP":      "10.1.0.1",
+		"x.notlab.corp": "10.0.0.1",
+	}
+	for host, want := range cases {
+		ip, err := r.Resolve(host)
+		require.NoError(t, err, host)
+		assert.Equal(t, want, ip.String(), host)
+	}
+
+	_, ttl, err := r.ResolveTTL("git.corp")
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, ttl)
+}
@@ -0,0 +1,310 @@
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServerTimeout = 5 * time.Second
+	maxMessageSize       = 65535
+	dnsMessageType       = "application/dns-message"
+)
+
+var (
+	ErrUnsupportedServer = errors.New("unsupported DNS server scheme")
+	errTruncated         = errors.New("truncated DNS response")
+)
+
+// Server exchanges one DNS message with an upstream server.
+type Server interface {
+	Exchange(query []byte) ([]byte, error)
+	String() string
+}
+
+// ServerOptions apply to every server built by ParseServer.
+type ServerOptions struct {
+	Timeout time.Duration
+	// Dial, when set, opens connections to the servers, e.g. through the
+	// configured outbound. UDP cannot be tunnelled, so udp:// servers are
+	// queried over TCP instead.
+	Dial      func(network, addr string) (net.Conn, error)
+	TLSConfig *tls.Config
+}
+
+// ParseServer builds a server from a URL:
+//
+//	udp://1.1.1.1:53, tcp://1.1.1.1:53      plain DNS (port defaults to 53)
+//	tls://1.1.1.1:853?servername=one.one.one.one   DNS over TLS (RFC 7858)
+//	https://dns.google/dns-query            DNS over HTTPS with POST (RFC 8484)
+//	https+get://dns.google/dns-query        DNS over HTTPS with GET
+//
+// A bare host or host:port is treated as udp://.
+func ParseServer(raw string, opts ServerOptions) (Server, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "udp://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parse DNS server %q: %w", raw, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("DNS server %q: missing host", raw)
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultServerTimeout
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "udp", "tcp":
+		return &PlainServer{
+			Addr:    hostPort(u, "53"),
+			TCP:     strings.EqualFold(u.Scheme, "tcp"),
+			Timeout: opts.Timeout,
+			Dial:    opts.Dial,
+		}, nil
+	case "tls":
+		serverName := u.Query().Get("servername")
+		if serverName == "" {
+			serverName = u.Hostname()
+		}
+		return &DoTServer{
+			Addr:       hostPort(u, "853"),
+			ServerName: serverName,
+			TLSConfig:  opts.TLSConfig,
+			Timeout:    opts.Timeout,
+			Dial:       opts.Dial,
+		}, nil
+	case "https", "https+get":
+		useGET := strings.EqualFold(u.Scheme, "https+get")
+		u.Scheme = "https"
+		return &DoHServer{
+			URL:    u.String(),
+			UseGET: useGET,
+			Client: newDoHClient(opts),
+		}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedServer, u.Scheme)
+	}
+}
+
+// ParseServers builds every server in raws, skipping blank entries.
+func ParseServers(raws []string, opts ServerOptions) ([]Server, error) {
+	var servers []Server
+	for _, raw := range raws {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		server, err := ParseServer(raw, opts)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// PlainServer speaks classic DNS over UDP or TCP. Truncated UDP answers are
+// retried over TCP.
+type PlainServer struct {
+	Addr    string
+	TCP     bool
+	Timeout time.Duration
+	Dial    func(network, addr string) (net.Conn, error)
+}
+
+func (s *PlainServer) String() string {
+	if s.TCP {
+		return "tcp://" + s.Addr
+	}
+	return "udp://" + s.Addr
+}
+
+func (s *PlainServer) Exchange(query []byte) ([]byte, error) {
+	if s.TCP || s.Dial != nil {
+		return s.exchangeTCP(query)
+	}
+
+	conn, err := net.DialTimeout("udp", s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that do not answer this query.
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 != 0 {
+			return s.exchangeTCP(query)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (s *PlainServer) exchangeTCP(query []byte) ([]byte, error) {
+	conn, err := dialWith(s.Dial, "tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+
+	return exchangeStream(conn, query)
+}
+
+// DoTServer speaks DNS over TLS (RFC 7858).
+type DoTServer struct {
+	Addr       string
+	ServerName string
+	TLSConfig  *tls.Config
+	Timeout    time.Duration
+	Dial       func(network, addr string) (net.Conn, error)
+}
+
+func (s *DoTServer) String() string {
+	return "tls://" + s.Addr
+}
+
+func (s *DoTServer) Exchange(query []byte) ([]byte, error) {
+	rawConn, err := dialWith(s.Dial, "tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer rawConn.Close()
+	_ = rawConn.SetDeadline(time.Now().Add(s.Timeout))
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.TLSConfig != nil {
+		tlsConfig = s.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = s.ServerName
+	}
+
+	conn := tls.Client(rawConn, tlsConfig)
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	return exchangeStream(conn, query)
+}
+
+// DoHServer speaks DNS over HTTPS (RFC 8484) using the wire format.
+type DoHServer struct {
+	URL    string
+	UseGET bool
+	Client *http.Client
+}
+
+func (s *DoHServer) String() string {
+	return s.URL
+}
+
+func (s *DoHServer) Exchange(query []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+	if s.UseGET {
+		u, parseErr := url.Parse(s.URL)
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(query))
+		u.RawQuery = values.Encode()
+		req, err = http.NewRequest(http.MethodGet, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(query))
+		if err == nil {
+			req.Header.Set("Content-Type", dnsMessageType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dnsMessageType)
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned %s", resp.Status)
+	}
+	if contentType := resp.Header.Get("Content-Type"); !strings.HasPrefix(contentType, dnsMessageType) {
+		return nil, fmt.Errorf("DoH server returned content type %q", contentType)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessageSize))
+}
+
+func newDoHClient(opts ServerOptions) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig:     opts.TLSConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if opts.Dial != nil {
+		dial := opts.Dial
+		transport.DialContext = func(_ context.Context, network, addr string) (net.Conn, error) {
+			return dial(network, addr)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: opts.Timeout}
+}
+
+func exchangeStream(conn net.Conn, query []byte) ([]byte, error) {
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func dialWith(dial func(network, addr string) (net.Conn, error), network, addr string, timeout time.Duration) (net.Conn, error) {
+	if dial != nil {
+		return dial(network, addr)
+	}
+	return net.DialTimeout(network, addr, timeout)
+}
+
+func hostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
@@ -0,0 +1,219 @@
+package routing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	RouteDirect    = "direct"
+	RouteTor       = "tor"
+	RouteBlackhole = "blackhole"
+	// RouteRefused names the route of connections that requested a route the
+	// client may not select. The requested name is client input and is never
+	// reported as a route.
+	RouteRefused = "refused"
+)
+
+var (
+	ErrBlackholed      = errors.New("connection blocked by routing policy")
+	ErrUnknownRoute    = errors.New("unknown route")
+	ErrRouteNotAllowed = errors.New("route not selectable by client")
+)
+
+// Request describes an outbound connection that is about to be dialed.
+type Request struct {
+	// Host is the destination name as requested by the client. It is empty
+	// when the client asked for a literal IP address.
+	Host string
+	// IP is the resolved or literal destination address.
+	IP       net.IP
+	Port     int
+	Username string
+	ClientIP net.IP
+	// Session is the client-chosen session tag, used for sticky selection.
+	Session string
+	// Route is a route requested by the client. It is only honoured when no
+	// rule matches and the operator made it selectable for the user, so
+	// neither policy rules nor the default route can be bypassed.
+	Route string
+	// SourceIP is set by outbounds that bind a local source address.
+	SourceIP net.IP
+}
+
+// AffinityKey identifies the client for sticky selection. Clients that send a
+// session tag get one key per tag, so changing the tag rotates the exit.
+func (r *Request) AffinityKey() string {
+	if r == nil {
+		return ""
+	}
+	if r.Session != "" {
+		return r.Username + "/" + r.Session
+	}
+	return r.Username
+}
+
+func (r *Request) destIP() net.IP {
+	if r.IP != nil {
+		return r.IP
+	}
+	return net.ParseIP(r.Host)
+}
+
+// Outbound opens connections for requests assigned to a route.
+type Outbound interface {
+	DialRoute(req *Request, network, addr string) (net.Conn, error)
+}
+
+// DialFunc adapts a plain dial function to the Outbound interface.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+func (f DialFunc) DialRoute(_ *Request, network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// Blackhole refuses every connection.
+var Blackhole Outbound = blackhole{}
+
+type blackhole struct{}
+
+func (blackhole) DialRoute(_ *Request, _, _ string) (net.Conn, error) {
+	return nil, ErrBlackholed
+}
+
+// refusedRoute refuses connections that requested a route the client may not
+// select, rather than silently sending them through the default route.
+type refusedRoute string
+
+func (u refusedRoute) DialRoute(_ *Request, _, _ string) (net.Conn, error) {
+	return nil, fmt.Errorf("%w: %q", ErrRouteNotAllowed, string(u))
+}
+
+// Router picks an outbound for each connection from an ordered rule list.
+// The first matching rule wins; unmatched connections use the default route.
+type Router struct {
+	rules        []compiledRule
+	outbounds    map[string]Outbound
+	defaultRoute string
+	// selectable and userSelectable are the routes clients may request.
+	selectable     []string
+	userSelectable map[string][]string
+}
+
+// NewRouter validates that every rule and the default route refer to a known
+// outbound. The blackhole route is always available.
+func NewRouter(rules []Rule, outbounds map[string]Outbound, defaultRoute string) (*Router, error) {
+	router := &Router{
+		outbounds:    make(map[string]Outbound, len(outbounds)+1),
+		defaultRoute: strings.TrimSpace(defaultRoute),
+	}
+	for name, outbound := range outbounds {
+		router.outbounds[name] = outbound
+	}
+	if _, ok := router.outbounds[RouteBlackhole]; !ok {
+		router.outbounds[RouteBlackhole] = Blackhole
+	}
+	if _, ok := router.outbounds[RouteRefused]; ok {
+		return nil, fmt.Errorf("route name %q is reserved", RouteRefused)
+	}
+
+	if router.defaultRoute == "" {
+		router.defaultRoute = RouteDirect
+	}
+	if _, ok := router.outbounds[router.defaultRoute]; !ok {
+		return nil, fmt.Errorf("%w: default route %q", ErrUnknownRoute, router.defaultRoute)
+	}
+
+	for i, rule := range rules {
+		compiled, err := compileRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		if _, ok := router.outbounds[compiled.route]; !ok {
+			return nil, fmt.Errorf("rule %d: %w %q", i+1, ErrUnknownRoute, compiled.route)
+		}
+		router.rules = append(router.rules, compiled)
+	}
+
+	return router, nil
+}
+
+// AllowClientRoutes lets clients request routes: routes are selectable by
+// every user and users lists further routes per username. Clients cannot
+// select any route until it is called. It must be called before the router
+// is used.
+func (r *Router) AllowClientRoutes(routes []string, users map[string][]string) error {
+	for _, route := range routes {
+		if _, ok := r.outbounds[route]; !ok {
+			return fmt.Errorf("%w: selectable route %q", ErrUnknownRoute, route)
+		}
+	}
+	for user, userRoutes := range users {
+		for _, route := range userRoutes {
+			if _, ok := r.outbounds[route]; !ok {
+				return fmt.Errorf("%w: selectable route %q of user %q", ErrUnknownRoute, route, user)
+			}
+		}
+	}
+	r.selectable, r.userSelectable = routes, users
+	return nil
+}
+
+// Select returns the route name and outbound for req. A route requested by the
+// client replaces the default route when the client may select it; any other
+// requested route yields RouteRefused and an outbound that fails with
+// ErrRouteNotAllowed.
+func (r *Router) Select(req *Request) (string, Outbound) {
+	for _, rule := range r.rules {
+		if rule.matches(req) {
+			return rule.route, r.outbounds[rule.route]
+		}
+	}
+	if req.Route != "" {
+		if !r.clientSelectable(req.Username, req.Route) {
+			return RouteRefused, refusedRoute(req.Route)
+		}
+		return req.Route, r.outbounds[req.Route]
+	}
+	return r.defaultRoute, r.outbounds[r.defaultRoute]
+}
+
+func (r *Router) clientSelectable(username, route string) bool {
+	return slices.Contains(r.selectable, route) || slices.Contains(r.userSelectable[username], route)
+}
+
+// Outbound returns the outbound registered under name.
+func (r *Router) Outbound(name string) (Outbound, bool) {
+	outbound, ok := r.outbounds[name]
+	return outbound, ok
+}
+
+// File is the on-disk routing configuration.
+type File struct {
+	Default   string              `json:"default"`
+	Upstreams map[string][]string `json:"upstreams,omitempty"`
+	Rules     []Rule              `json:"rules"`
+	// Selectable lists the routes every client may request with the route
+	// username parameter, and UserSelectable further routes per username.
+	Selectable     []string            `json:"selectable,omitempty"`
+	UserSelectable map[string][]string `json:"user_selectable,omitempty"`
+}
+
+// LoadFile reads a JSON routing configuration file.
+func LoadFile(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file File
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse routing file %s: %w", path, err)
+	}
+	return &file, nil
+}
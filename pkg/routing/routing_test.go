@@ -0,0 +1,206 @@
+package routing
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func namedOutbound(name string, dialed *[]string) Outbound {
+	return DialFunc(func(network, addr string) (net.Conn, error) {
+		*dialed = append(*dialed, name+"|"+addr)
+		return nil, errors.New(name)
+	})
+}
+
+func TestRouter_SelectFirstMatchingRule(t *testing.T) {
+	var dialed []string
+	router, err := NewRouter([]Rule{
+		{Route: "blackhole", Domains: []string{"ads.example.com"}},
+		{Route: "tor", Domains: []string{".onion"}},
+		{Route: "corp", CIDRs: []string{"10.0.0.0/8"}, Ports: []string{"443", "8000-8999"}},
+		{Route: "tor", Users: []string{"alice"}},
+	}, map[string]Outbound{
+		"direct": namedOutbound("direct", &dialed),
+		"tor":    namedOutbound("tor", &dialed),
+		"corp":   namedOutbound("corp", &dialed),
+	}, "direct")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		req   Request
+		route string
+	}{
+		{"blocked subdomain", Request{Host: "tracker.ads.example.com", Port: 80}, "blackhole"},
+		{"onion suffix", Request{Host: "abc.onion", Port: 80}, "tor"},
+		{"corp cidr and port", Request{IP: net.ParseIP("10.1.2.3"), Port: 8443}, "corp"},
+		{"corp cidr wrong port", Request{IP: net.ParseIP("10.1.2.3"), Port: 22}, "direct"},
+		{"user rule", Request{Host: "example.org", Port: 443, Username: "alice"}, "tor"},
+		{"default", Request{Host: "example.org", Port: 443, Username: "bob"}, "direct"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			route, outbound := router.Select(&tc.req)
+			assert.Equal(t, tc.route, route)
+			assert.NotNil(t, outbound)
+		})
+	}
+}
+
+func TestRouter_ClientCIDR(t *testing.T) {
+	var dialed []string
+	router, err := NewRouter([]Rule{
+		{Route: "lab", Clients: []string{"192.168.10.0/24", "127.0.0.1"}},
+	}, map[string]Outbound{
+		"direct": namedOutbound("direct", &dialed),
+		"lab":    namedOutbound("lab", &dialed),
+	}, "")
+	require.NoError(t, err)
+
+	route, _ := router.Select(&Request{Host: "example.org", ClientIP: net.ParseIP("192.168.10.7")})
+	assert.Equal(t, "lab", route)
+
+	route, _ = router.Select(&Request{Host: "example.org", ClientIP: net.ParseIP("127.0.0.1")})
+	assert.Equal(t, "lab", route)
+
+	route, _ = router.Select(&Request{Host: "example.org", ClientIP: net.ParseIP("192.168.11.7")})
+	assert.Equal(t, "direct", route)
+}
+
+func TestRouter_Blackhole(t *testing.T) {
+	router, err := NewRouter([]Rule{{Route: RouteBlackhole, Ports: []string{"25"}}}, map[string]Outbound{
+		RouteDirect: DialFunc(net.Dial),
+	}, RouteDirect)
+	require.NoError(t, err)
+
+	req := &Request{Host: "mail.example.com", Port: 25}
+	route, outbound := router.Select(req)
+	assert.Equal(t, RouteBlackhole, route)
+
+	_, err = outbound.DialRoute(req, "tcp", "mail.example.com:25")
+	assert.ErrorIs(t, err, ErrBlackholed)
+}
+
+func TestRouter_RequestedRoute(t *testing.T) {
+	var dialed []string
+	router, err := NewRouter([]Rule{{Route: RouteBlackhole, Ports: []string{"25"}}}, map[string]Outbound{
+		RouteDirect: namedOutbound("direct", &dialed),
+		RouteTor:    namedOutbound("tor", &dialed),
+	}, RouteDirect)
+	require.NoError(t, err)
+	require.NoError(t, router.AllowClientRoutes([]string{RouteTor}, nil))
+
+	route, _ := router.Select(&Request{Host: "example.org", Port: 443, Route: RouteTor})
+	assert.Equal(t, RouteTor, route)
+
+	// Rules take precedence over the requested route.
+	route, _ = router.Select(&Request{Host: "example.org", Port: 25, Route: RouteTor})
+	assert.Equal(t, RouteBlackhole, route)
+
+	req := &Request{Host: "example.org", Port: 443, Route: "missing"}
+	route, outbound := router.Select(req)
+	assert.Equal(t, RouteRefused, route)
+	_, err = outbound.DialRoute(req, "tcp", "example.org:443")
+	assert.ErrorIs(t, err, ErrRouteNotAllowed)
+	assert.Empty(t, dialed)
+}
+
+func TestRouter_RequestedRouteCannotEscapeDefault(t *testing.T) {
+	var dialed []string
+	router, err := NewRouter(nil, map[string]Outbound{
+		RouteDirect: namedOutbound("direct", &dialed),
+		RouteTor:    namedOutbound("tor", &dialed),
+		"corp":      namedOutbound("corp", &dialed),
+	}, RouteTor)
+	require.NoError(t, err)
+
+	// Without an allowlist no route can be requested.
+	req := &Request{Host: "example.org", Port: 443, Username: "mallory", Route: RouteDirect}
+	route, outbound := router.Select(req)
+	assert.Equal(t, RouteRefused, route)
+	_, err = outbound.DialRoute(req, "tcp", "example.org:443")
+	assert.ErrorIs(t, err, ErrRouteNotAllowed)
+
+	// The requested name is client input, so it is not reported as the route.
+	route, _ = router.Select(&Request{Host: "example.org", Port: 443, Username: "mallory", Route: "x7f3"})
+	assert.Equal(t, RouteRefused, route)
+
+	require.NoError(t, router.AllowClientRoutes([]string{"corp"}, map[string][]string{"alice": {RouteDirect}}))
+
+	_, outbound = router.Select(req)
+	_, err = outbound.DialRoute(req, "tcp", "example.org:443")
+	assert.ErrorIs(t, err, ErrRouteNotAllowed)
+	assert.Empty(t, dialed)
+
+	route, _ = router.Select(&Request{Host: "example.org", Port: 443, Username: "mallory", Route: "corp"})
+	assert.Equal(t, "corp", route)
+	route, _ = router.Select(&Request{Host: "example.org", Port: 443, Username: "alice", Route: RouteDirect})
+	assert.Equal(t, RouteDirect, route)
+	route, _ = router.Select(&Request{Host: "example.org", Port: 443, Username: "mallory"})
+	assert.Equal(t, RouteTor, route)
+
+	assert.ErrorIs(t, router.AllowClientRoutes([]string{"missing"}, nil), ErrUnknownRoute)
+	assert.ErrorIs(t, router.AllowClientRoutes(nil, map[string][]string{"alice": {"missing"}}), ErrUnknownRoute)
+
+	_, err = NewRouter(nil, map[string]Outbound{RouteDirect: Blackhole, RouteRefused: Blackhole}, RouteDirect)
+	assert.Error(t, err)
+}
+
+func TestRequest_AffinityKey(t *testing.T) {
+	assert.Equal(t, "alice", (&Request{Username: "alice"}).AffinityKey())
+	assert.Equal(t, "alice/abc", (&Request{Username: "alice", Session: "abc"}).AffinityKey())
+	assert.Equal(t, "", (*Request)(nil).AffinityKey())
+}
+
+func TestNewRouter_UnknownRoute(t *testing.T) {
+	_, err := NewRouter([]Rule{{Route: "missing"}}, map[string]Outbound{RouteDirect: Blackhole}, RouteDirect)
+	assert.ErrorIs(t, err, ErrUnknownRoute)
+
+	_, err = NewRouter(nil, map[string]Outbound{RouteDirect: Blackhole}, "missing")
+	assert.ErrorIs(t, err, ErrUnknownRoute)
+}
+
+func TestNewRouter_InvalidRule(t *testing.T) {
+	outbounds := map[string]Outbound{RouteDirect: Blackhole}
+
+	_, err := NewRouter([]Rule{{Route: RouteDirect, CIDRs: []string{"not-a-cidr"}}}, outbounds, RouteDirect)
+	assert.Error(t, err)
+
+	_, err = NewRouter([]Rule{{Route: RouteDirect, Ports: []string{"90-80"}}}, outbounds, RouteDirect)
+	assert.Error(t, err)
+
+	_, err = NewRouter([]Rule{{Domains: []string{"example.com"}}}, outbounds, RouteDirect)
+	assert.Error(t, err)
+}
+
+func TestLoadFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	content := `{
+  "default": "direct",
+  "upstreams": {"corp": ["http://gw.internal:3128"]},
+  "rules": [{"route": "corp", "domains": ["corp.example.com"]}]
+}`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	file, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "direct", file.Default)
+	assert.Equal(t, []string{"http://gw.internal:3128"}, file.Upstreams["corp"])
+	require.Len(t, file.Rules, 1)
+	assert.Equal(t, "corp", file.Rules[0].Route)
+}
+
+func TestLoadFile_InvalidJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+
+	_, err := LoadFile(path)
+	assert.Error(t, err)
+}
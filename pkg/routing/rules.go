@@ -0,0 +1,184 @@
+package routing
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Rule selects Route for connections matching every non-empty criterion.
+// Within a criterion, any listed value may match.
+type Rule struct {
+	Route   string   `json:"route"`
+	Domains []string `json:"domains,omitempty"`
+	CIDRs   []string `json:"cidrs,omitempty"`
+	Ports   []string `json:"ports,omitempty"`
+	Users   []string `json:"users,omitempty"`
+	Clients []string `json:"clients,omitempty"`
+}
+
+type portRange struct {
+	from int
+	to   int
+}
+
+type compiledRule struct {
+	route   string
+	domains []string
+	cidrs   []*net.IPNet
+	ports   []portRange
+	users   map[string]struct{}
+	clients []*net.IPNet
+}
+
+func compileRule(rule Rule) (compiledRule, error) {
+	compiled := compiledRule{route: strings.TrimSpace(rule.Route)}
+	if compiled.route == "" {
+		return compiledRule{}, fmt.Errorf("rule is missing a route")
+	}
+
+	for _, domain := range rule.Domains {
+		if d := normalizeDomain(domain); d != "" {
+			compiled.domains = append(compiled.domains, d)
+		}
+	}
+
+	for _, raw := range rule.CIDRs {
+		ipNet, err := ParseCIDR(raw)
+		if err != nil {
+			return compiledRule{}, err
+		}
+		compiled.cidrs = append(compiled.cidrs, ipNet)
+	}
+
+	for _, raw := range rule.Ports {
+		pr, err := parsePortRange(raw)
+		if err != nil {
+			return compiledRule{}, err
+		}
+		compiled.ports = append(compiled.ports, pr)
+	}
+
+	if len(rule.Users) > 0 {
+		compiled.users = make(map[string]struct{}, len(rule.Users))
+		for _, user := range rule.Users {
+			compiled.users[strings.TrimSpace(user)] = struct{}{}
+		}
+	}
+
+	for _, raw := range rule.Clients {
+		ipNet, err := ParseCIDR(raw)
+		if err != nil {
+			return compiledRule{}, err
+		}
+		compiled.clients = append(compiled.clients, ipNet)
+	}
+
+	return compiled, nil
+}
+
+func (r compiledRule) matches(req *Request) bool {
+	if len(r.domains) > 0 && !MatchDomain(r.domains, req.Host) {
+		return false
+	}
+	if len(r.cidrs) > 0 && !matchIP(r.cidrs, req.destIP()) {
+		return false
+	}
+	if len(r.ports) > 0 && !matchPort(r.ports, req.Port) {
+		return false
+	}
+	if len(r.users) > 0 {
+		if _, ok := r.users[req.Username]; !ok {
+			return false
+		}
+	}
+	if len(r.clients) > 0 && !matchIP(r.clients, req.ClientIP) {
+		return false
+	}
+	return true
+}
+
+// MatchDomain reports whether host equals one of the suffixes or is a
+// subdomain of one. Suffixes must already be normalized.
+func MatchDomain(suffixes []string, host string) bool {
+	host = normalizeDomain(host)
+	if host == "" {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDR accepts either CIDR notation or a single IP address.
+func ParseCIDR(raw string) (*net.IPNet, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "/") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip address %q", raw)
+		}
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cidr %q: %w", raw, err)
+	}
+	return ipNet, nil
+}
+
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimPrefix(domain, "*.")
+	domain = strings.TrimPrefix(domain, ".")
+	return strings.TrimSuffix(domain, ".")
+}
+
+func parsePortRange(raw string) (portRange, error) {
+	raw = strings.TrimSpace(raw)
+	from, to, found := strings.Cut(raw, "-")
+	if !found {
+		to = from
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil || start < 1 || start > 65535 {
+		return portRange{}, fmt.Errorf("invalid port %q", raw)
+	}
+	end, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil || end < start || end > 65535 {
+		return portRange{}, fmt.Errorf("invalid port range %q", raw)
+	}
+
+	return portRange{from: start, to: end}, nil
+}
+
+func matchIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPort(ranges []portRange, port int) bool {
+	for _, pr := range ranges {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
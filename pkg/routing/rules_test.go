@@ -0,0 +1,61 @@
+package routing
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchDomain(t *testing.T) {
+	suffixes := []string{normalizeDomain("*.Example.COM."), normalizeDomain(".internal")}
+
+	assert.True(t, MatchDomain(suffixes, "example.com"))
+	assert.True(t, MatchDomain(suffixes, "api.example.com"))
+	assert.True(t, MatchDomain(suffixes, "db.internal."))
+	assert.False(t, MatchDomain(suffixes, "notexample.com"))
+	assert.False(t, MatchDomain(suffixes, ""))
+}
+
+func TestParseCIDR(t *testing.T) {
+	ipNet, err := ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	assert.True(t, ipNet.Contains(net.ParseIP("10.20.30.40")))
+
+	single, err := ParseCIDR("192.0.2.1")
+	require.NoError(t, err)
+	assert.True(t, single.Contains(net.ParseIP("192.0.2.1")))
+	assert.False(t, single.Contains(net.ParseIP("192.0.2.2")))
+
+	single6, err := ParseCIDR("2001:db8::1")
+	require.NoError(t, err)
+	assert.True(t, single6.Contains(net.ParseIP("2001:db8::1")))
+
+	_, err = ParseCIDR("bogus")
+	assert.Error(t, err)
+}
+
+func TestParsePortRange(t *testing.T) {
+	pr, err := parsePortRange("443")
+	require.NoError(t, err)
+	assert.Equal(t, portRange{from: 443, to: 443}, pr)
+
+	pr, err = parsePortRange("8000-8999")
+	require.NoError(t, err)
+	assert.True(t, matchPort([]portRange{pr}, 8080))
+	assert.False(t, matchPort([]portRange{pr}, 9000))
+
+	_, err = parsePortRange("0")
+	assert.Error(t, err)
+	_, err = parsePortRange("10-70000")
+	assert.Error(t, err)
+}
+
+func TestCompiledRule_LiteralHostMatchesCIDR(t *testing.T) {
+	rule, err := compileRule(Rule{Route: "corp", CIDRs: []string{"10.0.0.0/8"}})
+	require.NoError(t, err)
+
+	assert.True(t, rule.matches(&Request{Host: "10.1.1.1"}))
+	assert.False(t, rule.matches(&Request{Host: "example.com"}))
+}
@@ -25,6 +25,9 @@ const (
 	NoAuth       AuthType = 0x00
 	NoAcceptable AuthType = 0xFF
 	UserPassAuth AuthType = 0x02
+	// ClientCertAuth marks a client identified by its TLS certificate. It is
+	// never negotiated; such clients select NoAuth on the wire.
+	ClientCertAuth AuthType = 0xFE
 
 	AuthSuccess AuthStatus = 0x00
 	AuthFailure AuthStatus = 0x01
@@ -42,8 +45,12 @@ type Context struct {
 	Method AuthType
 	// Payload provided during negotiation.
 	// Keys depend on the used auth method.
-	// For UserPass-auth contains Username
+	// For UserPass-auth contains Username and any username parameters
+	// (e.g. "session", "route") extracted by the configured grammar.
 	Payload map[string]string
+	// Grant is set when the client authenticated with an ephemeral
+	// credential and restricts what it may do.
+	Grant *credential.Grant
 }
 
 // Authenticator is the interface implemented by types that can handle authentication
@@ -63,12 +70,15 @@ func (a *NoAuthAuthenticator) GetCode() AuthType {
 // Authenticate handles the authentication process
 func (a *NoAuthAuthenticator) Authenticate(_ io.Reader, writer io.Writer) (*Context, error) {
 	_, err := writer.Write([]byte{Version, uint8(NoAuth)})
-	return &Context{NoAuth, nil}, err
+	return &Context{Method: NoAuth}, err
 }
 
 // UserPassAuthenticator is used to handle username/password-based authentication
 type UserPassAuthenticator struct {
 	Credentials credential.Store
+	// Params, when set, extracts parameters appended to the username. The
+	// password is then checked against the base username.
+	Params *credential.UsernameGrammar
 }
 
 // GetCode returns the code of the authenticator
@@ -112,8 +122,16 @@ func (a *UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		return nil, err
 	}
 
-	// Check the credentials
-	if a.Credentials.Valid(string(user), string(pass)) {
+	// Check the credentials. The whole username is tried before the base
+	// username Params extracts, so accounts whose name contains a parameter
+	// key keep working.
+	username, params := string(user), map[string]string(nil)
+	grant, ok := a.valid(username, string(pass))
+	if base, baseParams := a.Params.Parse(username); !ok && base != username {
+		username, params = base, baseParams
+		grant, ok = a.valid(username, string(pass))
+	}
+	if ok {
 		if _, err := writer.Write([]byte{UserAuthVersion, uint8(AuthSuccess)}); err != nil {
 			return nil, err
 		}
@@ -124,7 +142,21 @@ func (a *UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		return nil, fmt.Errorf("invalid credentials")
 	}
 
-	return &Context{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	payload := map[string]string{"Username": username}
+	for key, value := range params {
+		payload[key] = value
+	}
+	return &Context{Method: UserPassAuth, Payload: payload, Grant: grant}, nil
+}
+
+// valid checks password, or the secret of an ephemeral credential, for user.
+func (a *UserPassAuthenticator) valid(user, password string) (*credential.Grant, bool) {
+	if grants, ok := a.Credentials.(credential.GrantStore); ok {
+		if grant, ok := grants.Grant(user, password); ok {
+			return grant, true
+		}
+	}
+	return nil, a.Credentials.Valid(user, password)
 }
 
 func readMethods(bufConn io.Reader) ([]byte, error) {
@@ -3,7 +3,9 @@ package socks5
 import (
 	"bytes"
 	"testing"
+	"time"
 
+	"github.com/ryanbekhen/nanoproxy/pkg/credential"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,6 +61,87 @@ func TestUserPassAuthenticator(t *testing.T) {
 	assert.Equal(t, UserPassAuth, auth.GetCode())
 }
 
+func TestUserPassAuthenticator_UsernameParams(t *testing.T) {
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("alice", "pass")
+	auth := &UserPassAuthenticator{
+		Credentials: credentials,
+		Params:      credential.NewUsernameGrammar("", nil),
+	}
+	user := []byte("alice-session-abc-route-tor")
+	payload := append([]byte{UserAuthVersion, byte(len(user))}, user...)
+	payload = append(payload, 4, 'p', 'a', 's', 's')
+
+	ctx, err := auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Username": "alice", "session": "abc", "route": "tor"}, ctx.Payload)
+}
+
+func TestUserPassAuthenticator_UsernameContainsParamKey(t *testing.T) {
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("ops-session-bot", "pass")
+	credentials.Add("ops", "other")
+	auth := &UserPassAuthenticator{
+		Credentials: credentials,
+		Params:      credential.NewUsernameGrammar("", nil),
+	}
+	authenticate := func(user, pass string) (*Context, error) {
+		payload := append([]byte{UserAuthVersion, byte(len(user))}, user...)
+		payload = append(payload, byte(len(pass)))
+		payload = append(payload, pass...)
+		return auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	}
+
+	ctx, err := authenticate("ops-session-bot", "pass")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Username": "ops-session-bot"}, ctx.Payload)
+
+	ctx, err = authenticate("ops-session-bot", "other")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Username": "ops", "session": "bot"}, ctx.Payload)
+}
+
+func TestUserPassAuthenticator_NamedCredential(t *testing.T) {
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("alice", "pass")
+	secret, err := credentials.IssueCredential("alice", "ci", time.Time{})
+	assert.NoError(t, err)
+	auth := &UserPassAuthenticator{Credentials: credentials}
+
+	payload := append([]byte{UserAuthVersion, 5, 'a', 'l', 'i', 'c', 'e', byte(len(secret))}, secret...)
+	ctx, err := auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", ctx.Payload["Username"])
+
+	credentials.RevokeCredential("alice", "ci")
+	_, err = auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	assert.Error(t, err)
+}
+
+func TestUserPassAuthenticator_EphemeralCredential(t *testing.T) {
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("alice", "pass")
+	ephemeral, secret, err := credentials.IssueEphemeral(credential.Ephemeral{
+		User:         "alice",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Destinations: []string{"example.com"},
+		SingleUse:    true,
+	})
+	assert.NoError(t, err)
+	auth := &UserPassAuthenticator{Credentials: credentials}
+
+	payload := append([]byte{UserAuthVersion, 5, 'a', 'l', 'i', 'c', 'e', byte(len(secret))}, secret...)
+	ctx, err := auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", ctx.Payload["Username"])
+	assert.Equal(t, ephemeral.ID, ctx.Grant.ID())
+	assert.True(t, ctx.Grant.Allows("www.example.com"))
+
+	// The credential was single-use.
+	_, err = auth.Authenticate(bytes.NewBuffer(payload), bytes.NewBuffer(nil))
+	assert.Error(t, err)
+}
+
 func TestUserPassAuthenticator_Authenticate(t *testing.T) {
 	auth := &UserPassAuthenticator{
 		Credentials: &mockCredentialStore{valid: false},
@@ -7,8 +7,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
 )
 
+// AddressRewriter picks the address a request connects to instead of its
+// destination. It runs before the destination name is resolved.
 type AddressRewriter interface {
 	Rewrite(request *Request) *AddrSpec
 }
@@ -54,6 +58,14 @@ type Request struct {
 	realAddr    *AddrSpec
 	BufferConn  io.Reader
 	Latency     time.Duration
+
+	route        string
+	outbound     routing.Outbound
+	routeRequest *routing.Request
+	// resolvedIPs holds every address of DestAddr.FQDN in dial order.
+	resolvedIPs []net.IP
+	// connectedAddr is the address that won the connection race.
+	connectedAddr string
 }
 
 var socks5DomainLengthOctets = func() [256]byte {
@@ -2,18 +2,27 @@ package socks5
 
 import (
 	"bufio"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/filter"
+	"github.com/ryanbekhen/nanoproxy/pkg/happyeyeballs"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
 	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
 )
 
@@ -28,18 +37,40 @@ type Config struct {
 	Resolver          resolver.Resolver
 	Rewriter          AddressRewriter
 	Tracker           *traffic.Tracker
+	Router            *routing.Router
+	// DialRemote tells that Dial reaches destinations through Tor or an
+	// upstream proxy, which resolve host names themselves. It is ignored
+	// when Router is set.
+	DialRemote bool
+	// ConnectionAttemptDelay is how long a connection attempt may run before
+	// the next resolved address is tried in parallel (RFC 8305). Zero selects
+	// happyeyeballs.DefaultDelay.
+	ConnectionAttemptDelay time.Duration
+	// ClientCertUsername, when set, maps the verified certificate of a
+	// client on a TLS listener to a username. Such clients may then pick
+	// "no authentication" and are treated as that user. An error leaves the
+	// client to the other authentication methods.
+	ClientCertUsername func(cert *x509.Certificate) (string, error)
+	// Interceptor, when set, takes over the CONNECT requests it selects for
+	// inspection instead of relaying them.
+	Interceptor mitm.Interceptor
+	// Filter, when set, refuses destinations in the content categories
+	// blocked for the user.
+	Filter *filter.Filter
 }
 
 type Server struct {
 	config         *Config
 	authentication map[AuthType]Authenticator
-	listener       net.Listener
+
+	mu        sync.Mutex
+	listeners []net.Listener
 }
 
 func New(conf *Config) *Server {
 	if len(conf.Authentication) == 0 {
 		if conf.Credentials != nil {
-			conf.Authentication = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+			conf.Authentication = []Authenticator{&UserPassAuthenticator{Credentials: conf.Credentials}}
 		} else {
 			conf.Authentication = []Authenticator{&NoAuthAuthenticator{}}
 		}
@@ -83,15 +114,32 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	return s.serve(l)
 }
 
+// ListenAndServeTLS serves SOCKS5 inside TLS. tlsConfig decides whether
+// clients must present certificates.
+func (s *Server) ListenAndServeTLS(network, addr string, tlsConfig *tls.Config) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.serve(tls.NewListener(l, tlsConfig))
+}
+
 func (s *Server) Shutdown() error {
-	if s.listener != nil {
-		return s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for _, l := range s.listeners {
+		errs = append(errs, l.Close())
 	}
-	return nil
+	s.listeners = nil
+	return errors.Join(errs...)
 }
 
 func (s *Server) serve(l net.Listener) error {
-	s.listener = l
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
 	for {
 		conn, err := l.Accept()
 		if err != nil {
@@ -121,6 +169,14 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
+	certUsername, err := s.clientCertUsername(conn, connLogger)
+	if err != nil {
+		if shouldLogRequestError(err) {
+			connLogger.Error().Err(err).Msg("tls handshake failed")
+		}
+		return
+	}
+
 	// Read the version byte
 	version, err := connectionBuffer.ReadByte()
 	if err != nil {
@@ -137,7 +193,7 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 
 	// Authenticate
-	authContext, err := s.authenticate(conn, connectionBuffer)
+	authContext, err := s.authenticate(conn, connectionBuffer, certUsername)
 	if err != nil {
 		if shouldLogRequestError(err) {
 			connLogger.Error().Err(err).Msg("proxy authentication failed")
@@ -146,7 +202,16 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 	username := usernameFromAuthContext(authContext)
 	connLogger = connLogger.With().Str("username", username).Logger()
-	if s.config.Credentials != nil {
+	sessionTag := payloadValue(authContext, credential.ParamSession)
+	if sessionTag != "" {
+		connLogger = connLogger.With().Str("session", sessionTag).Logger()
+	}
+	if authContext.Grant != nil {
+		connLogger = connLogger.With().Str("credential", authContext.Grant.ID()).Logger()
+	}
+	if authContext.Method == ClientCertAuth {
+		connLogger.Debug().Msg("client certificate authentication succeeded")
+	} else if s.config.Credentials != nil {
 		connLogger.Debug().Msg("proxy authentication succeeded")
 	} else {
 		connLogger.Debug().Msg("connection accepted without authentication")
@@ -174,12 +239,26 @@ func (s *Server) handleConnection(conn net.Conn) {
 	requestLogger.Debug().Msg("request received")
 	trafficSession := s.startTrafficSession(authContext, conn)
 	defer trafficSession.Close()
+	if sessionTag != "" {
+		trafficSession.SetTag(sessionTag)
+	}
+	if authContext.Grant != nil {
+		trafficSession.SetCredential(authContext.Grant.ID())
+	}
 
 	if clientAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
 		request.RemoteAddr = &AddrSpec{IP: clientAddr.IP, Port: clientAddr.Port}
 	}
 
 	err, updatedLogger := s.handleRequest(request, conn, trafficSession, requestLogger)
+	if request.routeRequest != nil && request.routeRequest.SourceIP != nil {
+		egressIP := request.routeRequest.SourceIP.String()
+		updatedLogger = updatedLogger.With().Str("egress_ip", egressIP).Logger()
+		trafficSession.SetEgressIP(egressIP)
+	}
+	if request.connectedAddr != "" {
+		updatedLogger = updatedLogger.With().Str("connected_addr", request.connectedAddr).Logger()
+	}
 	if err != nil && shouldLogRequestError(err) {
 		updatedLogger.Error().
 			Err(err).
@@ -197,13 +276,23 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
-func (s *Server) authenticate(conn net.Conn, bufConn *bufio.Reader) (*Context, error) {
+// authenticate negotiates the authentication method. certUsername is the
+// user named by a verified client certificate, which is accepted in place of
+// any other method when the client offers "no authentication".
+func (s *Server) authenticate(conn net.Conn, bufConn *bufio.Reader, certUsername string) (*Context, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read methods: %w", err)
 	}
 
+	if certUsername != "" && slices.Contains(methods, uint8(NoAuth)) {
+		if _, err := conn.Write([]byte{Version, uint8(NoAuth)}); err != nil {
+			return nil, err
+		}
+		return &Context{Method: ClientCertAuth, Payload: map[string]string{"Username": certUsername}}, nil
+	}
+
 	// Select a usable method
 	for _, method := range methods {
 		if a, ok := s.authentication[AuthType(method)]; ok {
@@ -217,20 +306,20 @@ func (s *Server) authenticate(conn net.Conn, bufConn *bufio.Reader) (*Context, e
 
 func (s *Server) handleRequest(req *Request, conn net.Conn, trafficSession *traffic.Session, requestLogger zerolog.Logger) (error, zerolog.Logger) {
 	dest := req.DestAddr
-	if dest.FQDN != "" {
-		addr, err := s.config.Resolver.Resolve(dest.FQDN)
-		if err != nil {
-			if err := sendReply(conn, StatusHostUnreachable.Uint8(), nil); err != nil {
-				return fmt.Errorf("%w: %w", ErrFailedToSendReply, err), requestLogger
-			}
-			return fmt.Errorf("failed to resolve destination: %w", err), requestLogger
+	if grant := grantFromAuthContext(req.AuthContext); !grant.Allows(destinationHost(dest)) {
+		if err := sendReply(conn, StatusConnectionNotAllowed.Uint8(), nil); err != nil {
+			return fmt.Errorf("%w: %w", ErrFailedToSendReply, err), requestLogger
+		}
+		return fmt.Errorf("destination %s not allowed for credential %s", destinationHost(dest), grant.ID()), requestLogger
+	}
+	username := usernameFromAuthContext(req.AuthContext)
+	if block, blocked := s.config.Filter.Check(filter.Request{Username: username, Host: destinationHost(dest)}); blocked {
+		requestLogger = requestLogger.With().Str("category", block.Category).Str("rule", block.Rule).Logger()
+		if err := sendReply(conn, StatusConnectionNotAllowed.Uint8(), nil); err != nil {
+			return fmt.Errorf("%w: %w", ErrFailedToSendReply, err), requestLogger
 		}
-		dest.IP = addr
-		requestLogger = requestLogger.With().Str("resolved_ip", addr.String()).Logger()
-		requestLogger.Debug().Msg("resolved destination address")
+		return fmt.Errorf("destination %s %w", destinationHost(dest), filter.ErrBlocked), requestLogger
 	}
-	// Update dest_addr with resolved IP for final logging
-	requestLogger = requestLogger.With().Str("dest_addr", dest.String()).Logger()
 
 	req.realAddr = req.DestAddr
 	if s.config.Rewriter != nil {
@@ -239,6 +328,26 @@ func (s *Server) handleRequest(req *Request, conn net.Conn, trafficSession *traf
 
 	switch req.Command {
 	case CommandConnect:
+		// The route is chosen before the name is resolved, so that Tor and
+		// upstream proxies get it unresolved. Inspected tunnels are routed
+		// by the interceptor.
+		intercepted := s.intercepts(req)
+		if !intercepted {
+			requestLogger = s.selectRoute(req, trafficSession, requestLogger)
+		}
+		if err := s.resolveDestination(conn, req, !intercepted && s.resolvesLocally(req.route)); err != nil {
+			return err, requestLogger
+		}
+		if len(req.resolvedIPs) > 0 {
+			requestLogger = requestLogger.With().Str("resolved_ip", req.resolvedIPs[0].String()).Logger()
+			requestLogger.Debug().Msg("resolved destination address")
+		}
+		// Update dest_addr with resolved IP for final logging
+		requestLogger = requestLogger.With().Str("dest_addr", dest.String()).Logger()
+
+		if intercepted {
+			return s.handleIntercept(conn, req, trafficSession, requestLogger), requestLogger
+		}
 		err := s.handleConnect(conn, req, trafficSession, requestLogger)
 		return err, requestLogger
 	// TODO: Implement these
@@ -247,6 +356,7 @@ func (s *Server) handleRequest(req *Request, conn net.Conn, trafficSession *traf
 	//case CommandAssociate:
 	//	return s.handleAssociate(conn, req)
 	default:
+		requestLogger = requestLogger.With().Str("dest_addr", dest.String()).Logger()
 		if err := sendReply(conn, StatusCommandNotSupported.Uint8(), nil); err != nil {
 			return fmt.Errorf("%w: %w", ErrFailedToSendReply, err), requestLogger
 		}
@@ -254,6 +364,54 @@ func (s *Server) handleRequest(req *Request, conn net.Conn, trafficSession *traf
 	}
 }
 
+// resolveDestination resolves the name of the destination of req when local
+// is set. Otherwise the name is kept for the outbound to resolve and only the
+// DNS policy is enforced.
+func (s *Server) resolveDestination(conn net.Conn, req *Request, local bool) error {
+	dest := req.DestAddr
+	if dest.FQDN == "" {
+		return nil
+	}
+
+	var (
+		addrs []net.IP
+		err   error
+	)
+	if local {
+		addrs, err = s.config.Resolver.ResolveAll(dest.FQDN)
+		if err == nil && len(addrs) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: dest.FQDN, IsNotFound: true}
+		}
+	} else if blocker, ok := s.config.Resolver.(resolver.Blocker); ok && blocker.Blocked(dest.FQDN) {
+		err = fmt.Errorf("%s: %w", dest.FQDN, resolver.ErrBlocked)
+	}
+	if err != nil {
+		status := StatusHostUnreachable
+		if errors.Is(err, resolver.ErrBlocked) {
+			status = StatusConnectionNotAllowed
+		}
+		if err := sendReply(conn, status.Uint8(), nil); err != nil {
+			return fmt.Errorf("%w: %w", ErrFailedToSendReply, err)
+		}
+		return fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	if len(addrs) > 0 {
+		dest.IP = addrs[0]
+		req.resolvedIPs = addrs
+	}
+	return nil
+}
+
+// resolvesLocally reports whether destinations on route are resolved by
+// the proxy: only connections dialed directly are. Tor and upstream proxies
+// get the host name, so it is not leaked to the local DNS servers.
+func (s *Server) resolvesLocally(route string) bool {
+	if s.config.Router == nil {
+		return !s.config.DialRemote
+	}
+	return route == routing.RouteDirect
+}
+
 func (s *Server) handleConnect(conn net.Conn, req *Request, trafficSession *traffic.Session, requestLogger zerolog.Logger) error {
 	dial := s.config.Dial
 	if dial == nil {
@@ -262,22 +420,48 @@ func (s *Server) handleConnect(conn net.Conn, req *Request, trafficSession *traf
 		}
 	}
 
+	targets := dialTargets(req)
+	// Attempts run concurrently, so each one gets its own copy of the route
+	// request for the outbound to annotate.
+	routeRequests := make([]*routing.Request, len(targets))
+	attempt := func(i int) (net.Conn, error) {
+		if req.outbound == nil {
+			return dial("tcp", targets[i])
+		}
+		routeRequest := *req.routeRequest
+		routeRequests[i] = &routeRequest
+		return req.outbound.DialRoute(&routeRequest, "tcp", targets[i])
+	}
+
 	processStartTimestamp := time.Now()
-	requestLogger.Debug().Msg("dialing destination")
-	dest, err := dial("tcp", req.realAddr.Address())
+	requestLogger.Debug().Int("addresses", len(targets)).Msg("dialing destination")
+	dest, winner, err := happyeyeballs.Dial(len(targets), s.config.ConnectionAttemptDelay, attempt)
 	req.Latency = time.Since(processStartTimestamp)
+	if err == nil {
+		req.connectedAddr = targets[winner]
+		if routeRequests[winner] != nil {
+			req.routeRequest.SourceIP = routeRequests[winner].SourceIP
+		}
+	}
 
 	if err != nil {
+		if errors.Is(err, routing.ErrBlackholed) || errors.Is(err, routing.ErrRouteNotAllowed) {
+			if err := sendReply(conn, StatusConnectionNotAllowed.Uint8(), nil); err != nil {
+				return fmt.Errorf("%w: %w", ErrFailedToSendReply, err)
+			}
+			return err
+		}
+
 		msg := err.Error()
 		resp := StatusHostUnreachable
 		if strings.Contains(msg, "refused") {
 			resp = StatusConnectionRefused
-			msg = "connection refused " + req.DestAddr.IP.String()
+			msg = "connection refused " + destinationHost(req.DestAddr)
 		}
 
 		if strings.Contains(msg, "unreachable network") {
 			resp = StatusNetworkUnreachable
-			msg = "unreachable network " + req.DestAddr.IP.String()
+			msg = "unreachable network " + destinationHost(req.DestAddr)
 		}
 
 		if err := sendReply(conn, resp.Uint8(), nil); err != nil {
@@ -296,9 +480,10 @@ func (s *Server) handleConnect(conn net.Conn, req *Request, trafficSession *traf
 		return fmt.Errorf("%w: %w", ErrFailedToSendReply, err)
 	}
 
+	grant := grantFromAuthContext(req.AuthContext)
 	errChan := make(chan error, 2)
-	go relayWithCount(dest, req.BufferConn, errChan, trafficSession.AddUpload)
-	go relayWithCount(conn, dest, errChan, trafficSession.AddDownload)
+	go relayWithCount(dest, grant.Reader(req.BufferConn), errChan, trafficSession.AddUpload)
+	go relayWithCount(conn, grant.Reader(dest), errChan, trafficSession.AddDownload)
 
 	for i := 0; i < 2; i++ {
 		if err := <-errChan; err != nil {
@@ -309,6 +494,129 @@ func (s *Server) handleConnect(conn net.Conn, req *Request, trafficSession *traf
 	return nil
 }
 
+func (s *Server) intercepts(req *Request) bool {
+	if s.config.Interceptor == nil {
+		return false
+	}
+	return s.config.Interceptor.Inspects(usernameFromAuthContext(req.AuthContext), destinationHost(req.realAddr), req.realAddr.Port)
+}
+
+// handleIntercept grants a CONNECT request selected for inspection without
+// dialing the destination and hands the tunnel to the interceptor, which
+// connects to the destination itself.
+func (s *Server) handleIntercept(conn net.Conn, req *Request, trafficSession *traffic.Session, requestLogger zerolog.Logger) error {
+	if err := sendReply(conn, StatusRequestGranted.Uint8(), nil); err != nil {
+		return fmt.Errorf("%w: %w", ErrFailedToSendReply, err)
+	}
+
+	requestLogger.Debug().Msg("handing tunnel over for inspection")
+	s.config.Interceptor.Intercept(&bufferedConn{Conn: conn, reader: req.BufferConn}, mitm.Target{
+		Username: usernameFromAuthContext(req.AuthContext),
+		Params: map[string]string{
+			credential.ParamSession: payloadValue(req.AuthContext, credential.ParamSession),
+			credential.ParamRoute:   payloadValue(req.AuthContext, credential.ParamRoute),
+		},
+		Host:       destinationHost(req.realAddr),
+		Port:       req.realAddr.Port,
+		ClientAddr: conn.RemoteAddr().String(),
+		Session:    trafficSession,
+		Grant:      grantFromAuthContext(req.AuthContext),
+	})
+	return nil
+}
+
+// destinationHost is the name a destination is known by for inspection and
+// credential restrictions: the domain the client asked for, or its address.
+func destinationHost(addr *AddrSpec) string {
+	if addr.FQDN != "" {
+		return addr.FQDN
+	}
+	return addr.IP.String()
+}
+
+// bufferedConn reads through the buffer the request was parsed from, so
+// data the client sent ahead of the reply is not lost.
+type bufferedConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// dialTargets returns the addresses to race for req. Every resolved address
+// is tried unless a rewriter redirected the request elsewhere.
+func dialTargets(req *Request) []string {
+	target, dest := req.realAddr, req.DestAddr
+	if len(req.resolvedIPs) < 2 || target.Port != dest.Port || target.FQDN != dest.FQDN || !target.IP.Equal(dest.IP) {
+		return []string{target.Address()}
+	}
+
+	targets := make([]string, 0, len(req.resolvedIPs))
+	for _, ip := range req.resolvedIPs {
+		targets = append(targets, net.JoinHostPort(ip.String(), strconv.Itoa(dest.Port)))
+	}
+	return targets
+}
+
+// selectRoute picks the outbound route for req when a router is configured.
+func (s *Server) selectRoute(req *Request, trafficSession *traffic.Session, requestLogger zerolog.Logger) zerolog.Logger {
+	if s.config.Router == nil {
+		return requestLogger
+	}
+
+	routeRequest := &routing.Request{
+		Host:     req.realAddr.FQDN,
+		IP:       req.realAddr.IP,
+		Port:     req.realAddr.Port,
+		Username: usernameFromAuthContext(req.AuthContext),
+		Session:  payloadValue(req.AuthContext, credential.ParamSession),
+		Route:    payloadValue(req.AuthContext, credential.ParamRoute),
+	}
+	if req.RemoteAddr != nil {
+		routeRequest.ClientIP = req.RemoteAddr.IP
+	}
+
+	route, outbound := s.config.Router.Select(routeRequest)
+
+	req.route = route
+	req.outbound = outbound
+	req.routeRequest = routeRequest
+	trafficSession.SetRoute(route)
+
+	return requestLogger.With().Str("route", route).Logger()
+}
+
+// clientCertUsername completes the TLS handshake of conn, if it is a TLS
+// connection, and returns the user named by the client certificate. A
+// certificate that is rejected, because it names no user, is revoked or
+// belongs to a disabled user, is ignored and the client has to authenticate
+// as usual.
+func (s *Server) clientCertUsername(conn net.Conn, connLogger zerolog.Logger) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if s.config.ClientCertUsername == nil || len(peerCertificates) == 0 {
+		return "", nil
+	}
+	username, err := s.config.ClientCertUsername(peerCertificates[0])
+	if err != nil {
+		connLogger.Warn().
+			Str("client_cert_subject", peerCertificates[0].Subject.String()).
+			Err(err).
+			Msg("client certificate rejected")
+		return "", nil
+	}
+	return username, nil
+}
+
 func (s *Server) startTrafficSession(authContext *Context, conn net.Conn) *traffic.Session {
 	if s.config.Tracker == nil {
 		return nil
@@ -354,6 +662,20 @@ func usernameFromAuthContext(authContext *Context) string {
 	return "anonymous"
 }
 
+func grantFromAuthContext(authContext *Context) *credential.Grant {
+	if authContext == nil {
+		return nil
+	}
+	return authContext.Grant
+}
+
+func payloadValue(authContext *Context, key string) string {
+	if authContext == nil || authContext.Payload == nil {
+		return ""
+	}
+	return authContext.Payload[key]
+}
+
 func shouldLogRequestError(err error) bool {
 	if err == nil {
 		return false
@@ -2,18 +2,35 @@ package socks5
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/rs/zerolog"
+	"github.com/ryanbekhen/nanoproxy/pkg/certauth"
 	"github.com/ryanbekhen/nanoproxy/pkg/credential"
+	"github.com/ryanbekhen/nanoproxy/pkg/filter"
+	"github.com/ryanbekhen/nanoproxy/pkg/mitm"
 	"github.com/ryanbekhen/nanoproxy/pkg/resolver"
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+	"github.com/ryanbekhen/nanoproxy/pkg/tlscert"
 	"github.com/ryanbekhen/nanoproxy/pkg/traffic"
 	"github.com/stretchr/testify/assert"
 )
@@ -24,6 +41,14 @@ func (f resolverFunc) Resolve(host string) (net.IP, error) {
 	return f(host)
 }
 
+func (f resolverFunc) ResolveAll(host string) ([]net.IP, error) {
+	ip, err := f(host)
+	if err != nil {
+		return nil, err
+	}
+	return []net.IP{ip}, nil
+}
+
 func parseJSONLogLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
 	t.Helper()
 
@@ -534,6 +559,89 @@ func TestHandleConnection_LogsSuccessfulRequestDetailsAtDebug(t *testing.T) {
 	assert.Equal(t, "dialing destination", entries[3]["message"])
 }
 
+type staticResolver []net.IP
+
+func (r staticResolver) Resolve(string) (net.IP, error) {
+	return r[0], nil
+}
+
+func (r staticResolver) ResolveAll(string) ([]net.IP, error) {
+	return r, nil
+}
+
+func TestHandleConnection_HappyEyeballsLogsWinningAddress(t *testing.T) {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer backend.Close()
+
+	go func() {
+		conn, acceptErr := backend.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	backendAddr := backend.Addr().(*net.TCPAddr)
+	var dialed []string
+	var logBuf bytes.Buffer
+	logger := zerolog.New(&logBuf)
+	server := New(&Config{
+		Authentication: []Authenticator{&NoAuthAuthenticator{}},
+		Logger:         &logger,
+		Resolver:       staticResolver{net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")},
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = append(dialed, addr)
+			if strings.HasPrefix(addr, "[2001:db8::1]") {
+				return nil, errors.New("network is unreachable")
+			}
+			return net.Dial(network, addr)
+		},
+	})
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.handleConnection(serverConn)
+	}()
+
+	request := bytes.NewBuffer(nil)
+	request.Write([]byte{Version})
+	request.Write([]byte{1, NoAuth.Uint8()})
+	request.Write([]byte{Version, CommandConnect.Uint8(), 0, AddressTypeDomain.Uint8(), 16})
+	request.WriteString("dual-target.test")
+	port := []byte{0, 0}
+	binary.BigEndian.PutUint16(port, uint16(backendAddr.Port))
+	request.Write(port)
+
+	_, err = clientConn.Write(request.Bytes())
+	assert.NoError(t, err)
+
+	response := make([]byte, 12)
+	_, err = io.ReadFull(clientConn, response)
+	assert.NoError(t, err)
+	assert.Equal(t, StatusRequestGranted.Uint8(), response[3])
+	_ = clientConn.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for connection handler")
+	}
+
+	assert.Len(t, dialed, 2)
+	entries := parseJSONLogLines(t, &logBuf)
+	if assert.NotEmpty(t, entries) {
+		entry := entries[len(entries)-1]
+		assert.Equal(t, "request completed", entry["message"])
+		assert.Equal(t, backendAddr.String(), entry["connected_addr"])
+	}
+}
+
 func TestListenAndServe_InvalidAuthType(t *testing.T) {
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	assert.NoError(t, err)
@@ -881,12 +989,100 @@ func TestHandleRequest_ResolverError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestHandleRequest_ResolverBlocked(t *testing.T) {
+	s := &Server{
+		config: &Config{
+			Resolver: resolverFunc(func(host string) (net.IP, error) {
+				return nil, &net.DNSError{Err: resolver.ErrBlocked.Error(), UnwrapErr: resolver.ErrBlocked, Name: host, IsNotFound: true}
+			}),
+		},
+	}
+
+	conn := &MockConn{}
+	req := &Request{
+		Command:  CommandConnect,
+		DestAddr: &AddrSpec{FQDN: "ads.example", Port: 443},
+	}
+
+	err := s.testHandleRequest(req, conn)
+	assert.ErrorIs(t, err, resolver.ErrBlocked)
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+}
+
+func TestHandleRequest_GrantDestinationNotAllowed(t *testing.T) {
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("alice", "pass")
+	_, secret, err := credentials.IssueEphemeral(credential.Ephemeral{
+		User:         "alice",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Destinations: []string{"example.com"},
+	})
+	assert.NoError(t, err)
+	grant, ok := credentials.Grant("alice", secret)
+	assert.True(t, ok)
+
+	s := &Server{
+		config: &Config{
+			Resolver: resolverFunc(func(host string) (net.IP, error) {
+				t.Fatalf("destination %s should not be resolved", host)
+				return nil, nil
+			}),
+		},
+	}
+
+	conn := &MockConn{}
+	req := &Request{
+		Command:     CommandConnect,
+		DestAddr:    &AddrSpec{FQDN: "other.example", Port: 443},
+		AuthContext: &Context{Method: UserPassAuth, Grant: grant},
+	}
+
+	err = s.testHandleRequest(req, conn)
+	assert.ErrorContains(t, err, "not allowed")
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+}
+
+func TestHandleRequest_ContentFilter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "filter.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`{
+  "categories": {"ads": {"domains": ["ads.example"]}},
+  "policies": [{"users": ["alice"], "block": ["ads"]}]
+}`), 0o600))
+	contentFilter, err := filter.New(filter.Config{File: path})
+	assert.NoError(t, err)
+
+	s := &Server{
+		config: &Config{
+			Filter: contentFilter,
+			Resolver: resolverFunc(func(host string) (net.IP, error) {
+				t.Fatalf("destination %s should not be resolved", host)
+				return nil, nil
+			}),
+		},
+	}
+
+	conn := &MockConn{}
+	req := &Request{
+		Command:     CommandConnect,
+		DestAddr:    &AddrSpec{FQDN: "www.ads.example", Port: 443},
+		AuthContext: &Context{Method: UserPassAuth, Payload: map[string]string{"Username": "alice"}},
+	}
+
+	err = s.testHandleRequest(req, conn)
+	assert.ErrorIs(t, err, filter.ErrBlocked)
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+}
+
 type mockFailResolver struct{}
 
 func (m *mockFailResolver) Resolve(_ string) (net.IP, error) {
 	return nil, errors.New("resolve failed")
 }
 
+func (m *mockFailResolver) ResolveAll(_ string) ([]net.IP, error) {
+	return nil, errors.New("resolve failed")
+}
+
 func TestHandleRequest_WithRewriter(t *testing.T) {
 	s := &Server{
 		config: &Config{
@@ -919,3 +1115,385 @@ type mockRewriter struct{}
 func (m *mockRewriter) Rewrite(req *Request) *AddrSpec {
 	return req.DestAddr
 }
+
+func TestHandleRequest_RouterBlackhole(t *testing.T) {
+	router, err := routing.NewRouter([]routing.Rule{
+		{Route: routing.RouteBlackhole, Domains: []string{"blocked.example"}},
+	}, map[string]routing.Outbound{
+		routing.RouteDirect: routing.DialFunc(func(network, addr string) (net.Conn, error) {
+			t.Fatalf("direct outbound should not be dialed")
+			return nil, nil
+		}),
+	}, routing.RouteDirect)
+	assert.NoError(t, err)
+
+	s := &Server{
+		config: &Config{
+			Resolver: resolverFunc(func(host string) (net.IP, error) {
+				return net.ParseIP("127.0.0.1"), nil
+			}),
+			Router: router,
+		},
+	}
+
+	conn := &MockConn{}
+	req := &Request{
+		Command:  CommandConnect,
+		DestAddr: &AddrSpec{FQDN: "ads.blocked.example", Port: 443},
+	}
+
+	err = s.testHandleRequest(req, conn)
+	assert.ErrorIs(t, err, routing.ErrBlackholed)
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+}
+
+func TestHandleRequest_RouterSelectsNamedOutbound(t *testing.T) {
+	var logBuf bytes.Buffer
+	logger := zerolog.New(&logBuf)
+
+	var dialedAddr string
+	var routedUser string
+	router, err := routing.NewRouter([]routing.Rule{
+		{Route: "corp", Users: []string{"alice"}},
+	}, map[string]routing.Outbound{
+		routing.RouteDirect: routing.Blackhole,
+		"corp": outboundFunc(func(req *routing.Request, network, addr string) (net.Conn, error) {
+			dialedAddr = addr
+			routedUser = req.Username
+			return nil, errors.New("corp gateway down")
+		}),
+	}, routing.RouteDirect)
+	assert.NoError(t, err)
+
+	s := &Server{config: &Config{Router: router, Logger: &logger}}
+	tracker := traffic.NewTracker()
+	session := tracker.Start("alice", "127.0.0.1")
+
+	req := &Request{
+		Command:     CommandConnect,
+		DestAddr:    &AddrSpec{IP: net.ParseIP("10.0.0.5"), Port: 8080},
+		AuthContext: &Context{Method: UserPassAuth, Payload: map[string]string{"Username": "alice"}},
+	}
+
+	err, reqLogger := s.handleRequest(req, &MockConn{}, session, logger)
+	assert.Error(t, err)
+	reqLogger.Info().Msg("done")
+	session.Close()
+
+	assert.Equal(t, "10.0.0.5:8080", dialedAddr)
+	assert.Equal(t, "alice", routedUser)
+	assert.Equal(t, "corp", parseLastJSONLogLine(t, &logBuf)["route"])
+	assert.Equal(t, uint64(1), tracker.TotalsByRoute()["corp"].Connections)
+}
+
+func TestHandleRequest_RouterUsesUsernameParams(t *testing.T) {
+	logger := zerolog.New(io.Discard)
+
+	var routed *routing.Request
+	router, err := routing.NewRouter(nil, map[string]routing.Outbound{
+		routing.RouteDirect: routing.Blackhole,
+		"pool": outboundFunc(func(req *routing.Request, network, addr string) (net.Conn, error) {
+			routed = req
+			return nil, errors.New("pool down")
+		}),
+	}, routing.RouteDirect)
+	assert.NoError(t, err)
+	assert.NoError(t, router.AllowClientRoutes([]string{"pool"}, nil))
+
+	s := &Server{config: &Config{Router: router, Logger: &logger}}
+	req := &Request{
+		Command:  CommandConnect,
+		DestAddr: &AddrSpec{IP: net.ParseIP("192.0.2.1"), Port: 443},
+		AuthContext: &Context{Method: UserPassAuth, Payload: map[string]string{
+			"Username": "alice",
+			"session":  "abc123",
+			"route":    "pool",
+		}},
+	}
+
+	err, _ = s.handleRequest(req, &MockConn{}, nil, logger)
+	assert.Error(t, err)
+	if assert.NotNil(t, routed) {
+		assert.Equal(t, "alice/abc123", routed.AffinityKey())
+	}
+
+	conn := &MockConn{}
+	req.AuthContext.Payload["route"] = routing.RouteDirect
+	err, _ = s.handleRequest(req, conn, nil, logger)
+	assert.ErrorIs(t, err, routing.ErrRouteNotAllowed)
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+}
+
+func TestHandleRequest_RemoteRouteKeepsHostName(t *testing.T) {
+	var resolved, dialed []string
+	res := resolverFunc(func(host string) (net.IP, error) {
+		resolved = append(resolved, host)
+		return net.ParseIP("192.0.2.10"), nil
+	})
+	remote := routing.DialFunc(func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("tor down")
+	})
+	router, err := routing.NewRouter([]routing.Rule{
+		{Route: routing.RouteDirect, Domains: []string{"direct.example"}},
+	}, map[string]routing.Outbound{
+		routing.RouteDirect: remote,
+		routing.RouteTor:    remote,
+	}, routing.RouteTor)
+	assert.NoError(t, err)
+
+	s := &Server{config: &Config{Resolver: res, Router: router}}
+	err = s.testHandleRequest(&Request{Command: CommandConnect, DestAddr: &AddrSpec{FQDN: "www.example.com", Port: 443}}, &MockConn{})
+	assert.Error(t, err)
+	assert.Empty(t, resolved)
+	assert.Equal(t, []string{"www.example.com:443"}, dialed)
+
+	// Direct connections are still resolved locally.
+	dialed = nil
+	err = s.testHandleRequest(&Request{Command: CommandConnect, DestAddr: &AddrSpec{FQDN: "www.direct.example", Port: 443}}, &MockConn{})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"www.direct.example"}, resolved)
+	assert.Equal(t, []string{"192.0.2.10:443"}, dialed)
+
+	// Without a router, DialRemote hands the name to Dial.
+	resolved, dialed = nil, nil
+	s = &Server{config: &Config{Resolver: res, Dial: remote, DialRemote: true}}
+	err = s.testHandleRequest(&Request{Command: CommandConnect, DestAddr: &AddrSpec{FQDN: "www.example.com", Port: 443}}, &MockConn{})
+	assert.Error(t, err)
+	assert.Empty(t, resolved)
+	assert.Equal(t, []string{"www.example.com:443"}, dialed)
+}
+
+func TestHandleRequest_RemoteRouteDNSPolicy(t *testing.T) {
+	blockList := filepath.Join(t.TempDir(), "blocked.txt")
+	assert.NoError(t, os.WriteFile(blockList, []byte("ads.example\n"), 0o600))
+	var resolved []string
+	policy, err := resolver.NewPolicyResolver(resolverFunc(func(host string) (net.IP, error) {
+		resolved = append(resolved, host)
+		return net.ParseIP("192.0.2.10"), nil
+	}), resolver.PolicyConfig{BlockLists: []string{blockList}})
+	assert.NoError(t, err)
+
+	s := &Server{config: &Config{
+		Resolver:   resolver.NewFamilyResolver(policy, resolver.FamilyPreferV4),
+		DialRemote: true,
+		Dial: func(network, addr string) (net.Conn, error) {
+			t.Fatalf("unexpected dial to %s", addr)
+			return nil, nil
+		},
+	}}
+	conn := &MockConn{}
+	err = s.testHandleRequest(&Request{Command: CommandConnect, DestAddr: &AddrSpec{FQDN: "www.ads.example", Port: 443}}, conn)
+	assert.ErrorIs(t, err, resolver.ErrBlocked)
+	assert.Equal(t, StatusConnectionNotAllowed.Uint8(), conn.buf.Bytes()[1])
+	assert.Empty(t, resolved)
+}
+
+type outboundFunc func(req *routing.Request, network, addr string) (net.Conn, error)
+
+func (f outboundFunc) DialRoute(req *routing.Request, network, addr string) (net.Conn, error) {
+	return f(req, network, addr)
+}
+
+// newTestClientCA returns a CA certificate in PEM and a function issuing
+// client certificates signed by it.
+func newTestClientCA(t *testing.T) ([]byte, func(commonName string) tls.Certificate) {
+	t.Helper()
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	caCert, err := x509.ParseCertificate(caDER)
+	assert.NoError(t, err)
+
+	issue := func(commonName string) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), issue
+}
+
+func TestHandleConnection_ClientCertificateAuth(t *testing.T) {
+	caPEM, issue := newTestClientCA(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, os.WriteFile(caFile, caPEM, 0o600))
+
+	certificates, err := tlscert.New(tlscert.Config{})
+	assert.NoError(t, err)
+	authenticator, err := certauth.New(certauth.Config{Policy: certauth.Policy{
+		CAFile: caFile,
+		Users:  map[string]bool{"mallory": false},
+	}})
+	assert.NoError(t, err)
+
+	credentials := credential.NewStaticCredentialStore()
+	credentials.Add("bob", "secret")
+
+	var logBuf syncBuffer
+	logger := zerolog.New(&logBuf)
+	server := New(&Config{
+		Credentials:        credentials,
+		Logger:             &logger,
+		ClientCertUsername: authenticator.Identify,
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go func() {
+		_ = server.serve(tls.NewListener(l, certificates.TLSConfigWithClientAuth(authenticator.ClientCAs, false)))
+	}()
+	defer server.Shutdown()
+
+	negotiate := func(clientCerts []tls.Certificate) []byte {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       clientCerts,
+		})
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+
+		_ = conn.SetDeadline(time.Now().Add(time.Second))
+		_, err = conn.Write([]byte{Version, 1, NoAuth.Uint8()})
+		assert.NoError(t, err)
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		assert.NoError(t, err)
+		return reply
+	}
+
+	t.Run("Certificate replaces password authentication", func(t *testing.T) {
+		assert.Equal(t, []byte{Version, NoAuth.Uint8()}, negotiate([]tls.Certificate{issue("alice")}))
+
+		assert.Eventually(t, func() bool {
+			for _, entry := range parseJSONLogLines(t, logBuf.Buffer()) {
+				if entry["message"] == "client certificate authentication succeeded" && entry["username"] == "alice" {
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Without a certificate a password is still required", func(t *testing.T) {
+		assert.Equal(t, []byte{Version, NoAcceptable.Uint8()}, negotiate(nil))
+	})
+
+	t.Run("Certificate of a disabled user is not accepted", func(t *testing.T) {
+		assert.Equal(t, []byte{Version, NoAcceptable.Uint8()}, negotiate([]tls.Certificate{issue("mallory")}))
+	})
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Buffer() *bytes.Buffer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return bytes.NewBuffer(append([]byte(nil), b.buf.Bytes()...))
+}
+
+type recordingInterceptor struct {
+	inspect bool
+	targets chan mitm.Target
+}
+
+func (i *recordingInterceptor) Inspects(username, host string, port int) bool {
+	return i.inspect && host == "api.example.com" && port == 443
+}
+
+func (i *recordingInterceptor) Intercept(conn net.Conn, target mitm.Target) {
+	defer conn.Close()
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err == nil && string(buf) == "ping" {
+		_, _ = conn.Write([]byte("pong"))
+	}
+	i.targets <- target
+}
+
+func TestHandleConnection_HandsInspectedTunnelToInterceptor(t *testing.T) {
+	interceptor := &recordingInterceptor{inspect: true, targets: make(chan mitm.Target, 1)}
+	var dialed bool
+	logger := zerolog.New(io.Discard)
+	server := New(&Config{
+		Authentication: []Authenticator{&NoAuthAuthenticator{}},
+		Logger:         &logger,
+		Tracker:        traffic.NewTracker(),
+		Resolver:       staticResolver{net.ParseIP("192.0.2.10")},
+		Interceptor:    interceptor,
+		Dial: func(network, addr string) (net.Conn, error) {
+			dialed = true
+			return nil, errors.New("unexpected dial")
+		},
+	})
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.handleConnection(serverConn)
+	}()
+
+	host := "api.example.com"
+	request := bytes.NewBuffer(nil)
+	request.Write([]byte{Version, 1, NoAuth.Uint8()})
+	request.Write([]byte{Version, CommandConnect.Uint8(), 0, AddressTypeDomain.Uint8(), byte(len(host))})
+	request.WriteString(host)
+	request.Write([]byte{0x01, 0xbb})
+	// The client sends data before it has read the reply.
+	request.WriteString("ping")
+
+	_, err := clientConn.Write(request.Bytes())
+	assert.NoError(t, err)
+
+	response := make([]byte, 2+10+4)
+	_, err = io.ReadFull(clientConn, response)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{Version, NoAuth.Uint8()}, response[:2])
+	assert.Equal(t, StatusRequestGranted.Uint8(), response[3])
+	assert.Equal(t, "pong", string(response[12:]))
+
+	select {
+	case target := <-interceptor.targets:
+		assert.Equal(t, "api.example.com", target.Host)
+		assert.Equal(t, 443, target.Port)
+		assert.Equal(t, "anonymous", target.Username)
+		assert.NotNil(t, target.Session)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for interceptor")
+	}
+	<-done
+	assert.False(t, dialed)
+}
@@ -0,0 +1,32 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+)
+
+// TLSConfigWithClientAuth is like TLSConfig but also verifies client
+// certificates against the pool clientCAs returns. The pool is fetched for
+// every handshake, so reloads apply without a restart. With require set,
+// clients without a certificate are rejected; otherwise a certificate is
+// only verified when one is presented. Later changes to the returned
+// configuration, such as NextProtos, apply to every handshake.
+func (m *Manager) TLSConfigWithClientAuth(clientCAs func() *x509.CertPool, require bool) *tls.Config {
+	conf := m.TLSConfig()
+	if clientCAs == nil {
+		return conf
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if require {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+	conf.ClientAuth = clientAuth
+	conf.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		handshake := conf.Clone()
+		handshake.GetConfigForClient = nil
+		handshake.ClientCAs = clientCAs()
+		return handshake, nil
+	}
+	return conf
+}
@@ -0,0 +1,28 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager_TLSConfigWithClientAuth(t *testing.T) {
+	m, err := New(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, m.TLSConfigWithClientAuth(nil, false).GetConfigForClient)
+
+	pool := x509.NewCertPool()
+	for _, requireCert := range []bool{false, true} {
+		conf, err := m.TLSConfigWithClientAuth(func() *x509.CertPool { return pool }, requireCert).GetConfigForClient(&tls.ClientHelloInfo{})
+		require.NoError(t, err)
+		assert.Same(t, pool, conf.ClientCAs)
+		if requireCert {
+			assert.Equal(t, tls.RequireAndVerifyClientCert, conf.ClientAuth)
+		} else {
+			assert.Equal(t, tls.VerifyClientCertIfGiven, conf.ClientAuth)
+		}
+	}
+}
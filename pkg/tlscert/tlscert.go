@@ -0,0 +1,204 @@
+// Package tlscert provides the certificates of the TLS listeners. It serves
+// a certificate and key loaded from files, reloading them when they change,
+// or a self-signed certificate generated at startup.
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/filewatch"
+)
+
+const (
+	DefaultReloadInterval = 30 * time.Second
+	selfSignedValidity    = 365 * 24 * time.Hour
+)
+
+var ErrKeyPairIncomplete = errors.New("both a certificate and a key file are required")
+
+type Config struct {
+	CertFile string
+	KeyFile  string
+	// Hosts are the DNS names and IP addresses put in the self-signed
+	// certificate generated when no files are configured. Empty selects
+	// "localhost" and the loopback addresses.
+	Hosts []string
+	// ReloadInterval is how often the files are checked for changes once
+	// Start has been called.
+	ReloadInterval time.Duration
+	// OnReload, when set, is called after the files changed and were read
+	// again, with the error if they could not be loaded.
+	OnReload func(err error)
+}
+
+// Manager holds the current certificate. A reload that fails keeps the
+// previous certificate in place.
+type Manager struct {
+	config      Config
+	selfSigned  bool
+	certificate atomic.Pointer[tls.Certificate]
+
+	files *filewatch.Watcher
+}
+
+func New(conf Config) (*Manager, error) {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, ErrKeyPairIncomplete
+	}
+	if conf.ReloadInterval <= 0 {
+		conf.ReloadInterval = DefaultReloadInterval
+	}
+
+	m := &Manager{
+		config: conf,
+		files:  filewatch.New(conf.ReloadInterval, conf.OnReload),
+	}
+	if conf.CertFile == "" {
+		hosts := conf.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{"localhost", "127.0.0.1", "::1"}
+		}
+		cert, err := GenerateSelfSigned(hosts, selfSignedValidity)
+		if err != nil {
+			return nil, err
+		}
+		m.selfSigned = true
+		m.certificate.Store(&cert)
+		return m, nil
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SelfSigned reports whether the certificate was generated rather than
+// loaded from files.
+func (m *Manager) SelfSigned() bool {
+	return m.selfSigned
+}
+
+// Certificate returns the certificate currently served.
+func (m *Manager) Certificate() *tls.Certificate {
+	return m.certificate.Load()
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the current leaf
+// certificate in hex, for clients that pin a self-signed certificate.
+func (m *Manager) Fingerprint() string {
+	cert := m.Certificate()
+	if cert == nil || len(cert.Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.Certificate(), nil
+}
+
+// TLSConfig returns a server configuration that always presents the current
+// certificate, so reloads apply to new handshakes without a restart.
+func (m *Manager) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: m.GetCertificate,
+	}
+}
+
+// Start checks the files for changes every ReloadInterval until Close is
+// called. It does nothing for a self-signed certificate.
+func (m *Manager) Start() {
+	if m.selfSigned {
+		return
+	}
+	m.files.Start(m.Reload)
+}
+
+func (m *Manager) Close() {
+	m.files.Close()
+}
+
+// Reload reads the files again if either of them changed since the last
+// load. It reports whether a reload was attempted.
+func (m *Manager) Reload() (bool, error) {
+	if m.selfSigned {
+		return false, nil
+	}
+	return m.files.Reload(m.read)
+}
+
+func (m *Manager) load() error {
+	return m.files.Load(m.read)
+}
+
+func (m *Manager) read(watch func(path string)) error {
+	watch(m.config.CertFile)
+	watch(m.config.KeyFile)
+	cert, err := tls.LoadX509KeyPair(m.config.CertFile, m.config.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load %s: %w", m.config.CertFile, err)
+	}
+	m.certificate.Store(&cert)
+	return nil
+}
+
+// GenerateSelfSigned creates an ECDSA P-256 certificate for hosts, which
+// may be DNS names or IP addresses. The first host becomes the common name.
+func GenerateSelfSigned(hosts []string, validFor time.Duration) (tls.Certificate, error) {
+	if len(hosts) == 0 {
+		return tls.Certificate{}, errors.New("self-signed certificate needs at least one host")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0], Organization: []string{"nanoproxy"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,115 @@
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyPair(t *testing.T, dir, host string) (string, string) {
+	t.Helper()
+
+	cert, err := GenerateSelfSigned([]string{host}, time.Hour)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+	return certFile, keyFile
+}
+
+func leafOf(t *testing.T, m *Manager) *x509.Certificate {
+	t.Helper()
+
+	cert, err := m.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return leaf
+}
+
+func TestNew_SelfSigned(t *testing.T) {
+	m, err := New(Config{Hosts: []string{"proxy.example", "192.0.2.1"}})
+	require.NoError(t, err)
+
+	assert.True(t, m.SelfSigned())
+	leaf := leafOf(t, m)
+	assert.Equal(t, "proxy.example", leaf.Subject.CommonName)
+	assert.Equal(t, []string{"proxy.example"}, leaf.DNSNames)
+	assert.Equal(t, "192.0.2.1", leaf.IPAddresses[0].String())
+	assert.NoError(t, leaf.VerifyHostname("192.0.2.1"))
+	assert.Len(t, m.Fingerprint(), 64)
+
+	reloaded, err := m.Reload()
+	assert.False(t, reloaded)
+	assert.NoError(t, err)
+}
+
+func TestNew_SelfSignedDefaultsToLocalhost(t *testing.T) {
+	m, err := New(Config{})
+	require.NoError(t, err)
+
+	leaf := leafOf(t, m)
+	assert.NoError(t, leaf.VerifyHostname("localhost"))
+	assert.NoError(t, leaf.VerifyHostname("127.0.0.1"))
+}
+
+func TestNew_RequiresBothFiles(t *testing.T) {
+	_, err := New(Config{CertFile: "cert.pem"})
+	assert.ErrorIs(t, err, ErrKeyPairIncomplete)
+
+	_, err = New(Config{CertFile: "missing.pem", KeyFile: "missing-key.pem"})
+	assert.Error(t, err)
+}
+
+func TestManager_Reload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "first.example")
+
+	var reloads []error
+	m, err := New(Config{CertFile: certFile, KeyFile: keyFile, OnReload: func(err error) { reloads = append(reloads, err) }})
+	require.NoError(t, err)
+	assert.False(t, m.SelfSigned())
+	assert.Equal(t, "first.example", leafOf(t, m).Subject.CommonName)
+
+	reloaded, err := m.Reload()
+	assert.False(t, reloaded)
+	assert.NoError(t, err)
+
+	writeKeyPair(t, dir, "second.example")
+	reloaded, err = m.Reload()
+	assert.True(t, reloaded)
+	assert.NoError(t, err)
+	assert.Equal(t, "second.example", leafOf(t, m).Subject.CommonName)
+
+	require.NoError(t, os.WriteFile(keyFile, []byte("not a key"), 0o600))
+	reloaded, err = m.Reload()
+	assert.True(t, reloaded)
+	assert.Error(t, err)
+	assert.Equal(t, "second.example", leafOf(t, m).Subject.CommonName)
+	assert.Len(t, reloads, 2)
+	assert.NoError(t, reloads[0])
+	assert.Error(t, reloads[1])
+}
+
+func TestManager_TLSConfigServesCurrentCertificate(t *testing.T) {
+	m, err := New(Config{Hosts: []string{"localhost"}})
+	require.NoError(t, err)
+
+	conf := m.TLSConfig()
+	assert.Equal(t, uint16(tls.VersionTLS12), conf.MinVersion)
+	cert, err := conf.GetCertificate(&tls.ClientHelloInfo{})
+	require.NoError(t, err)
+	assert.Same(t, m.Certificate(), cert)
+}
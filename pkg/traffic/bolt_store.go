@@ -15,6 +15,7 @@ var trafficBucket = []byte("traffic")
 type storedTraffic struct {
 	UploadBytes   uint64    `json:"upload_bytes"`
 	DownloadBytes uint64    `json:"download_bytes"`
+	CachedBytes   uint64    `json:"cached_bytes,omitempty"`
 	LastClientIP  string    `json:"last_client_ip"`
 	LastSeenAt    time.Time `json:"last_seen_at"`
 }
@@ -57,6 +58,7 @@ func (b *BoltStore) LoadTraffic() (map[string]UserTotals, error) {
 			out[string(k)] = UserTotals{
 				UploadBytes:   rec.UploadBytes,
 				DownloadBytes: rec.DownloadBytes,
+				CachedBytes:   rec.CachedBytes,
 				LastClientIP:  rec.LastClientIP,
 				LastSeenAt:    rec.LastSeenAt,
 			}
@@ -91,6 +93,7 @@ func (b *BoltStore) SaveTraffic(totals map[string]UserTotals) error {
 			rec := storedTraffic{
 				UploadBytes:   t.UploadBytes,
 				DownloadBytes: t.DownloadBytes,
+				CachedBytes:   t.CachedBytes,
 				LastClientIP:  t.LastClientIP,
 				LastSeenAt:    t.LastSeenAt,
 			}
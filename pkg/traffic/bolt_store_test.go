@@ -19,6 +19,7 @@ func TestBoltStore_SaveAndLoadTraffic(t *testing.T) {
 		"alice": {
 			UploadBytes:   1024,
 			DownloadBytes: 2048,
+			CachedBytes:   256,
 			LastClientIP:  "10.0.0.2",
 			LastSeenAt:    time.Now(),
 		},
@@ -37,6 +38,7 @@ func TestBoltStore_SaveAndLoadTraffic(t *testing.T) {
 	assert.Len(t, loaded, 2)
 	assert.Equal(t, uint64(1024), loaded["alice"].UploadBytes)
 	assert.Equal(t, uint64(2048), loaded["alice"].DownloadBytes)
+	assert.Equal(t, uint64(256), loaded["alice"].CachedBytes)
 	assert.Equal(t, "10.0.0.2", loaded["alice"].LastClientIP)
 }
 
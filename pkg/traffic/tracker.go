@@ -17,33 +17,63 @@ type Snapshot struct {
 	UploadBPS     uint64
 	DownloadBPS   uint64
 	StartedAt     time.Time
+	Route         string
+	Tag           string
+	EgressIP      string
+	Credential    string
 }
 
 type Tracker struct {
-	mu       sync.Mutex
-	sessions map[string]*sessionState
-	totals   map[string]UserTotals
-	lastRate map[string]UserTotals
-	lastPoll time.Time
-	nextID   atomic.Uint64
+	mu          sync.Mutex
+	sessions    map[string]*sessionState
+	totals      map[string]UserTotals
+	routes      map[string]RouteTotals
+	credentials map[string]CredentialTotals
+	lastRate    map[string]UserTotals
+	lastPoll    time.Time
+	nextID      atomic.Uint64
 }
 
 type UserTotals struct {
 	UploadBytes   uint64
 	DownloadBytes uint64
-	UploadBPS     uint64
-	DownloadBPS   uint64
-	LastSeenAt    time.Time
-	LastClientIP  string
+	// CachedBytes is the part of DownloadBytes served from the HTTP cache
+	// instead of the destination.
+	CachedBytes  uint64
+	UploadBPS    uint64
+	DownloadBPS  uint64
+	LastSeenAt   time.Time
+	LastClientIP string
+}
+
+// RouteTotals aggregates traffic per outbound route.
+type RouteTotals struct {
+	Connections   uint64
+	UploadBytes   uint64
+	DownloadBytes uint64
+}
+
+// CredentialTotals aggregates traffic per ephemeral credential. The same
+// traffic also counts towards the totals of Username.
+type CredentialTotals struct {
+	Username      string
+	Connections   uint64
+	UploadBytes   uint64
+	DownloadBytes uint64
 }
 
 type sessionState struct {
-	username string
-	clientIP string
-	started  time.Time
+	username   string
+	clientIP   string
+	route      string
+	tag        string
+	egressIP   string
+	credential string
+	started    time.Time
 
 	uploadBytes   atomic.Uint64
 	downloadBytes atomic.Uint64
+	cachedBytes   atomic.Uint64
 
 	lastSampleAt       time.Time
 	lastUploadSample   uint64
@@ -85,9 +115,11 @@ func (s *Session) DownloadBytes() uint64 {
 
 func NewTracker() *Tracker {
 	return &Tracker{
-		sessions: make(map[string]*sessionState),
-		totals:   make(map[string]UserTotals),
-		lastRate: make(map[string]UserTotals),
+		sessions:    make(map[string]*sessionState),
+		totals:      make(map[string]UserTotals),
+		routes:      make(map[string]RouteTotals),
+		credentials: make(map[string]CredentialTotals),
+		lastRate:    make(map[string]UserTotals),
 	}
 }
 
@@ -151,6 +183,55 @@ func (t *Tracker) Start(username, clientIP string) *Session {
 	return &Session{tracker: t, id: id}
 }
 
+// SetRoute records the outbound route chosen for the session.
+func (s *Session) SetRoute(route string) {
+	if s == nil || s.tracker == nil {
+		return
+	}
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	if state := s.tracker.sessions[s.id]; state != nil {
+		state.route = route
+	}
+}
+
+// SetTag records the client-chosen session tag, e.g. from username parameters.
+func (s *Session) SetTag(tag string) {
+	if s == nil || s.tracker == nil {
+		return
+	}
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	if state := s.tracker.sessions[s.id]; state != nil {
+		state.tag = tag
+	}
+}
+
+// SetCredential records the ephemeral credential the session authenticated
+// with, so its traffic is attributed to the credential as well as the user.
+func (s *Session) SetCredential(id string) {
+	if s == nil || s.tracker == nil {
+		return
+	}
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	if state := s.tracker.sessions[s.id]; state != nil {
+		state.credential = id
+	}
+}
+
+// SetEgressIP records the local source address used for the session.
+func (s *Session) SetEgressIP(ip string) {
+	if s == nil || s.tracker == nil {
+		return
+	}
+	s.tracker.mu.Lock()
+	defer s.tracker.mu.Unlock()
+	if state := s.tracker.sessions[s.id]; state != nil {
+		state.egressIP = ip
+	}
+}
+
 func (s *Session) AddUpload(n int64) {
 	if s == nil || n <= 0 || s.tracker == nil {
 		return
@@ -179,6 +260,23 @@ func (s *Session) AddDownload(n int64) {
 	state.lastSeenUnix.Store(time.Now().UnixNano())
 }
 
+// AddCached counts a response body served from the HTTP cache. It is
+// downloaded traffic of the session, also reported as cached.
+func (s *Session) AddCached(n int64) {
+	if s == nil || n <= 0 || s.tracker == nil {
+		return
+	}
+	s.tracker.mu.Lock()
+	state := s.tracker.sessions[s.id]
+	s.tracker.mu.Unlock()
+	if state == nil {
+		return
+	}
+	state.downloadBytes.Add(uint64(n))
+	state.cachedBytes.Add(uint64(n))
+	state.lastSeenUnix.Store(time.Now().UnixNano())
+}
+
 func (s *Session) Close() {
 	if s == nil || s.tracker == nil {
 		return
@@ -190,6 +288,7 @@ func (s *Session) Close() {
 			totals := s.tracker.totals[state.username]
 			totals.UploadBytes += state.uploadBytes.Load()
 			totals.DownloadBytes += state.downloadBytes.Load()
+			totals.CachedBytes += state.cachedBytes.Load()
 			lastSeenUnix := state.lastSeenUnix.Load()
 			lastSeenAt := time.Unix(0, lastSeenUnix)
 			if lastSeenUnix <= 0 {
@@ -200,6 +299,23 @@ func (s *Session) Close() {
 				totals.LastClientIP = state.clientIP
 			}
 			s.tracker.totals[state.username] = totals
+
+			if state.route != "" {
+				routeTotals := s.tracker.routes[state.route]
+				routeTotals.Connections++
+				routeTotals.UploadBytes += state.uploadBytes.Load()
+				routeTotals.DownloadBytes += state.downloadBytes.Load()
+				s.tracker.routes[state.route] = routeTotals
+			}
+
+			if state.credential != "" {
+				credentialTotals := s.tracker.credentials[state.credential]
+				credentialTotals.Username = state.username
+				credentialTotals.Connections++
+				credentialTotals.UploadBytes += state.uploadBytes.Load()
+				credentialTotals.DownloadBytes += state.downloadBytes.Load()
+				s.tracker.credentials[state.credential] = credentialTotals
+			}
 		}
 		delete(s.tracker.sessions, s.id)
 		s.tracker.mu.Unlock()
@@ -224,6 +340,7 @@ func (t *Tracker) TotalsByUser() map[string]UserTotals {
 		totals := out[s.username]
 		totals.UploadBytes += s.uploadBytes.Load()
 		totals.DownloadBytes += s.downloadBytes.Load()
+		totals.CachedBytes += s.cachedBytes.Load()
 		lastSeenUnix := s.lastSeenUnix.Load()
 		lastSeenAt := time.Unix(0, lastSeenUnix)
 		if lastSeenUnix <= 0 {
@@ -265,6 +382,104 @@ func (t *Tracker) TotalsByUser() map[string]UserTotals {
 	return out
 }
 
+// UserForClientIP returns the user most recently seen connecting from
+// clientIP. Open sessions are preferred over closed ones; anonymous sessions
+// are ignored.
+func (t *Tracker) UserForClientIP(clientIP string) (string, bool) {
+	if t == nil || clientIP == "" {
+		return "", false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var username string
+	var latest time.Time
+	for _, s := range t.sessions {
+		if s.clientIP == clientIP && s.username != "anonymous" && s.started.After(latest) {
+			username, latest = s.username, s.started
+		}
+	}
+	if username != "" {
+		return username, true
+	}
+
+	for name, totals := range t.totals {
+		if totals.LastClientIP == clientIP && name != "anonymous" && totals.LastSeenAt.After(latest) {
+			username, latest = name, totals.LastSeenAt
+		}
+	}
+	return username, username != ""
+}
+
+// TotalsByRoute returns traffic per outbound route, including sessions that
+// are still open.
+func (t *Tracker) TotalsByRoute() map[string]RouteTotals {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]RouteTotals, len(t.routes))
+	for route, totals := range t.routes {
+		out[route] = totals
+	}
+	for _, s := range t.sessions {
+		if s.route == "" {
+			continue
+		}
+		totals := out[s.route]
+		totals.Connections++
+		totals.UploadBytes += s.uploadBytes.Load()
+		totals.DownloadBytes += s.downloadBytes.Load()
+		out[s.route] = totals
+	}
+
+	return out
+}
+
+// TotalsByCredential returns traffic per ephemeral credential, including
+// sessions that are still open.
+func (t *Tracker) TotalsByCredential() map[string]CredentialTotals {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	out := make(map[string]CredentialTotals, len(t.credentials))
+	for id, totals := range t.credentials {
+		out[id] = totals
+	}
+	for _, s := range t.sessions {
+		if s.credential == "" {
+			continue
+		}
+		totals := out[s.credential]
+		totals.Username = s.username
+		totals.Connections++
+		totals.UploadBytes += s.uploadBytes.Load()
+		totals.DownloadBytes += s.downloadBytes.Load()
+		out[s.credential] = totals
+	}
+
+	return out
+}
+
+// ForgetCredential drops the totals of an ephemeral credential that no
+// longer exists. Its traffic stays counted for its user.
+func (t *Tracker) ForgetCredential(id string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.credentials, id)
+}
+
 func (t *Tracker) Snapshot() []Snapshot {
 	if t == nil {
 		return nil
@@ -301,6 +516,10 @@ func (t *Tracker) Snapshot() []Snapshot {
 			UploadBPS:     uploadBPS,
 			DownloadBPS:   downloadBPS,
 			StartedAt:     s.started,
+			Route:         s.route,
+			Tag:           s.tag,
+			EgressIP:      s.egressIP,
+			Credential:    s.credential,
 		})
 	}
 	t.mu.Unlock()
@@ -70,6 +70,22 @@ func TestTracker_TotalsByUser_PersistsAfterSessionClose(t *testing.T) {
 	assert.Equal(t, "10.0.0.3", totals["alice"].LastClientIP)
 }
 
+func TestTracker_AddCached(t *testing.T) {
+	tracker := NewTracker()
+	s := tracker.Start("alice", "10.0.0.2")
+	s.AddDownload(300)
+	s.AddCached(200)
+
+	totals := tracker.TotalsByUser()
+	assert.Equal(t, uint64(500), totals["alice"].DownloadBytes)
+	assert.Equal(t, uint64(200), totals["alice"].CachedBytes)
+
+	s.Close()
+	totals = tracker.TotalsByUser()
+	assert.Equal(t, uint64(500), totals["alice"].DownloadBytes)
+	assert.Equal(t, uint64(200), totals["alice"].CachedBytes)
+}
+
 func TestTracker_TotalsByUser_ComputesRateAcrossPolls(t *testing.T) {
 	tracker := NewTracker()
 
@@ -89,3 +105,105 @@ func TestTracker_TotalsByUser_ComputesRateAcrossPolls(t *testing.T) {
 	assert.Greater(t, totals["alice"].UploadBPS, uint64(0))
 	assert.Greater(t, totals["alice"].DownloadBPS, uint64(0))
 }
+
+func TestTracker_TotalsByRoute(t *testing.T) {
+	tracker := NewTracker()
+
+	s1 := tracker.Start("alice", "10.0.0.2")
+	s1.SetRoute("tor")
+	s1.AddUpload(10)
+	s1.AddDownload(20)
+	s1.Close()
+
+	s2 := tracker.Start("bob", "10.0.0.3")
+	s2.SetRoute("tor")
+	s2.AddDownload(5)
+
+	s3 := tracker.Start("bob", "10.0.0.3")
+	s3.AddDownload(7)
+	s3.Close()
+
+	routes := tracker.TotalsByRoute()
+	assert.Equal(t, RouteTotals{Connections: 2, UploadBytes: 10, DownloadBytes: 25}, routes["tor"])
+	assert.Len(t, routes, 1)
+
+	snapshots := tracker.Snapshot()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "tor", snapshots[0].Route)
+}
+
+func TestTracker_TotalsByCredential(t *testing.T) {
+	tracker := NewTracker()
+
+	s1 := tracker.Start("ci", "10.0.0.2")
+	s1.SetCredential("eph_1")
+	s1.AddUpload(10)
+	s1.AddDownload(20)
+	s1.Close()
+
+	s2 := tracker.Start("ci", "10.0.0.2")
+	s2.SetCredential("eph_1")
+	s2.AddDownload(5)
+
+	s3 := tracker.Start("ci", "10.0.0.3")
+	s3.AddDownload(7)
+	s3.Close()
+
+	credentials := tracker.TotalsByCredential()
+	assert.Equal(t, CredentialTotals{Username: "ci", Connections: 2, UploadBytes: 10, DownloadBytes: 25}, credentials["eph_1"])
+	assert.Len(t, credentials, 1)
+
+	// The parent user is charged for the same traffic.
+	totals := tracker.TotalsByUser()["ci"]
+	assert.Equal(t, uint64(10), totals.UploadBytes)
+	assert.Equal(t, uint64(32), totals.DownloadBytes)
+	assert.Equal(t, "eph_1", tracker.Snapshot()[0].Credential)
+
+	s2.Close()
+	tracker.ForgetCredential("eph_1")
+	assert.Empty(t, tracker.TotalsByCredential())
+	assert.Equal(t, uint64(32), tracker.TotalsByUser()["ci"].DownloadBytes)
+}
+
+func TestTracker_SessionTagAndEgressIP(t *testing.T) {
+	tracker := NewTracker()
+
+	s := tracker.Start("alice", "10.0.0.2")
+	s.SetTag("abc123")
+	s.SetEgressIP("203.0.113.7")
+
+	snapshots := tracker.Snapshot()
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "abc123", snapshots[0].Tag)
+	assert.Equal(t, "203.0.113.7", snapshots[0].EgressIP)
+
+	var nilSession *Session
+	nilSession.SetTag("ignored")
+	nilSession.SetEgressIP("ignored")
+}
+
+func TestTracker_UserForClientIP(t *testing.T) {
+	tracker := NewTracker()
+
+	closed := tracker.Start("bob", "10.0.0.3")
+	closed.Close()
+	anonymous := tracker.Start("anonymous", "10.0.0.2")
+	defer anonymous.Close()
+	open := tracker.Start("alice", "10.0.0.2")
+	defer open.Close()
+
+	username, ok := tracker.UserForClientIP("10.0.0.2")
+	assert.True(t, ok)
+	assert.Equal(t, "alice", username)
+
+	username, ok = tracker.UserForClientIP("10.0.0.3")
+	assert.True(t, ok)
+	assert.Equal(t, "bob", username)
+
+	_, ok = tracker.UserForClientIP("10.0.0.9")
+	assert.False(t, ok)
+
+	var nilTracker *Tracker
+	_, ok = nilTracker.UserForClientIP("10.0.0.2")
+	assert.False(t, ok)
+}
@@ -0,0 +1,109 @@
+package upstream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var ErrConnectRejected = errors.New("http connect rejected")
+
+// HTTPConnectDialer tunnels connections through an HTTP or HTTPS parent proxy
+// using the CONNECT method.
+type HTTPConnectDialer struct {
+	ProxyAddr string
+	TLS       bool
+	TLSConfig *tls.Config
+	Username  string
+	Password  string
+	// Timeout bounds the TLS handshake and CONNECT exchange with the parent.
+	// Zero uses DefaultTimeout.
+	Timeout time.Duration
+	Forward Dialer
+}
+
+func (d *HTTPConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("http connect: unsupported network %q", network)
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &Direct{}
+	}
+	conn, err := forward.Dial("tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("http connect: dial proxy %s: %w", d.ProxyAddr, err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout(d.Timeout))); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: %w", err)
+	}
+
+	if d.TLS {
+		tlsConfig := d.TLSConfig
+		if tlsConfig == nil {
+			host, _, _ := net.SplitHostPort(d.ProxyAddr)
+			tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("http connect: tls handshake with %s: %w", d.ProxyAddr, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.Username != "" {
+		creds := base64.StdEncoding.EncodeToString([]byte(d.Username + ":" + d.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+creds)
+	}
+
+	if err := req.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: write request: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: read response: %w", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrConnectRejected, resp.Status)
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("http connect: %w", err)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn keeps bytes the parent sent right after its CONNECT reply.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
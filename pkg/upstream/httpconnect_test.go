@@ -0,0 +1,132 @@
+package upstream
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectParentHandler(user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if user != "" {
+			want := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+			if r.Header.Get("Proxy-Authorization") != want {
+				w.WriteHeader(http.StatusProxyAuthRequired)
+				return
+			}
+		}
+
+		dest, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dest.Close()
+
+		clientConn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+		_, _ = clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+		go func() { _, _ = io.Copy(dest, clientConn) }()
+		_, _ = io.Copy(clientConn, dest)
+	})
+}
+
+// startHTTPConnectParent starts an HTTP proxy that only supports CONNECT.
+func startHTTPConnectParent(t *testing.T, user, pass string) string {
+	t.Helper()
+
+	srv := httptest.NewServer(connectParentHandler(user, pass))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestHTTPConnectDialer_WithBasicAuth(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	parentAddr := startHTTPConnectParent(t, "bob", "pw")
+
+	dialer, err := Parse("http://bob:pw@"+parentAddr, nil, 0)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestHTTPConnectDialer_AuthRequired(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	parentAddr := startHTTPConnectParent(t, "bob", "pw")
+
+	dialer := &HTTPConnectDialer{ProxyAddr: parentAddr}
+	_, err := dialer.Dial("tcp", echoAddr)
+	assert.ErrorIs(t, err, ErrConnectRejected)
+	assert.Contains(t, err.Error(), "407")
+}
+
+func TestHTTPConnectDialer_TLSParent(t *testing.T) {
+	echoAddr := startEchoServer(t)
+
+	srv := httptest.NewUnstartedServer(connectParentHandler("", ""))
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	tlsConfig := srv.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	tlsConfig.ServerName = "127.0.0.1"
+	dialer := &HTTPConnectDialer{
+		ProxyAddr: strings.TrimPrefix(srv.URL, "https://"),
+		TLS:       true,
+		TLSConfig: tlsConfig,
+	}
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assertEcho(t, conn)
+}
+
+func TestHTTPConnectDialer_SilentParentTimesOut(t *testing.T) {
+	dialer := &HTTPConnectDialer{ProxyAddr: startSilentParent(t), Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err := dialer.Dial("tcp", "127.0.0.1:80")
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestHTTPConnectDialer_ClearsDeadline(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	dialer := &HTTPConnectDialer{ProxyAddr: startHTTPConnectParent(t, "", ""), Timeout: 100 * time.Millisecond}
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	time.Sleep(200 * time.Millisecond)
+	assertEcho(t, conn)
+}
+
+func TestHTTPConnectDialer_UnsupportedNetwork(t *testing.T) {
+	dialer := &HTTPConnectDialer{ProxyAddr: "127.0.0.1:1"}
+	_, err := dialer.Dial("udp", "127.0.0.1:53")
+	assert.Error(t, err)
+}
@@ -0,0 +1,444 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ryanbekhen/nanoproxy/pkg/routing"
+)
+
+type Strategy string
+
+const (
+	StrategyRoundRobin   Strategy = "round-robin"
+	StrategyRandom       Strategy = "random"
+	StrategyLeastLatency Strategy = "least-latency"
+	StrategySticky       Strategy = "sticky"
+)
+
+type ProbeMode string
+
+const (
+	ProbeTCP     ProbeMode = "tcp"
+	ProbeConnect ProbeMode = "connect"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultOpenDuration     = 30 * time.Second
+	defaultProbeInterval    = 30 * time.Second
+	defaultProbeTimeout     = 5 * time.Second
+	defaultStickyTTL        = 30 * time.Minute
+	stickySweepSize         = 1024
+	latencySmoothing        = 0.3
+)
+
+var ErrNoUpstreamAvailable = errors.New("no upstream proxy available")
+
+// Member is one upstream proxy in a pool. Addr is the address of the proxy
+// itself and is used by TCP health probes.
+type Member struct {
+	Name   string
+	Addr   string
+	Dialer Dialer
+}
+
+// PoolConfig controls selection, health checking and circuit breaking.
+type PoolConfig struct {
+	Name     string
+	Strategy Strategy
+	// ProbeMode selects between a plain TCP connect to the upstream and a full
+	// tunnel to ProbeTarget through it. An empty ProbeTarget disables probing.
+	ProbeMode     ProbeMode
+	ProbeTarget   string
+	ProbeInterval time.Duration
+	ProbeTimeout  time.Duration
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit of a member for OpenDuration.
+	FailureThreshold int
+	OpenDuration     time.Duration
+	// MaxAttempts bounds how many members a single dial tries. Zero means every
+	// member may be tried once.
+	MaxAttempts int
+	// StickyTTL is how long an idle sticky session keeps its member. Zero
+	// means 30 minutes.
+	StickyTTL time.Duration
+}
+
+// MemberStatus is a point-in-time view of one pool member.
+type MemberStatus struct {
+	Name                string
+	Addr                string
+	Healthy             bool
+	CircuitOpen         bool
+	Latency             time.Duration
+	ConsecutiveFailures int
+	Successes           uint64
+	Failures            uint64
+	LastError           string
+	LastCheck           time.Time
+}
+
+type stickyEntry struct {
+	member  string
+	expires time.Time
+}
+
+type poolMember struct {
+	Member
+
+	healthy             bool
+	latency             time.Duration
+	consecutiveFailures int
+	openUntil           time.Time
+	successes           uint64
+	failures            uint64
+	lastError           string
+	lastCheck           time.Time
+}
+
+// Pool spreads connections across several upstream proxies and fails over
+// to another member when a dial fails.
+type Pool struct {
+	config  PoolConfig
+	members []*poolMember
+	sticky  map[string]stickyEntry
+	next    int
+	now     func() time.Time
+	mu      sync.Mutex
+	stop    chan struct{}
+	stopped sync.Once
+}
+
+func NewPool(conf PoolConfig, members []Member) (*Pool, error) {
+	if len(members) == 0 {
+		return nil, fmt.Errorf("pool %q: no members", conf.Name)
+	}
+
+	switch conf.Strategy {
+	case "":
+		conf.Strategy = StrategyRoundRobin
+	case StrategyRoundRobin, StrategyRandom, StrategyLeastLatency, StrategySticky:
+	default:
+		return nil, fmt.Errorf("pool %q: unknown strategy %q", conf.Name, conf.Strategy)
+	}
+
+	switch conf.ProbeMode {
+	case "":
+		conf.ProbeMode = ProbeTCP
+	case ProbeTCP, ProbeConnect:
+	default:
+		return nil, fmt.Errorf("pool %q: unknown probe mode %q", conf.Name, conf.ProbeMode)
+	}
+
+	if conf.FailureThreshold <= 0 {
+		conf.FailureThreshold = defaultFailureThreshold
+	}
+	if conf.OpenDuration <= 0 {
+		conf.OpenDuration = defaultOpenDuration
+	}
+	if conf.ProbeInterval <= 0 {
+		conf.ProbeInterval = defaultProbeInterval
+	}
+	if conf.ProbeTimeout <= 0 {
+		conf.ProbeTimeout = defaultProbeTimeout
+	}
+	if conf.MaxAttempts <= 0 || conf.MaxAttempts > len(members) {
+		conf.MaxAttempts = len(members)
+	}
+	if conf.StickyTTL <= 0 {
+		conf.StickyTTL = defaultStickyTTL
+	}
+
+	pool := &Pool{
+		config: conf,
+		sticky: make(map[string]stickyEntry),
+		now:    time.Now,
+		stop:   make(chan struct{}),
+	}
+	for _, m := range members {
+		if m.Dialer == nil {
+			return nil, fmt.Errorf("pool %q: member %q has no dialer", conf.Name, m.Name)
+		}
+		pool.members = append(pool.members, &poolMember{Member: m, healthy: true})
+	}
+
+	return pool, nil
+}
+
+func (p *Pool) Name() string {
+	return p.config.Name
+}
+
+// Dial picks a member without affinity.
+func (p *Pool) Dial(network, addr string) (net.Conn, error) {
+	return p.DialKey("", network, addr)
+}
+
+// DialRoute implements routing.Outbound. With the sticky strategy the proxy
+// username and session tag pin the connection to one member.
+func (p *Pool) DialRoute(req *routing.Request, network, addr string) (net.Conn, error) {
+	return p.DialKey(req.AffinityKey(), network, addr)
+}
+
+// DialKey dials addr through a pool member, retrying on other members when the
+// dial fails. key is used for sticky selection and ignored otherwise.
+func (p *Pool) DialKey(key, network, addr string) (net.Conn, error) {
+	tried := make(map[*poolMember]bool, p.config.MaxAttempts)
+	var lastErr error
+
+	for attempt := 0; attempt < p.config.MaxAttempts; attempt++ {
+		member := p.pick(key, tried)
+		if member == nil {
+			break
+		}
+		tried[member] = true
+
+		start := p.now()
+		conn, err := member.Dialer.Dial(network, addr)
+		if err != nil {
+			p.recordFailure(member, err)
+			lastErr = fmt.Errorf("upstream %s: %w", member.Name, err)
+			continue
+		}
+		p.recordSuccess(member, p.now().Sub(start))
+		if key != "" && p.config.Strategy == StrategySticky {
+			p.stick(key, member)
+		}
+		return conn, nil
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoUpstreamAvailable, lastErr)
+	}
+	return nil, fmt.Errorf("%w in pool %q", ErrNoUpstreamAvailable, p.config.Name)
+}
+
+func (p *Pool) pick(key string, tried map[*poolMember]bool) *poolMember {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	candidates := make([]*poolMember, 0, len(p.members))
+	for _, m := range p.members {
+		if tried[m] || !m.availableAt(now) {
+			continue
+		}
+		candidates = append(candidates, m)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.config.Strategy {
+	case StrategyRandom:
+		return candidates[rand.IntN(len(candidates))] // #nosec G404 -- load spreading, not security sensitive
+	case StrategyLeastLatency:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return effectiveLatency(candidates[i]) < effectiveLatency(candidates[j])
+		})
+		return candidates[0]
+	case StrategySticky:
+		if entry, ok := p.sticky[key]; ok && key != "" && now.Before(entry.expires) {
+			for _, m := range candidates {
+				if m.Name == entry.member {
+					return m
+				}
+			}
+		}
+	}
+
+	member := candidates[p.next%len(candidates)]
+	p.next++
+	return member
+}
+
+// stick pins key to member until it has been idle for StickyTTL. Expired
+// sessions are swept once the map grows large, so clients rotating session
+// tags cannot grow it without bound.
+func (p *Pool) stick(key string, member *poolMember) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	if _, ok := p.sticky[key]; !ok && len(p.sticky) >= stickySweepSize {
+		for k, entry := range p.sticky {
+			if !now.Before(entry.expires) {
+				delete(p.sticky, k)
+			}
+		}
+	}
+	p.sticky[key] = stickyEntry{member: member.Name, expires: now.Add(p.config.StickyTTL)}
+}
+
+// availableAt reports whether the member may receive traffic. Once the open
+// period of a tripped circuit has passed the member is tried again
+// (half-open); a single failure re-opens it.
+func (m *poolMember) availableAt(now time.Time) bool {
+	if !m.openUntil.IsZero() {
+		return !now.Before(m.openUntil)
+	}
+	return m.healthy
+}
+
+func effectiveLatency(m *poolMember) time.Duration {
+	if m.latency == 0 {
+		// Unmeasured members are tried before slow ones so they get a sample.
+		return time.Nanosecond
+	}
+	return m.latency
+}
+
+func (p *Pool) recordSuccess(m *poolMember, latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.successes++
+	m.consecutiveFailures = 0
+	m.openUntil = time.Time{}
+	m.healthy = true
+	m.lastError = ""
+	if m.latency == 0 {
+		m.latency = latency
+	} else {
+		m.latency = time.Duration(latencySmoothing*float64(latency) + (1-latencySmoothing)*float64(m.latency))
+	}
+}
+
+func (p *Pool) recordFailure(m *poolMember, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m.failures++
+	m.consecutiveFailures++
+	m.lastError = err.Error()
+	halfOpen := !m.openUntil.IsZero()
+	if halfOpen || m.consecutiveFailures >= p.config.FailureThreshold {
+		m.openUntil = p.now().Add(p.config.OpenDuration)
+	}
+}
+
+// StartHealthChecks probes every member on the configured interval until
+// Close is called. It is a no-op when no probe target is configured and the
+// probe mode needs one.
+func (p *Pool) StartHealthChecks() {
+	if p.config.ProbeMode == ProbeConnect && p.config.ProbeTarget == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(p.config.ProbeInterval)
+		defer ticker.Stop()
+
+		p.CheckNow()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				p.CheckNow()
+			}
+		}
+	}()
+}
+
+// CheckNow runs one round of health probes against every member.
+func (p *Pool) CheckNow() {
+	var wg sync.WaitGroup
+	for _, m := range p.members {
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+			p.probe(m)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (p *Pool) probe(m *poolMember) {
+	start := p.now()
+	err := p.runProbe(m)
+	latency := p.now().Sub(start)
+
+	p.mu.Lock()
+	m.lastCheck = p.now()
+	p.mu.Unlock()
+
+	if err != nil {
+		p.recordFailure(m, err)
+		p.mu.Lock()
+		m.healthy = false
+		p.mu.Unlock()
+		return
+	}
+	p.recordSuccess(m, latency)
+}
+
+func (p *Pool) runProbe(m *poolMember) error {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		var conn net.Conn
+		var err error
+		if p.config.ProbeMode == ProbeConnect {
+			conn, err = m.Dialer.Dial("tcp", p.config.ProbeTarget)
+		} else {
+			conn, err = net.DialTimeout("tcp", m.Addr, p.config.ProbeTimeout)
+		}
+		done <- result{conn: conn, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.conn != nil {
+			_ = res.conn.Close()
+		}
+		return res.err
+	case <-time.After(p.config.ProbeTimeout):
+		go func() {
+			if res := <-done; res.conn != nil {
+				_ = res.conn.Close()
+			}
+		}()
+		return fmt.Errorf("health probe timed out after %s", p.config.ProbeTimeout)
+	}
+}
+
+// Close stops background health checks.
+func (p *Pool) Close() {
+	p.stopped.Do(func() { close(p.stop) })
+}
+
+// Status returns the state of every member in configuration order.
+func (p *Pool) Status() []MemberStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	out := make([]MemberStatus, 0, len(p.members))
+	for _, m := range p.members {
+		circuitOpen := !m.openUntil.IsZero() && now.Before(m.openUntil)
+		out = append(out, MemberStatus{
+			Name:                m.Name,
+			Addr:                m.Addr,
+			Healthy:             m.healthy && !circuitOpen,
+			CircuitOpen:         circuitOpen,
+			Latency:             m.latency,
+			ConsecutiveFailures: m.consecutiveFailures,
+			Successes:           m.successes,
+			Failures:            m.failures,
+			LastError:           m.lastError,
+			LastCheck:           m.lastCheck,
+		})
+	}
+	return out
+}
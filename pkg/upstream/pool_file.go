@@ -0,0 +1,114 @@
+package upstream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PoolsFile is the on-disk definition of named upstream pools.
+type PoolsFile struct {
+	Pools map[string]PoolSpec `json:"pools"`
+}
+
+type PoolSpec struct {
+	Strategy         Strategy        `json:"strategy"`
+	Members          []string        `json:"members"`
+	HealthCheck      HealthCheckSpec `json:"health_check"`
+	FailureThreshold int             `json:"failure_threshold"`
+	OpenDuration     string          `json:"open_duration"`
+	MaxAttempts      int             `json:"max_attempts"`
+	StickyTTL        string          `json:"sticky_ttl"`
+}
+
+type HealthCheckSpec struct {
+	Mode     ProbeMode `json:"mode"`
+	Target   string    `json:"target"`
+	Interval string    `json:"interval"`
+	Timeout  string    `json:"timeout"`
+}
+
+// LoadPoolsFile reads pool definitions and builds one Pool per entry. Member
+// URLs use the same schemes as Parse and are reached through forward, with
+// timeout bounding the handshake with each member.
+func LoadPoolsFile(path string, forward Dialer, timeout time.Duration) ([]*Pool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file PoolsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse pools file %s: %w", path, err)
+	}
+
+	names := make([]string, 0, len(file.Pools))
+	for name := range file.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pools := make([]*Pool, 0, len(names))
+	for _, name := range names {
+		pool, err := BuildPool(name, file.Pools[name], forward, timeout)
+		if err != nil {
+			return nil, err
+		}
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// BuildPool creates a pool from its file specification.
+func BuildPool(name string, spec PoolSpec, forward Dialer, timeout time.Duration) (*Pool, error) {
+	conf := PoolConfig{
+		Name:             name,
+		Strategy:         spec.Strategy,
+		ProbeMode:        spec.HealthCheck.Mode,
+		ProbeTarget:      spec.HealthCheck.Target,
+		FailureThreshold: spec.FailureThreshold,
+		MaxAttempts:      spec.MaxAttempts,
+	}
+
+	var err error
+	if conf.OpenDuration, err = parseOptionalDuration(spec.OpenDuration); err != nil {
+		return nil, fmt.Errorf("pool %q: open_duration: %w", name, err)
+	}
+	if conf.ProbeInterval, err = parseOptionalDuration(spec.HealthCheck.Interval); err != nil {
+		return nil, fmt.Errorf("pool %q: health_check.interval: %w", name, err)
+	}
+	if conf.ProbeTimeout, err = parseOptionalDuration(spec.HealthCheck.Timeout); err != nil {
+		return nil, fmt.Errorf("pool %q: health_check.timeout: %w", name, err)
+	}
+	if conf.StickyTTL, err = parseOptionalDuration(spec.StickyTTL); err != nil {
+		return nil, fmt.Errorf("pool %q: sticky_ttl: %w", name, err)
+	}
+
+	members := make([]Member, 0, len(spec.Members))
+	for _, rawURL := range spec.Members {
+		dialer, err := Parse(rawURL, forward, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("pool %q: %w", name, err)
+		}
+		u, _ := url.Parse(strings.TrimSpace(rawURL))
+		members = append(members, Member{
+			Name:   Redact(rawURL),
+			Addr:   proxyAddr(u),
+			Dialer: dialer,
+		})
+	}
+
+	return NewPool(conf, members)
+}
+
+func parseOptionalDuration(raw string) (time.Duration, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(raw)
+}
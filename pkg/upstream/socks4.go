@@ -0,0 +1,100 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version        = 0x04
+	socks4CommandConnect = 0x01
+	socks4Granted        = 0x5a
+)
+
+var ErrSOCKS4Rejected = errors.New("socks4 request rejected")
+
+// SOCKS4Dialer connects through a SOCKS4 parent. Destinations given by name
+// are sent using the SOCKS4a extension so the parent resolves them.
+type SOCKS4Dialer struct {
+	ProxyAddr string
+	UserID    string
+	// Timeout bounds the request and reply exchanged with the parent. Zero
+	// uses DefaultTimeout.
+	Timeout time.Duration
+	Forward Dialer
+}
+
+func (d *SOCKS4Dialer) Dial(network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" {
+		return nil, fmt.Errorf("socks4: unsupported network %q", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: %w", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("socks4: invalid port %q", portStr)
+	}
+
+	var ip4 net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 = ip.To4(); ip4 == nil {
+			return nil, fmt.Errorf("socks4: ipv6 destination %s is not supported", host)
+		}
+	}
+
+	forward := d.Forward
+	if forward == nil {
+		forward = &Direct{}
+	}
+	conn, err := forward.Dial("tcp", d.ProxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("socks4: dial proxy %s: %w", d.ProxyAddr, err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout(d.Timeout))); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4: %w", err)
+	}
+
+	req := []byte{socks4Version, socks4CommandConnect, byte(port >> 8), byte(port)}
+	if ip4 != nil {
+		req = append(req, ip4...)
+	} else {
+		// SOCKS4a: an invalid address of 0.0.0.x tells the parent to use the
+		// hostname that follows the user id.
+		req = append(req, 0, 0, 0, 1)
+	}
+	req = append(req, d.UserID...)
+	req = append(req, 0)
+	if ip4 == nil {
+		req = append(req, host...)
+		req = append(req, 0)
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4: write request: %w", err)
+	}
+
+	var resp [8]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4: read reply: %w", err)
+	}
+	if resp[1] != socks4Granted {
+		_ = conn.Close()
+		return nil, fmt.Errorf("%w: code %d", ErrSOCKS4Rejected, resp[1])
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("socks4: %w", err)
+	}
+
+	return conn, nil
+}
@@ -0,0 +1,118 @@
+package upstream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSOCKS4Parent starts a minimal SOCKS4/4a parent and reports the user id
+// and destination of each request on the returned channel.
+func startSOCKS4Parent(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	seen := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+
+				head := make([]byte, 8)
+				if _, err := io.ReadFull(r, head); err != nil {
+					return
+				}
+				userID, _ := r.ReadString(0)
+				port := binary.BigEndian.Uint16(head[2:4])
+				host := net.IP(head[4:8]).String()
+				if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+					name, _ := r.ReadString(0)
+					host = name[:len(name)-1]
+				}
+				seen <- userID[:len(userID)-1] + "@" + host
+
+				dest, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+				if err != nil {
+					_, _ = conn.Write([]byte{0, 0x5b, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer dest.Close()
+				_, _ = conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+
+				go func() { _, _ = io.Copy(dest, r) }()
+				_, _ = io.Copy(conn, dest)
+			}()
+		}
+	}()
+
+	return l.Addr().String(), seen
+}
+
+func TestSOCKS4Dialer_IPv4Destination(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	parentAddr, seen := startSOCKS4Parent(t)
+
+	dialer, err := Parse("socks4://scraper@"+parentAddr, nil, 0)
+	require.NoError(t, err)
+
+	conn, err := dialer.Dial("tcp", echoAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assertEcho(t, conn)
+	assert.Equal(t, "scraper@127.0.0.1", <-seen)
+}
+
+func TestSOCKS4Dialer_HostnameUsesSOCKS4a(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echoAddr)
+	parentAddr, seen := startSOCKS4Parent(t)
+
+	dialer := &SOCKS4Dialer{ProxyAddr: parentAddr}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort("localhost", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assertEcho(t, conn)
+	assert.Equal(t, "@localhost", <-seen)
+}
+
+func TestSOCKS4Dialer_Rejected(t *testing.T) {
+	parentAddr, _ := startSOCKS4Parent(t)
+
+	dialer := &SOCKS4Dialer{ProxyAddr: parentAddr}
+	_, err := dialer.Dial("tcp", "127.0.0.1:1")
+	assert.ErrorIs(t, err, ErrSOCKS4Rejected)
+}
+
+func TestSOCKS4Dialer_SilentParentTimesOut(t *testing.T) {
+	dialer := &SOCKS4Dialer{ProxyAddr: startSilentParent(t), Timeout: 100 * time.Millisecond}
+
+	start := time.Now()
+	_, err := dialer.Dial("tcp", "127.0.0.1:80")
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestSOCKS4Dialer_RejectsIPv6(t *testing.T) {
+	dialer := &SOCKS4Dialer{ProxyAddr: "127.0.0.1:1"}
+	_, err := dialer.Dial("tcp", "[::1]:80")
+	assert.Error(t, err)
+}
@@ -0,0 +1,209 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var (
+	ErrUnsupportedScheme = errors.New("unsupported upstream proxy scheme")
+	ErrEmptyChain        = errors.New("upstream proxy chain is empty")
+)
+
+// DefaultTimeout bounds the handshake with a parent proxy when no timeout is
+// configured.
+const DefaultTimeout = 5 * time.Second
+
+// Dialer opens outbound connections. It matches the Dial hook used by
+// socks5.Config and httpproxy.Config.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// DialFunc adapts a plain dial function to the Dialer interface.
+type DialFunc func(network, addr string) (net.Conn, error)
+
+func (f DialFunc) Dial(network, addr string) (net.Conn, error) {
+	return f(network, addr)
+}
+
+// Direct dials destinations without any parent proxy.
+type Direct struct {
+	Timeout time.Duration
+}
+
+func (d *Direct) Dial(network, addr string) (net.Conn, error) {
+	return net.DialTimeout(network, addr, d.Timeout)
+}
+
+// socks5Dialer bounds the handshake of a proxy.SOCKS5 dialer, which only
+// honours a deadline given through the context.
+type socks5Dialer struct {
+	dialer  proxy.ContextDialer
+	timeout time.Duration
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	return d.dialer.DialContext(ctx, network, addr)
+}
+
+// Parse builds a dialer for a single parent proxy URL. Supported schemes are
+// socks5, socks5h, socks4, socks4a, http and https. Credentials are taken from
+// the URL userinfo. Connections to the parent itself are opened through forward.
+// timeout bounds the handshake with the parent; zero uses DefaultTimeout.
+func Parse(rawURL string, forward Dialer, timeout time.Duration) (Dialer, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, fmt.Errorf("parse upstream proxy %q: %w", rawURL, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("upstream proxy %q: missing host", rawURL)
+	}
+	timeout = handshakeTimeout(timeout)
+	if forward == nil {
+		forward = &Direct{Timeout: timeout}
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", hostWithDefaultPort(u, "1080"), auth, forward)
+		if err != nil {
+			return nil, err
+		}
+		return &socks5Dialer{dialer: d.(proxy.ContextDialer), timeout: timeout}, nil
+	case "socks4", "socks4a":
+		d := &SOCKS4Dialer{
+			ProxyAddr: hostWithDefaultPort(u, "1080"),
+			Timeout:   timeout,
+			Forward:   forward,
+		}
+		if u.User != nil {
+			d.UserID = u.User.Username()
+		}
+		return d, nil
+	case "http", "https":
+		d := &HTTPConnectDialer{
+			ProxyAddr: hostWithDefaultPort(u, defaultHTTPPort(u.Scheme)),
+			TLS:       strings.EqualFold(u.Scheme, "https"),
+			Timeout:   timeout,
+			Forward:   forward,
+		}
+		if u.User != nil {
+			d.Username = u.User.Username()
+			d.Password, _ = u.User.Password()
+		}
+		return d, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedScheme, u.Scheme)
+	}
+}
+
+// ParseChain builds a multi-hop dialer. The first URL is the hop closest to
+// nanoproxy; every following hop is reached through the previous one. timeout
+// bounds the handshake with each hop.
+func ParseChain(rawURLs []string, forward Dialer, timeout time.Duration) (Dialer, error) {
+	timeout = handshakeTimeout(timeout)
+	if forward == nil {
+		forward = &Direct{Timeout: timeout}
+	}
+
+	dialer := forward
+	hops := 0
+	for _, rawURL := range rawURLs {
+		if strings.TrimSpace(rawURL) == "" {
+			continue
+		}
+		next, err := Parse(rawURL, dialer, timeout)
+		if err != nil {
+			return nil, err
+		}
+		dialer = next
+		hops++
+	}
+
+	if hops == 0 {
+		return nil, ErrEmptyChain
+	}
+	return dialer, nil
+}
+
+// LoadChainFile reads upstream proxy URLs from a file, one per line. Blank
+// lines and lines starting with '#' are ignored.
+func LoadChainFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var urls []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// Redact returns the proxy URL with any password removed, for logging.
+func Redact(rawURL string) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return "invalid-url"
+	}
+	return u.Redacted()
+}
+
+// proxyAddr returns the host:port of the parent proxy described by u.
+func proxyAddr(u *url.URL) string {
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return hostWithDefaultPort(u, defaultHTTPPort(u.Scheme))
+	default:
+		return hostWithDefaultPort(u, "1080")
+	}
+}
+
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func defaultHTTPPort(scheme string) string {
+	if strings.EqualFold(scheme, "https") {
+		return "443"
+	}
+	return "80"
+}
+
+func handshakeTimeout(timeout time.Duration) time.Duration {
+	if timeout <= 0 {
+		return DefaultTimeout
+	}
+	return timeout
+}